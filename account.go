@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// accountDeletionGrace is how long a deleted account is kept, so the user can
+// change their mind by logging in again
+const accountDeletionGrace = 7 * 24 * time.Hour
+
+// ScheduleAccountDeletion marks a user's account for deletion after the
+// grace period and ends their sessions, together so an account is never
+// scheduled with sessions still open
+func (app *App) ScheduleAccountDeletion(ctx context.Context, userID int64, now time.Time) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	deleteAfter := now.Add(accountDeletionGrace)
+	err := app.InTx(ctx, func(ctx context.Context) error {
+		if _, err := app.DBFrom(ctx).ExecContext(ctx, "UPDATE users SET delete_after = ? WHERE id = ?", deleteAfter, userID); err != nil {
+			return fmt.Errorf("failed to schedule account deletion: %w", err)
+		}
+		app.userCache.Invalidate(ctx, strconv.FormatInt(userID, 10))
+		return app.Sessions.DeleteForUser(ctx, userID)
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return deleteAfter, nil
+}
+
+// CancelAccountDeletion keeps an account that was scheduled for deletion.
+// It reports whether there was a deletion to cancel.
+func (app *App) CancelAccountDeletion(ctx context.Context, userID int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	result, err := app.DBFrom(ctx).ExecContext(ctx, "UPDATE users SET delete_after = NULL WHERE id = ? AND delete_after IS NOT NULL", userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to cancel account deletion: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to cancel account deletion: %w", err)
+	}
+	app.userCache.Invalidate(ctx, strconv.FormatInt(userID, 10))
+	return n > 0, nil
+}
+
+// PurgeDeletedAccounts deletes the accounts whose grace period ended before
+// now
+func (app *App) PurgeDeletedAccounts(ctx context.Context, now time.Time) error {
+	// Only the query is bounded, deleting each account has its own timeout
+	qctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	rows, err := app.DB.QueryContext(qctx, "SELECT id FROM users WHERE delete_after <= ?", now)
+	if err != nil {
+		return fmt.Errorf("failed to query deleted accounts: %w", err)
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan user row: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating user rows: %w", err)
+	}
+
+	for _, id := range ids {
+		if err := app.DeleteUser(ctx, id); err != nil {
+			return err
+		}
+		slog.Info("Deleted account", "user_id", id)
+	}
+	return nil
+}
+
+// AccountExport is everything stored about a user, as downloaded from
+// /settings/account/export
+type AccountExport struct {
+	ExportedAt        time.Time             `json:"exported_at"`
+	Profile           ExportProfile         `json:"profile"`
+	Devices           []ExportDevice        `json:"devices"`
+	Sessions          []ExportSession       `json:"sessions"`
+	Passkeys          []ExportPasskey       `json:"passkeys"`
+	OAuthIdentities   []ExportOAuthIdentity `json:"oauth_identities"`
+	APITokens         []ExportAPIToken      `json:"api_tokens"`
+	PushSubscriptions []ExportPush          `json:"push_subscriptions"`
+}
+
+// ExportProfile is the user's own row
+type ExportProfile struct {
+	ID               int64     `json:"id"`
+	Email            string    `json:"email"`
+	Role             string    `json:"role"`
+	DisplayName      string    `json:"display_name"`
+	TimeZone         string    `json:"time_zone"`
+	Avatar           string    `json:"avatar"`
+	Digest           string    `json:"digest"`
+	TwoFactorEnabled bool      `json:"two_factor_enabled"`
+	BackupCodesLeft  int       `json:"backup_codes_left"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// ExportDevice is a device and the facts its agent last reported
+type ExportDevice struct {
+	ID        int64           `json:"id"`
+	Hostname  string          `json:"hostname"`
+	Type      string          `json:"type"`
+	Notes     string          `json:"notes"`
+	CreatedAt time.Time       `json:"created_at"`
+	Facts     json.RawMessage `json:"facts,omitempty"`
+}
+
+// ExportSession is a device the user is logged in on
+type ExportSession struct {
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// ExportPasskey is a registered passkey, without its key material
+type ExportPasskey struct {
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// ExportOAuthIdentity is a linked sign in provider
+type ExportOAuthIdentity struct {
+	Provider  string    `json:"provider"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ExportAPIToken is a personal access token, without the secret
+type ExportAPIToken struct {
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
+// ExportPush is a browser subscribed to notifications
+type ExportPush struct {
+	Endpoint  string    `json:"endpoint"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ExportAccount collects a user's data. The database tables are read in a
+// single transaction so the export is consistent.
+func (app *App) ExportAccount(ctx context.Context, userID int64, now time.Time) (AccountExport, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	export := AccountExport{
+		ExportedAt:        now,
+		Devices:           []ExportDevice{},
+		Sessions:          []ExportSession{},
+		Passkeys:          []ExportPasskey{},
+		OAuthIdentities:   []ExportOAuthIdentity{},
+		APITokens:         []ExportAPIToken{},
+		PushSubscriptions: []ExportPush{},
+	}
+
+	err := app.WithTx(ctx, func(tx *sql.Tx) error {
+		p := &export.Profile
+		err := tx.QueryRowContext(ctx, `
+			SELECT id, email, role, display_name, time_zone, avatar, digest, totp_enabled, created_at,
+				(SELECT COUNT(*) FROM backup_codes WHERE user_id = users.id AND used_at IS NULL)
+			FROM users
+			WHERE id = ?
+		`, userID).Scan(&p.ID, &p.Email, &p.Role, &p.DisplayName, &p.TimeZone, &p.Avatar, &p.Digest, &p.TwoFactorEnabled, &p.CreatedAt, &p.BackupCodesLeft)
+		if err != nil {
+			return fmt.Errorf("failed to query user: %w", err)
+		}
+
+		err = queryRows(ctx, tx, `
+			SELECT d.id, d.hostname, d.device_type, d.notes, d.created_at, f.facts
+			FROM devices d
+			LEFT JOIN device_facts f ON f.device_id = d.id
+			WHERE d.user_id = ?
+			ORDER BY d.id
+		`, userID, func(rows *sql.Rows) error {
+			var d ExportDevice
+			var facts sql.NullString
+			if err := rows.Scan(&d.ID, &d.Hostname, &d.Type, &d.Notes, &d.CreatedAt, &facts); err != nil {
+				return err
+			}
+			if facts.Valid {
+				d.Facts = json.RawMessage(facts.String)
+			}
+			export.Devices = append(export.Devices, d)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to export devices: %w", err)
+		}
+
+		err = queryRows(ctx, tx, `
+			SELECT name, created_at, last_used_at
+			FROM webauthn_credentials
+			WHERE user_id = ?
+			ORDER BY id
+		`, userID, func(rows *sql.Rows) error {
+			var pk ExportPasskey
+			var lastUsed sql.NullTime
+			if err := rows.Scan(&pk.Name, &pk.CreatedAt, &lastUsed); err != nil {
+				return err
+			}
+			pk.LastUsedAt = nullTimePtr(lastUsed)
+			export.Passkeys = append(export.Passkeys, pk)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to export passkeys: %w", err)
+		}
+
+		err = queryRows(ctx, tx, `
+			SELECT provider, email, created_at
+			FROM oauth_identities
+			WHERE user_id = ?
+			ORDER BY created_at
+		`, userID, func(rows *sql.Rows) error {
+			var id ExportOAuthIdentity
+			if err := rows.Scan(&id.Provider, &id.Email, &id.CreatedAt); err != nil {
+				return err
+			}
+			export.OAuthIdentities = append(export.OAuthIdentities, id)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to export oauth identities: %w", err)
+		}
+
+		err = queryRows(ctx, tx, "SELECT "+apiTokenColumns+" FROM api_tokens WHERE user_id = ? ORDER BY id", userID, func(rows *sql.Rows) error {
+			t, err := scanAPIToken(rows)
+			if err != nil {
+				return err
+			}
+			export.APITokens = append(export.APITokens, ExportAPIToken{
+				Name:       t.Name,
+				Prefix:     t.Prefix,
+				Scopes:     t.Scopes,
+				CreatedAt:  t.CreatedAt,
+				LastUsedAt: timePtr(t.LastUsedAt),
+				ExpiresAt:  timePtr(t.ExpiresAt),
+			})
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to export api tokens: %w", err)
+		}
+
+		err = queryRows(ctx, tx, `
+			SELECT endpoint, created_at
+			FROM push_subscriptions
+			WHERE user_id = ?
+			ORDER BY id
+		`, userID, func(rows *sql.Rows) error {
+			var push ExportPush
+			if err := rows.Scan(&push.Endpoint, &push.CreatedAt); err != nil {
+				return err
+			}
+			export.PushSubscriptions = append(export.PushSubscriptions, push)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to export push subscriptions: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return AccountExport{}, err
+	}
+
+	// Sessions may live outside the database
+	sessions, err := app.Sessions.List(ctx)
+	if err != nil {
+		return AccountExport{}, err
+	}
+	for _, s := range sessions {
+		if s.UserID != userID {
+			continue
+		}
+		export.Sessions = append(export.Sessions, ExportSession{
+			UserAgent:  s.UserAgent,
+			IP:         s.IP,
+			CreatedAt:  s.CreatedAt,
+			LastSeenAt: s.LastSeenAt,
+			ExpiresAt:  s.ExpiresAt,
+		})
+	}
+	return export, nil
+}
+
+// queryRows runs a query in tx and calls fn for each row
+func queryRows(ctx context.Context, tx *sql.Tx, query string, arg any, fn func(rows *sql.Rows) error) error {
+	rows, err := tx.QueryContext(ctx, query, arg)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// timePtr returns nil for the zero time, so it's exported as null
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// nullTimePtr returns nil for a NULL time
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// AccountPage holds data for the account settings template
+type AccountPage struct {
+	Meta  PageMeta
+	Grace string
+	Error string
+}
+
+// handleAccountSettings exports and deletes the user's account
+func (app *App) handleAccountSettings(w http.ResponseWriter, r *http.Request, count int, user *User) error {
+	page := AccountPage{
+		Meta: PageMeta{
+			Title: "Account",
+			Count: count,
+			User:  user,
+
+			CSRFToken: csrfToken(r),
+		},
+		Grace: fmt.Sprintf("%d days", int(accountDeletionGrace.Hours()/24)),
+	}
+
+	switch {
+	case r.URL.Path == "/settings/account" && r.Method == http.MethodGet:
+	case r.URL.Path == "/settings/account/export" && r.Method == http.MethodGet:
+		now := time.Now()
+		export, err := app.ExportAccount(r.Context(), user.ID, now)
+		if err != nil {
+			return err
+		}
+		slog.InfoContext(r.Context(), "Account exported", "user_id", user.ID)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="tulip-account-%s.json"`, now.Format("2006-01-02")))
+		w.Header().Set("Cache-Control", "no-store")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(export); err != nil {
+			return fmt.Errorf("failed to write account export: %w", err)
+		}
+		return nil
+	case r.URL.Path == "/settings/account/delete" && r.Method == http.MethodPost:
+		if !strings.EqualFold(strings.TrimSpace(r.FormValue("email")), user.Email) {
+			page.Error = "Type your email address to confirm."
+			break
+		}
+		deleteAfter, err := app.ScheduleAccountDeletion(r.Context(), user.ID, time.Now())
+		if err != nil {
+			return err
+		}
+		slog.InfoContext(r.Context(), "Account deletion scheduled", "user_id", user.ID, "delete_after", deleteAfter)
+
+		clearSessionCookie(w)
+		http.Redirect(w, r, "/login?status=account_deleted", http.StatusSeeOther)
+		return nil
+	default:
+		return app.notFound(w, r)
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := app.render(w, r, http.StatusOK, "account.html", page); err != nil {
+		return fmt.Errorf("failed to render account page: %w", err)
+	}
+	return nil
+}
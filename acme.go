@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newCertManager gets and renews certificates from Let's Encrypt, or the
+// CA at ACME_DIRECTORY_URL, for the hosts in ACME_DOMAINS and every site's
+// host. Certificates are kept in ACME_CACHE_DIR so a restart doesn't ask
+// for new ones. It returns nil if ACME_DOMAINS isn't set.
+func newCertManager(cfg Config, sites []*Site) (*autocert.Manager, error) {
+	if len(cfg.ACMEDomains) == 0 {
+		return nil, nil
+	}
+	if err := validateACMEDomains(cfg.ACMEDomains); err != nil {
+		return nil, err
+	}
+
+	hosts := cfg.ACMEDomains
+	for _, site := range sites {
+		if site.Host != "" {
+			hosts = append(hosts, site.Host)
+		}
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cfg.ACMECacheDir),
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Email:      cfg.ACMEEmail,
+	}
+	if cfg.ACMEDirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: cfg.ACMEDirectoryURL}
+	}
+	slog.Info("Serving HTTPS with ACME certificates", "hosts", hosts, "cache", cfg.ACMECacheDir)
+	return m, nil
+}
+
+// validateACMEDomains checks ACME_DOMAINS are host names a CA can issue a
+// certificate for with an HTTP-01 challenge
+func validateACMEDomains(domains []string) error {
+	for _, d := range domains {
+		switch {
+		case strings.ContainsAny(d, ":/ "):
+			return fmt.Errorf("invalid ACME_DOMAINS entry %q, expected a host name like example.com", d)
+		case net.ParseIP(d) != nil:
+			return fmt.Errorf("invalid ACME_DOMAINS entry %q, certificates can't be issued for IP addresses", d)
+		case strings.HasPrefix(d, "*."):
+			return fmt.Errorf("invalid ACME_DOMAINS entry %q, wildcards need a DNS challenge", d)
+		case !strings.Contains(d, "."):
+			return fmt.Errorf("invalid ACME_DOMAINS entry %q, expected a public host name", d)
+		}
+	}
+	return nil
+}
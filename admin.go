@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminPage holds data for the admin dashboard template
+type AdminPage struct {
+	Meta       PageMeta
+	Users      []AdminUser
+	Sessions   []Session
+	MagicLinks []MagicLink
+	Devices    int
+	PostCache  PostCacheStats
+	Caches     []CacheStats
+	Posts      []Post
+	Digest     string
+	Flags      []Flag
+	// Syndications are recent cross-posts to other platforms
+	Syndications []Syndication
+	// SlugConflicts are posts hidden because their slug is taken
+	SlugConflicts []SlugConflict
+	// ContentProblems are post files that failed to load
+	ContentProblems []ContentProblem
+	// Outbox is email that hasn't gone out yet or has given up
+	Outbox []OutboxMail
+	// Webmentions are the most recently received mentions of posts
+	Webmentions []Webmention
+	// Blocked are submissions turned away by challenges in the last week
+	Blocked []ChallengeBlocks
+	// AuditLog is the most recent changes made by admins and API clients
+	AuditLog []AuditEntry
+}
+
+// handleAdmin serves the admin dashboard and its actions. Callers must wrap
+// it with RequireRole(RoleAdmin, ...).
+func (app *App) handleAdmin(w http.ResponseWriter, r *http.Request, count int, user *User) error {
+	switch {
+	case r.URL.Path == "/admin" && r.Method == http.MethodGet:
+		return app.handleAdminDashboard(w, r, count, user)
+	case r.URL.Path == "/admin/sessions/revoke" && r.Method == http.MethodPost:
+		return app.handleAdminRevokeSession(w, r, user)
+	case r.URL.Path == "/admin/users/delete" && r.Method == http.MethodPost:
+		return app.handleAdminDeleteUser(w, r, user)
+	case r.URL.Path == "/admin/users/role" && r.Method == http.MethodPost:
+		return app.handleAdminSetRole(w, r, user)
+	case r.URL.Path == "/admin/digest" && r.Method == http.MethodPost:
+		return app.handleAdminSetDigest(w, r, user)
+	case r.URL.Path == "/admin/flags" && r.Method == http.MethodPost:
+		return app.handleAdminSetFlag(w, r, user)
+	case r.URL.Path == "/admin/syndication/retry" && r.Method == http.MethodPost:
+		return app.handleAdminRetrySyndication(w, r, user)
+	case (r.URL.Path == "/admin/outbox/retry" || r.URL.Path == "/admin/outbox/delete") && r.Method == http.MethodPost:
+		return app.handleAdminOutbox(w, r, user)
+	case (r.URL.Path == "/admin/webmentions/approve" || r.URL.Path == "/admin/webmentions/delete") && r.Method == http.MethodPost:
+		return app.handleAdminWebmention(w, r, user)
+	case r.URL.Path == "/admin/shortlinks" || strings.HasPrefix(r.URL.Path, "/admin/shortlinks/"):
+		return app.handleAdminShortlinks(w, r, count, user)
+	case r.URL.Path == "/admin/jobs" || r.URL.Path == "/admin/jobs/run":
+		return app.handleAdminJobs(w, r, count, user)
+	case r.URL.Path == "/admin/posts/new",
+		strings.HasPrefix(r.URL.Path, "/admin/posts/") && strings.HasSuffix(r.URL.Path, "/edit"):
+		return app.handleEditor(w, r, count, user)
+	}
+
+	return app.notFound(w, r)
+}
+
+// adminOverview is the part of the admin dashboard that's the same for
+// every admin
+type adminOverview struct {
+	Users        []AdminUser
+	Sessions     []Session
+	MagicLinks   []MagicLink
+	Devices      int
+	PostCache    PostCacheStats
+	Flags        []Flag
+	Syndications []Syndication
+	Outbox       []OutboxMail
+	Webmentions  []Webmention
+	Blocked      []ChallengeBlocks
+	AuditLog     []AuditEntry
+}
+
+// loadAdminOverview runs the dashboard's queries. Several are aggregates over
+// whole tables, so handleAdminDashboard coalesces concurrent loads.
+func (app *App) loadAdminOverview(ctx context.Context) (*adminOverview, error) {
+	var o adminOverview
+	var err error
+	o.Users, err = app.ListUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+
+	o.Sessions, err = app.ListActiveSessions(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+
+	o.MagicLinks, err = app.ListRecentMagicLinks(ctx, 20)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list magic links: %w", err)
+	}
+
+	o.PostCache, err = app.GetPostCacheStats(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get post cache stats: %w", err)
+	}
+
+	o.Flags, err = app.ListFlags(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	o.Syndications, err = app.ListSyndications(ctx, 20)
+	if err != nil {
+		return nil, err
+	}
+
+	o.Outbox, err = app.ListOutbox(ctx, 20)
+	if err != nil {
+		return nil, err
+	}
+
+	o.Webmentions, err = app.ListWebmentions(ctx, 50)
+	if err != nil {
+		return nil, err
+	}
+
+	o.Blocked, err = app.ListChallengeBlocks(ctx, time.Now().AddDate(0, 0, -7))
+	if err != nil {
+		return nil, err
+	}
+
+	o.AuditLog, err = app.ListAuditLog(ctx, 50)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, u := range o.Users {
+		o.Devices += u.Devices
+	}
+	return &o, nil
+}
+
+// handleAdminDashboard renders an overview of users, sessions and activity
+func (app *App) handleAdminDashboard(w http.ResponseWriter, r *http.Request, count int, user *User) error {
+	overview, err := coalesce(r.Context(), &app.flights, "admin-overview", app.loadAdminOverview)
+	if err != nil {
+		return err
+	}
+
+	digest, err := app.GetUserDigest(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+
+	// Posts are the ones of the site the dashboard is visited on
+	blog := app.siteFor(r).Blog()
+	w.Header().Set("Content-Type", "text/html")
+	data := AdminPage{
+		Meta: PageMeta{
+			Title: "Admin",
+			Count: count,
+			User:  user,
+
+			CSRFToken: csrfToken(r),
+		},
+		Users:      overview.Users,
+		Sessions:   overview.Sessions,
+		MagicLinks: overview.MagicLinks,
+		Devices:    overview.Devices,
+		PostCache:  overview.PostCache,
+		Caches:     app.CacheStats(),
+		Posts:      blog.Posts,
+		Digest:     digest,
+		Flags:      overview.Flags,
+
+		SlugConflicts:   blog.Conflicts,
+		ContentProblems: blog.Problems,
+		Syndications:    overview.Syndications,
+		Outbox:          overview.Outbox,
+		Webmentions:     overview.Webmentions,
+		Blocked:         overview.Blocked,
+		AuditLog:        overview.AuditLog,
+	}
+	if err := app.render(w, r, http.StatusOK, "admin.html", data); err != nil {
+		return fmt.Errorf("failed to render admin page: %w", err)
+	}
+	return nil
+}
+
+// handleAdminRevokeSession deletes a single session
+func (app *App) handleAdminRevokeSession(w http.ResponseWriter, r *http.Request, user *User) error {
+	id := r.FormValue("id")
+	if id == "" {
+		return NewHTTPError(fmt.Errorf("missing session id"), http.StatusBadRequest)
+	}
+
+	if err := app.DeleteSessionByID(r.Context(), id); errors.Is(err, errNotRevocable) {
+		return NewHTTPError(err, http.StatusBadRequest)
+	} else if err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+
+	if err := app.Audit(r.Context(), *user, nil, "session.revoke", "session "+id); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+	return nil
+}
+
+// handleAdminDeleteUser deletes a user and everything that belongs to them
+func (app *App) handleAdminDeleteUser(w http.ResponseWriter, r *http.Request, user *User) error {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		return NewHTTPError(fmt.Errorf("invalid user id: %w", err), http.StatusBadRequest)
+	}
+	if id == user.ID {
+		return NewHTTPError(fmt.Errorf("you can't delete your own account from the admin dashboard"), http.StatusBadRequest)
+	}
+
+	subject, err := app.GetUserByID(r.Context(), id)
+	if errors.Is(err, errUserNotFound) {
+		return NewHTTPError(err, http.StatusNotFound)
+	} else if err != nil {
+		return err
+	}
+	err = app.InTx(r.Context(), func(ctx context.Context) error {
+		if err := app.DeleteUser(ctx, id); err != nil {
+			return fmt.Errorf("failed to delete user: %w", err)
+		}
+		return app.Audit(ctx, *user, &subject, "user.delete", "")
+	})
+	if err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+	return nil
+}
+
+// handleAdminSetRole promotes or demotes a user
+func (app *App) handleAdminSetRole(w http.ResponseWriter, r *http.Request, user *User) error {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		return NewHTTPError(fmt.Errorf("invalid user id: %w", err), http.StatusBadRequest)
+	}
+
+	role := r.FormValue("role")
+	if _, ok := roleRank[role]; !ok {
+		return NewHTTPError(fmt.Errorf("unknown role %q", role), http.StatusBadRequest)
+	}
+	if id == user.ID {
+		return NewHTTPError(fmt.Errorf("you can't change your own role"), http.StatusBadRequest)
+	}
+
+	subject, err := app.GetUserByID(r.Context(), id)
+	if errors.Is(err, errUserNotFound) {
+		return NewHTTPError(err, http.StatusNotFound)
+	} else if err != nil {
+		return err
+	}
+	err = app.InTx(r.Context(), func(ctx context.Context) error {
+		if err := app.SetUserRole(ctx, id, role); err != nil {
+			return fmt.Errorf("failed to set role: %w", err)
+		}
+		// Sessions from before the change, however they were obtained,
+		// don't carry over to the new role
+		if err := app.RevokeSessions(ctx, id); err != nil {
+			return err
+		}
+		return app.Audit(ctx, *user, &subject, "user.role", subject.Role+" to "+role)
+	})
+	if err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+	return nil
+}
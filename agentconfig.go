@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxAgentCommands limits how many commands an agent config can allow
+const maxAgentCommands = 50
+
+// agentCommandPattern is what an allowed command can look like: a program
+// name or path, without arguments
+var agentCommandPattern = regexp.MustCompile(`^[A-Za-z0-9._/-]{1,100}$`)
+
+// AgentConfig is the settings a device's agent fetches from the site and
+// applies. It's edited per device or per tag, see ResolveAgentConfig.
+type AgentConfig struct {
+	// HeartbeatSeconds is how often the agent sends a heartbeat
+	HeartbeatSeconds int `json:"heartbeat_seconds"`
+	// MetricsEnabled is whether the agent reports metrics with its
+	// heartbeats
+	MetricsEnabled bool `json:"metrics_enabled"`
+	// Commands are the only programs the agent may run when asked to
+	Commands []string `json:"commands"`
+}
+
+// defaultAgentConfig is what agents get until a config is saved for their
+// device or one of its tags
+var defaultAgentConfig = AgentConfig{HeartbeatSeconds: 60, MetricsEnabled: true, Commands: []string{}}
+
+// Validate checks the config is one an agent can apply. Heartbeats have to
+// come often enough that the device stays online between them.
+func (c *AgentConfig) Validate() error {
+	maxHeartbeat := int((deviceOnlineWindow - time.Minute).Seconds())
+	if c.HeartbeatSeconds < 10 || c.HeartbeatSeconds > maxHeartbeat {
+		return fmt.Errorf("heartbeat_seconds must be between 10 and %d", maxHeartbeat)
+	}
+	if c.Commands == nil {
+		c.Commands = []string{}
+	}
+	if len(c.Commands) > maxAgentCommands {
+		return fmt.Errorf("too many commands, the limit is %d", maxAgentCommands)
+	}
+	for _, command := range c.Commands {
+		if !agentCommandPattern.MatchString(command) {
+			return fmt.Errorf("invalid command %q: use a program name or path without arguments", command)
+		}
+	}
+	return nil
+}
+
+// deviceConfigScope and tagConfigScope name what a saved config applies to
+func deviceConfigScope(deviceID int64) string {
+	return fmt.Sprintf("device:%d", deviceID)
+}
+
+func tagConfigScope(tag string) string {
+	return "tag:" + tag
+}
+
+// AgentConfigVersion is one saved version of an agent config. Versions are
+// numbered across all of a user's configs, so a version identifies exactly
+// what an agent was sent.
+type AgentConfigVersion struct {
+	Version   int64
+	Scope     string
+	Config    AgentConfig
+	CreatedAt time.Time
+}
+
+// APIAgentConfig is the config an agent should apply
+type APIAgentConfig struct {
+	// Version is 0 for the defaults. Agents report back which version they
+	// applied, see AgentConfigStatus.
+	Version int64 `json:"version"`
+	// Source is where the config came from: "device", a tag like
+	// "tag:office", or "default"
+	Source string `json:"source"`
+	// RolledBack is set when the newest config failed on this device, so
+	// the one it last applied is sent instead
+	RolledBack bool        `json:"rolled_back"`
+	Config     AgentConfig `json:"config"`
+}
+
+// AgentConfigStatus is what an agent reports after trying to apply a
+// config. Error is empty when it worked.
+type AgentConfigStatus struct {
+	Version int64  `json:"version"`
+	Error   string `json:"error"`
+}
+
+// SaveAgentConfig stores a new version of the config for a device or tag
+// and returns its version
+func (app *App) SaveAgentConfig(ctx context.Context, userID int64, scope string, config AgentConfig) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode agent config: %w", err)
+	}
+	var version int64
+	err = app.DB.QueryRowContext(ctx, `
+		INSERT INTO agent_configs (user_id, scope, config, created_at)
+		VALUES (?, ?, ?, ?)
+		RETURNING id
+	`, userID, scope, string(data), time.Now()).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to save agent config: %w", err)
+	}
+	return version, nil
+}
+
+// ClearAgentConfig removes every version saved for a device or tag, so
+// its devices go back to a tag's config or the defaults
+func (app *App) ClearAgentConfig(ctx context.Context, userID int64, scope string) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := app.DBFrom(ctx).ExecContext(ctx, "DELETE FROM agent_configs WHERE user_id = ? AND scope = ?", userID, scope)
+	if err != nil {
+		return fmt.Errorf("failed to clear agent config: %w", err)
+	}
+	return nil
+}
+
+// ListAgentConfigVersions returns the versions saved for a device or tag,
+// newest first
+func (app *App) ListAgentConfigVersions(ctx context.Context, userID int64, scope string, limit int) ([]AgentConfigVersion, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	rows, err := app.DB.QueryContext(ctx, `
+		SELECT id, scope, config, created_at FROM agent_configs
+		WHERE user_id = ? AND scope = ?
+		ORDER BY id DESC
+		LIMIT ?
+	`, userID, scope, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query agent configs: %w", err)
+	}
+	defer rows.Close()
+
+	var versions []AgentConfigVersion
+	for rows.Next() {
+		v, err := scanAgentConfig(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read agent configs: %w", err)
+	}
+	return versions, nil
+}
+
+// GetAgentConfigVersion returns one of a user's saved configs
+func (app *App) GetAgentConfigVersion(ctx context.Context, userID, version int64) (AgentConfigVersion, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	v, err := scanAgentConfig(app.DB.QueryRowContext(ctx,
+		"SELECT id, scope, config, created_at FROM agent_configs WHERE user_id = ? AND id = ?",
+		userID, version,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return AgentConfigVersion{}, false, nil
+	} else if err != nil {
+		return AgentConfigVersion{}, false, err
+	}
+	return v, true, nil
+}
+
+// latestAgentConfig returns the newest config saved for any of the scopes.
+// A device's own config wins over its tags', and between tags the most
+// recently saved one does.
+func (app *App) latestAgentConfig(ctx context.Context, userID int64, scopes []string) (AgentConfigVersion, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	args := []any{userID}
+	for _, scope := range scopes {
+		args = append(args, scope)
+	}
+	v, err := scanAgentConfig(app.DB.QueryRowContext(ctx, `
+		SELECT id, scope, config, created_at FROM agent_configs
+		WHERE user_id = ? AND scope IN (?`+strings.Repeat(", ?", len(scopes)-1)+`)
+		ORDER BY CASE WHEN scope LIKE 'device:%' THEN 0 ELSE 1 END, id DESC
+		LIMIT 1
+	`, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return AgentConfigVersion{}, false, nil
+	} else if err != nil {
+		return AgentConfigVersion{}, false, err
+	}
+	return v, true, nil
+}
+
+func scanAgentConfig(row interface{ Scan(...any) error }) (AgentConfigVersion, error) {
+	var v AgentConfigVersion
+	var data string
+	if err := row.Scan(&v.Version, &v.Scope, &data, &v.CreatedAt); errors.Is(err, sql.ErrNoRows) {
+		return v, err
+	} else if err != nil {
+		return v, fmt.Errorf("failed to scan agent config: %w", err)
+	}
+	if err := json.Unmarshal([]byte(data), &v.Config); err != nil {
+		return v, fmt.Errorf("failed to decode agent config %d: %w", v.Version, err)
+	}
+	return v, nil
+}
+
+// ResolveAgentConfig works out which config a device's agent should apply:
+// the newest one saved for the device or its tags, or the defaults. If the
+// agent reported that version as invalid, it gets the version it last
+// applied instead until a new one is saved.
+func (app *App) ResolveAgentConfig(ctx context.Context, device Device) (APIAgentConfig, error) {
+	scopes := []string{deviceConfigScope(device.ID)}
+	for _, tag := range device.Tags {
+		scopes = append(scopes, tagConfigScope(tag))
+	}
+	latest, ok, err := app.latestAgentConfig(ctx, device.UserID, scopes)
+	if err != nil {
+		return APIAgentConfig{}, err
+	}
+	if !ok {
+		return APIAgentConfig{Source: "default", Config: defaultAgentConfig}, nil
+	}
+	if latest.Version != device.ConfigFailedVersion {
+		return apiAgentConfig(latest), nil
+	}
+
+	// Roll back to what the agent had working
+	if device.ConfigVersion != 0 {
+		previous, ok, err := app.GetAgentConfigVersion(ctx, device.UserID, device.ConfigVersion)
+		if err != nil {
+			return APIAgentConfig{}, err
+		}
+		if ok {
+			config := apiAgentConfig(previous)
+			config.RolledBack = true
+			return config, nil
+		}
+	}
+	return APIAgentConfig{Source: "default", RolledBack: true, Config: defaultAgentConfig}, nil
+}
+
+// apiAgentConfig converts a saved version for the API
+func apiAgentConfig(v AgentConfigVersion) APIAgentConfig {
+	source := v.Scope
+	if strings.HasPrefix(source, "device:") {
+		source = "device"
+	}
+	return APIAgentConfig{Version: v.Version, Source: source, Config: v.Config}
+}
+
+// RecordAgentConfigStatus remembers whether a device's agent managed to
+// apply a config version
+func (app *App) RecordAgentConfigStatus(ctx context.Context, userID, deviceID int64, status AgentConfigStatus) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var result sql.Result
+	var err error
+	if status.Error == "" {
+		result, err = app.DBFrom(ctx).ExecContext(ctx, `
+			UPDATE devices SET config_version = ?, config_error = '',
+				config_failed_version = CASE WHEN config_failed_version = ? THEN 0 ELSE config_failed_version END
+			WHERE id = ? AND user_id = ?
+		`, status.Version, status.Version, deviceID, userID)
+	} else {
+		result, err = app.DBFrom(ctx).ExecContext(ctx,
+			"UPDATE devices SET config_failed_version = ?, config_error = ? WHERE id = ? AND user_id = ?",
+			status.Version, status.Error, deviceID, userID,
+		)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record agent config status: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to record agent config status: %w", err)
+	} else if n == 0 {
+		return errDeviceNotFound
+	}
+	return nil
+}
+
+// handleAgentConfigAPI serves a device's config to its agent with
+// GET /api/devices/{id}/config, and takes the agent's report of applying
+// it with POST /api/devices/{id}/config/status
+func (app *App) handleAgentConfigAPI(w http.ResponseWriter, r *http.Request) error {
+	isStatus := strings.HasSuffix(r.URL.Path, "/config/status")
+	if isStatus && r.Method != http.MethodPost || !isStatus && r.Method != http.MethodGet {
+		return NewHTTPError(fmt.Errorf("method not allowed"), http.StatusMethodNotAllowed)
+	}
+	auth, err := app.authenticateRequest(w, r)
+	if err != nil {
+		return err
+	}
+	scope := "devices:read"
+	if isStatus {
+		scope = "devices:write"
+	}
+	if err := requireScope(auth, scope); err != nil {
+		return err
+	}
+	deviceID, err := deviceIDFromPath(r.URL.Path, "/api/devices/")
+	if err != nil {
+		return err
+	}
+	device, err := app.GetDevice(r.Context(), auth.User.ID, deviceID)
+	if errors.Is(err, errDeviceNotFound) {
+		return NewHTTPError(err, http.StatusNotFound)
+	} else if err != nil {
+		return err
+	}
+
+	if !isStatus {
+		config, err := app.ResolveAgentConfig(r.Context(), device)
+		if err != nil {
+			return err
+		}
+		// Agents poll, so let them revalidate cheaply
+		etag := fmt.Sprintf(`"%d-%s"`, config.Version, config.Source)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("ETag", etag)
+		if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+		return writeJSON(w, config)
+	}
+
+	var status AgentConfigStatus
+	if err := readJSON(w, r, &status); err != nil {
+		return err
+	}
+	if status.Version < 0 || len(status.Error) > 1000 {
+		return NewHTTPError(fmt.Errorf("version can't be negative and error can be up to 1000 characters"), http.StatusUnprocessableEntity)
+	}
+	if err := app.RecordAgentConfigStatus(r.Context(), auth.User.ID, deviceID, status); err != nil {
+		return err
+	}
+	if status.Error != "" {
+		slog.WarnContext(r.Context(), "Agent rejected config", "device_id", deviceID, "version", status.Version, "error", status.Error)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// AgentConfigPage holds data for the agent config template
+type AgentConfigPage struct {
+	Meta PageMeta
+	// Device is set when editing a device's config, and Tag when editing a
+	// tag's
+	Device *Device
+	Tag    string
+	// Action is where the form posts
+	Action string
+	// Config is the form's values, and Saved whether the scope has a
+	// config of its own rather than showing what it inherits
+	Config AgentConfig
+	Saved  bool
+	// Effective is what the device's agent is sent now
+	Effective APIAgentConfig
+	Versions  []AgentConfigVersion
+	Error     string
+}
+
+// handleAgentConfig edits the agent config for a device at
+// /devices/{id}/config, or for every device with a tag at
+// /devices/tags/{tag}/config. Saving adds a new version, and an older
+// version can be restored. Callers must make sure the user is logged in.
+func (app *App) handleAgentConfig(w http.ResponseWriter, r *http.Request, count int, user *User) error {
+	page := AgentConfigPage{
+		Meta: PageMeta{
+			Count: count,
+			User:  user,
+
+			CSRFToken: csrfToken(r),
+		},
+		Action: r.URL.Path,
+	}
+
+	var scope string
+	if rest, ok := strings.CutPrefix(r.URL.Path, "/devices/tags/"); ok {
+		tag, err := url.PathUnescape(strings.TrimSuffix(rest, "/config"))
+		if err != nil || !deviceTagPattern.MatchString(tag) {
+			return NewHTTPError(fmt.Errorf("page not found: %s", r.URL.Path), http.StatusNotFound)
+		}
+		page.Tag = tag
+		page.Meta.Title = "Agent config for " + tag
+		scope = tagConfigScope(tag)
+	} else {
+		deviceID, err := deviceIDFromPath(r.URL.Path, "/devices/")
+		if err != nil {
+			return err
+		}
+		device, err := app.GetDevice(r.Context(), user.ID, deviceID)
+		if errors.Is(err, errDeviceNotFound) {
+			return NewHTTPError(err, http.StatusNotFound)
+		} else if err != nil {
+			return err
+		}
+		page.Device = &device
+		page.Meta.Title = "Agent config for " + device.Name
+		scope = deviceConfigScope(device.ID)
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var config AgentConfig
+		switch {
+		case r.FormValue("action") == "clear":
+			if err := app.ClearAgentConfig(r.Context(), user.ID, scope); err != nil {
+				return err
+			}
+			if err := app.Audit(r.Context(), *user, user, "agent_config.clear", scope); err != nil {
+				return err
+			}
+			http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+			return nil
+		case r.FormValue("restore") != "":
+			version, err := strconv.ParseInt(r.FormValue("restore"), 10, 64)
+			if err != nil {
+				return NewHTTPError(fmt.Errorf("invalid version: %w", err), http.StatusBadRequest)
+			}
+			v, ok, err := app.GetAgentConfigVersion(r.Context(), user.ID, version)
+			if err != nil {
+				return err
+			} else if !ok || v.Scope != scope {
+				return NewHTTPError(fmt.Errorf("no such version: %d", version), http.StatusNotFound)
+			}
+			config = v.Config
+		default:
+			config.HeartbeatSeconds, _ = strconv.Atoi(r.FormValue("heartbeat_seconds"))
+			config.MetricsEnabled = r.FormValue("metrics_enabled") != ""
+			config.Commands = strings.Fields(r.FormValue("commands"))
+		}
+
+		if err := config.Validate(); err != nil {
+			page.Error = err.Error()
+			page.Config = config
+			break
+		}
+		version, err := app.SaveAgentConfig(r.Context(), user.ID, scope, config)
+		if err != nil {
+			return err
+		}
+		if err := app.Audit(r.Context(), *user, user, "agent_config.save", fmt.Sprintf("%s version %d", scope, version)); err != nil {
+			return err
+		}
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return nil
+	default:
+		return methodNotAllowed(w, r, []string{http.MethodGet, http.MethodPost})
+	}
+
+	var err error
+	if page.Versions, err = app.ListAgentConfigVersions(r.Context(), user.ID, scope, 10); err != nil {
+		return err
+	}
+	page.Saved = len(page.Versions) > 0
+	if page.Device != nil {
+		if page.Effective, err = app.ResolveAgentConfig(r.Context(), *page.Device); err != nil {
+			return err
+		}
+	}
+	if page.Error == "" {
+		switch {
+		case page.Saved:
+			page.Config = page.Versions[0].Config
+		case page.Device != nil:
+			page.Config = page.Effective.Config
+		default:
+			page.Config = defaultAgentConfig
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := app.render(w, r, http.StatusOK, "agent_config.html", page); err != nil {
+		return fmt.Errorf("failed to render agent config page: %w", err)
+	}
+	return nil
+}
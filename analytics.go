@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	pageViewBufferSize    = 1024
+	pageViewFlushInterval = time.Second
+)
+
+// pageView is a single view waiting to be written to the page_views table
+type pageView struct {
+	path string
+	day  string
+}
+
+// StartPageViewRecorder loads the current view total and starts the goroutine
+// that writes buffered page views to the database
+func (app *App) StartPageViewRecorder() error {
+	var total sql.NullInt64
+	if err := app.DB.QueryRowContext(context.Background(), "SELECT SUM(count) FROM page_views").Scan(&total); err != nil {
+		return fmt.Errorf("failed to load page view total: %w", err)
+	}
+	app.pageViewTotal.Store(total.Int64)
+
+	go func() {
+		ticker := time.NewTicker(pageViewFlushInterval)
+		defer ticker.Stop()
+
+		pending := map[pageView]int{}
+		save := func() {
+			if len(pending) == 0 {
+				return
+			}
+			if err := app.savePageViews(context.Background(), pending); err != nil {
+				slog.Error("Failed to save page views", "error", err, "paths", len(pending))
+			}
+			pending = map[pageView]int{}
+		}
+		for {
+			select {
+			case view := <-app.pageViews:
+				pending[view]++
+			case <-ticker.C:
+				save()
+			case done := <-app.pageViewFlush:
+				for len(app.pageViews) > 0 {
+					pending[<-app.pageViews]++
+				}
+				save()
+				close(done)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// RecordPageView counts a view of a page that was served and returns the
+// new site-wide total. The write happens in the background so rendering
+// never waits on the database; if the buffer is full the view is dropped
+// from the per-path stats.
+func (app *App) RecordPageView(path string) int {
+	select {
+	case app.pageViews <- pageView{path: path, day: time.Now().UTC().Format(time.DateOnly)}:
+	default:
+		slog.Warn("Page view buffer full, dropping view", "path", path)
+	}
+	return int(app.pageViewTotal.Add(1))
+}
+
+// FlushPageViews writes the views recorded so far, for shutdown once
+// requests have finished
+func (app *App) FlushPageViews(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case app.pageViewFlush <- done:
+	case <-ctx.Done():
+		return fmt.Errorf("failed to flush page views: %w", ctx.Err())
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to flush page views: %w", ctx.Err())
+	}
+}
+
+// PageViewTotal returns the site-wide view total without recording a view
+func (app *App) PageViewTotal() int {
+	return int(app.pageViewTotal.Load())
+}
+
+// savePageViews adds the pending counts to the page_views table
+func (app *App) savePageViews(ctx context.Context, pending map[pageView]int) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	tx, err := app.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for view, count := range pending {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO page_views (path, day, count) VALUES (?, ?, ?)
+			ON CONFLICT (path, day) DO UPDATE SET count = page_views.count + excluded.count
+		`, view.path, view.day, count)
+		if err != nil {
+			return fmt.Errorf("failed to save page views for %s: %w", view.path, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// RecordServerError counts a 5xx response for the activity digest
+func (app *App) RecordServerError(ctx context.Context, status int) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := app.DB.ExecContext(ctx, `
+		INSERT INTO server_errors (day, status, count) VALUES (?, ?, 1)
+		ON CONFLICT (day, status) DO UPDATE SET count = server_errors.count + 1
+	`, time.Now().UTC().Format(time.DateOnly), status)
+	if err != nil {
+		slog.Error("Failed to record server error", "error", err)
+	}
+}
+
+// migrateCounter moves the total from the old single-row counter table into
+// page_views so the site-wide count carries over
+func (app *App) migrateCounter(ctx context.Context) error {
+	exists, err := app.Store.HasTable(ctx, app.DB, "counter")
+	if err != nil {
+		return fmt.Errorf("failed to check for counter table: %w", err)
+	}
+	if !exists {
+		return nil
+	}
+
+	tx, err := app.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Views from before per-path tracking are stored under an empty path
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO page_views (path, day, count)
+		SELECT '', ?, count FROM counter WHERE id = 1 AND count > 0
+	`, time.Now().UTC().Format(time.DateOnly))
+	if err != nil {
+		return fmt.Errorf("failed to copy counter: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "DROP TABLE counter"); err != nil {
+		return fmt.Errorf("failed to drop counter table: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// PostStats holds view totals for a single post
+type PostStats struct {
+	Post       Post
+	Total      int
+	LastWeek   int
+	LastViewed string
+}
+
+// StatsPage holds data for the stats template
+type StatsPage struct {
+	Meta  PageMeta
+	Posts []PostStats
+	Total int
+}
+
+// GetPostStats returns view totals for each post, most viewed first
+func (app *App) GetPostStats(ctx context.Context, posts []Post) ([]PostStats, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	weekAgo := time.Now().UTC().AddDate(0, 0, -7).Format(time.DateOnly)
+	rows, err := app.DB.QueryContext(ctx, `
+		SELECT path,
+			SUM(count),
+			SUM(CASE WHEN day > ? THEN count ELSE 0 END),
+			MAX(day)
+		FROM page_views
+		WHERE path LIKE '/blog/_%'
+		GROUP BY path
+	`, weekAgo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query post stats: %w", err)
+	}
+	defer rows.Close()
+
+	bySlug := map[string]PostStats{}
+	for rows.Next() {
+		var path string
+		var stats PostStats
+		if err := rows.Scan(&path, &stats.Total, &stats.LastWeek, &stats.LastViewed); err != nil {
+			return nil, fmt.Errorf("failed to scan post stats row: %w", err)
+		}
+		bySlug[strings.TrimPrefix(path, "/blog/")] = stats
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating post stats rows: %w", err)
+	}
+
+	result := make([]PostStats, 0, len(posts))
+	for _, post := range posts {
+		stats := bySlug[post.Slug]
+		stats.Post = post
+		result = append(result, stats)
+	}
+
+	// Stable so posts with equal views stay in published order
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Total > result[j].Total
+	})
+
+	return result, nil
+}
+
+// GetPostViews returns the total and last week's views of one post
+func (app *App) GetPostViews(ctx context.Context, slug string) (total, lastWeek int, err error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	weekAgo := time.Now().UTC().AddDate(0, 0, -7).Format(time.DateOnly)
+	err = app.DB.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(count), 0),
+			COALESCE(SUM(CASE WHEN day > ? THEN count ELSE 0 END), 0)
+		FROM page_views
+		WHERE path = ?
+	`, weekAgo, "/blog/"+slug).Scan(&total, &lastWeek)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to query post views: %w", err)
+	}
+	return total, lastWeek, nil
+}
+
+// handleStats renders per-post view totals. Callers must wrap it with
+// RequireRole(RoleAdmin, ...).
+func (app *App) handleStats(w http.ResponseWriter, r *http.Request, posts []Post, count int, user *User) error {
+	stats, err := coalesce(r.Context(), &app.flights, "post-stats:"+postsHash(posts), func(ctx context.Context) ([]PostStats, error) {
+		return app.GetPostStats(ctx, posts)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get post stats: %w", err)
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	data := StatsPage{
+		Meta: PageMeta{
+			Title: "Stats",
+			Count: count,
+			User:  user,
+
+			CSRFToken: csrfToken(r),
+		},
+		Posts: stats,
+		Total: count,
+	}
+	if err := app.render(w, r, http.StatusOK, "stats.html", data); err != nil {
+		return fmt.Errorf("failed to render stats page: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Only pages that were served count as views: not redirects, errors or
+// 404 probes
+func TestPageViewStatuses(t *testing.T) {
+	app := newTestApp(t)
+	if _, err := app.CreateShortlink(context.Background(), 1, "gh", "https://github.com/maxmcd/tulip", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method   string
+		path     string
+		status   int
+		recorded bool
+	}{
+		{http.MethodGet, "/", http.StatusOK, true},
+		{http.MethodGet, "/blog", http.StatusOK, true},
+		{http.MethodGet, "/login", http.StatusOK, true},
+		{http.MethodGet, "/s/gh", http.StatusFound, false},
+		{http.MethodGet, "/settings", http.StatusSeeOther, false},
+		{http.MethodGet, "/wp-login.php", http.StatusNotFound, false},
+		{http.MethodGet, "/blog/missing", http.StatusNotFound, false},
+		{http.MethodPost, "/login", http.StatusForbidden, false},
+	}
+	handler := app.Handler()
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+
+			var recorded []string
+			for len(app.pageViews) > 0 {
+				recorded = append(recorded, (<-app.pageViews).path)
+			}
+			if tt.recorded && (len(recorded) != 1 || recorded[0] != tt.path) {
+				t.Errorf("recorded %q, want a view of %s", recorded, tt.path)
+			} else if !tt.recorded && len(recorded) > 0 {
+				t.Errorf("recorded %q, want no view", recorded)
+			}
+		})
+	}
+}
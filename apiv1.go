@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// apiV1Prefix is where the versioned JSON API lives
+const apiV1Prefix = "/api/v1"
+
+// APIPost is a blog post in the JSON API. HTML is only included when a
+// single post is fetched.
+type APIPost struct {
+	Slug        string    `json:"slug"`
+	Title       string    `json:"title"`
+	Date        time.Time `json:"date"`
+	Description string    `json:"description"`
+	Image       string    `json:"image"`
+	URL         string    `json:"url"`
+	HTML        string    `json:"html,omitempty"`
+}
+
+// APIUser is the caller's profile in the JSON API
+type APIUser struct {
+	ID        int64     `json:"id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+	// DisplayName and TimeZone are "" until the user sets them, and
+	// AvatarURL is "" until they pick an avatar
+	DisplayName string `json:"display_name"`
+	TimeZone    string `json:"time_zone"`
+	AvatarURL   string `json:"avatar_url"`
+	// DeleteAfter is when the account will be deleted, if the user asked
+	DeleteAfter *time.Time `json:"delete_after"`
+}
+
+// apiPost converts a post for the JSON API
+func apiPost(r *http.Request, post Post) APIPost {
+	return APIPost{
+		Slug:        post.Slug,
+		Title:       post.Title,
+		Date:        post.Date,
+		Description: post.Description,
+		Image:       absoluteURL(r, post.Image),
+		URL:         baseURL(r) + "/blog/" + post.Slug,
+	}
+}
+
+// originAllowed reports whether an Origin header is in a list of origins,
+// which may be "*" for any
+func originAllowed(origins []string, origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, o := range origins {
+		if o == "*" || strings.TrimSuffix(o, "/") == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// setAPICORS allows the request's origin to call the API if it's in
+// API_ORIGINS, and answers preflight requests. It reports whether the
+// request was a preflight, which needs no further response. Cross-origin
+// calls are off by default. Cookies are never sent cross-origin, so
+// sessions can't be used this way.
+func setAPICORS(w http.ResponseWriter, r *http.Request, origins []string) bool {
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	allowed := originAllowed(origins, origin)
+	if allowed {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, Retry-After")
+	}
+
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	if allowed {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, "+actingAsHeader)
+		w.Header().Set("Access-Control-Max-Age", "3600")
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// acceptsJSON reports whether the Accept header allows a JSON response
+func acceptsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+		switch mediaType {
+		case "*/*", "application/*", "application/json":
+			return true
+		}
+	}
+	return false
+}
+
+// handleAPIV1 serves the versioned JSON API under /api/v1. Posts and the
+// site status are public, and the rest authenticate like the other JSON endpoints. Device
+// endpoints are the same handlers as the older paths under /api/devices.
+func (app *App) handleAPIV1(w http.ResponseWriter, r *http.Request) error {
+	if setAPICORS(w, r, app.Config.APIOrigins) {
+		return nil
+	}
+	if !acceptsJSON(r) {
+		return NewHTTPError(fmt.Errorf("this endpoint only responds with application/json"), http.StatusNotAcceptable)
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, apiV1Prefix)
+	switch {
+	case path == "/posts":
+		return app.handleAPIPosts(w, r)
+	case strings.HasPrefix(path, "/posts/"):
+		return app.handleAPIPost(w, r, strings.TrimPrefix(path, "/posts/"))
+	case path == "/status":
+		return app.handleAPIStatus(w, r)
+	case path == "/me":
+		return app.handleAPIMe(w, r)
+	case path == "/media":
+		return app.handleAPIMedia(w, r)
+	case path == "/flags":
+		var user *User
+		if currentUser, err := app.getCurrentUser(r); err == nil {
+			user = &currentUser
+		}
+		return app.handleFlags(w, r, user)
+	case path == "/devices" || strings.HasPrefix(path, "/devices/"):
+		// The device handlers parse IDs out of the unversioned path
+		u := *r.URL
+		u.Path = "/api" + path
+		r2 := r.Clone(r.Context())
+		r2.URL = &u
+		return app.handleDeviceAPI(w, r2)
+	}
+	return NewHTTPError(fmt.Errorf("no such endpoint: %s", r.URL.Path), http.StatusNotFound)
+}
+
+// handleAPIPosts lists published posts, newest first, at GET /api/v1/posts
+func (app *App) handleAPIPosts(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return NewHTTPError(fmt.Errorf("method not allowed"), http.StatusMethodNotAllowed)
+	}
+	posts := app.siteFor(r).Blog().Posts
+	result := make([]APIPost, 0, len(posts))
+	for _, post := range posts {
+		result = append(result, apiPost(r, post))
+	}
+	return writeJSON(w, result)
+}
+
+// handleAPIPost returns a post and its rendered HTML at
+// GET /api/v1/posts/{slug}
+func (app *App) handleAPIPost(w http.ResponseWriter, r *http.Request, slug string) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return NewHTTPError(fmt.Errorf("method not allowed"), http.StatusMethodNotAllowed)
+	}
+	slug, err := url.PathUnescape(slug)
+	if err != nil {
+		return NewHTTPError(fmt.Errorf("no such post"), http.StatusNotFound)
+	}
+	post, ok := app.siteFor(r).Blog().PostBySlug(slug)
+	if !ok {
+		return NewHTTPError(fmt.Errorf("no such post: %s", slug), http.StatusNotFound)
+	}
+	result := apiPost(r, post)
+	result.HTML = string(post.Content)
+	return writeJSON(w, result)
+}
+
+// handleAPIMe returns the caller's profile at GET /api/v1/me. Any token
+// can read it.
+func (app *App) handleAPIMe(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return NewHTTPError(fmt.Errorf("method not allowed"), http.StatusMethodNotAllowed)
+	}
+	auth, err := app.authenticateRequest(w, r)
+	if err != nil {
+		return err
+	}
+
+	result := APIUser{
+		ID:        auth.User.ID,
+		Email:     auth.User.Email,
+		Role:      auth.User.Role,
+		CreatedAt: auth.User.CreatedAt,
+
+		DisplayName: auth.User.DisplayName,
+		TimeZone:    auth.User.TimeZone,
+		AvatarURL:   absoluteURL(r, auth.User.AvatarURL()),
+	}
+	if !auth.User.DeleteAfter.IsZero() {
+		result.DeleteAfter = &auth.User.DeleteAfter
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return writeJSON(w, result)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http/httputil"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/sync/singleflight"
+)
+
+// App is one instance of the server: its database, sites, mailer and
+// settings. Handlers and the helpers they use are methods on it, so several
+// can run side by side in one process.
+type App struct {
+	DB    *sql.DB
+	Store Store
+
+	// sites are the sites served, each with its own posts and templates.
+	// The default site is first, see siteFor.
+	sites []*Site
+
+	// Mailer sends all email, or is nil when email isn't configured
+	Mailer   Mailer
+	Sessions SessionStore
+	Config   Config
+
+	// upstream serves the paths this site doesn't handle, if set
+	upstream *httputil.ReverseProxy
+
+	// pageViews buffers views for StartPageViewRecorder to write, and
+	// pageViewFlush asks it to write them now, see FlushPageViews
+	pageViews     chan pageView
+	pageViewFlush chan chan struct{}
+	pageViewTotal atomic.Int64
+
+	// outboxWake tells the mail worker there's new mail to look at
+	outboxWake chan struct{}
+
+	// consumers are the event subscribers, and eventWake tells the event
+	// bus there are new events for them
+	consumers []*eventConsumer
+	eventWake chan struct{}
+
+	// webmentionWake tells the verifier there are mentions to check
+	webmentionWake chan struct{}
+
+	// deviceEvents tells open devices pages about heartbeats
+	deviceEvents deviceHub
+
+	// latency and startedAt are reported by the status endpoint, and
+	// draining is set once the server is shutting down, see serve
+	latency   latencyTracker
+	startedAt time.Time
+	draining  atomic.Bool
+
+	flags flagCache
+
+	// sessionCache, userCache and mentionCache keep the lookups most pages
+	// make in memory, see Cache. They're nil if CACHE_TTL is 0.
+	sessionCache *Cache[Session]
+	userCache    *Cache[User]
+	mentionCache *Cache[[]Webmention]
+
+	// jobs are the scheduled jobs this instance runs, see StartJobs
+	jobs []*scheduledJob
+
+	// errorReports buffers reports for the error tracker, or is nil if
+	// ERROR_REPORTING isn't set, see StartErrorReporter
+	errorReports chan ErrorReport
+
+	// tracer exports spans to an OTLP collector, or is nil if TRACING is
+	// off, see StartTracing
+	tracer *Tracer
+
+	// flights coalesces concurrent loads of the same expensive page data,
+	// see coalesce
+	flights singleflight.Group
+
+	// certs gets TLS certificates for serve, or is nil if ACME_DOMAINS
+	// isn't set and a proxy in front handles TLS
+	certs *autocert.Manager
+
+	// challengeKey signs abuse challenge tokens, see AbuseChallenge
+	challengeKey []byte
+}
+
+// flagCache holds the flag settings between loads, see currentFlags
+type flagCache struct {
+	mu       sync.Mutex
+	byName   map[string]Flag
+	loadedAt time.Time
+	// hash identifies the current flag settings so cached pages are
+	// invalidated when they change
+	hash string
+}
+
+// NewApp connects to the database and loads everything the site serves
+// from it. Background work waits for Start.
+func NewApp(config Config) (*App, error) {
+	app := &App{
+		Config:     config,
+		startedAt:  time.Now(),
+		pageViews:  make(chan pageView, pageViewBufferSize),
+		outboxWake: make(chan struct{}, 1),
+		eventWake:  make(chan struct{}, 1),
+
+		pageViewFlush:  make(chan chan struct{}),
+		webmentionWake: make(chan struct{}, 1),
+
+		sessionCache: newCache[Session]("sessions", config.CacheTTL, cacheSize),
+		userCache:    newCache[User]("users", config.CacheTTL, cacheSize),
+		mentionCache: newCache[[]Webmention]("webmentions", config.CacheTTL, cacheSize),
+	}
+	app.subscribeConsumers()
+
+	// Set up tracing first so loading the posts is traced
+	var err error
+	app.tracer, err = newTracer(app.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure tracing: %w", err)
+	}
+
+	ok := false
+	defer func() {
+		if !ok && app.DB != nil {
+			app.DB.Close()
+		}
+	}()
+	if err := app.InitDB(); err != nil {
+		return nil, fmt.Errorf("failed to initialize database: %w", err)
+	}
+
+	// Every replica signs abuse challenges with the same key
+	app.challengeKey, err = app.signingKey(context.Background(), "challenge")
+	if err != nil {
+		return nil, err
+	}
+
+	// Login sessions live in the database unless configured otherwise
+	app.Sessions, err = app.newSessionStore()
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure session store: %w", err)
+	}
+
+	// Login links and digests go out through the configured mail provider
+	app.Mailer, err = newMailer(app.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure email: %w", err)
+	}
+
+	// Optional upstream for paths this site doesn't handle
+	app.upstream, err = app.newUpstreamProxy()
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure upstream proxy: %w", err)
+	}
+
+	// Load each site's templates, posts and search index
+	app.sites, err = parseSites(app.Config)
+	if err != nil {
+		return nil, err
+	}
+	for _, site := range app.sites {
+		site.pages, site.text, err = app.parseTemplates(site, embeddedTemplates())
+		if err != nil {
+			return nil, err
+		}
+		site.blog.Store(&Blog{Hash: postsHash(nil), Search: &SearchIndex{app: app, docs: staticPages}})
+	}
+	// Certificates for the sites' hosts, when serving TLS directly
+	app.certs, err = newCertManager(app.Config, app.sites)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure ACME: %w", err)
+	}
+
+	if err := app.ReloadPosts(context.Background()); err != nil {
+		slog.Error("Failed to load posts", "error", err)
+	}
+	if dir := app.Config.templatesDir(); dir != "" {
+		slog.Info("Reloading templates from disk on every render", "dir", dir)
+	}
+
+	ok = true
+	return app, nil
+}
+
+// Start runs the app's background work: writing page views, cleaning up
+// and archiving expired data, delivering events, and sending email,
+// cross-posts and digests
+func (app *App) Start() error {
+	// Start writing page views in the background
+	if err := app.StartPageViewRecorder(); err != nil {
+		return fmt.Errorf("failed to start page view recorder: %w", err)
+	}
+
+	// Send server errors to Sentry or an OTLP collector when configured
+	if err := app.StartErrorReporter(); err != nil {
+		return fmt.Errorf("failed to start error reporting: %w", err)
+	}
+
+	// Export traces to an OTLP collector when configured
+	app.StartTracing()
+
+	// Run the scheduled jobs: cleanup, retention, cross-posting, digests
+	// and exports
+	if err := app.StartJobs(); err != nil {
+		return fmt.Errorf("failed to start jobs: %w", err)
+	}
+
+	// Send queued email, retrying anything that failed to go out
+	app.StartMailWorker()
+
+	// Deliver published events to their consumers
+	app.StartEventBus()
+
+	// Check received webmentions link to the post they mention
+	app.StartWebmentionVerifier()
+
+	// Copy the SQLite database's changes to its replica as they're made
+	if err := app.StartReplication(); err != nil {
+		return fmt.Errorf("failed to start replication: %w", err)
+	}
+
+	// Back up the SQLite database to S3 when configured
+	if err := app.StartBackups(); err != nil {
+		return fmt.Errorf("failed to configure backups: %w", err)
+	}
+
+	return nil
+}
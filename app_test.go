@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+)
+
+// newTestApp returns an app with an empty SQLite database in a temporary
+// directory, configured from the defaults
+func newTestApp(t *testing.T) *App {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	cfg, err := loadConfig("")
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if err := loadSessionPolicy(cfg); err != nil {
+		t.Fatalf("failed to configure sessions: %v", err)
+	}
+	if err := initMarkdown(cfg.HighlightStyle); err != nil {
+		t.Fatalf("failed to configure markdown: %v", err)
+	}
+	app, err := NewApp(cfg)
+	if err != nil {
+		t.Fatalf("failed to create app: %v", err)
+	}
+	t.Cleanup(func() { app.DB.Close() })
+	return app
+}
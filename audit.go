@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// actingAsHeader lets an admin make an API request on behalf of another
+// user, given by ID. The request sees that user's data, and its writes are
+// audited with both identities.
+const actingAsHeader = "X-Acting-As"
+
+// AuditEntry is a change recorded in the audit log. Emails are copied in
+// when the entry is written so it still says who was involved after either
+// account is deleted.
+type AuditEntry struct {
+	ID         int64
+	ActorID    int64
+	ActorEmail string
+	// UserID is who the change was made to or on behalf of, or 0 when it
+	// doesn't concern a user, like a feature flag
+	UserID    int64
+	UserEmail string
+	Action    string
+	Detail    string
+	CreatedAt time.Time
+}
+
+// ActingAs reports whether the actor made the change on another user's behalf
+func (e AuditEntry) ActingAs() bool {
+	return e.UserID != 0 && e.UserID != e.ActorID
+}
+
+// Audit records that actor made a change, to subject if it concerns a user,
+// and publishes it as a topicAudit event. It goes through DBFrom so it
+// commits or rolls back with the request's transaction when there is one.
+func (app *App) Audit(ctx context.Context, actor User, subject *User, action, detail string) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	entry := AuditEntry{
+		ActorID:    actor.ID,
+		ActorEmail: actor.Email,
+		Action:     action,
+		Detail:     detail,
+		CreatedAt:  time.Now().UTC(),
+	}
+	var userID sql.NullInt64
+	if subject != nil {
+		userID = sql.NullInt64{Int64: subject.ID, Valid: true}
+		entry.UserID = subject.ID
+		entry.UserEmail = subject.Email
+	}
+
+	return app.InTx(ctx, func(ctx context.Context) error {
+		err := app.DBFrom(ctx).QueryRowContext(ctx, `
+			INSERT INTO audit_log (actor_id, actor_email, user_id, user_email, action, detail, request_id, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			RETURNING id
+		`, entry.ActorID, entry.ActorEmail, userID, entry.UserEmail, entry.Action, entry.Detail, RequestID(ctx), entry.CreatedAt).Scan(&entry.ID)
+		if err != nil {
+			return fmt.Errorf("failed to write audit log: %w", err)
+		}
+		if err := app.Publish(ctx, topicAudit, entry); err != nil {
+			return err
+		}
+
+		slog.InfoContext(ctx, "Audit", "action", action, "actor_id", actor.ID, "user_id", entry.UserID, "detail", detail)
+		return nil
+	})
+}
+
+// AuditActingAs records an API write made with X-Acting-As. Agents write on
+// a schedule, so only writes made on someone's behalf are worth auditing.
+func (app *App) AuditActingAs(ctx context.Context, auth Auth, action, detail string) error {
+	if auth.Actor.ID == auth.User.ID {
+		return nil
+	}
+	return app.Audit(ctx, auth.Actor, &auth.User, action, detail)
+}
+
+// ListAuditLog returns the most recent audit log entries
+func (app *App) ListAuditLog(ctx context.Context, limit int) ([]AuditEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	rows, err := app.DB.QueryContext(ctx, `
+		SELECT id, actor_id, actor_email, COALESCE(user_id, 0), user_email, action, detail, created_at
+		FROM audit_log
+		ORDER BY id DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit log: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.ActorID, &e.ActorEmail, &e.UserID, &e.UserEmail, &e.Action, &e.Detail, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan audit log row: %w", err)
+		}
+		entries = append(entries, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating audit log rows: %w", err)
+	}
+
+	return entries, nil
+}
+
+// actAs switches an authenticated API request to the user in X-Acting-As.
+// Only admins can act as someone else, and an API token additionally needs
+// the admin:act-as scope.
+func (app *App) actAs(w http.ResponseWriter, r *http.Request, auth Auth) (Auth, error) {
+	auth.Actor = auth.User
+	value := strings.TrimSpace(r.Header.Get(actingAsHeader))
+	if value == "" {
+		return auth, nil
+	}
+
+	if !isAdmin(&auth.User) {
+		return Auth{}, NewHTTPError(fmt.Errorf("only admins can use %s", actingAsHeader), http.StatusForbidden)
+	}
+	if err := requireScope(auth, "admin:act-as"); err != nil {
+		return Auth{}, err
+	}
+	if err := app.checkAdminGuard(w, r); err != nil {
+		return Auth{}, err
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return Auth{}, NewHTTPError(fmt.Errorf("%s must be a user ID", actingAsHeader), http.StatusBadRequest)
+	}
+	user, err := app.GetUserByID(r.Context(), id)
+	if errors.Is(err, errUserNotFound) {
+		return Auth{}, NewHTTPError(fmt.Errorf("%s: %w", actingAsHeader, err), http.StatusNotFound)
+	} else if err != nil {
+		return Auth{}, err
+	}
+
+	auth.User = user
+	setRequestActingAs(r, user.ID)
+	return auth, nil
+}
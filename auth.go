@@ -1,19 +1,23 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
-const (
-	sessionCookieName = "tulip_session"
-	cookieMaxAge      = 7 * 24 * 60 * 60 // 7 days in seconds
-)
+const sessionCookieName = "tulip_session"
+
+// loginBrowserCookieName marks the browser a login link was opened in, so
+// the browser that used a link can submit it again, see VerifyMagicLink
+const loginBrowserCookieName = "tulip_login_browser"
 
 // generateRandomToken creates a secure random token
 func generateRandomToken(length int) (string, error) {
@@ -25,62 +29,125 @@ func generateRandomToken(length int) (string, error) {
 }
 
 // getCurrentUser gets the current user from a request's cookies
-func getCurrentUser(r *http.Request) (User, error) {
+func (app *App) getCurrentUser(r *http.Request) (User, error) {
 	cookie, err := r.Cookie(sessionCookieName)
 	if err != nil {
 		return User{}, fmt.Errorf("no session cookie: %w", err)
 	}
 
-	user, err := GetUserFromSession(cookie.Value)
+	user, _, err := app.GetUserFromSession(r.Context(), cookie.Value)
 	if err != nil {
 		return User{}, fmt.Errorf("invalid session: %w", err)
 	}
 
+	setRequestUser(r, user.ID)
 	return user, nil
 }
 
+// User roles, from least to most privileged
+const (
+	RoleMember = "member"
+	RoleAdmin  = "admin"
+)
+
+var roleRank = map[string]int{
+	RoleMember: 1,
+	RoleAdmin:  2,
+}
+
+// hasRole reports whether the user has at least the given role
+func hasRole(user *User, role string) bool {
+	return user != nil && roleRank[user.Role] >= roleRank[role]
+}
+
+// isAdmin reports whether the user is an admin
+func isAdmin(user *User) bool {
+	return hasRole(user, RoleAdmin)
+}
+
+// isBootstrapAdmin reports whether the email is listed in ADMIN_EMAILS.
+// Listed users are promoted to admin when they log in.
+func (app *App) isBootstrapAdmin(email string) bool {
+	for _, admin := range app.Config.AdminEmails {
+		if strings.EqualFold(admin, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// currentSession returns the session for the request's cookie
+func (app *App) currentSession(r *http.Request) (Session, error) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return Session{}, fmt.Errorf("no session cookie: %w", err)
+	}
+	return app.Sessions.Lookup(r.Context(), cookie.Value)
+}
+
+// RequireRole wraps a handler so it only runs for logged-in users with at
+// least the given role. Anonymous users are sent to the login page and
+// everyone else gets a 403.
+func (app *App) RequireRole(role string, h func(http.ResponseWriter, *http.Request) error) func(http.ResponseWriter, *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, err := app.getCurrentUser(r)
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return nil
+		}
+		if !hasRole(&user, role) {
+			return NewHTTPError(fmt.Errorf("%s access required", role), http.StatusForbidden)
+		}
+		// Admin pages outside the guarded paths still need to pass the guard
+		if role == RoleAdmin {
+			if err := app.checkAdminGuard(w, r); err != nil {
+				return err
+			}
+		}
+		return h(w, r)
+	}
+}
+
 // createLoginLink generates a magic login link for a user
-func createLoginLink(email string, r *http.Request) (string, error) {
+func (app *App) createLoginLink(email string, r *http.Request) (string, error) {
 	// Create magic link token
-	token, err := CreateMagicLink(email)
+	token, err := app.CreateMagicLink(r.Context(), email)
 	if err != nil {
 		return "", fmt.Errorf("failed to create magic link: %w", err)
 	}
 
 	// Build login URL
-	scheme := "http"
-	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
-		scheme = "https"
-	}
-
-	host := r.Host
-	loginURL := fmt.Sprintf("%s://%s/login/verify?token=%s", scheme, host, url.QueryEscape(token))
+	loginURL := fmt.Sprintf("%s/login/verify?token=%s", baseURL(r), url.QueryEscape(token))
 
 	return loginURL, nil
 }
 
-// sendLoginEmail sends a magic login link to the user's email
-func sendLoginEmail(email, loginURL string) error {
-	subject := "Your Login Link for Tulip"
-	body := fmt.Sprintf(`Hello,
-
-Click the link below to log in to your Tulip account:
-
-%s
-
-This link will expire in 15 minutes.
-
-If you didn't request this login link, you can safely ignore this email.
-
-Best regards,
-The Tulip Team
-`, loginURL)
+// LoginEmail holds data for the login email templates
+type LoginEmail struct {
+	Email    string
+	LoginURL string
+	SiteURL  string
+	// ExpiresIn is how long the link works for, like "15 minutes"
+	ExpiresIn string
+}
 
-	return sendMail(email, subject, body)
+// sendLoginEmail sends a magic login link to the user's email
+func (app *App) sendLoginEmail(ctx context.Context, email, loginURL, siteURL string) error {
+	msg, err := app.renderMail(email, "Your Login Link for Tulip", "login", LoginEmail{
+		Email:     email,
+		LoginURL:  loginURL,
+		SiteURL:   siteURL,
+		ExpiresIn: fmt.Sprintf("%d minutes", int(magicLinkLifetime.Minutes())),
+	})
+	if err != nil {
+		return err
+	}
+	return app.queueMail(ctx, msg)
 }
 
-// setSessionCookie sets a session cookie for the authenticated user
-func setSessionCookie(w http.ResponseWriter, sessionToken string) {
+// setSessionCookie sets a session cookie for the authenticated user that
+// lasts as long as the session
+func setSessionCookie(w http.ResponseWriter, sessionToken string, expiresAt time.Time) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     sessionCookieName,
 		Value:    sessionToken,
@@ -88,7 +155,7 @@ func setSessionCookie(w http.ResponseWriter, sessionToken string) {
 		HttpOnly: true,
 		Secure:   true,
 		SameSite: http.SameSiteLaxMode,
-		MaxAge:   cookieMaxAge,
+		MaxAge:   int(time.Until(expiresAt).Seconds()),
 	})
 }
 
@@ -106,7 +173,7 @@ func clearSessionCookie(w http.ResponseWriter) {
 }
 
 // handleLoginWithError is a wrapper for handleLogin that returns errors
-func handleLoginWithError(w http.ResponseWriter, r *http.Request) error {
+func (app *App) handleLoginWithError(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 
 	// Only handle POST requests
@@ -128,40 +195,80 @@ func handleLoginWithError(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
+	// Turn away bots before they use up anyone's rate limit
+	if err := loginChallenge.Check(r, app.DB, app.challengeKey); errors.Is(err, errChallengeFailed) {
+		http.Redirect(w, r, "/login?error=challenge_failed", http.StatusSeeOther)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Stop login email spam, both from one client and to one address
+	if err := app.checkRateLimit(w, r, loginIPLimit, clientIP(r).String()); err != nil {
+		return err
+	}
+	if err := app.checkRateLimit(w, r, loginEmailLimit, normalizeEmail(email)); err != nil {
+		return err
+	}
+
 	// Generate login link
-	loginURL, err := createLoginLink(email, r)
+	loginURL, err := app.createLoginLink(email, r)
 	if err != nil {
 		slog.ErrorContext(ctx, "Failed to create login link", "error", err)
 		http.Redirect(w, r, "/login?error=server_error", http.StatusSeeOther)
 		return err
 	}
 
-	// Send login email
-	err = sendLoginEmail(email, loginURL)
-	if err != nil {
+	// Send login email. Temporary failures are retried from the outbox, so
+	// only a rejected address, which is the user's to fix, is reported.
+	err = app.sendLoginEmail(r.Context(), email, loginURL, baseURL(r))
+	if isPermanentMailError(err) {
+		slog.WarnContext(ctx, "Login email rejected", "error", err, "email", email)
+		http.Redirect(w, r, "/login?error=email_rejected", http.StatusSeeOther)
+		return nil
+	} else if err != nil {
 		slog.ErrorContext(ctx, "Failed to send login email", "error", err, "email", email)
 		http.Redirect(w, r, "/login?error=email_send_failed", http.StatusSeeOther)
 		return err
 	}
 
-	slog.InfoContext(ctx, "Login email sent", "email", email)
+	slog.InfoContext(ctx, "Login email queued", "email", email)
 	http.Redirect(w, r, "/login?status=email_sent", http.StatusSeeOther)
 	return nil
 }
 
 // handleLoginVerifyWithError is a wrapper for handleLoginVerify that returns errors
-func handleLoginVerifyWithError(w http.ResponseWriter, r *http.Request) error {
+func (app *App) handleLoginVerifyWithError(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 
-	// Get token from query
-	token := r.URL.Query().Get("token")
+	// Stop clients from guessing tokens
+	if err := app.checkRateLimit(w, r, verifyIPLimit, clientIP(r).String()); err != nil {
+		return err
+	}
+
+	// Opening the link only asks the user to confirm. Email scanners that
+	// follow every link in a message would otherwise use it up before the
+	// user gets to click it.
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return app.handleLoginConfirm(w, r)
+	case http.MethodPost:
+	default:
+		return methodNotAllowed(w, r, []string{http.MethodGet, http.MethodPost})
+	}
+
+	token := r.FormValue("token")
 	if token == "" {
 		http.Redirect(w, r, "/login?error=invalid_token", http.StatusSeeOther)
 		return nil
 	}
 
 	// Verify token
-	email, err := VerifyMagicLink(token)
+	var browser string
+	if cookie, err := r.Cookie(loginBrowserCookieName); err == nil {
+		browser = cookie.Value
+	}
+	email, err := app.VerifyMagicLink(ctx, token, browser)
 	if err != nil {
 		slog.ErrorContext(ctx, "Failed to verify magic link", "error", err)
 		http.Redirect(w, r, "/login?error=invalid_token", http.StatusSeeOther)
@@ -169,38 +276,133 @@ func handleLoginVerifyWithError(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	// Get or create user
-	user, err := CreateOrGetUser(email)
+	user, err := app.CreateOrGetUser(ctx, email)
 	if err != nil {
 		slog.ErrorContext(ctx, "Failed to get/create user", "error", err, "email", email)
 		http.Redirect(w, r, "/login?error=server_error", http.StatusSeeOther)
 		return fmt.Errorf("failed to get/create user: %w", err)
 	}
 
-	// Create session
-	sessionToken, err := CreateSession(user.ID)
-	if err != nil {
-		slog.ErrorContext(ctx, "Failed to create session", "error", err, "user_id", user.ID)
+	if err := app.completeLogin(w, r, user, "magic_link"); err != nil {
+		slog.ErrorContext(ctx, "Failed to start session", "error", err, "user_id", user.ID)
 		http.Redirect(w, r, "/login?error=server_error", http.StatusSeeOther)
+		return err
+	}
+	return nil
+}
+
+// LoginConfirmPage holds data for the login link confirmation template
+type LoginConfirmPage struct {
+	Meta  PageMeta
+	Token string
+}
+
+// handleLoginConfirm shows the button that uses a login link, and marks the
+// browser it was opened in
+func (app *App) handleLoginConfirm(w http.ResponseWriter, r *http.Request) error {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Redirect(w, r, "/login?error=invalid_token", http.StatusSeeOther)
+		return nil
+	}
+
+	if _, err := r.Cookie(loginBrowserCookieName); err != nil {
+		browser, err := generateRandomToken(32)
+		if err != nil {
+			return fmt.Errorf("failed to generate browser token: %w", err)
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     loginBrowserCookieName,
+			Value:    browser,
+			Path:     "/login/verify",
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteLaxMode,
+			MaxAge:   int(magicLinkLifetime.Seconds()),
+		})
+	}
+
+	// The page has the token in it
+	w.Header().Set("Cache-Control", "no-store")
+	if err := app.render(w, r, http.StatusOK, "login_confirm.html", LoginConfirmPage{
+		Token: token,
+		Meta: PageMeta{
+			Title: "Log in",
+
+			CSRFToken: csrfToken(r),
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to render login confirmation: %w", err)
+	}
+	return nil
+}
+
+// startSession logs the user in on this browser, promoting bootstrap admins
+// on the way
+func (app *App) startSession(w http.ResponseWriter, r *http.Request, user User) error {
+	if app.isBootstrapAdmin(user.Email) && user.Role != RoleAdmin {
+		if err := app.SetUserRole(r.Context(), user.ID, RoleAdmin); err != nil {
+			return fmt.Errorf("failed to promote admin: %w", err)
+		}
+		slog.InfoContext(r.Context(), "Promoted user to admin", "user_id", user.ID, "email", user.Email)
+	}
+
+	// Logging in during the grace period keeps the account
+	if cancelled, err := app.CancelAccountDeletion(r.Context(), user.ID); err != nil {
+		return err
+	} else if cancelled {
+		slog.InfoContext(r.Context(), "Account deletion cancelled", "user_id", user.ID)
+	}
+
+	return app.RenewSession(w, r, user.ID)
+}
+
+// RenewSession gives the browser a new session token for the user and ends
+// the session the request came with, if any. Handlers call it once an
+// identity-sensitive change, like logging in or a change of role or email,
+// has been made for the signed in user, so a token planted or copied before
+// the change stops working straight away rather than after the rotation
+// grace period.
+func (app *App) RenewSession(w http.ResponseWriter, r *http.Request, userID int64) error {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		if err := app.DeleteSession(r.Context(), cookie.Value); err != nil {
+			return fmt.Errorf("failed to end previous session: %w", err)
+		}
+	}
+
+	now := time.Now()
+	sessionToken, err := app.CreateSession(r.Context(), userID, SessionClient{
+		UserAgent: truncate(r.UserAgent(), 256),
+		IP:        clientIP(r).String(),
+	})
+	if err != nil {
 		return fmt.Errorf("failed to create session: %w", err)
 	}
 
-	// Set session cookie
-	setSessionCookie(w, sessionToken)
+	setSessionCookie(w, sessionToken, sessionPolicy.expiry(now, now))
+	replaceRequestCookie(r, sessionCookieName, sessionToken)
+	return rotateCSRFToken(w)
+}
 
-	slog.InfoContext(ctx, "User logged in", "user_id", user.ID, "email", user.Email)
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+// RevokeSessions ends all of a user's sessions after an identity-sensitive
+// change made by someone else, like an admin changing their role. They
+// sign in again to get a session that reflects it.
+func (app *App) RevokeSessions(ctx context.Context, userID int64) error {
+	if err := app.Sessions.DeleteForUser(ctx, userID); err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", err)
+	}
 	return nil
 }
 
 // handleLogoutWithError is a wrapper for handleLogout that returns errors
-func handleLogoutWithError(w http.ResponseWriter, r *http.Request) error {
+func (app *App) handleLogoutWithError(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 
 	// Get session token from cookie
 	cookie, err := r.Cookie(sessionCookieName)
 	if err == nil {
 		// Delete session from database
-		err = DeleteSession(cookie.Value)
+		err = app.DeleteSession(r.Context(), cookie.Value)
 		if err != nil {
 			slog.ErrorContext(ctx, "Failed to delete session", "error", err)
 			// Continue with logout even if session deletion fails
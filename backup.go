@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// backupKeyTime is the timestamp in a backup's key, which sorts by age
+const backupKeyTime = "20060102T150405Z"
+
+// backupKeyPattern matches the keys of backups under the prefix, so other
+// objects in the bucket are never pruned
+var backupKeyPattern = regexp.MustCompile(`^tulip-(\d{8}T\d{6}Z)\.db\.gz$`)
+
+// BackupConfig is where and how often the SQLite database is backed up
+type BackupConfig struct {
+	client   *s3Client
+	prefix   string
+	interval time.Duration
+	// keep is how many backups are kept, newest first
+	keep int
+}
+
+// backupConfig returns where backups go: BACKUP_BUCKET, with keys under
+// BACKUP_PREFIX, every BACKUP_INTERVAL, keeping the newest BACKUP_KEEP. ok
+// is false if backups aren't set up.
+func backupConfig(c Config) (cfg BackupConfig, ok bool, err error) {
+	if c.BackupBucket == "" {
+		return BackupConfig{}, false, nil
+	}
+	cfg = BackupConfig{prefix: c.BackupPrefix, interval: c.BackupInterval, keep: c.BackupKeep}
+	cfg.client, err = newS3Client(c, c.BackupBucket)
+	if err != nil {
+		return BackupConfig{}, false, err
+	}
+	return cfg, true, nil
+}
+
+// backupDatabase snapshots the SQLite database with VACUUM INTO, which
+// makes a consistent copy while requests carry on, and uploads it gzipped.
+// It returns the backup's key.
+func backupDatabase(ctx context.Context, db *sql.DB, cfg BackupConfig, now time.Time) (string, error) {
+	dir, err := os.MkdirTemp("", "tulip-backup-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	snapshot := filepath.Join(dir, "tulip.db")
+	if _, err := db.ExecContext(ctx, "VACUUM INTO ?", snapshot); err != nil {
+		return "", fmt.Errorf("failed to snapshot database: %w", err)
+	}
+
+	f, err := os.Open(snapshot)
+	if err != nil {
+		return "", fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	defer f.Close()
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := io.Copy(zw, f); err != nil {
+		return "", fmt.Errorf("failed to compress snapshot: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return "", fmt.Errorf("failed to compress snapshot: %w", err)
+	}
+
+	key := cfg.prefix + "tulip-" + now.UTC().Format(backupKeyTime) + ".db.gz"
+	if err := cfg.client.Put(key, compressed.Bytes(), http.Header{"Content-Type": {"application/gzip"}}); err != nil {
+		return "", fmt.Errorf("failed to upload backup: %w", err)
+	}
+	return key, nil
+}
+
+// listBackups returns the keys of the backups in the bucket, oldest first
+func listBackups(cfg BackupConfig) ([]string, error) {
+	objects, err := cfg.client.List(cfg.prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	var keys []string
+	for _, o := range objects {
+		if backupKeyPattern.MatchString(strings.TrimPrefix(o.Key, cfg.prefix)) {
+			keys = append(keys, o.Key)
+		}
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
+
+// pruneBackups deletes all but the newest backups, returning how many it
+// deleted
+func pruneBackups(cfg BackupConfig) (int, error) {
+	keys, err := listBackups(cfg)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for len(keys)-deleted > cfg.keep {
+		if err := cfg.client.Delete(keys[deleted]); err != nil {
+			return deleted, fmt.Errorf("failed to delete backup: %w", err)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// runBackup takes a backup and prunes the old ones
+func runBackup(ctx context.Context, db *sql.DB, cfg BackupConfig) error {
+	start := time.Now()
+	key, err := backupDatabase(ctx, db, cfg, start)
+	if err != nil {
+		return err
+	}
+	pruned, err := pruneBackups(cfg)
+	if err != nil {
+		return err
+	}
+	slog.Info("Backed up database", "key", key, "pruned", pruned, "duration", time.Since(start).String())
+	return nil
+}
+
+// nextBackup returns when the next backup is due, going by the newest one
+// in the bucket so restarts don't each take a backup
+func nextBackup(cfg BackupConfig, now time.Time) time.Time {
+	keys, err := listBackups(cfg)
+	if err != nil {
+		slog.Error("Failed to find the last backup", "error", err)
+		return now
+	}
+	if len(keys) == 0 {
+		return now
+	}
+	m := backupKeyPattern.FindStringSubmatch(strings.TrimPrefix(keys[len(keys)-1], cfg.prefix))
+	last, err := time.Parse(backupKeyTime, m[1])
+	if err != nil {
+		return now
+	}
+	return last.Add(cfg.interval)
+}
+
+// StartBackups backs up the SQLite database on a schedule, if BACKUP_BUCKET
+// is set. Postgres has its own backups, so it's left alone.
+func (app *App) StartBackups() error {
+	cfg, ok, err := backupConfig(app.Config)
+	if err != nil {
+		return err
+	} else if !ok {
+		return nil
+	}
+	if _, isSQLite := app.Store.(sqliteStore); !isSQLite {
+		slog.Warn("BACKUP_BUCKET is set but only SQLite databases are backed up, skipping backups")
+		return nil
+	}
+
+	go func() {
+		time.Sleep(time.Until(nextBackup(cfg, time.Now())))
+		for {
+			if err := runBackup(context.Background(), app.DB, cfg); err != nil {
+				slog.Error("Failed to back up database", "error", err)
+			}
+			time.Sleep(cfg.interval)
+		}
+	}()
+	return nil
+}
+
+// backupCommand handles `tulip backup`, which backs up the database now
+func backupCommand(c Config) error {
+	cfg, ok, err := backupConfig(c)
+	if err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("BACKUP_BUCKET is not set")
+	}
+	if c.DatabaseURL != "" {
+		return fmt.Errorf("only SQLite databases can be backed up, DATABASE_URL is set")
+	}
+
+	db, err := sqliteStore{path: databasePath()}.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+	return runBackup(context.Background(), db, cfg)
+}
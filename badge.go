@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// badgeCacheControl keeps badges fresh without every embed hitting the
+// database
+const badgeCacheControl = "public, max-age=60"
+
+// BadgeViews is the JSON form of a badge
+type BadgeViews struct {
+	Views int `json:"views"`
+	// Post fields are only set for post badges
+	Slug     string `json:"slug,omitempty"`
+	Title    string `json:"title,omitempty"`
+	LastWeek *int   `json:"views_last_week,omitempty"`
+}
+
+// setBadgeCORS allows the request's origin to read the response if it's in
+// BADGE_ORIGINS, a list of origins that may fetch badges with JavaScript.
+// It defaults to "*", since the counts are public anyway. Set it to "none"
+// to turn cross-origin reads off. Image embeds don't need this, only fetch
+// and XHR do.
+func setBadgeCORS(w http.ResponseWriter, r *http.Request, origins []string) {
+	if slices.Contains(origins, "*") {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	w.Header().Add("Vary", "Origin")
+	if origin := r.Header.Get("Origin"); originAllowed(origins, origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+}
+
+// handleBadge serves view counts for embedding: /badge/views.svg and
+// /badge/views.json for the whole site, and /badge/posts/{slug}.svg and
+// .json for a post. SVG badges take an optional label parameter.
+func (app *App) handleBadge(w http.ResponseWriter, r *http.Request) error {
+	setBadgeCORS(w, r, app.Config.BadgeOrigins)
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions:
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD")
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	default:
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		return NewHTTPError(fmt.Errorf("method not allowed"), http.StatusMethodNotAllowed)
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/badge/")
+	format := "svg"
+	if base, ok := strings.CutSuffix(name, ".json"); ok {
+		name, format = base, "json"
+	} else if base, ok := strings.CutSuffix(name, ".svg"); ok {
+		name = base
+	} else {
+		return NewHTTPError(fmt.Errorf("page not found: %s", r.URL.Path), http.StatusNotFound)
+	}
+
+	var views BadgeViews
+	if name == "views" {
+		views.Views = app.PageViewTotal()
+	} else if slug, ok := strings.CutPrefix(name, "posts/"); ok {
+		post, ok := app.siteFor(r).Blog().PostBySlug(slug)
+		if !ok {
+			return NewHTTPError(fmt.Errorf("page not found: %s", r.URL.Path), http.StatusNotFound)
+		}
+		total, lastWeek, err := app.GetPostViews(r.Context(), post.Slug)
+		if err != nil {
+			return err
+		}
+		views = BadgeViews{Views: total, Slug: post.Slug, Title: post.Title, LastWeek: &lastWeek}
+	} else {
+		return NewHTTPError(fmt.Errorf("page not found: %s", r.URL.Path), http.StatusNotFound)
+	}
+
+	w.Header().Set("Cache-Control", badgeCacheControl)
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(views); err != nil {
+			return fmt.Errorf("failed to write badge: %w", err)
+		}
+		return nil
+	}
+
+	label := r.URL.Query().Get("label")
+	if label == "" {
+		label = "views"
+	}
+	if utf8.RuneCountInString(label) > 40 {
+		return NewHTTPError(fmt.Errorf("label is too long"), http.StatusBadRequest)
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	if err := badgeSVG.Execute(w, newBadge(label, formatCount(views.Views))); err != nil {
+		return fmt.Errorf("failed to write badge: %w", err)
+	}
+	return nil
+}
+
+// badge is the layout of a two part badge
+type badge struct {
+	Label, Value           string
+	LabelWidth, ValueWidth int
+	Width, LabelX, ValueX  int
+}
+
+// newBadge sizes a badge for its text. Widths are estimated at 7px a
+// character, which fits the 11px sans-serif font closely enough.
+func newBadge(label, value string) badge {
+	b := badge{
+		Label:      label,
+		Value:      value,
+		LabelWidth: utf8.RuneCountInString(label)*7 + 10,
+		ValueWidth: utf8.RuneCountInString(value)*7 + 10,
+	}
+	b.Width = b.LabelWidth + b.ValueWidth
+	b.LabelX = b.LabelWidth / 2
+	b.ValueX = b.LabelWidth + b.ValueWidth/2
+	return b
+}
+
+// formatCount adds thousands separators, like 12,345
+func formatCount(n int) string {
+	s := strconv.Itoa(n)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+// badgeSVG draws a flat badge in the site's colors. html/template escapes
+// the label, which comes from the query string.
+var badgeSVG = template.Must(template.New("badge").Parse(
+	`<svg xmlns="http://www.w3.org/2000/svg" width="{{.Width}}" height="20" role="img" aria-label="{{.Label}}: {{.Value}}">` +
+		`<title>{{.Label}}: {{.Value}}</title>` +
+		`<rect width="{{.LabelWidth}}" height="20" fill="#555"/>` +
+		`<rect x="{{.LabelWidth}}" width="{{.ValueWidth}}" height="20" fill="#0366d6"/>` +
+		`<g fill="#fff" text-anchor="middle" font-family="Verdana,DejaVu Sans,sans-serif" font-size="11">` +
+		`<text x="{{.LabelX}}" y="14">{{.Label}}</text>` +
+		`<text x="{{.ValueX}}" y="14">{{.Value}}</text>` +
+		`</g></svg>`,
+))
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// cacheSize is how many values each cache holds
+const cacheSize = 10000
+
+// Cache keeps values that take a query to load in memory for CACHE_TTL, so
+// hot pages don't go to the database on every request. Concurrent misses
+// for a key share one load, see coalesce. Code that changes what a value
+// was loaded from calls Invalidate, so this instance sees the change on the
+// next read. Other instances sharing a Postgres database don't hear about
+// it, and can serve the old value until it expires.
+//
+// A nil *Cache, from CACHE_TTL=0, loads every time.
+type Cache[T any] struct {
+	name string
+	ttl  time.Duration
+	size int
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry[T]
+	// generation changes whenever something is invalidated, so a load that
+	// started before isn't stored over the change
+	generation uint64
+
+	flights      singleflight.Group
+	hits, misses atomic.Int64
+}
+
+type cacheEntry[T any] struct {
+	value   T
+	expires time.Time
+}
+
+// newCache makes a cache holding up to size values for ttl each, or
+// returns nil if ttl is 0
+func newCache[T any](name string, ttl time.Duration, size int) *Cache[T] {
+	if ttl <= 0 {
+		return nil
+	}
+	return &Cache[T]{name: name, ttl: ttl, size: size, entries: make(map[string]cacheEntry[T])}
+}
+
+// Get returns the value for key, calling load if it isn't cached or has
+// expired. Errors aren't cached.
+func (c *Cache[T]) Get(ctx context.Context, key string, load func(context.Context) (T, error)) (T, error) {
+	if c == nil {
+		return load(ctx)
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	generation := c.generation
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		c.hits.Add(1)
+		return entry.value, nil
+	}
+
+	c.misses.Add(1)
+	value, err := coalesce(ctx, &c.flights, key, load)
+	if err != nil {
+		return value, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation == generation {
+		if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+			c.evict()
+		}
+		c.entries[key] = cacheEntry[T]{value: value, expires: time.Now().Add(c.ttl)}
+	}
+	return value, nil
+}
+
+// evict makes room for an entry, dropping the expired ones or, if none
+// have, an arbitrary one. Callers must hold mu.
+func (c *Cache[T]) evict() {
+	now := time.Now()
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < c.size {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
+
+// Invalidate drops the values for keys. When ctx carries a transaction
+// they're dropped again once it commits, since until then a read outside
+// it can load and cache the old value.
+func (c *Cache[T]) Invalidate(ctx context.Context, keys ...string) {
+	if c == nil {
+		return
+	}
+	drop := func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.generation++
+		for _, key := range keys {
+			delete(c.entries, key)
+		}
+	}
+	drop()
+	afterCommit(ctx, drop)
+}
+
+// Clear drops every value, for writes that can't tell which keys they
+// change. Like Invalidate, it waits for ctx's transaction to commit too.
+func (c *Cache[T]) Clear(ctx context.Context) {
+	if c == nil {
+		return
+	}
+	drop := func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.generation++
+		clear(c.entries)
+	}
+	drop()
+	afterCommit(ctx, drop)
+}
+
+// CacheStats is how a cache has been doing since startup, for the admin
+// dashboard
+type CacheStats struct {
+	Name    string
+	Entries int
+	Hits    int64
+	Misses  int64
+}
+
+// Stats returns the cache's size and hit counts
+func (c *Cache[T]) Stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Name: c.name, Entries: len(c.entries), Hits: c.hits.Load(), Misses: c.misses.Load()}
+}
+
+// CacheStats returns the stats of each of the app's caches, or nothing if
+// CACHE_TTL is 0
+func (app *App) CacheStats() []CacheStats {
+	if app.Config.CacheTTL <= 0 {
+		return nil
+	}
+	return []CacheStats{app.sessionCache.Stats(), app.userCache.Stats(), app.mentionCache.Stats()}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AbuseChallenge guards an anonymous endpoint against bots. Every
+// submission needs a single use token from the page, and forms also get a
+// honeypot field and a minimum time to fill them in. Bits adds a
+// hashcash-style proof of work, set per endpoint with CHALLENGE_POW.
+//
+// Tokens are signed rather than stored, so serving a page costs no write
+// and can't fill the database. Only tokens that were used are stored, to
+// stop them being used again.
+type AbuseChallenge struct {
+	Name string
+	// MinAge is how long a person takes to fill in the form at the least
+	MinAge time.Duration
+}
+
+var (
+	// loginChallenge guards the magic link form
+	loginChallenge = AbuseChallenge{Name: "login", MinAge: 2 * time.Second}
+	// pushChallenge guards anonymous push subscriptions, which are sent
+	// by script so there's no form to fill in
+	pushChallenge = AbuseChallenge{Name: "push"}
+)
+
+// challengeTTL is how long a page can sit before its challenge expires
+const challengeTTL = time.Hour
+
+// maxPowBits keeps the work reasonable on a phone. Each extra bit doubles
+// it, and 16 bits takes a second or two in a browser.
+const maxPowBits = 22
+
+// honeypotField is left empty by people, who never see it
+const honeypotField = "website"
+
+// errChallengeFailed is returned for submissions that look automated
+var errChallengeFailed = errors.New("challenge failed")
+
+// parseChallengePOW reads the proof of work difficulty of each challenge
+// from CHALLENGE_POW, a comma separated list like "login=18,push=16"
+func parseChallengePOW(setting string) (map[string]int, error) {
+	bits := map[string]int{}
+	for _, part := range strings.Split(setting, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		n, err := strconv.Atoi(value)
+		if !ok || err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid CHALLENGE_POW entry %q, expected name=bits", part)
+		}
+		bits[name] = min(n, maxPowBits)
+	}
+	return bits, nil
+}
+
+// Bits returns the proof of work difficulty set for the challenge in
+// CHALLENGE_POW. Endpoints that aren't listed don't need any work.
+func (c AbuseChallenge) Bits(setting string) int {
+	bits, _ := parseChallengePOW(setting)
+	return bits[c.Name]
+}
+
+// ChallengeToken is an issued challenge
+type ChallengeToken struct {
+	Token string `json:"token"`
+	Bits  int    `json:"bits"`
+}
+
+// Issue signs a new challenge token for a page or script to submit, with
+// the difficulty set in CHALLENGE_POW
+func (c AbuseChallenge) Issue(key []byte, pow string) (ChallengeToken, error) {
+	nonce, err := generateRandomToken(16)
+	if err != nil {
+		return ChallengeToken{}, fmt.Errorf("failed to generate challenge: %w", err)
+	}
+	difficulty := c.Bits(pow)
+	return ChallengeToken{Token: c.sign(key, nonce, time.Now(), difficulty), Bits: difficulty}, nil
+}
+
+// sign makes a token of "nonce.issued.bits.mac", which only this site can
+// make and which is only good for the challenge it was issued for
+func (c AbuseChallenge) sign(key []byte, nonce string, issuedAt time.Time, difficulty int) string {
+	payload := nonce + "." + strconv.FormatInt(issuedAt.Unix(), 10) + "." + strconv.Itoa(difficulty)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(c.Name + "\x00" + payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns when a token was issued and its difficulty, or ok false if
+// this site didn't sign it for the challenge
+func (c AbuseChallenge) verify(key []byte, token string) (issuedAt time.Time, difficulty int, ok bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return time.Time{}, 0, false
+	}
+	issued, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	difficulty, err = strconv.Atoi(parts[2])
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	issuedAt = time.Unix(issued, 0)
+	if !hmac.Equal([]byte(c.sign(key, parts[0], issuedAt, difficulty)), []byte(token)) {
+		return time.Time{}, 0, false
+	}
+	return issuedAt, difficulty, true
+}
+
+// Check verifies a submission's challenge. The token and proof of work
+// nonce come from the challenge and challenge_nonce form fields, or the
+// X-Challenge and X-Challenge-Nonce headers for scripts. Blocked
+// submissions are counted by reason and return errChallengeFailed.
+func (c AbuseChallenge) Check(r *http.Request, db *sql.DB, key []byte) error {
+	reason, err := c.check(r, db, key)
+	if err != nil {
+		return err
+	}
+	if reason == "" {
+		return nil
+	}
+
+	slog.WarnContext(r.Context(), "Blocked submission", "challenge", c.Name, "reason", reason, "ip", clientIP(r).String())
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO challenge_blocks (day, name, reason, count) VALUES (?, ?, ?, 1)
+		ON CONFLICT (day, name, reason) DO UPDATE SET count = challenge_blocks.count + 1
+	`, time.Now().UTC().Format(time.DateOnly), c.Name, reason)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to record blocked submission", "error", err)
+	}
+	return fmt.Errorf("%w: %s", errChallengeFailed, reason)
+}
+
+// check returns why a submission was blocked, or "" if it passed. Only a
+// submission that passes everything else uses up its token.
+func (c AbuseChallenge) check(r *http.Request, db *sql.DB, key []byte) (string, error) {
+	if r.FormValue(honeypotField) != "" {
+		return "honeypot", nil
+	}
+
+	token, nonce := r.FormValue("challenge"), r.FormValue("challenge_nonce")
+	if h := r.Header.Get("X-Challenge"); h != "" {
+		token, nonce = h, r.Header.Get("X-Challenge-Nonce")
+	}
+	if token == "" {
+		return "missing", nil
+	}
+	issuedAt, difficulty, ok := c.verify(key, token)
+	if !ok {
+		return "invalid", nil
+	}
+
+	now := time.Now()
+	expiresAt := issuedAt.Add(challengeTTL)
+	switch {
+	case now.After(expiresAt):
+		return "expired", nil
+	case now.Sub(issuedAt) < c.MinAge:
+		return "too_fast", nil
+	case difficulty > 0 && !checkProofOfWork(token, nonce, difficulty):
+		return "proof_of_work", nil
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+	res, err := db.ExecContext(ctx, `
+		INSERT INTO abuse_challenges (token, name, bits, issued_at, expires_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (token) DO NOTHING
+	`, token, c.Name, difficulty, issuedAt, expiresAt)
+	if err != nil {
+		return "", fmt.Errorf("failed to use challenge: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return "", fmt.Errorf("failed to use challenge: %w", err)
+	} else if n == 0 {
+		return "reused", nil
+	}
+	return "", nil
+}
+
+// checkProofOfWork reports whether SHA-256 of "token:nonce" starts with at
+// least difficulty zero bits
+func checkProofOfWork(token, nonce string, difficulty int) bool {
+	if nonce == "" || len(nonce) > 32 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(token + ":" + nonce))
+	zeros := 0
+	for _, b := range sum {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros >= difficulty
+}
+
+// challengeFields renders the hidden fields for a form guarded by the
+// challenge: the token, a honeypot, and a script that does the proof of
+// work when the form is submitted
+func challengeFields(c ChallengeToken) template.HTML {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<input type="hidden" name="challenge" value="%s">`, template.HTMLEscapeString(c.Token))
+	fmt.Fprintf(&b, `<div class="hp" aria-hidden="true"><label>Leave this empty <input type="text" name="%s" tabindex="-1" autocomplete="off"></label></div>`, honeypotField)
+	if c.Bits > 0 {
+		fmt.Fprintf(&b, `<input type="hidden" name="challenge_nonce" data-bits="%d">`, c.Bits)
+		b.WriteString(`<script>
+  (function () {
+    const nonce = document.currentScript.previousElementSibling;
+    const form = nonce.form;
+    form.addEventListener("submit", async function (event) {
+      if (nonce.value) {
+        return;
+      }
+      event.preventDefault();
+      nonce.value = await solveChallenge(form.elements.challenge.value, Number(nonce.dataset.bits));
+      form.submit();
+    });
+  })();
+</script>`)
+	}
+	return template.HTML(b.String())
+}
+
+// handleChallenge issues a challenge to scripts at /challenge/{name}
+func (app *App) handleChallenge(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return NewHTTPError(fmt.Errorf("method not allowed"), http.StatusMethodNotAllowed)
+	}
+	var c AbuseChallenge
+	switch strings.TrimPrefix(r.URL.Path, "/challenge/") {
+	case pushChallenge.Name:
+		c = pushChallenge
+	default:
+		return NewHTTPError(fmt.Errorf("page not found: %s", r.URL.Path), http.StatusNotFound)
+	}
+
+	token, err := c.Issue(app.challengeKey, app.Config.ChallengePOW)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(token); err != nil {
+		return fmt.Errorf("failed to write challenge: %w", err)
+	}
+	return nil
+}
+
+// ChallengeBlocks counts blocked submissions for one endpoint and reason
+type ChallengeBlocks struct {
+	Name   string
+	Reason string
+	Count  int
+}
+
+// ListChallengeBlocks returns blocked submissions since the given day,
+// most first
+func (app *App) ListChallengeBlocks(ctx context.Context, since time.Time) ([]ChallengeBlocks, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	rows, err := app.DB.QueryContext(ctx, `
+		SELECT name, reason, SUM(count)
+		FROM challenge_blocks
+		WHERE day >= ?
+		GROUP BY name, reason
+		ORDER BY SUM(count) DESC
+	`, since.UTC().Format(time.DateOnly))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query blocked submissions: %w", err)
+	}
+	defer rows.Close()
+
+	var blocks []ChallengeBlocks
+	for rows.Next() {
+		var b ChallengeBlocks
+		if err := rows.Scan(&b.Name, &b.Reason, &b.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan blocked submissions row: %w", err)
+		}
+		blocks = append(blocks, b)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating blocked submissions rows: %w", err)
+	}
+	return blocks, nil
+}
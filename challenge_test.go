@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAbuseChallengeCheck(t *testing.T) {
+	app := newTestApp(t)
+	key := app.challengeKey
+	past := time.Now().Add(-time.Minute)
+
+	token := func(c AbuseChallenge, key []byte, issuedAt time.Time, bits int) string {
+		return c.sign(key, "0123456789abcdef", issuedAt, bits)
+	}
+	solve := func(token string, bits int) string {
+		for i := 0; ; i++ {
+			if nonce := strconv.Itoa(i); checkProofOfWork(token, nonce, bits) {
+				return nonce
+			}
+		}
+	}
+	reused := token(loginChallenge, key, past, 0)
+	withWork := token(loginChallenge, key, past, 8)
+
+	tests := []struct {
+		name   string
+		form   url.Values
+		reason string
+	}{
+		{"valid", url.Values{"challenge": {reused}}, ""},
+		{"reused", url.Values{"challenge": {reused}}, "reused"},
+		{"missing", url.Values{}, "missing"},
+		{"honeypot", url.Values{"challenge": {token(loginChallenge, key, past, 0)}, honeypotField: {"https://spam.example"}}, "honeypot"},
+		{"garbage", url.Values{"challenge": {"not-a-token"}}, "invalid"},
+		{"other key", url.Values{"challenge": {token(loginChallenge, []byte("another key"), past, 0)}}, "invalid"},
+		{"other challenge", url.Values{"challenge": {token(pushChallenge, key, past, 0)}}, "invalid"},
+		{"lowered difficulty", url.Values{"challenge": {strings.Replace(withWork, ".8.", ".0.", 1)}}, "invalid"},
+		{"expired", url.Values{"challenge": {token(loginChallenge, key, time.Now().Add(-challengeTTL-time.Minute), 0)}}, "expired"},
+		{"too fast", url.Values{"challenge": {token(loginChallenge, key, time.Now(), 0)}}, "too_fast"},
+		{"no work", url.Values{"challenge": {withWork}}, "proof_of_work"},
+		{"wrong work", url.Values{"challenge": {withWork}, "challenge_nonce": {"x"}}, "proof_of_work"},
+		{"work", url.Values{"challenge": {withWork}, "challenge_nonce": {solve(withWork, 8)}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(tt.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			reason, err := loginChallenge.check(r, app.DB, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reason != tt.reason {
+				t.Errorf("reason %q, want %q", reason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestAbuseChallengeIssue(t *testing.T) {
+	key := []byte("key")
+	issued, err := loginChallenge.Issue(key, "login=12,push=4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued.Bits != 12 {
+		t.Errorf("issued %d bits, want 12", issued.Bits)
+	}
+	issuedAt, bits, ok := loginChallenge.verify(key, issued.Token)
+	if !ok || bits != 12 || time.Since(issuedAt) > time.Minute {
+		t.Errorf("verify(%q) = %v, %d, %t", issued.Token, issuedAt, bits, ok)
+	}
+}
+
+// Serving the login form doesn't write anything, so crawlers can't fill the
+// database with challenges
+func TestLoginPageStoresNoChallenge(t *testing.T) {
+	app := newTestApp(t)
+	handler := app.Handler()
+	for range 3 {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/login", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /login: status %d", w.Code)
+		}
+	}
+	var n int
+	if err := app.DB.QueryRow("SELECT COUNT(*) FROM abuse_challenges").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%d challenges stored, want 0", n)
+	}
+}
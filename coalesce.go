@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// coalesce runs fn once for all the callers asking for the same key at the
+// same time, so a burst of requests for a cold page costs one query rather
+// than one each. fn is given a context that isn't canceled with ctx, since
+// the result is shared and one caller giving up shouldn't fail the others.
+// A caller whose own ctx is done stops waiting and gets its error.
+func coalesce[T any](ctx context.Context, g *singleflight.Group, key string, fn func(context.Context) (T, error)) (T, error) {
+	shared := context.WithoutCancel(ctx)
+	ch := g.DoChan(key, func() (any, error) {
+		return fn(shared)
+	})
+
+	var zero T
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return zero, res.Err
+		}
+		return res.Val.(T), nil
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
@@ -0,0 +1,658 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/mail"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the server's settings, loaded once at startup by loadConfig.
+// Each field tagged with env is a setting, read from that environment
+// variable, or from the config file under the same name, or else its
+// default. Fields tagged secret are redacted when printed or logged, and
+// secret:"url" only hides the password in a URL.
+//
+// LISTEN_FDS and LISTEN_PID aren't settings, since systemd sets them for
+// each process, and neither is RENDER, which the platform sets.
+type Config struct {
+	// Env is "development" to capture email instead of sending it and
+	// reload templates from disk
+	Env  string `env:"ENV"`
+	Port int    `env:"PORT" default:"8080"`
+	// DevTemplatesDir is where templates are reloaded from in development,
+	// by default ./tmpl if it's there
+	DevTemplatesDir string `env:"DEV_TEMPLATES_DIR"`
+	// ListenSocket is a Unix socket to listen on instead of Port, with
+	// SocketMode permissions in octal
+	ListenSocket string `env:"LISTEN_SOCKET"`
+	SocketMode   string `env:"SOCKET_MODE" default:"0660"`
+	// ACMEDomains serves the site over HTTPS on HTTPSPort instead of Port,
+	// with certificates from Let's Encrypt, see newCertManager. HTTPPort
+	// answers the CA's challenges and redirects everything else to HTTPS.
+	ACMEDomains      []string `env:"ACME_DOMAINS"`
+	ACMEEmail        string   `env:"ACME_EMAIL"`
+	ACMECacheDir     string   `env:"ACME_CACHE_DIR" default:"./certs"`
+	ACMEDirectoryURL string   `env:"ACME_DIRECTORY_URL"`
+	HTTPSPort        int      `env:"HTTPS_PORT" default:"443"`
+	HTTPPort         int      `env:"HTTP_PORT" default:"80"`
+	// HTTP3 also serves HTTP/3 over QUIC on HTTPSPort's UDP port, and
+	// advertises it to browsers with Alt-Svc, see newHTTP3Server
+	HTTP3 bool `env:"HTTP3"`
+	// SiteURL is the site's public URL, for links in email. Passkeys use
+	// its scheme and host as the WebAuthn relying party, see relyingParty.
+	SiteURL string `env:"SITE_URL"`
+	// SiteTitle names the default site in page titles
+	SiteTitle string `env:"SITE_TITLE" default:"Tulip"`
+	// SecurityContact is where /.well-known/security.txt tells researchers
+	// to report problems, as mailto: or https: URLs. It defaults to
+	// ADMIN_EMAILS.
+	SecurityContact []string `env:"SECURITY_CONTACT"`
+	// WebFingerAccounts are the names /.well-known/webfinger answers for as
+	// acct:NAME@HOST, pointing at the site
+	WebFingerAccounts []string `env:"WEBFINGER_ACCOUNTS"`
+	// Sites are the other sites served by this process, by name from
+	// SITES_<NAME>, see parseSites
+	Sites map[string]string `env:"SITES_*"`
+	// TrustProxy believes X-Forwarded-For, see clientIP. Listening on a
+	// Unix socket needs it, since requests on one have no client address.
+	TrustProxy bool `env:"TRUST_PROXY"`
+	// ProxyUpstream is a server to forward the paths this site doesn't
+	// handle to, see newUpstreamProxy
+	ProxyUpstream  string        `env:"PROXY_UPSTREAM"`
+	ProxyTimeout   time.Duration `env:"PROXY_TIMEOUT" default:"30s"`
+	PluginsDir     string        `env:"PLUGINS_DIR" default:"./plugins"`
+	HighlightStyle string        `env:"HIGHLIGHT_STYLE" default:"github"`
+	// ErrorWebhookURL is sent a PanicReport for each panic in a handler,
+	// with ErrorWebhookSecret as a bearer token if it's set
+	ErrorWebhookURL    string `env:"ERROR_WEBHOOK_URL"`
+	ErrorWebhookSecret string `env:"ERROR_WEBHOOK_SECRET" secret:"true"`
+	// ErrorReporting is "sentry" or "otlp" to send server errors and panics
+	// to SENTRY_DSN or the collector at OTEL_EXPORTER_OTLP_ENDPOINT, see
+	// newErrorReporter. Every panic is sent, and ErrorSamplePercent of
+	// other errors.
+	ErrorReporting     string `env:"ERROR_REPORTING"`
+	ErrorSamplePercent int    `env:"ERROR_SAMPLE_PERCENT" default:"100"`
+	SentryDSN          string `env:"SENTRY_DSN" secret:"true"`
+	OTLPEndpoint       string `env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	OTLPHeaders        string `env:"OTEL_EXPORTER_OTLP_HEADERS" secret:"true"`
+	OTelServiceName    string `env:"OTEL_SERVICE_NAME" default:"tulip"`
+	// Tracing sends OpenTelemetry traces of requests, queries, email and
+	// page rendering to OTEL_EXPORTER_OTLP_ENDPOINT, for TraceSamplePercent
+	// of the requests that don't bring their own traceparent
+	Tracing            bool `env:"TRACING"`
+	TraceSamplePercent int  `env:"TRACE_SAMPLE_PERCENT" default:"100"`
+	// PublicStatus serves the site status at /api/v1/status
+	PublicStatus bool `env:"PUBLIC_STATUS" default:"true"`
+	// APIOrigins and BadgeOrigins are the origins whose pages may call the
+	// API and read badges, or "*" for any
+	APIOrigins   []string `env:"API_ORIGINS"`
+	BadgeOrigins []string `env:"BADGE_ORIGINS" default:"*"`
+	// ChallengePOW is the proof of work difficulty per challenge, like
+	// "login=18,push=16"
+	ChallengePOW   string `env:"CHALLENGE_POW"`
+	VAPIDPublicKey string `env:"VAPID_PUBLIC_KEY"`
+
+	// AdminEmails are promoted to admin when they log in
+	AdminEmails []string `env:"ADMIN_EMAILS"`
+	// AdminAllowCIDRs and AdminBasicAuth ("user:password") guard the admin
+	// pages, see AdminGuard
+	AdminAllowCIDRs []string `env:"ADMIN_ALLOW_CIDRS"`
+	AdminBasicAuth  string   `env:"ADMIN_BASIC_AUTH" secret:"true"`
+	// EncryptionKey seals secrets stored in the database, like TOTP keys
+	EncryptionKey string `env:"ENCRYPTION_KEY" secret:"true"`
+
+	// SessionStore is "sqlite", "redis" or "cookie", see newSessionStore.
+	// REDIS_URL is a redis:// URL, or rediss:// to connect with TLS.
+	SessionStore          string        `env:"SESSION_STORE" default:"sqlite"`
+	RedisURL              string        `env:"REDIS_URL" secret:"url"`
+	SessionSecret         string        `env:"SESSION_SECRET" secret:"true"`
+	SessionIdleTimeout    time.Duration `env:"SESSION_IDLE_TIMEOUT" default:"168h"`
+	SessionMaxLifetime    time.Duration `env:"SESSION_MAX_LIFETIME" default:"720h"`
+	SessionRotateInterval time.Duration `env:"SESSION_ROTATE_INTERVAL" default:"24h"`
+	SessionRotateGrace    time.Duration `env:"SESSION_ROTATE_GRACE" default:"1m"`
+
+	GitHubClientID     string `env:"GITHUB_CLIENT_ID"`
+	GitHubClientSecret string `env:"GITHUB_CLIENT_SECRET" secret:"true"`
+	GoogleClientID     string `env:"GOOGLE_CLIENT_ID"`
+	GoogleClientSecret string `env:"GOOGLE_CLIENT_SECRET" secret:"true"`
+
+	// DatabaseURL is a postgres:// URL, or empty for SQLite
+	DatabaseURL string `env:"DATABASE_URL" secret:"url"`
+	// CacheTTL is how long sessions, users and posts' webmentions are kept
+	// in memory between queries, see Cache. 0 turns the caches off.
+	CacheTTL time.Duration `env:"CACHE_TTL" default:"30s"`
+	// ReplicaURL is where litestream replicates SQLite to
+	ReplicaURL       string    `env:"REPLICA_URL" secret:"url"`
+	LitestreamPath   string    `env:"LITESTREAM_PATH" default:"litestream"`
+	RestoreTimestamp time.Time `env:"RESTORE_TIMESTAMP"`
+	BackupBucket     string    `env:"BACKUP_BUCKET"`
+	BackupPrefix     string    `env:"BACKUP_PREFIX" default:"backups/"`
+	// BackupInterval must be at least a minute
+	BackupInterval time.Duration `env:"BACKUP_INTERVAL" default:"6h"`
+	BackupKeep     int           `env:"BACKUP_KEEP" default:"28"`
+	ArchiveBucket  string        `env:"ARCHIVE_BUCKET"`
+	ArchivePrefix  string        `env:"ARCHIVE_PREFIX" default:"archive/"`
+	// ExportBucket is where page views and device metrics are exported as
+	// Parquet, a day at a time
+	ExportBucket string `env:"EXPORT_BUCKET"`
+	ExportPrefix string `env:"EXPORT_PREFIX" default:"exports/"`
+	// Retention overrides the retention policies' periods, by policy name
+	// from RETENTION_<NAME>
+	Retention map[string]string `env:"RETENTION_*"`
+	// JobSchedules overrides the scheduled jobs' cron schedules, by job name
+	// from JOB_SCHEDULE_<NAME>, see jobSchedules
+	JobSchedules map[string]string `env:"JOB_SCHEDULE_*"`
+
+	// MailProvider is "smtp", "ses", "mailgun" or "postmark", see newMailer
+	MailProvider        string `env:"MAIL_PROVIDER"`
+	MailFrom            string `env:"MAIL_FROM"`
+	MailReplyTo         string `env:"MAIL_REPLY_TO"`
+	SMTPHost            string `env:"SMTP_HOST"`
+	SMTPEmail           string `env:"SMTP_EMAIL"`
+	SMTPPassword        string `env:"SMTP_PASSWORD" secret:"true"`
+	SESEndpoint         string `env:"SES_ENDPOINT"`
+	MailgunAPIKey       string `env:"MAILGUN_API_KEY" secret:"true"`
+	MailgunDomain       string `env:"MAILGUN_DOMAIN"`
+	MailgunAPIURL       string `env:"MAILGUN_API_URL" default:"https://api.mailgun.net"`
+	PostmarkServerToken string `env:"POSTMARK_SERVER_TOKEN" secret:"true"`
+	PostmarkAPIURL      string `env:"POSTMARK_API_URL" default:"https://api.postmarkapp.com"`
+
+	AWSRegion          string `env:"AWS_REGION"`
+	AWSAccessKeyID     string `env:"AWS_ACCESS_KEY_ID"`
+	AWSSecretAccessKey string `env:"AWS_SECRET_ACCESS_KEY" secret:"true"`
+	AWSSessionToken    string `env:"AWS_SESSION_TOKEN" secret:"true"`
+	// S3Endpoint is set for S3 compatible services like R2 or MinIO
+	S3Endpoint  string `env:"S3_ENDPOINT"`
+	MediaBucket string `env:"MEDIA_BUCKET"`
+	MediaPrefix string `env:"MEDIA_PREFIX" default:"media/"`
+
+	// Discovery is "consul", "route53" or "webhook" to register the
+	// instance at DiscoveryAddress ("host:port") while it runs, see
+	// newRegistrar. DiscoveryDrain is how long it keeps serving after
+	// being taken out.
+	Discovery              string        `env:"DISCOVERY"`
+	DiscoveryService       string        `env:"DISCOVERY_SERVICE" default:"tulip"`
+	DiscoveryAddress       string        `env:"DISCOVERY_ADDRESS"`
+	DiscoveryDrain         time.Duration `env:"DISCOVERY_DRAIN" default:"10s"`
+	DiscoveryWebhookURL    string        `env:"DISCOVERY_WEBHOOK_URL"`
+	DiscoveryWebhookSecret string        `env:"DISCOVERY_WEBHOOK_SECRET" secret:"true"`
+	ConsulAddr             string        `env:"CONSUL_HTTP_ADDR" default:"http://127.0.0.1:8500"`
+	ConsulToken            string        `env:"CONSUL_HTTP_TOKEN" secret:"true"`
+	Route53ZoneID          string        `env:"ROUTE53_ZONE_ID"`
+	Route53RecordName      string        `env:"ROUTE53_RECORD_NAME"`
+	Route53TTL             int           `env:"ROUTE53_TTL" default:"60"`
+
+	DevtoAPIKey   string `env:"DEVTO_API_KEY" secret:"true"`
+	MediumToken   string `env:"MEDIUM_TOKEN" secret:"true"`
+	MastodonURL   string `env:"MASTODON_URL"`
+	MastodonToken string `env:"MASTODON_TOKEN" secret:"true"`
+
+	// BlogDir holds the post markdown files
+	BlogDir string
+	// AdminGuard is parsed from AdminAllowCIDRs and AdminBasicAuth
+	AdminGuard AdminGuardConfig
+
+	// file is the config file, if any, and sources says where each
+	// setting came from: "env", the file, or "default"
+	file    string
+	sources map[string]string
+}
+
+// setting is one of Config's settings
+type setting struct {
+	Name    string
+	Default string
+	// secret is "true" or "url", see Config
+	secret string
+	value  reflect.Value
+}
+
+// settings returns cfg's settings in the order they're declared
+func (cfg *Config) settings() []setting {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	var settings []setting
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, ok := f.Tag.Lookup("env")
+		if !ok {
+			continue
+		}
+		settings = append(settings, setting{
+			Name:    name,
+			Default: f.Tag.Get("default"),
+			secret:  f.Tag.Get("secret"),
+			value:   v.Field(i),
+		})
+	}
+	return settings
+}
+
+// prefix returns the variable name prefix of a setting that collects
+// several variables, like RETENTION_ for RETENTION_*
+func (s setting) prefix() (string, bool) {
+	return strings.CutSuffix(s.Name, "*")
+}
+
+// loadConfig reads the settings from the environment and, if path isn't
+// empty, from a YAML file of NAME: value pairs. The environment wins over
+// the file, and the file over the defaults. Every problem found is
+// returned, not just the first.
+func loadConfig(path string) (Config, error) {
+	file := map[string]string{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("failed to read config file: %w", err)
+		}
+		var raw map[string]any
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return Config{}, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		for name, value := range raw {
+			file[strings.ToUpper(name)] = yamlSettingValue(value)
+		}
+	}
+
+	cfg := Config{BlogDir: blogDir, file: path, sources: map[string]string{}}
+	var errs []error
+	known := map[string]bool{}
+	for _, s := range cfg.settings() {
+		if prefix, ok := s.prefix(); ok {
+			values := map[string]string{}
+			for name, value := range file {
+				if suffix, ok := strings.CutPrefix(name, prefix); ok {
+					values[strings.ToLower(suffix)] = value
+					known[name] = true
+					cfg.sources[name] = path
+				}
+			}
+			for _, kv := range os.Environ() {
+				name, value, _ := strings.Cut(kv, "=")
+				if suffix, ok := strings.CutPrefix(name, prefix); ok && value != "" {
+					values[strings.ToLower(suffix)] = value
+					cfg.sources[name] = "env"
+				}
+			}
+			s.value.Set(reflect.ValueOf(values))
+			continue
+		}
+
+		known[s.Name] = true
+		value, source := s.Default, "default"
+		if v, ok := file[s.Name]; ok {
+			value, source = v, path
+		}
+		if v := os.Getenv(s.Name); v != "" {
+			value, source = v, "env"
+		}
+		cfg.sources[s.Name] = source
+		if err := setSettingValue(s.value, value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s %q: %w", s.Name, value, err))
+		}
+	}
+	for name := range file {
+		if !known[name] {
+			errs = append(errs, fmt.Errorf("unknown setting %s in %s", name, path))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return Config{}, err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// yamlSettingValue turns a value from the config file into the string the
+// environment variable would hold. Lists are joined with commas.
+func yamlSettingValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []any:
+		parts := make([]string, len(v))
+		for i, part := range v {
+			parts[i] = yamlSettingValue(part)
+		}
+		return strings.Join(parts, ",")
+	case time.Time:
+		return v.Format(time.RFC3339)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// setSettingValue parses a setting into a field. Lists are comma separated,
+// and durations are Go durations like "30s".
+func setSettingValue(field reflect.Value, value string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(value)
+	case bool:
+		b, err := parseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case int:
+		if value == "" {
+			field.SetInt(0)
+			return nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("expected a number")
+		}
+		field.SetInt(int64(n))
+	case time.Duration:
+		if value == "" {
+			field.SetInt(0)
+			return nil
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("expected a duration like 30s or 6h")
+		}
+		field.SetInt(int64(d))
+	case time.Time:
+		var t time.Time
+		if value != "" {
+			var err error
+			if t, err = time.Parse(time.RFC3339, value); err != nil {
+				return fmt.Errorf("expected an RFC 3339 time")
+			}
+		}
+		field.Set(reflect.ValueOf(t))
+	case []string:
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
+
+// parseBool accepts the usual ways of writing a boolean, and empty as false
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "", "false", "0", "no", "off":
+		return false, nil
+	case "true", "1", "yes", "on":
+		return true, nil
+	}
+	return false, fmt.Errorf("expected true or false")
+}
+
+// formatSettingValue is the inverse of setSettingValue
+func formatSettingValue(field reflect.Value) string {
+	switch v := field.Interface().(type) {
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return strconv.Itoa(v)
+	case time.Duration:
+		return v.String()
+	case time.Time:
+		if v.IsZero() {
+			return ""
+		}
+		return v.Format(time.RFC3339)
+	case []string:
+		return strings.Join(v, ",")
+	}
+	return fmt.Sprint(field.Interface())
+}
+
+// values returns each setting's name and value, for printing, with secrets
+// redacted. Settings that collect several variables are listed by their
+// full names.
+func (cfg *Config) values() [][2]string {
+	var values [][2]string
+	for _, s := range cfg.settings() {
+		if prefix, ok := s.prefix(); ok {
+			m := s.value.Interface().(map[string]string)
+			for _, key := range slices.Sorted(maps.Keys(m)) {
+				values = append(values, [2]string{prefix + strings.ToUpper(key), m[key]})
+			}
+			continue
+		}
+
+		value := formatSettingValue(s.value)
+		switch {
+		case value == "":
+		case s.secret == "url":
+			value = redactURL(value)
+		case s.secret != "":
+			value = "[redacted]"
+		}
+		values = append(values, [2]string{s.Name, value})
+	}
+	return values
+}
+
+// LogValue logs the settings that aren't defaults, with secrets redacted
+func (cfg Config) LogValue() slog.Value {
+	var attrs []slog.Attr
+	for _, v := range cfg.values() {
+		if cfg.sources[v[0]] != "default" {
+			attrs = append(attrs, slog.String(v[0], v[1]))
+		}
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// printConfig writes every setting as YAML, which can be used as a config
+// file once the redacted secrets are filled in. Comments say where each
+// setting came from.
+func printConfig(w io.Writer, cfg Config) error {
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	for _, v := range cfg.values() {
+		key := &yaml.Node{Kind: yaml.ScalarNode, Value: v[0]}
+		value := &yaml.Node{Kind: yaml.ScalarNode, Value: v[1], LineComment: cfg.sources[v[0]]}
+		if _, err := strconv.ParseFloat(v[1], 64); err == nil || v[1] == "" {
+			// Keep strings like "0660" and empty values from changing type
+			value.Style = yaml.DoubleQuotedStyle
+		}
+		doc.Content = append(doc.Content, key, value)
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return fmt.Errorf("failed to print config: %w", err)
+	}
+	return enc.Close()
+}
+
+// isDevelopment reports whether ENV=development, which captures email
+// instead of sending it and reloads templates from disk
+func (cfg Config) isDevelopment() bool {
+	return cfg.Env == "development"
+}
+
+// templatesDir is the directory templates are reloaded from, or empty to
+// use the ones built into the binary
+func (cfg Config) templatesDir() string {
+	if !cfg.isDevelopment() {
+		return ""
+	}
+	if cfg.DevTemplatesDir != "" {
+		return cfg.DevTemplatesDir
+	}
+	// Running from a checkout of the source
+	if info, err := os.Stat("tmpl"); err == nil && info.IsDir() {
+		return "tmpl"
+	}
+	return ""
+}
+
+// validate checks the settings make sense together, so mistakes show up at
+// startup rather than the first time a setting is used. Whether buckets
+// and servers can be reached is left to preflight.
+func (cfg *Config) validate() error {
+	var errs []error
+	if len(cfg.ACMEDomains) > 0 {
+		if err := validateACMEDomains(cfg.ACMEDomains); err != nil {
+			errs = append(errs, err)
+		}
+		if cfg.ListenSocket != "" {
+			errs = append(errs, fmt.Errorf("ACME_DOMAINS can't be used with LISTEN_SOCKET, the proxy in front should handle TLS"))
+		}
+		for _, port := range []int{cfg.HTTPSPort, cfg.HTTPPort} {
+			if port < 1 || port > 65535 {
+				errs = append(errs, fmt.Errorf("invalid port %d, HTTPS_PORT and HTTP_PORT must be from 1 to 65535", port))
+			}
+		}
+		if cfg.ACMEDirectoryURL != "" {
+			if u, err := url.Parse(cfg.ACMEDirectoryURL); err != nil || u.Scheme != "https" || u.Host == "" {
+				errs = append(errs, fmt.Errorf("invalid ACME_DIRECTORY_URL %q, expected an https URL", cfg.ACMEDirectoryURL))
+			}
+		}
+	}
+	if cfg.HTTP3 && len(cfg.ACMEDomains) == 0 {
+		errs = append(errs, fmt.Errorf("HTTP3 needs ACME_DOMAINS, since QUIC can't be served behind a TLS proxy"))
+	}
+	if cfg.ListenSocket == "" && (cfg.Port < 1 || cfg.Port > 65535) {
+		errs = append(errs, fmt.Errorf("PORT must be between 1 and 65535"))
+	}
+	if cfg.ListenSocket != "" && !cfg.TrustProxy {
+		errs = append(errs, fmt.Errorf("LISTEN_SOCKET needs TRUST_PROXY, since the proxy in front is the only one that knows clients' addresses"))
+	}
+	if _, err := strconv.ParseUint(cfg.SocketMode, 8, 32); err != nil {
+		errs = append(errs, fmt.Errorf("invalid SOCKET_MODE %q, expected octal permissions like 0660", cfg.SocketMode))
+	}
+	if cfg.SiteURL != "" {
+		if u, err := url.Parse(cfg.SiteURL); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid SITE_URL %q, expected a URL like https://example.com", cfg.SiteURL))
+		}
+	}
+	for _, contact := range cfg.SecurityContact {
+		if u, err := url.Parse(contact); err != nil || (u.Scheme != "mailto" && u.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("invalid SECURITY_CONTACT entry %q, expected a mailto: or https: URL", contact))
+		}
+	}
+	for _, name := range cfg.WebFingerAccounts {
+		if name == "" || strings.ContainsAny(name, "@:/ ") {
+			errs = append(errs, fmt.Errorf("invalid WEBFINGER_ACCOUNTS entry %q, expected a name like alice", name))
+		}
+	}
+	if cfg.ProxyUpstream != "" {
+		if u, err := url.Parse(cfg.ProxyUpstream); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid PROXY_UPSTREAM %q", cfg.ProxyUpstream))
+		}
+	}
+	if cfg.ErrorWebhookURL != "" {
+		if u, err := url.Parse(cfg.ErrorWebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid ERROR_WEBHOOK_URL %q", cfg.ErrorWebhookURL))
+		}
+	}
+	if _, err := newErrorReporter(*cfg); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.ErrorSamplePercent < 0 || cfg.ErrorSamplePercent > 100 {
+		errs = append(errs, fmt.Errorf("ERROR_SAMPLE_PERCENT must be from 0 to 100"))
+	}
+	if _, err := newTracer(*cfg); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.TraceSamplePercent < 0 || cfg.TraceSamplePercent > 100 {
+		errs = append(errs, fmt.Errorf("TRACE_SAMPLE_PERCENT must be from 0 to 100"))
+	}
+	if cfg.DevTemplatesDir != "" {
+		if !cfg.isDevelopment() {
+			errs = append(errs, fmt.Errorf("DEV_TEMPLATES_DIR only works with ENV=development"))
+		} else if info, err := os.Stat(cfg.DevTemplatesDir); err != nil || !info.IsDir() {
+			errs = append(errs, fmt.Errorf("DEV_TEMPLATES_DIR %q isn't a directory", cfg.DevTemplatesDir))
+		}
+	}
+	if _, err := parseChallengePOW(cfg.ChallengePOW); err != nil {
+		errs = append(errs, err)
+	}
+	for _, email := range cfg.AdminEmails {
+		if _, err := mail.ParseAddress(email); err != nil {
+			errs = append(errs, fmt.Errorf("invalid ADMIN_EMAILS entry %q", email))
+		}
+	}
+
+	var err error
+	if cfg.AdminGuard, err = loadAdminGuardConfig(*cfg); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.EncryptionKey != "" {
+		if _, err := encryptionAEAD(cfg.EncryptionKey); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if _, err := newSessionPolicy(*cfg); err != nil {
+		errs = append(errs, err)
+	}
+	switch cfg.SessionStore {
+	case "sqlite":
+	case "redis":
+		if cfg.RedisURL == "" {
+			errs = append(errs, fmt.Errorf("REDIS_URL must be set for redis sessions"))
+		} else if _, err := redis.ParseURL(cfg.RedisURL); err != nil {
+			errs = append(errs, fmt.Errorf("invalid REDIS_URL, expected redis:// or rediss:// for TLS: %w", err))
+		}
+	case "cookie":
+		if len(cfg.SessionSecret) < 32 {
+			errs = append(errs, fmt.Errorf("SESSION_SECRET must be at least 32 characters for cookie sessions"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown SESSION_STORE %q", cfg.SessionStore))
+	}
+
+	if _, err := newStore(*cfg); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.BackupInterval < time.Minute {
+		errs = append(errs, fmt.Errorf("BACKUP_INTERVAL must be at least 1m"))
+	}
+	if cfg.BackupKeep < 1 {
+		errs = append(errs, fmt.Errorf("BACKUP_KEEP must be at least 1"))
+	}
+	if _, err := retentionPeriods(*cfg); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := jobSchedules(*cfg); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := parseSites(*cfg); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := newRegistrar(*cfg); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.DiscoveryDrain < 0 {
+		errs = append(errs, fmt.Errorf("DISCOVERY_DRAIN can't be negative"))
+	}
+
+	// Catches a missing SMTP password or port before anyone tries to log in
+	if _, err := newMailer(*cfg); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+)
+
+const (
+	csrfCookieName = "tulip_csrf"
+	csrfFieldName  = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+type csrfTokenKey struct{}
+
+// CSRFProtect issues every browser a CSRF token in a cookie and requires it
+// back, as a csrf_token form field or X-CSRF-Token header, on state-changing
+// requests. Requests for which exempt returns true aren't checked.
+func CSRFProtect(exempt func(*http.Request) bool, h func(http.ResponseWriter, *http.Request) error) func(http.ResponseWriter, *http.Request) error {
+	return IssueCSRFToken(func(w http.ResponseWriter, r *http.Request) error {
+		if exempt == nil || !exempt(r) {
+			if err := checkCSRF(r); err != nil {
+				return err
+			}
+		}
+		return h(w, r)
+	})
+}
+
+// IssueCSRFToken issues every browser a CSRF token in a cookie, like
+// CSRFProtect, but leaves checking it to h, with checkCSRF
+func IssueCSRFToken(h func(http.ResponseWriter, *http.Request) error) func(http.ResponseWriter, *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var token string
+		if cookie, err := r.Cookie(csrfCookieName); err == nil && cookie.Value != "" {
+			token = cookie.Value
+		} else {
+			var err error
+			token, err = generateRandomToken(32)
+			if err != nil {
+				return fmt.Errorf("failed to generate csrf token: %w", err)
+			}
+			setCSRFCookie(w, token)
+		}
+		return h(w, r.WithContext(context.WithValue(r.Context(), csrfTokenKey{}, token)))
+	}
+}
+
+// checkCSRF returns a 403 if a state-changing request doesn't carry the
+// request's CSRF token, which IssueCSRFToken must have set
+func checkCSRF(r *http.Request) error {
+	if isSafeMethod(r.Method) {
+		return nil
+	}
+	sent := r.Header.Get(csrfHeaderName)
+	if sent == "" {
+		sent = r.FormValue(csrfFieldName)
+	}
+	token := csrfToken(r)
+	if token == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+		slog.WarnContext(r.Context(), "Rejected request with invalid CSRF token", "path", r.URL.Path, "method", r.Method)
+		return NewHTTPError(fmt.Errorf("invalid or missing CSRF token, please reload the page and try again"), http.StatusForbidden)
+	}
+	return nil
+}
+
+// isSafeMethod reports whether the method can't change state
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// csrfToken returns the CSRF token for the request, for use in PageMeta
+func csrfToken(r *http.Request) string {
+	token, _ := r.Context().Value(csrfTokenKey{}).(string)
+	return token
+}
+
+// rotateCSRFToken gives the browser a new CSRF token, so a token planted
+// before login can't be used against the new session
+func rotateCSRFToken(w http.ResponseWriter) error {
+	token, err := generateRandomToken(32)
+	if err != nil {
+		return fmt.Errorf("failed to generate csrf token: %w", err)
+	}
+	setCSRFCookie(w, token)
+	return nil
+}
+
+// setCSRFCookie stores the CSRF token for the browser session
+func setCSRFCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// csrfField renders the hidden form input carrying the CSRF token
+func csrfField(token string) template.HTML {
+	return template.HTML(`<input type="hidden" name="` + csrfFieldName + `" value="` + template.HTMLEscapeString(token) + `">`)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRFProtect(t *testing.T) {
+	const token = "csrf-token"
+	tests := []struct {
+		name   string
+		method string
+		cookie string
+		header string
+		form   string
+		bearer bool
+		want   int
+		issues bool
+	}{
+		{name: "GET without a cookie", method: http.MethodGet, want: http.StatusOK, issues: true},
+		{name: "GET with a cookie", method: http.MethodGet, cookie: token, want: http.StatusOK},
+		{name: "HEAD without a token", method: http.MethodHead, cookie: token, want: http.StatusOK},
+		{name: "POST with the header", method: http.MethodPost, cookie: token, header: token, want: http.StatusOK},
+		{name: "POST with the form field", method: http.MethodPost, cookie: token, form: token, want: http.StatusOK},
+		{name: "POST without a token", method: http.MethodPost, cookie: token, want: http.StatusForbidden},
+		{name: "POST with the wrong token", method: http.MethodPost, cookie: token, header: "other", want: http.StatusForbidden},
+		{name: "POST without a cookie", method: http.MethodPost, header: token, want: http.StatusForbidden, issues: true},
+		{name: "DELETE without a token", method: http.MethodDelete, cookie: token, want: http.StatusForbidden},
+		{name: "POST with a bearer token", method: http.MethodPost, bearer: true, want: http.StatusOK, issues: true},
+		{name: "POST with a bearer token and cookie", method: http.MethodPost, cookie: token, bearer: true, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			h := CSRFProtect(hasBearerToken, func(w http.ResponseWriter, r *http.Request) error {
+				seen = csrfToken(r)
+				return nil
+			})
+
+			var body *strings.Reader
+			if tt.form != "" {
+				body = strings.NewReader(url.Values{csrfFieldName: {tt.form}}.Encode())
+			} else {
+				body = strings.NewReader("")
+			}
+			r := httptest.NewRequest(tt.method, "/settings", body)
+			if tt.form != "" {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: tt.cookie})
+			}
+			if tt.header != "" {
+				r.Header.Set(csrfHeaderName, tt.header)
+			}
+			if tt.bearer {
+				r.Header.Set("Authorization", "Bearer some-token")
+			}
+			w := httptest.NewRecorder()
+
+			status := http.StatusOK
+			if err := h(w, r); err != nil {
+				var httpErr HTTPError
+				if !errors.As(err, &httpErr) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				status = httpErr.StatusCode
+			}
+			if status != tt.want {
+				t.Errorf("status %d, want %d", status, tt.want)
+			}
+
+			var issued string
+			for _, cookie := range w.Result().Cookies() {
+				if cookie.Name == csrfCookieName {
+					issued = cookie.Value
+				}
+			}
+			if tt.issues != (issued != "") {
+				t.Errorf("issued cookie %q, want one issued: %t", issued, tt.issues)
+			}
+			if status == http.StatusOK {
+				want := tt.cookie
+				if tt.issues {
+					want = issued
+				}
+				if seen != want {
+					t.Errorf("handler saw token %q, want %q", seen, want)
+				}
+			}
+		})
+	}
+}
+
+// checkCSRF relies on IssueCSRFToken having run, so a request without a
+// token in its context fails even if it sends an empty one
+func TestCheckCSRFWithoutToken(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set(csrfHeaderName, "")
+	var httpErr HTTPError
+	if err := checkCSRF(r); !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusForbidden {
+		t.Errorf("checkCSRF: %v, want 403", err)
+	}
+}
@@ -1,66 +1,139 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-// DB is a global database connection
-var DB *sql.DB
+// queryTimeout bounds the queries a helper runs, so a locked or unreachable
+// database fails the request instead of holding it open. Helpers take the
+// request's context, which also cancels their queries if the client goes
+// away.
+const queryTimeout = 10 * time.Second
 
-// InitDB initializes the database connection and creates necessary tables
-func InitDB() error {
-	// Determine database path
-	dbPath := "tulip.db"
+// databasePath is where the SQLite database lives
+func databasePath() string {
 	if _, exists := os.LookupEnv("RENDER"); exists {
-		dbPath = filepath.Join("/data", "tulip.db")
+		return filepath.Join("/data", "tulip.db")
 	}
-	slog.Info("Using database path", "path", dbPath)
+	return "tulip.db"
+}
 
-	// Open database
+// InitDB initializes the database connection and creates necessary tables
+func (app *App) InitDB() error {
 	var err error
-	DB, err = sql.Open("sqlite3", dbPath)
+	app.Store, err = newStore(app.Config)
+	if err != nil {
+		return err
+	}
+	slog.Info("Using database", "store", app.Store.String())
+
+	// A new disk gets the database back from its replica, if there is one
+	if s, isSQLite := app.Store.(sqliteStore); isSQLite {
+		cfg, ok, err := replicaConfig(app.Config)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err := restoreReplica(context.Background(), cfg, s.path); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Open database
+	app.DB, err = app.Store.Open()
 	if err != nil {
 		return fmt.Errorf("failed to open database: %w", err)
 	}
 
+	// Migrations can take a while on big tables, so they don't get the
+	// usual query timeout
+	ctx := context.Background()
+
 	// Create tables if they don't exist
-	err = createTables()
+	err = app.createTables(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to create tables: %w", err)
 	}
 
-	// Initialize counter if needed
-	err = initializeCounter()
+	// Add columns introduced after a table was first created
+	err = app.migrateColumns(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to initialize counter: %w", err)
+		return fmt.Errorf("failed to migrate columns: %w", err)
+	}
+
+	// Carry the old global counter over into page_views
+	err = app.migrateCounter(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to migrate counter: %w", err)
 	}
 
 	return nil
 }
 
 // createTables creates all required tables if they don't exist
-func createTables() error {
+func (app *App) createTables(ctx context.Context) error {
 	queries := []string{
-		`CREATE TABLE IF NOT EXISTS counter (
-			id INTEGER PRIMARY KEY,
-			count INTEGER
+		`CREATE TABLE IF NOT EXISTS page_views (
+			path TEXT NOT NULL,
+			day TEXT NOT NULL,
+			count INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (path, day)
 		)`,
 		`CREATE TABLE IF NOT EXISTS users (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			email TEXT UNIQUE NOT NULL,
+			role TEXT NOT NULL DEFAULT 'member',
+			digest TEXT NOT NULL DEFAULT '',
+			digest_sent_at TIMESTAMP,
+			totp_secret BLOB,
+			totp_enabled INTEGER NOT NULL DEFAULT 0,
+			totp_last_step INTEGER NOT NULL DEFAULT 0,
+			delete_after TIMESTAMP,
+			display_name TEXT NOT NULL DEFAULT '',
+			time_zone TEXT NOT NULL DEFAULT '',
+			avatar TEXT NOT NULL DEFAULT '',
+			avatar_image BLOB,
+			avatar_hash TEXT NOT NULL DEFAULT '',
 			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 		)`,
+		`CREATE TABLE IF NOT EXISTS rate_limits (
+			bucket TEXT PRIMARY KEY,
+			tokens REAL NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS server_errors (
+			day TEXT NOT NULL,
+			status INTEGER NOT NULL,
+			count INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (day, status)
+		)`,
 		`CREATE TABLE IF NOT EXISTS sessions (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			user_id INTEGER NOT NULL,
 			token TEXT UNIQUE NOT NULL,
+			user_agent TEXT NOT NULL DEFAULT '',
+			ip TEXT NOT NULL DEFAULT '',
+			last_seen_at TIMESTAMP,
+			rotated_at TIMESTAMP,
+			previous_token TEXT,
+			previous_expires_at TIMESTAMP,
 			expires_at TIMESTAMP NOT NULL,
 			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
 			FOREIGN KEY (user_id) REFERENCES users(id)
@@ -71,21 +144,272 @@ func createTables() error {
 			token TEXT UNIQUE NOT NULL,
 			expires_at TIMESTAMP NOT NULL,
 			used BOOLEAN NOT NULL DEFAULT 0,
+			used_by TEXT NOT NULL DEFAULT '',
 			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 		)`,
-		`DROP TABLE IF EXISTS devices`,
+		`CREATE TABLE IF NOT EXISTS post_cache (
+			hash TEXT PRIMARY KEY,
+			html TEXT NOT NULL,
+			last_used_at TIMESTAMP NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS push_subscriptions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			endpoint TEXT UNIQUE NOT NULL,
+			p256dh TEXT NOT NULL,
+			auth TEXT NOT NULL,
+			user_id INTEGER,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)`,
 		`CREATE TABLE IF NOT EXISTS devices (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			user_id INTEGER NOT NULL,
 			hostname TEXT NOT NULL,
+			name TEXT NOT NULL DEFAULT '',
 			device_type TEXT NOT NULL,
+			notes TEXT NOT NULL DEFAULT '',
+			tags TEXT NOT NULL DEFAULT '',
+			os TEXT NOT NULL DEFAULT '',
+			arch TEXT NOT NULL DEFAULT '',
+			ip TEXT NOT NULL DEFAULT '',
+			last_seen_at TIMESTAMP,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)`,
+		// The generated columns pull commonly queried facts out of the JSON
+		`CREATE TABLE IF NOT EXISTS device_facts (
+			device_id INTEGER PRIMARY KEY,
+			schema_version INTEGER NOT NULL,
+			facts TEXT NOT NULL,
+			reported_at TIMESTAMP NOT NULL,
+			os_name TEXT GENERATED ALWAYS AS (json_extract(facts, '$.os.name')) VIRTUAL,
+			os_version TEXT GENERATED ALWAYS AS (json_extract(facts, '$.os.version')) VIRTUAL,
+			architecture TEXT GENERATED ALWAYS AS (json_extract(facts, '$.hardware.architecture')) VIRTUAL,
+			memory_bytes INTEGER GENERATED ALWAYS AS (json_extract(facts, '$.hardware.memory_bytes')) VIRTUAL,
+			package_count INTEGER GENERATED ALWAYS AS (json_array_length(facts, '$.packages')) VIRTUAL,
+			FOREIGN KEY (device_id) REFERENCES devices(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS device_facts_os ON device_facts (os_name, os_version)`,
+		// Samples are averaged into buckets of metricsBucket
+		`CREATE TABLE IF NOT EXISTS device_metrics (
+			device_id INTEGER NOT NULL,
+			bucket TIMESTAMP NOT NULL,
+			samples INTEGER NOT NULL,
+			cpu_percent REAL NOT NULL,
+			memory_percent REAL NOT NULL,
+			disk_percent REAL NOT NULL,
+			uptime_seconds INTEGER NOT NULL,
+			PRIMARY KEY (device_id, bucket),
+			FOREIGN KEY (device_id) REFERENCES devices(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_device_metrics_bucket ON device_metrics(bucket)`,
+		// Each save is a new row, so the id is the config's version. scope is
+		// "device:<id>" or "tag:<tag>".
+		`CREATE TABLE IF NOT EXISTS agent_configs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			scope TEXT NOT NULL,
+			config TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_agent_configs_scope ON agent_configs(user_id, scope, id)`,
+		`CREATE TABLE IF NOT EXISTS api_tokens (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			token_hash TEXT UNIQUE NOT NULL,
+			prefix TEXT NOT NULL,
+			scopes TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			last_used_at TIMESTAMP,
+			expires_at TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS webauthn_credentials (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			credential_id TEXT UNIQUE NOT NULL,
+			public_key BLOB NOT NULL,
+			algorithm INTEGER NOT NULL,
+			sign_count INTEGER NOT NULL DEFAULT 0,
+			name TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			last_used_at TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS oauth_identities (
+			provider TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			user_id INTEGER NOT NULL,
+			email TEXT NOT NULL,
 			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (provider, subject),
 			FOREIGN KEY (user_id) REFERENCES users(id)
 		)`,
+		`CREATE TABLE IF NOT EXISTS syndications (
+			slug TEXT NOT NULL,
+			target TEXT NOT NULL,
+			canonical_url TEXT NOT NULL,
+			status TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			remote_url TEXT NOT NULL DEFAULT '',
+			last_error TEXT NOT NULL DEFAULT '',
+			next_attempt_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (slug, target)
+		)`,
+		`CREATE TABLE IF NOT EXISTS webmentions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			source TEXT NOT NULL,
+			slug TEXT NOT NULL,
+			target TEXT NOT NULL,
+			title TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL,
+			approved BOOLEAN NOT NULL DEFAULT 0,
+			last_error TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			UNIQUE (source, slug)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_webmentions_slug ON webmentions(slug, status)`,
+		`CREATE TABLE IF NOT EXISTS sent_webmentions (
+			slug TEXT NOT NULL,
+			target TEXT NOT NULL,
+			endpoint TEXT NOT NULL DEFAULT '',
+			last_error TEXT NOT NULL DEFAULT '',
+			sent_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (slug, target)
+		)`,
+		`CREATE TABLE IF NOT EXISTS email_outbox (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			recipient TEXT NOT NULL,
+			reply_to TEXT NOT NULL DEFAULT '',
+			subject TEXT NOT NULL,
+			text_body TEXT NOT NULL,
+			html_body TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT NOT NULL DEFAULT '',
+			next_attempt_at TIMESTAMP NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_email_outbox_due ON email_outbox(status, next_attempt_at)`,
+		// Each dataset's days that have been exported, including empty ones
+		`CREATE TABLE IF NOT EXISTS exports (
+			dataset TEXT NOT NULL,
+			day TEXT NOT NULL,
+			row_count INTEGER NOT NULL,
+			exported_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (dataset, day)
+		)`,
+		`CREATE TABLE IF NOT EXISTS post_slugs (
+			file_name TEXT PRIMARY KEY,
+			slug TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS slug_redirects (
+			old_slug TEXT PRIMARY KEY,
+			new_slug TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS backup_codes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			code_hash TEXT NOT NULL,
+			used_at TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS pending_logins (
+			token TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			method TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			expires_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS flags (
+			name TEXT PRIMARY KEY,
+			enabled INTEGER NOT NULL,
+			rollout INTEGER NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS webauthn_challenges (
+			challenge TEXT PRIMARY KEY,
+			user_id INTEGER,
+			expires_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS abuse_challenges (
+			token TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			bits INTEGER NOT NULL DEFAULT 0,
+			issued_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			actor_id INTEGER NOT NULL,
+			actor_email TEXT NOT NULL,
+			user_id INTEGER,
+			user_email TEXT NOT NULL DEFAULT '',
+			action TEXT NOT NULL,
+			detail TEXT NOT NULL DEFAULT '',
+			request_id TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_user ON audit_log(user_id)`,
+		// Published events, and how far each consumer has read them
+		`CREATE TABLE IF NOT EXISTS events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			topic TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_events_topic ON events(topic, id)`,
+		`CREATE TABLE IF NOT EXISTS event_offsets (
+			consumer TEXT PRIMARY KEY,
+			last_id INTEGER NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS challenge_blocks (
+			day TEXT NOT NULL,
+			name TEXT NOT NULL,
+			reason TEXT NOT NULL,
+			count INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (day, name, reason)
+		)`,
+		`CREATE TABLE IF NOT EXISTS shortlinks (
+			code TEXT PRIMARY KEY,
+			target TEXT NOT NULL,
+			created_by INTEGER,
+			created_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP,
+			clicks INTEGER NOT NULL DEFAULT 0
+		)`,
+		`CREATE TABLE IF NOT EXISTS jobs (
+			name TEXT PRIMARY KEY,
+			running_since TIMESTAMP,
+			last_started_at TIMESTAMP,
+			last_duration_ms INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT NOT NULL DEFAULT '',
+			last_success_at TIMESTAMP,
+			runs INTEGER NOT NULL DEFAULT 0,
+			failures INTEGER NOT NULL DEFAULT 0
+		)`,
+		`CREATE TABLE IF NOT EXISTS revoked_sessions (
+			id TEXT PRIMARY KEY,
+			revoked_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS signing_keys (
+			name TEXT PRIMARY KEY,
+			secret BLOB NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)`,
 	}
 
 	for _, query := range queries {
-		_, err := DB.Exec(query)
+		_, err := app.DB.ExecContext(ctx, app.Store.Schema(query))
 		if err != nil {
 			return fmt.Errorf("failed to create table: %w", err)
 		}
@@ -94,64 +418,130 @@ func createTables() error {
 	return nil
 }
 
-// initializeCounter initializes the counter table if needed
-func initializeCounter() error {
-	var count int
-	err := DB.QueryRow("SELECT count FROM counter WHERE id = 1").Scan(&count)
-	if err == sql.ErrNoRows {
-		_, err = DB.Exec("INSERT INTO counter (id, count) VALUES (1, 0)")
+// migrateColumns adds columns that were introduced after their table was
+// first created. CREATE TABLE IF NOT EXISTS leaves existing tables alone, so
+// new columns on old databases have to be added here as well.
+func (app *App) migrateColumns(ctx context.Context) error {
+	columns := []struct {
+		table      string
+		column     string
+		definition string
+	}{
+		{"users", "role", "TEXT NOT NULL DEFAULT 'member'"},
+		{"users", "digest", "TEXT NOT NULL DEFAULT ''"},
+		{"users", "digest_sent_at", "TIMESTAMP"},
+		{"users", "totp_secret", "BLOB"},
+		{"users", "totp_enabled", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "delete_after", "TIMESTAMP"},
+		{"users", "display_name", "TEXT NOT NULL DEFAULT ''"},
+		{"users", "time_zone", "TEXT NOT NULL DEFAULT ''"},
+		{"users", "avatar", "TEXT NOT NULL DEFAULT ''"},
+		{"users", "avatar_image", "BLOB"},
+		{"users", "avatar_hash", "TEXT NOT NULL DEFAULT ''"},
+		{"magic_links", "used_by", "TEXT NOT NULL DEFAULT ''"},
+		{"devices", "name", "TEXT NOT NULL DEFAULT ''"},
+		{"devices", "notes", "TEXT NOT NULL DEFAULT ''"},
+		{"devices", "tags", "TEXT NOT NULL DEFAULT ''"},
+		{"devices", "os", "TEXT NOT NULL DEFAULT ''"},
+		{"devices", "arch", "TEXT NOT NULL DEFAULT ''"},
+		{"devices", "ip", "TEXT NOT NULL DEFAULT ''"},
+		{"devices", "last_seen_at", "TIMESTAMP"},
+		{"devices", "config_version", "INTEGER NOT NULL DEFAULT 0"},
+		{"devices", "config_failed_version", "INTEGER NOT NULL DEFAULT 0"},
+		{"devices", "config_error", "TEXT NOT NULL DEFAULT ''"},
+		{"sessions", "user_agent", "TEXT NOT NULL DEFAULT ''"},
+		{"sessions", "ip", "TEXT NOT NULL DEFAULT ''"},
+		{"sessions", "last_seen_at", "TIMESTAMP"},
+		{"sessions", "rotated_at", "TIMESTAMP"},
+		{"sessions", "previous_token", "TEXT"},
+		{"sessions", "previous_expires_at", "TIMESTAMP"},
+		{"shortlinks", "clicks", "INTEGER NOT NULL DEFAULT 0"},
+	}
+
+	for _, c := range columns {
+		exists, err := app.Store.HasColumn(ctx, app.DB, c.table, c.column)
 		if err != nil {
-			return fmt.Errorf("failed to initialize counter: %w", err)
+			return fmt.Errorf("failed to inspect %s: %w", c.table, err)
 		}
-	} else if err != nil {
-		return fmt.Errorf("failed to query counter: %w", err)
+		if exists {
+			continue
+		}
+
+		_, err = app.DB.ExecContext(ctx, app.Store.Schema(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.definition)))
+		if err != nil {
+			return fmt.Errorf("failed to add %s.%s: %w", c.table, c.column, err)
+		}
+		slog.Info("Added column", "table", c.table, "column", c.column)
 	}
+
 	return nil
 }
 
-// IncrementCounter increments the page view counter and returns the new count
-func IncrementCounter() (int, error) {
-	_, err := DB.Exec("UPDATE counter SET count = count + 1 WHERE id = 1")
-	if err != nil {
-		return 0, fmt.Errorf("failed to update counter: %w", err)
-	}
+// signingKey returns the key with the name, creating it the first time.
+// Keys live in the database so every replica signs with the same one.
+func (app *App) signingKey(ctx context.Context, name string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
 
-	var count int
-	err = DB.QueryRow("SELECT count FROM counter WHERE id = 1").Scan(&count)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate %s key: %w", name, err)
+	}
+	_, err := app.DB.ExecContext(ctx,
+		"INSERT INTO signing_keys (name, secret, created_at) VALUES (?, ?, ?) ON CONFLICT (name) DO NOTHING",
+		name, secret, time.Now(),
+	)
 	if err != nil {
-		return 0, fmt.Errorf("failed to read counter: %w", err)
+		return nil, fmt.Errorf("failed to create %s key: %w", name, err)
 	}
-
-	return count, nil
+	if err := app.DB.QueryRowContext(ctx, "SELECT secret FROM signing_keys WHERE name = ?", name).Scan(&secret); err != nil {
+		return nil, fmt.Errorf("failed to load %s key: %w", name, err)
+	}
+	return secret, nil
 }
 
+var errUserNotFound = errors.New("user not found")
+
 // User represents a user in the database
 type User struct {
 	ID        int64
 	Email     string
+	Role      string
 	CreatedAt time.Time
+	// DeleteAfter is when the account will be deleted, if the user asked
+	DeleteAfter time.Time
+
+	// DisplayName, TimeZone and Avatar are set on the settings page, see
+	// Name, Location and AvatarURL
+	DisplayName string
+	TimeZone    string
+	Avatar      string
+	// AvatarHash identifies the uploaded avatar, so its URL changes with it
+	AvatarHash string
 }
 
 // CreateOrGetUser creates a new user or gets an existing one by email
-func CreateOrGetUser(email string) (User, error) {
+func (app *App) CreateOrGetUser(ctx context.Context, email string) (User, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	db := app.DBFrom(ctx)
 	var user User
 
 	// Check if user exists
-	err := DB.QueryRow("SELECT id, email, created_at FROM users WHERE email = ?", email).Scan(&user.ID, &user.Email, &user.CreatedAt)
+	err := db.QueryRowContext(ctx, "SELECT id, email, role, created_at FROM users WHERE email = ?", email).Scan(&user.ID, &user.Email, &user.Role, &user.CreatedAt)
 	if err == sql.ErrNoRows {
 		// Create new user
-		result, err := DB.Exec("INSERT INTO users (email) VALUES (?)", email)
+		var id int64
+		err := db.QueryRowContext(ctx, "INSERT INTO users (email) VALUES (?) RETURNING id", email).Scan(&id)
 		if err != nil {
 			return User{}, fmt.Errorf("failed to create user: %w", err)
 		}
 
-		id, err := result.LastInsertId()
-		if err != nil {
-			return User{}, fmt.Errorf("failed to get user ID: %w", err)
-		}
-
 		user.ID = id
 		user.Email = email
+		user.Role = RoleMember
 		user.CreatedAt = time.Now()
 		return user, nil
 	} else if err != nil {
@@ -161,8 +551,83 @@ func CreateOrGetUser(email string) (User, error) {
 	return user, nil
 }
 
+// SetUserRole changes a user's role
+func (app *App) SetUserRole(ctx context.Context, userID int64, role string) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := app.DBFrom(ctx).ExecContext(ctx, "UPDATE users SET role = ? WHERE id = ?", role, userID)
+	if err != nil {
+		return fmt.Errorf("failed to set user role: %w", err)
+	}
+	app.userCache.Invalidate(ctx, strconv.FormatInt(userID, 10))
+	return nil
+}
+
+// GetUserDigest returns how often the user wants the activity digest, or ""
+// if they haven't opted in
+func (app *App) GetUserDigest(ctx context.Context, userID int64) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var digest string
+	err := app.DB.QueryRowContext(ctx, "SELECT digest FROM users WHERE id = ?", userID).Scan(&digest)
+	if err != nil {
+		return "", fmt.Errorf("failed to get digest setting: %w", err)
+	}
+	return digest, nil
+}
+
+// SetUserDigest changes how often the user receives the activity digest
+func (app *App) SetUserDigest(ctx context.Context, userID int64, digest string) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := app.DB.ExecContext(ctx, "UPDATE users SET digest = ? WHERE id = ?", digest, userID)
+	if err != nil {
+		return fmt.Errorf("failed to set digest setting: %w", err)
+	}
+	return nil
+}
+
+// SearchUsers returns users whose email contains the query
+func (app *App) SearchUsers(ctx context.Context, query string) ([]User, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	rows, err := app.DB.QueryContext(ctx,
+		"SELECT id, email, role, created_at FROM users WHERE lower(email) LIKE lower(?) ORDER BY email LIMIT 50",
+		"%"+query+"%",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Email, &user.Role, &user.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan user row: %w", err)
+		}
+		users = append(users, user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating user rows: %w", err)
+	}
+
+	return users, nil
+}
+
+// magicLinkLifetime is how long a login link works for
+const magicLinkLifetime = 15 * time.Minute
+
 // CreateMagicLink creates a new magic link for the given email
-func CreateMagicLink(email string) (string, error) {
+func (app *App) CreateMagicLink(ctx context.Context, email string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	// Generate a random token
 	token, err := generateRandomToken(32)
 	if err != nil {
@@ -170,10 +635,10 @@ func CreateMagicLink(email string) (string, error) {
 	}
 
 	// Set expiration time (15 minutes from now)
-	expiresAt := time.Now().Add(15 * time.Minute)
+	expiresAt := time.Now().Add(magicLinkLifetime)
 
 	// Insert into database
-	_, err = DB.Exec(
+	_, err = app.DB.ExecContext(ctx,
 		"INSERT INTO magic_links (email, token, expires_at) VALUES (?, ?, ?)",
 		email, token, expiresAt,
 	)
@@ -184,17 +649,24 @@ func CreateMagicLink(email string) (string, error) {
 	return token, nil
 }
 
-// VerifyMagicLink verifies a magic link token and returns the associated email if valid
-func VerifyMagicLink(token string) (string, error) {
-	var email string
+// VerifyMagicLink verifies a magic link token and returns the associated
+// email if valid. browser is the login browser cookie, see
+// loginBrowserCookieName: a link can be used again by the browser that used
+// it, so a double submit or going back doesn't fail, but not by any other.
+func (app *App) VerifyMagicLink(ctx context.Context, token, browser string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	db := app.DBFrom(ctx)
+	var email, usedBy string
 	var expiresAt time.Time
 	var used bool
 
 	// Find the magic link
-	err := DB.QueryRow(
-		"SELECT email, expires_at, used FROM magic_links WHERE token = ?",
+	err := db.QueryRowContext(ctx,
+		"SELECT email, expires_at, used, used_by FROM magic_links WHERE token = ?",
 		token,
-	).Scan(&email, &expiresAt, &used)
+	).Scan(&email, &expiresAt, &used, &usedBy)
 
 	if err == sql.ErrNoRows {
 		return "", fmt.Errorf("invalid magic link")
@@ -207,114 +679,478 @@ func VerifyMagicLink(token string) (string, error) {
 		return "", fmt.Errorf("magic link expired")
 	}
 
-	// Check if it's been used
+	// Check if it's been used, by another browser
+	var browserHash string
+	if browser != "" {
+		sum := sha256.Sum256([]byte(browser))
+		browserHash = hex.EncodeToString(sum[:])
+	}
 	if used {
+		if browserHash != "" && usedBy == browserHash {
+			return email, nil
+		}
 		return "", fmt.Errorf("magic link already used")
 	}
 
-	// Mark it as used
-	_, err = DB.Exec("UPDATE magic_links SET used = 1 WHERE token = ?", token)
+	// Mark it as used, unless another request just did
+	result, err := db.ExecContext(ctx, "UPDATE magic_links SET used = 1, used_by = ? WHERE token = ? AND used = 0", browserHash, token)
 	if err != nil {
 		return "", fmt.Errorf("failed to mark magic link as used: %w", err)
 	}
+	if n, err := result.RowsAffected(); err != nil {
+		return "", fmt.Errorf("failed to mark magic link as used: %w", err)
+	} else if n == 0 {
+		return "", fmt.Errorf("magic link already used")
+	}
 
 	return email, nil
 }
 
 // CreateSession creates a new session for the given user
-func CreateSession(userID int64) (string, error) {
-	// Generate a random token
-	token, err := generateRandomToken(32)
+func (app *App) CreateSession(ctx context.Context, userID int64, client SessionClient) (string, error) {
+	return app.Sessions.Create(ctx, userID, client)
+}
+
+// GetUserFromSession retrieves a user and their session from a session
+// token. Activity is recorded by RefreshSessions.
+func (app *App) GetUserFromSession(ctx context.Context, token string) (User, Session, error) {
+	session, err := app.Sessions.Lookup(ctx, token)
 	if err != nil {
-		return "", fmt.Errorf("failed to generate token: %w", err)
+		return User{}, Session{}, err
 	}
 
-	// Set expiration time (7 days from now)
-	expiresAt := time.Now().Add(7 * 24 * time.Hour)
-
-	// Insert into database
-	_, err = DB.Exec(
-		"INSERT INTO sessions (user_id, token, expires_at) VALUES (?, ?, ?)",
-		userID, token, expiresAt,
-	)
+	user, err := app.GetUserByID(ctx, session.UserID)
 	if err != nil {
-		return "", fmt.Errorf("failed to create session: %w", err)
+		return User{}, Session{}, err
 	}
-
-	return token, nil
+	// Sessions are ended when deletion is scheduled, this catches any that
+	// were started at the same time
+	if !user.DeleteAfter.IsZero() {
+		return User{}, Session{}, errInvalidSession
+	}
+	return user, session, nil
 }
 
-// GetUserFromSession retrieves a user from a session token
-func GetUserFromSession(token string) (User, error) {
-	var user User
-	var expiresAt time.Time
+// GetUserByID looks up a user by ID
+func (app *App) GetUserByID(ctx context.Context, id int64) (User, error) {
+	return app.userCache.Get(ctx, strconv.FormatInt(id, 10), func(ctx context.Context) (User, error) {
+		return app.getUserByID(ctx, id)
+	})
+}
 
-	// Find the session and user
-	err := DB.QueryRow(`
-		SELECT u.id, u.email, u.created_at, s.expires_at
-		FROM sessions s
-		JOIN users u ON s.user_id = u.id
-		WHERE s.token = ?
-	`, token).Scan(&user.ID, &user.Email, &user.CreatedAt, &expiresAt)
+func (app *App) getUserByID(ctx context.Context, id int64) (User, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
 
+	var user User
+	var deleteAfter sql.NullTime
+	err := app.DB.QueryRowContext(ctx, `
+		SELECT id, email, role, created_at, delete_after, display_name, time_zone, avatar, avatar_hash
+		FROM users WHERE id = ?
+	`, id).Scan(&user.ID, &user.Email, &user.Role, &user.CreatedAt, &deleteAfter, &user.DisplayName, &user.TimeZone, &user.Avatar, &user.AvatarHash)
 	if err == sql.ErrNoRows {
-		return User{}, fmt.Errorf("invalid session")
+		return User{}, errUserNotFound
 	} else if err != nil {
-		return User{}, fmt.Errorf("failed to query session: %w", err)
+		return User{}, fmt.Errorf("failed to query user: %w", err)
 	}
+	user.DeleteAfter = deleteAfter.Time
+	return user, nil
+}
 
-	// Check if it's expired
-	if time.Now().After(expiresAt) {
-		// Delete expired session
-		_, _ = DB.Exec("DELETE FROM sessions WHERE token = ?", token)
-		return User{}, fmt.Errorf("session expired")
+// DeleteSession removes a session by token
+func (app *App) DeleteSession(ctx context.Context, token string) error {
+	return app.Sessions.Delete(ctx, token)
+}
+
+// AdminUser is a user with counts of related rows for the admin dashboard
+type AdminUser struct {
+	User
+	Devices  int
+	Sessions int
+}
+
+// ListUsers returns all users with their device and active session counts
+func (app *App) ListUsers(ctx context.Context) ([]AdminUser, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	sessions, err := app.Sessions.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sessionCounts := map[int64]int{}
+	for _, session := range sessions {
+		sessionCounts[session.UserID]++
 	}
 
-	return user, nil
+	rows, err := app.DB.QueryContext(ctx, `
+		SELECT u.id, u.email, u.role, u.created_at,
+			(SELECT COUNT(*) FROM devices d WHERE d.user_id = u.id)
+		FROM users u
+		ORDER BY u.created_at DESC
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []AdminUser
+	for rows.Next() {
+		var user AdminUser
+		err := rows.Scan(&user.ID, &user.Email, &user.Role, &user.CreatedAt, &user.Devices)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan user row: %w", err)
+		}
+		user.Sessions = sessionCounts[user.ID]
+		users = append(users, user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating user rows: %w", err)
+	}
+
+	return users, nil
 }
 
-// DeleteSession removes a session by token
-func DeleteSession(token string) error {
-	_, err := DB.Exec("DELETE FROM sessions WHERE token = ?", token)
+// Session is a login session. The token is never exposed outside the auth code.
+type Session struct {
+	ID         string
+	UserID     int64
+	Email      string
+	UserAgent  string
+	IP         string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	RotatedAt  time.Time
+	ExpiresAt  time.Time
+	// Superseded is set when the session was found by a token that has
+	// been rotated out and is in its grace period
+	Superseded bool
+}
+
+// ListActiveSessions returns all unexpired sessions with their user's email,
+// newest first
+func (app *App) ListActiveSessions(ctx context.Context) ([]Session, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	sessions, err := app.Sessions.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	emails := map[int64]string{}
+	rows, err := app.DB.QueryContext(ctx, "SELECT id, email FROM users")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var email string
+		if err := rows.Scan(&id, &email); err != nil {
+			return nil, fmt.Errorf("failed to scan user row: %w", err)
+		}
+		emails[id] = email
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating user rows: %w", err)
+	}
+
+	// Sessions of deleted users are skipped
+	active := sessions[:0]
+	for _, session := range sessions {
+		if email, ok := emails[session.UserID]; ok {
+			session.Email = email
+			active = append(active, session)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].CreatedAt.After(active[j].CreatedAt)
+	})
+
+	return active, nil
+}
+
+// DeleteSessionByID removes a session by its ID
+func (app *App) DeleteSessionByID(ctx context.Context, id string) error {
+	return app.Sessions.DeleteByID(ctx, id)
+}
+
+// MagicLink is a login link as shown on the admin dashboard
+type MagicLink struct {
+	ID        int64
+	Email     string
+	Used      bool
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// ListRecentMagicLinks returns the most recently created magic links
+func (app *App) ListRecentMagicLinks(ctx context.Context, limit int) ([]MagicLink, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	rows, err := app.DB.QueryContext(ctx, `
+		SELECT id, email, used, created_at, expires_at
+		FROM magic_links
+		ORDER BY created_at DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query magic links: %w", err)
+	}
+	defer rows.Close()
+
+	var links []MagicLink
+	for rows.Next() {
+		var link MagicLink
+		err := rows.Scan(&link.ID, &link.Email, &link.Used, &link.CreatedAt, &link.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan magic link row: %w", err)
+		}
+		links = append(links, link)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating magic link rows: %w", err)
+	}
+
+	return links, nil
+}
+
+// DeleteUser removes a user along with their sessions, devices and magic links
+func (app *App) DeleteUser(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	return app.InTx(ctx, func(ctx context.Context) error {
+		if err := app.Sessions.DeleteForUser(ctx, id); err != nil {
+			return err
+		}
+		app.userCache.Invalidate(ctx, strconv.FormatInt(id, 10))
+
+		queries := []string{
+			"DELETE FROM device_facts WHERE device_id IN (SELECT id FROM devices WHERE user_id = ?)",
+			"DELETE FROM device_metrics WHERE device_id IN (SELECT id FROM devices WHERE user_id = ?)",
+			"DELETE FROM devices WHERE user_id = ?",
+			"DELETE FROM agent_configs WHERE user_id = ?",
+			"DELETE FROM webauthn_credentials WHERE user_id = ?",
+			"DELETE FROM api_tokens WHERE user_id = ?",
+			"DELETE FROM oauth_identities WHERE user_id = ?",
+			"DELETE FROM backup_codes WHERE user_id = ?",
+			"DELETE FROM pending_logins WHERE user_id = ?",
+			"DELETE FROM webauthn_challenges WHERE user_id = ?",
+			"DELETE FROM push_subscriptions WHERE user_id = ?",
+			"DELETE FROM magic_links WHERE email = (SELECT email FROM users WHERE id = ?)",
+			"DELETE FROM email_outbox WHERE recipient = (SELECT email FROM users WHERE id = ?)",
+			"DELETE FROM users WHERE id = ?",
+		}
+		for _, query := range queries {
+			if _, err := app.DBFrom(ctx).ExecContext(ctx, query, id); err != nil {
+				return fmt.Errorf("failed to delete user: %w", err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// WithTx runs fn in a transaction. The transaction is committed if fn
+// returns nil and rolled back otherwise. If ctx already carries a
+// transaction from InTx, fn runs in that one and it's left to its owner to
+// commit.
+func (app *App) WithTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	return app.InTx(ctx, func(ctx context.Context) error {
+		return fn(ctx.Value(requestTxKey{}).(*sql.Tx))
+	})
+}
+
+// InTx runs fn as one unit of work: helpers it calls with the context it's
+// given and that use DBFrom all write in the same transaction. It's
+// committed if fn returns nil and rolled back if it returns an error or
+// panics. Nested calls join the outer transaction.
+func (app *App) InTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(requestTxKey{}).(*sql.Tx); ok {
+		return fn(ctx)
+	}
+
+	tx, err := app.DB.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to delete session: %w", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var committed []func()
+	ctx = context.WithValue(ctx, requestTxKey{}, tx)
+	ctx = context.WithValue(ctx, afterCommitKey{}, &committed)
+	if err := fn(ctx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	for _, f := range committed {
+		f()
 	}
 	return nil
 }
 
-// CleanupExpiredData removes expired sessions and magic links
-func CleanupExpiredData() error {
+// afterCommitKey is the context key for the functions InTx runs once its
+// transaction is committed
+type afterCommitKey struct{}
+
+// afterCommit runs fn once the transaction ctx carries from InTx is
+// committed, or right away if it doesn't carry one. It isn't run if the
+// transaction is rolled back.
+func afterCommit(ctx context.Context, fn func()) {
+	if committed, ok := ctx.Value(afterCommitKey{}).(*[]func()); ok {
+		*committed = append(*committed, fn)
+		return
+	}
+	fn()
+}
+
+// Querier runs queries. *sql.DB and *sql.Tx both implement it.
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// requestTxKey is the context key for the transaction from InTx
+type requestTxKey struct{}
+
+// DBFrom returns the transaction ctx carries when it comes from InTx or a
+// handler wrapped with WithRequestTx, and the app's DB otherwise
+func (app *App) DBFrom(ctx context.Context) Querier {
+	if tx, ok := ctx.Value(requestTxKey{}).(*sql.Tx); ok {
+		return tx
+	}
+	return app.DB
+}
+
+// WithRequestTx runs a handler in a transaction, committed if it returns
+// nil and rolled back if it returns an error or panics. Helpers that take
+// the request's context and use DBFrom join the transaction.
+//
+// SQLite allows one writer, so once the transaction has written, writes
+// through DB wait on it until they time out. Anything the handler writes
+// after that has to go through DBFrom. Writes that should stick even if
+// the request fails, like rate limits, belong before the first write.
+func (app *App) WithRequestTx(h func(http.ResponseWriter, *http.Request) error) func(http.ResponseWriter, *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		return app.InTx(r.Context(), func(ctx context.Context) error {
+			return h(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// CleanupExpiredData removes expired sessions, magic links, rate limits,
+// passkey and abuse challenges, and accounts past their deletion grace
+// period. Logs kept for a while, like sent emails, are left to the
+// retention policies.
+func (app *App) CleanupExpiredData(ctx context.Context) error {
 	// Delete expired sessions
-	_, err := DB.Exec("DELETE FROM sessions WHERE expires_at < ?", time.Now())
-	if err != nil {
-		return fmt.Errorf("failed to delete expired sessions: %w", err)
+	if err := app.Sessions.Cleanup(ctx); err != nil {
+		return err
 	}
 
 	// Delete expired magic links
-	_, err = DB.Exec("DELETE FROM magic_links WHERE expires_at < ?", time.Now())
+	_, err := app.DB.ExecContext(ctx, "DELETE FROM magic_links WHERE expires_at < ?", time.Now())
 	if err != nil {
 		return fmt.Errorf("failed to delete expired magic links: %w", err)
 	}
 
+	// Delete rate limit buckets that have long since refilled
+	_, err = app.DB.ExecContext(ctx, "DELETE FROM rate_limits WHERE updated_at < ?", time.Now().UTC().Add(-24*time.Hour))
+	if err != nil {
+		return fmt.Errorf("failed to delete old rate limits: %w", err)
+	}
+
+	// Delete logins that never got their second factor
+	_, err = app.DB.ExecContext(ctx, "DELETE FROM pending_logins WHERE expires_at < ?", time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to delete expired pending logins: %w", err)
+	}
+
+	// Delete API tokens past their expiry
+	_, err = app.DB.ExecContext(ctx, "DELETE FROM api_tokens WHERE expires_at < ?", time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to delete expired api tokens: %w", err)
+	}
+
+	// Delete abandoned passkey challenges
+	_, err = app.DB.ExecContext(ctx, "DELETE FROM webauthn_challenges WHERE expires_at < ?", time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to delete expired passkey challenges: %w", err)
+	}
+
+	// Forget used challenges once they've expired, when they can't be
+	// used again anyway
+	_, err = app.DB.ExecContext(ctx, "DELETE FROM abuse_challenges WHERE expires_at < ?", time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to delete expired challenges: %w", err)
+	}
+
+	// Delete accounts whose grace period is over
+	if err := app.PurgeDeletedAccounts(ctx, time.Now()); err != nil {
+		return err
+	}
+
 	return nil
 }
 
 // Device represents a device in the database
 type Device struct {
-	ID         int64
-	UserID     int64
-	Hostname   string
+	ID       int64
+	UserID   int64
+	Hostname string
+	// Name is what the user calls the device, the hostname unless they've
+	// renamed it
+	Name       string
 	DeviceType string
+	Notes      string
+	Tags       []string
 	CreatedAt  time.Time
+
+	// IP is the address its agent last registered or sent a heartbeat from
+	IP         string
+	LastSeenAt time.Time
+
+	// OS and Architecture come from the facts its agent last reported, or
+	// from registration before it has reported any
+	OS              string
+	Architecture    string
+	Packages        int
+	FactsReportedAt time.Time
+
+	// ConfigVersion is the agent config version its agent last applied,
+	// and ConfigFailedVersion and ConfigError the last one it couldn't
+	ConfigVersion       int64
+	ConfigFailedVersion int64
+	ConfigError         string
+}
+
+// Online reports whether the device's agent has sent a heartbeat recently
+func (d Device) Online() bool {
+	return !d.LastSeenAt.IsZero() && time.Since(d.LastSeenAt) < deviceOnlineWindow
 }
 
 // GetDevices retrieves all devices for a specific user
-func GetDevices(userID int64) ([]Device, error) {
-	rows, err := DB.Query(`
-		SELECT id, user_id, hostname, device_type, created_at
-		FROM devices
-		WHERE user_id = ?
-		ORDER BY created_at DESC
+func (app *App) GetDevices(ctx context.Context, userID int64) ([]Device, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	rows, err := app.DB.QueryContext(ctx, `
+		SELECT d.id, d.user_id, d.hostname, COALESCE(NULLIF(d.name, ''), d.hostname), d.device_type, d.notes, d.tags,
+			d.created_at, d.ip, d.last_seen_at,
+			COALESCE(NULLIF(TRIM(COALESCE(f.os_name, '') || ' ' || COALESCE(f.os_version, '')), ''), d.os),
+			COALESCE(NULLIF(f.architecture, ''), d.arch), COALESCE(f.package_count, 0), f.reported_at
+		FROM devices d
+		LEFT JOIN device_facts f ON f.device_id = d.id
+		WHERE d.user_id = ?
+		ORDER BY d.created_at DESC, d.id DESC
 	`, userID)
 
 	if err != nil {
@@ -325,18 +1161,32 @@ func GetDevices(userID int64) ([]Device, error) {
 	var devices []Device
 	for rows.Next() {
 		var device Device
+		var tags string
+		var lastSeenAt, reportedAt sql.NullTime
 
 		err := rows.Scan(
 			&device.ID,
 			&device.UserID,
 			&device.Hostname,
+			&device.Name,
 			&device.DeviceType,
+			&device.Notes,
+			&tags,
 			&device.CreatedAt,
+			&device.IP,
+			&lastSeenAt,
+			&device.OS,
+			&device.Architecture,
+			&device.Packages,
+			&reportedAt,
 		)
 
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan device row: %w", err)
 		}
+		device.Tags = strings.Fields(tags)
+		device.LastSeenAt = lastSeenAt.Time
+		device.FactsReportedAt = reportedAt.Time
 
 		devices = append(devices, device)
 	}
@@ -347,40 +1197,3 @@ func GetDevices(userID int64) ([]Device, error) {
 
 	return devices, nil
 }
-
-// InsertSampleDevices adds sample devices for a user if they don't have any
-func InsertSampleDevices(userID int64) error {
-	// Check if user already has devices
-	var count int
-	err := DB.QueryRow("SELECT COUNT(*) FROM devices WHERE user_id = ?", userID).Scan(&count)
-	if err != nil {
-		return fmt.Errorf("failed to check existing devices: %w", err)
-	}
-
-	// If user already has devices, don't add samples
-	if count > 0 {
-		return nil
-	}
-
-	// Sample device data
-	sampleDevices := []struct {
-		hostname   string
-		deviceType string
-	}{
-		{"maxm", "linux"},
-	}
-
-	// Insert sample devices
-	for _, device := range sampleDevices {
-		_, err := DB.Exec(`
-			INSERT INTO devices (user_id, hostname, device_type)
-			VALUES (?, ?, ?)
-		`, userID, device.hostname, device.deviceType)
-
-		if err != nil {
-			return fmt.Errorf("failed to insert sample device: %w", err)
-		}
-	}
-
-	return nil
-}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// deviceOnlineWindow is how long a device counts as online after its last
+// heartbeat. Agents should send one every minute or so.
+const deviceOnlineWindow = 5 * time.Minute
+
+// DeviceRegistration is what an agent sends to register its machine
+type DeviceRegistration struct {
+	Hostname string `json:"hostname"`
+	// Type is the kind of device, like "linux" or "macos". It defaults to
+	// the lowercased first word of os.
+	Type string `json:"type"`
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+	IP   string `json:"ip"`
+}
+
+// DeviceHeartbeat is the optional body of a heartbeat
+type DeviceHeartbeat struct {
+	IP string `json:"ip"`
+}
+
+// Validate checks the registration and fills in the defaults, taking the
+// IP from the request when the agent didn't send one
+func (reg *DeviceRegistration) Validate(r *http.Request) error {
+	reg.Hostname = strings.TrimSpace(reg.Hostname)
+	if reg.Hostname == "" || len(reg.Hostname) > 255 {
+		return fmt.Errorf("hostname is required and can be up to 255 characters")
+	}
+	if reg.Type == "" {
+		reg.Type, _, _ = strings.Cut(strings.ToLower(strings.TrimSpace(reg.OS)), " ")
+	}
+	if reg.Type == "" {
+		reg.Type = "unknown"
+	}
+	if len(reg.Type) > 50 || len(reg.OS) > 100 || len(reg.Arch) > 50 {
+		return fmt.Errorf("type, os or arch is too long")
+	}
+	ip, err := deviceIP(r, reg.IP)
+	if err != nil {
+		return err
+	}
+	reg.IP = ip
+	return nil
+}
+
+// deviceIP returns the address an agent reported, or the address the
+// request came from if it didn't report one
+func deviceIP(r *http.Request, reported string) (string, error) {
+	if reported == "" {
+		return clientIP(r).String(), nil
+	}
+	ip, err := netip.ParseAddr(reported)
+	if err != nil {
+		return "", fmt.Errorf("invalid ip %q", reported)
+	}
+	return ip.String(), nil
+}
+
+// RegisterDevice adds a device for the user, or updates their existing
+// device with the same hostname so reinstalling an agent doesn't leave a
+// duplicate behind
+func (app *App) RegisterDevice(ctx context.Context, userID int64, reg DeviceRegistration) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var id int64
+	err := app.InTx(ctx, func(ctx context.Context) error {
+		db := app.DBFrom(ctx)
+		now := time.Now()
+
+		err := db.QueryRowContext(ctx,
+			"SELECT id FROM devices WHERE user_id = ? AND hostname = ? ORDER BY id LIMIT 1",
+			userID, reg.Hostname,
+		).Scan(&id)
+		if err == sql.ErrNoRows {
+			err = db.QueryRowContext(ctx, `
+				INSERT INTO devices (user_id, hostname, device_type, os, arch, ip, last_seen_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?)
+				RETURNING id
+			`, userID, reg.Hostname, reg.Type, reg.OS, reg.Arch, reg.IP, now).Scan(&id)
+			if err != nil {
+				return fmt.Errorf("failed to register device: %w", err)
+			}
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to query device: %w", err)
+		}
+
+		_, err = db.ExecContext(ctx,
+			"UPDATE devices SET device_type = ?, os = ?, arch = ?, ip = ?, last_seen_at = ? WHERE id = ?",
+			reg.Type, reg.OS, reg.Arch, reg.IP, now, id,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update device: %w", err)
+		}
+		return nil
+	})
+	return id, err
+}
+
+// RecordHeartbeat marks one of a user's devices as seen now from an address
+func (app *App) RecordHeartbeat(ctx context.Context, userID, deviceID int64, ip string, now time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	result, err := app.DBFrom(ctx).ExecContext(ctx,
+		"UPDATE devices SET ip = ?, last_seen_at = ? WHERE id = ? AND user_id = ?",
+		ip, now, deviceID, userID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record heartbeat: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to record heartbeat: %w", err)
+	} else if n == 0 {
+		return errDeviceNotFound
+	}
+	return nil
+}
+
+// handleDeviceAPI routes the device endpoints under /api/devices
+func (app *App) handleDeviceAPI(w http.ResponseWriter, r *http.Request) error {
+	path := r.URL.Path
+	switch {
+	case path == "/api/devices":
+		return app.handleAPIDevices(w, r)
+	case path == "/api/devices/register":
+		return app.handleRegisterDevice(w, r)
+	case strings.HasSuffix(path, "/config"), strings.HasSuffix(path, "/config/status"):
+		return app.handleAgentConfigAPI(w, r)
+	case strings.HasSuffix(path, "/heartbeat"):
+		return app.handleDeviceHeartbeat(w, r)
+	case strings.HasSuffix(path, "/facts"):
+		return app.handleReportFacts(w, r)
+	case strings.HasSuffix(path, "/metrics"):
+		return app.handleDeviceMetrics(w, r)
+	case !strings.Contains(strings.TrimPrefix(path, "/api/devices/"), "/"):
+		return app.handleAPIDevice(w, r)
+	}
+	return NewHTTPError(fmt.Errorf("page not found: %s", path), http.StatusNotFound)
+}
+
+// handleRegisterDevice registers the agent's machine with
+// POST /api/devices/register and returns the device
+func (app *App) handleRegisterDevice(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return NewHTTPError(fmt.Errorf("method not allowed"), http.StatusMethodNotAllowed)
+	}
+	auth, err := app.authenticateRequest(w, r)
+	if err != nil {
+		return err
+	}
+	if err := requireScope(auth, "devices:write"); err != nil {
+		return err
+	}
+
+	var reg DeviceRegistration
+	if err := readJSON(w, r, &reg); err != nil {
+		return err
+	}
+	if err := reg.Validate(r); err != nil {
+		return NewHTTPError(fmt.Errorf("invalid registration: %w", err), http.StatusUnprocessableEntity)
+	}
+
+	id, err := app.RegisterDevice(r.Context(), auth.User.ID, reg)
+	if err != nil {
+		return err
+	}
+	if err := app.AuditActingAs(r.Context(), auth, "device.register", reg.Hostname); err != nil {
+		return err
+	}
+	device, err := app.GetDevice(r.Context(), auth.User.ID, id)
+	if err != nil {
+		return err
+	}
+
+	app.deviceSeen(auth.User.ID, id, device.IP, device.LastSeenAt)
+	slog.InfoContext(r.Context(), "Device registered", "device_id", id, "hostname", reg.Hostname)
+	w.Header().Set("Cache-Control", "no-store")
+	return writeJSON(w, apiDevice(device))
+}
+
+// handleDeviceHeartbeat records that a device's agent is running with
+// POST /api/devices/{id}/heartbeat
+func (app *App) handleDeviceHeartbeat(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return NewHTTPError(fmt.Errorf("method not allowed"), http.StatusMethodNotAllowed)
+	}
+	auth, err := app.authenticateRequest(w, r)
+	if err != nil {
+		return err
+	}
+	if err := requireScope(auth, "devices:write"); err != nil {
+		return err
+	}
+	deviceID, err := deviceIDFromPath(r.URL.Path, "/api/devices/")
+	if err != nil {
+		return err
+	}
+
+	// The body is optional
+	var heartbeat DeviceHeartbeat
+	if r.ContentLength != 0 {
+		if err := readJSON(w, r, &heartbeat); err != nil {
+			return err
+		}
+	}
+	ip, err := deviceIP(r, heartbeat.IP)
+	if err != nil {
+		return NewHTTPError(err, http.StatusUnprocessableEntity)
+	}
+
+	now := time.Now()
+	if err := app.RecordHeartbeat(r.Context(), auth.User.ID, deviceID, ip, now); errors.Is(err, errDeviceNotFound) {
+		return NewHTTPError(err, http.StatusNotFound)
+	} else if err != nil {
+		return err
+	}
+	app.deviceSeen(auth.User.ID, deviceID, ip, now)
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// maxDeviceTags limits how many tags a device can have
+const maxDeviceTags = 20
+
+// deviceTagPattern is what a tag can look like, like "office" or "env:prod"
+var deviceTagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._:-]{0,31}$`)
+
+// parseDeviceTags splits tags separated by commas or spaces, lowercasing
+// them and dropping duplicates
+func parseDeviceTags(s string) ([]string, error) {
+	var tags []string
+	for _, tag := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	}) {
+		if !deviceTagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("invalid tag %q: use up to 32 letters, numbers, dots, dashes, underscores and colons", tag)
+		}
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > maxDeviceTags {
+		return nil, fmt.Errorf("too many tags, the limit is %d", maxDeviceTags)
+	}
+	return tags, nil
+}
+
+// DeviceUpdate is a change to a device's name, notes or tags. Nil fields
+// are left alone.
+type DeviceUpdate struct {
+	Name  *string   `json:"name"`
+	Notes *string   `json:"notes"`
+	Tags  *[]string `json:"tags"`
+}
+
+// Validate checks the update, normalizing the name and tags
+func (u *DeviceUpdate) Validate() error {
+	if u.Name != nil {
+		name := strings.TrimSpace(*u.Name)
+		if len(name) > 255 {
+			return fmt.Errorf("name can be up to 255 characters")
+		}
+		u.Name = &name
+	}
+	if u.Notes != nil && len(*u.Notes) > 1000 {
+		return fmt.Errorf("notes can be up to 1000 characters")
+	}
+	if u.Tags != nil {
+		tags, err := parseDeviceTags(strings.Join(*u.Tags, " "))
+		if err != nil {
+			return err
+		}
+		u.Tags = &tags
+	}
+	return nil
+}
+
+// UpdateDevice renames one of a user's devices or changes its notes or
+// tags. An empty name goes back to the hostname.
+func (app *App) UpdateDevice(ctx context.Context, userID, deviceID int64, update DeviceUpdate) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var sets []string
+	var args []any
+	if update.Name != nil {
+		sets = append(sets, "name = ?")
+		args = append(args, *update.Name)
+	}
+	if update.Notes != nil {
+		sets = append(sets, "notes = ?")
+		args = append(args, *update.Notes)
+	}
+	if update.Tags != nil {
+		sets = append(sets, "tags = ?")
+		args = append(args, strings.Join(*update.Tags, " "))
+	}
+	if len(sets) == 0 {
+		_, err := app.GetDevice(ctx, userID, deviceID)
+		return err
+	}
+
+	result, err := app.DB.ExecContext(ctx,
+		"UPDATE devices SET "+strings.Join(sets, ", ")+" WHERE id = ? AND user_id = ?",
+		append(args, deviceID, userID)...,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update device: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to update device: %w", err)
+	} else if n == 0 {
+		return errDeviceNotFound
+	}
+	return nil
+}
+
+// DeleteDevice removes one of a user's devices along with its facts,
+// metrics and agent config
+func (app *App) DeleteDevice(ctx context.Context, userID, deviceID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	return app.InTx(ctx, func(ctx context.Context) error {
+		db := app.DBFrom(ctx)
+		result, err := db.ExecContext(ctx, "DELETE FROM devices WHERE id = ? AND user_id = ?", deviceID, userID)
+		if err != nil {
+			return fmt.Errorf("failed to delete device: %w", err)
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return fmt.Errorf("failed to delete device: %w", err)
+		} else if n == 0 {
+			return errDeviceNotFound
+		}
+		if _, err := db.ExecContext(ctx, "DELETE FROM device_facts WHERE device_id = ?", deviceID); err != nil {
+			return fmt.Errorf("failed to delete device facts: %w", err)
+		}
+		if _, err := db.ExecContext(ctx, "DELETE FROM device_metrics WHERE device_id = ?", deviceID); err != nil {
+			return fmt.Errorf("failed to delete device metrics: %w", err)
+		}
+		if err := app.ClearAgentConfig(ctx, userID, deviceConfigScope(deviceID)); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// handleAPIDevice changes or deletes one of the user's devices with
+// PATCH or DELETE /api/devices/{id}
+func (app *App) handleAPIDevice(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPatch && r.Method != http.MethodDelete {
+		return NewHTTPError(fmt.Errorf("method not allowed"), http.StatusMethodNotAllowed)
+	}
+	auth, err := app.authenticateRequest(w, r)
+	if err != nil {
+		return err
+	}
+	if err := requireScope(auth, "devices:write"); err != nil {
+		return err
+	}
+	deviceID, err := deviceIDFromPath(r.URL.Path, "/api/devices/")
+	if err != nil {
+		return err
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := app.DeleteDevice(r.Context(), auth.User.ID, deviceID); errors.Is(err, errDeviceNotFound) {
+			return NewHTTPError(err, http.StatusNotFound)
+		} else if err != nil {
+			return err
+		}
+		if err := app.AuditActingAs(r.Context(), auth, "device.delete", fmt.Sprintf("device %d", deviceID)); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	var update DeviceUpdate
+	if err := readJSON(w, r, &update); err != nil {
+		return err
+	}
+	if err := update.Validate(); err != nil {
+		return NewHTTPError(fmt.Errorf("invalid update: %w", err), http.StatusUnprocessableEntity)
+	}
+	if err := app.UpdateDevice(r.Context(), auth.User.ID, deviceID, update); errors.Is(err, errDeviceNotFound) {
+		return NewHTTPError(err, http.StatusNotFound)
+	} else if err != nil {
+		return err
+	}
+	if err := app.AuditActingAs(r.Context(), auth, "device.update", fmt.Sprintf("device %d", deviceID)); err != nil {
+		return err
+	}
+	device, err := app.GetDevice(r.Context(), auth.User.ID, deviceID)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return writeJSON(w, apiDevice(device))
+}
+
+// DevicesPage holds data for the devices template
+type DevicesPage struct {
+	Meta    PageMeta
+	Devices []Device
+	// Metrics are each device's charts, for those that report metrics
+	Metrics map[int64]MetricsSeries
+	// Tag filters the list when set
+	Tag string
+}
+
+// handleDevices lists the user's devices, optionally only those with a
+// tag. Callers must make sure the user is logged in.
+func (app *App) handleDevices(w http.ResponseWriter, r *http.Request, count int, user *User) error {
+	devices, err := app.GetDevices(r.Context(), user.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get devices: %w", err)
+	}
+
+	metrics, err := app.GetDeviceMetrics(r.Context(), user.ID, time.Now().Add(-metricsWindow))
+	if err != nil {
+		return err
+	}
+
+	tag := r.URL.Query().Get("tag")
+	if tag != "" {
+		devices = slices.DeleteFunc(devices, func(d Device) bool {
+			return !slices.Contains(d.Tags, tag)
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	data := DevicesPage{
+		Meta: PageMeta{
+			Title: "Your Devices",
+			Count: count,
+			User:  user,
+
+			CanonicalURL: canonicalURL(r),
+
+			CSRFToken: csrfToken(r),
+		},
+		Devices: devices,
+		Metrics: metrics,
+		Tag:     tag,
+	}
+	if err := app.render(w, r, http.StatusOK, "devices.html", data); err != nil {
+		return fmt.Errorf("failed to render devices page: %w", err)
+	}
+	return nil
+}
+
+// DeviceEditPage holds data for the device settings template
+type DeviceEditPage struct {
+	Meta   PageMeta
+	Device Device
+	Error  string
+}
+
+// handleDeviceEdit renames a device or changes its notes and tags at
+// /devices/{id}/edit, and deletes it at /devices/{id}/delete. Callers must
+// make sure the user is logged in.
+func (app *App) handleDeviceEdit(w http.ResponseWriter, r *http.Request, count int, user *User) error {
+	deviceID, err := deviceIDFromPath(r.URL.Path, "/devices/")
+	if err != nil {
+		return err
+	}
+	device, err := app.GetDevice(r.Context(), user.ID, deviceID)
+	if errors.Is(err, errDeviceNotFound) {
+		return NewHTTPError(err, http.StatusNotFound)
+	} else if err != nil {
+		return err
+	}
+
+	page := DeviceEditPage{
+		Meta: PageMeta{
+			Title: "Edit " + device.Name,
+			Count: count,
+			User:  user,
+
+			CSRFToken: csrfToken(r),
+		},
+		Device: device,
+	}
+
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/delete") && r.Method == http.MethodPost:
+		if err := app.DeleteDevice(r.Context(), user.ID, deviceID); err != nil {
+			return err
+		}
+		slog.InfoContext(r.Context(), "Device deleted", "user_id", user.ID, "device_id", deviceID)
+		http.Redirect(w, r, "/devices", http.StatusSeeOther)
+		return nil
+	case strings.HasSuffix(r.URL.Path, "/edit") && r.Method == http.MethodPost:
+		name, notes := r.FormValue("name"), r.FormValue("notes")
+		tags := []string{r.FormValue("tags")}
+		update := DeviceUpdate{Name: &name, Notes: &notes, Tags: &tags}
+		if err := update.Validate(); err != nil {
+			page.Error = err.Error()
+			page.Device.Name, page.Device.Notes = name, notes
+			break
+		}
+		if err := app.UpdateDevice(r.Context(), user.ID, deviceID, update); err != nil {
+			return err
+		}
+		http.Redirect(w, r, "/devices", http.StatusSeeOther)
+		return nil
+	case strings.HasSuffix(r.URL.Path, "/edit") && r.Method == http.MethodGet:
+	default:
+		return NewHTTPError(fmt.Errorf("page not found: %s", r.URL.Path), http.StatusNotFound)
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := app.render(w, r, http.StatusOK, "device_edit.html", page); err != nil {
+		return fmt.Errorf("failed to render device page: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// deviceStreamPing is how often the device stream checks for devices that
+// have gone offline, and sends a comment to keep idle connections open
+const deviceStreamPing = 30 * time.Second
+
+// DeviceStatus is a device's online state, sent to the devices page when
+// it changes or the device sends a heartbeat
+type DeviceStatus struct {
+	ID         int64     `json:"id"`
+	Online     bool      `json:"online"`
+	IP         string    `json:"ip"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+// deviceHub fans heartbeats out to the devices pages open in this process,
+// each only hearing about its own user's devices. The zero value is ready
+// to use.
+type deviceHub struct {
+	mu   sync.Mutex
+	subs map[int64]map[chan DeviceStatus]struct{}
+}
+
+// subscribe returns a channel of the user's device heartbeats and a
+// function to stop them
+func (h *deviceHub) subscribe(userID int64) (chan DeviceStatus, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs == nil {
+		h.subs = map[int64]map[chan DeviceStatus]struct{}{}
+	}
+	if h.subs[userID] == nil {
+		h.subs[userID] = map[chan DeviceStatus]struct{}{}
+	}
+	ch := make(chan DeviceStatus, 16)
+	h.subs[userID][ch] = struct{}{}
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subs[userID], ch)
+		if len(h.subs[userID]) == 0 {
+			delete(h.subs, userID)
+		}
+	}
+}
+
+// publish tells the user's subscribers a device was seen. A subscriber that
+// isn't keeping up misses it rather than holding up the heartbeat.
+func (h *deviceHub) publish(userID int64, status DeviceStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[userID] {
+		select {
+		case ch <- status:
+		default:
+		}
+	}
+}
+
+// deviceSeen tells the user's open devices pages that a device's agent was
+// heard from
+func (app *App) deviceSeen(userID, deviceID int64, ip string, at time.Time) {
+	app.deviceEvents.publish(userID, DeviceStatus{ID: deviceID, Online: true, IP: ip, LastSeenAt: at})
+}
+
+// writeDeviceStatus sends a status as a server-sent event
+func writeDeviceStatus(w http.ResponseWriter, rc *http.ResponseController, status DeviceStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return fmt.Errorf("failed to encode device status: %w", err)
+	}
+	if _, err := fmt.Fprintf(w, "event: status\ndata: %s\n\n", data); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
+// handleDeviceEvents streams the logged in user's device heartbeats, and
+// devices going offline, to the devices page with server-sent events
+func (app *App) handleDeviceEvents(w http.ResponseWriter, r *http.Request) error {
+	user, err := app.getCurrentUser(r)
+	if err != nil {
+		return NewHTTPError(fmt.Errorf("not logged in"), http.StatusUnauthorized)
+	}
+
+	// Subscribe before loading the devices so no heartbeat falls between
+	// the two
+	heartbeats, unsubscribe := app.deviceEvents.subscribe(user.ID)
+	defer unsubscribe()
+
+	devices, err := app.GetDevices(r.Context(), user.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get devices: %w", err)
+	}
+	lastSeen := make(map[int64]DeviceStatus, len(devices))
+	for _, d := range devices {
+		lastSeen[d.ID] = DeviceStatus{ID: d.ID, Online: d.Online(), IP: d.IP, LastSeenAt: d.LastSeenAt}
+	}
+
+	rc := http.NewResponseController(w)
+	// The stream outlives any write timeout
+	_ = rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return nil
+	}
+
+	ticker := time.NewTicker(deviceStreamPing)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case status := <-heartbeats:
+			lastSeen[status.ID] = status
+			if err := writeDeviceStatus(w, rc, status); err != nil {
+				return nil
+			}
+		case <-ticker.C:
+			for id, status := range lastSeen {
+				if status.Online && time.Since(status.LastSeenAt) >= deviceOnlineWindow {
+					status.Online = false
+					lastSeen[id] = status
+					if err := writeDeviceStatus(w, rc, status); err != nil {
+						return nil
+					}
+				}
+			}
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return nil
+			}
+			if err := rc.Flush(); err != nil {
+				return nil
+			}
+		}
+	}
+}
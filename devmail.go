@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// devMailDir is where the development mailer saves emails, as .eml files
+// that open in any mail client
+const devMailDir = "./dev-mail"
+
+// devMailboxSize is how many emails /dev/mailbox keeps
+const devMailboxSize = 50
+
+// CapturedMail is an email the development mailer didn't send
+type CapturedMail struct {
+	ID     int
+	Mail   Mail
+	SentAt time.Time
+	Path   string
+}
+
+// devMailer saves email to devMailDir and logs its links, so logging in
+// works locally without a mail provider
+type devMailer struct {
+	from *mail.Address
+
+	mu     sync.Mutex
+	nextID int
+	recent []CapturedMail
+}
+
+// linkPattern finds links in the text part of an email
+var linkPattern = regexp.MustCompile(`https?://\S+`)
+
+func (m *devMailer) Send(msg Mail) error {
+	now := time.Now()
+	data, err := buildMIMEMessage(m.from, msg, now)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.nextID++
+	captured := CapturedMail{ID: m.nextID, Mail: msg, SentAt: now}
+	m.mu.Unlock()
+
+	if err := os.MkdirAll(devMailDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", devMailDir, err)
+	}
+	captured.Path = filepath.Join(devMailDir, fmt.Sprintf("%s-%d.eml", now.Format("20060102-150405"), captured.ID))
+	if err := os.WriteFile(captured.Path, data, 0o600); err != nil {
+		return fmt.Errorf("failed to save email: %w", err)
+	}
+
+	m.mu.Lock()
+	m.recent = append(m.recent, captured)
+	if len(m.recent) > devMailboxSize {
+		m.recent = m.recent[len(m.recent)-devMailboxSize:]
+	}
+	m.mu.Unlock()
+
+	slog.Info("Captured email", "to", msg.To, "subject", msg.Subject, "path", captured.Path,
+		"links", linkPattern.FindAllString(msg.Text, -1))
+	return nil
+}
+
+// Recent returns the captured emails, newest first
+func (m *devMailer) Recent() []CapturedMail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mails := make([]CapturedMail, len(m.recent))
+	for i, c := range m.recent {
+		mails[len(m.recent)-1-i] = c
+	}
+	return mails
+}
+
+// MailboxPage holds data for the development mailbox template
+type MailboxPage struct {
+	Meta  PageMeta
+	Mails []CapturedMail
+}
+
+// handleDevMailbox lists captured emails at /dev/mailbox, and serves the
+// HTML part of one at /dev/mailbox/{id}. It's only registered in
+// development.
+func (app *App) handleDevMailbox(w http.ResponseWriter, r *http.Request) error {
+	dm, ok := app.Mailer.(*devMailer)
+	if !ok {
+		return NewHTTPError(fmt.Errorf("page not found: %s", r.URL.Path), http.StatusNotFound)
+	}
+
+	if id := strings.TrimPrefix(r.URL.Path, "/dev/mailbox/"); id != r.URL.Path {
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			return NewHTTPError(fmt.Errorf("page not found: %s", r.URL.Path), http.StatusNotFound)
+		}
+		for _, c := range dm.Recent() {
+			if c.ID == n {
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				_, err := w.Write([]byte(c.Mail.HTML))
+				return err
+			}
+		}
+		return NewHTTPError(fmt.Errorf("page not found: %s", r.URL.Path), http.StatusNotFound)
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	data := MailboxPage{
+		Meta:  PageMeta{Title: "Mailbox"},
+		Mails: dm.Recent(),
+	}
+	if err := app.render(w, r, http.StatusOK, "mailbox.html", data); err != nil {
+		return fmt.Errorf("failed to render mailbox: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// digestIntervals are the digest frequencies admins can opt in to
+var digestIntervals = map[string]time.Duration{
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+// Digest summarizes site activity over a period for the digest email
+type Digest struct {
+	Frequency    string
+	Since        time.Time
+	Until        time.Time
+	SiteURL      string
+	Signups      []User
+	Views        int
+	TopPosts     []PostStats
+	ServerErrors int
+}
+
+// BuildDigest gathers activity between since and until
+func (app *App) BuildDigest(ctx context.Context, since, until time.Time) (Digest, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	digest := Digest{
+		Since:   since,
+		Until:   until,
+		SiteURL: strings.TrimSuffix(app.Config.SiteURL, "/"),
+	}
+
+	rows, err := app.DB.QueryContext(ctx,
+		"SELECT id, email, role, created_at FROM users WHERE created_at >= ? AND created_at < ? ORDER BY created_at",
+		since.UTC(), until.UTC(),
+	)
+	if err != nil {
+		return Digest{}, fmt.Errorf("failed to query signups: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Email, &user.Role, &user.CreatedAt); err != nil {
+			return Digest{}, fmt.Errorf("failed to scan signup row: %w", err)
+		}
+		digest.Signups = append(digest.Signups, user)
+	}
+	if err := rows.Err(); err != nil {
+		return Digest{}, fmt.Errorf("error iterating signup rows: %w", err)
+	}
+
+	// Page views and errors are stored per day, so the period is rounded to
+	// whole days
+	sinceDay := since.UTC().Format(time.DateOnly)
+	untilDay := until.UTC().Format(time.DateOnly)
+
+	err = app.DB.QueryRowContext(ctx,
+		"SELECT COALESCE(SUM(count), 0) FROM page_views WHERE day >= ? AND day < ?",
+		sinceDay, untilDay,
+	).Scan(&digest.Views)
+	if err != nil {
+		return Digest{}, fmt.Errorf("failed to count page views: %w", err)
+	}
+
+	err = app.DB.QueryRowContext(ctx,
+		"SELECT COALESCE(SUM(count), 0) FROM server_errors WHERE day >= ? AND day < ?",
+		sinceDay, untilDay,
+	).Scan(&digest.ServerErrors)
+	if err != nil {
+		return Digest{}, fmt.Errorf("failed to count server errors: %w", err)
+	}
+
+	posts, err := app.DB.QueryContext(ctx, `
+		SELECT path, SUM(count) AS views
+		FROM page_views
+		WHERE path LIKE '/blog/_%' AND day >= ? AND day < ?
+		GROUP BY path
+		ORDER BY views DESC
+		LIMIT 5
+	`, sinceDay, untilDay)
+	if err != nil {
+		return Digest{}, fmt.Errorf("failed to query top posts: %w", err)
+	}
+	defer posts.Close()
+	blog := app.defaultSite().Blog()
+	for posts.Next() {
+		var path string
+		var stats PostStats
+		if err := posts.Scan(&path, &stats.Total); err != nil {
+			return Digest{}, fmt.Errorf("failed to scan top post row: %w", err)
+		}
+		post, ok := blog.PostBySlug(strings.TrimPrefix(path, "/blog/"))
+		if !ok {
+			continue
+		}
+		stats.Post = post
+		digest.TopPosts = append(digest.TopPosts, stats)
+	}
+	if err := posts.Err(); err != nil {
+		return Digest{}, fmt.Errorf("error iterating top post rows: %w", err)
+	}
+
+	return digest, nil
+}
+
+// SendDueDigests emails every opted-in admin whose digest period has passed
+// since they last received one. Without email configured it does nothing.
+func (app *App) SendDueDigests(ctx context.Context, now time.Time) error {
+	if app.Mailer == nil {
+		return nil
+	}
+
+	type recipient struct {
+		id        int64
+		email     string
+		frequency string
+		sentAt    sql.NullTime
+	}
+
+	// Only the query is bounded, building and sending digests can take a while
+	qctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	rows, err := app.DB.QueryContext(qctx, "SELECT id, email, digest, digest_sent_at FROM users WHERE role = ? AND digest != ''", RoleAdmin)
+	if err != nil {
+		return fmt.Errorf("failed to query digest recipients: %w", err)
+	}
+	var recipients []recipient
+	for rows.Next() {
+		var r recipient
+		if err := rows.Scan(&r.id, &r.email, &r.frequency, &r.sentAt); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan digest recipient: %w", err)
+		}
+		recipients = append(recipients, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating digest recipients: %w", err)
+	}
+
+	for _, r := range recipients {
+		interval, ok := digestIntervals[r.frequency]
+		if !ok {
+			continue
+		}
+		since := now.Add(-interval)
+		if r.sentAt.Valid {
+			if now.Sub(r.sentAt.Time) < interval {
+				continue
+			}
+			since = r.sentAt.Time
+		}
+
+		digest, err := app.BuildDigest(ctx, since, now)
+		if err != nil {
+			return err
+		}
+		digest.Frequency = r.frequency
+
+		msg, err := app.renderMail(r.email, fmt.Sprintf("Your %s Tulip digest", r.frequency), "digest", digest)
+		if err != nil {
+			return err
+		}
+		if err := app.queueMail(ctx, msg); err != nil {
+			// Try again next time rather than giving up on the other admins
+			slog.Error("Failed to send digest", "error", err, "user_id", r.id)
+			continue
+		}
+
+		if _, err := app.DB.ExecContext(ctx, "UPDATE users SET digest_sent_at = ? WHERE id = ?", now.UTC(), r.id); err != nil {
+			return fmt.Errorf("failed to record digest sent: %w", err)
+		}
+		slog.Info("Sent digest", "user_id", r.id, "frequency", r.frequency)
+	}
+
+	return nil
+}
+
+// handleAdminSetDigest opts the current admin in or out of the digest email
+func (app *App) handleAdminSetDigest(w http.ResponseWriter, r *http.Request, user *User) error {
+	frequency := r.FormValue("digest")
+	if _, ok := digestIntervals[frequency]; !ok && frequency != "" {
+		return NewHTTPError(fmt.Errorf("unknown digest frequency %q", frequency), http.StatusBadRequest)
+	}
+
+	if err := app.SetUserDigest(r.Context(), user.ID, frequency); err != nil {
+		return err
+	}
+
+	slog.InfoContext(r.Context(), "Admin changed digest setting", "admin_id", user.ID, "digest", frequency)
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+	return nil
+}
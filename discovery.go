@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Registrar adds this instance to an external service directory, so load
+// balancers and DNS send it traffic, and takes it out again when it stops.
+// Drain is called first on the way out, while requests are still being
+// served, and Deregister once the drain period is over.
+type Registrar interface {
+	Register(ctx context.Context, node DiscoveryNode) error
+	Drain(ctx context.Context, node DiscoveryNode) error
+	Deregister(ctx context.Context, node DiscoveryNode) error
+}
+
+// DiscoveryNode is this instance as the service directory sees it
+type DiscoveryNode struct {
+	// ID is unique to the instance, like "tulip-web1-8080"
+	ID      string `json:"id"`
+	Service string `json:"service"`
+	Host    string `json:"host"`
+	Port    int    `json:"port"`
+	// HealthURL answers 200 while the instance should get traffic, and 503
+	// once it's draining or can't reach its database
+	HealthURL string `json:"health_url"`
+}
+
+// discoveryClient is used to talk to the service directories
+var discoveryClient = &http.Client{Timeout: 10 * time.Second}
+
+// discoveryNode describes this instance from DISCOVERY_ADDRESS, which
+// defaults to the host name and PORT
+func discoveryNode(cfg Config) (DiscoveryNode, error) {
+	address := cfg.DiscoveryAddress
+	if address == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return DiscoveryNode{}, fmt.Errorf("failed to get host name for DISCOVERY_ADDRESS: %w", err)
+		}
+		address = net.JoinHostPort(hostname, strconv.Itoa(cfg.Port))
+	}
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return DiscoveryNode{}, fmt.Errorf("invalid DISCOVERY_ADDRESS %q, expected host:port", address)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return DiscoveryNode{}, fmt.Errorf("invalid DISCOVERY_ADDRESS %q, expected host:port", address)
+	}
+	return DiscoveryNode{
+		ID:        fmt.Sprintf("%s-%s-%d", cfg.DiscoveryService, host, port),
+		Service:   cfg.DiscoveryService,
+		Host:      host,
+		Port:      port,
+		HealthURL: "http://" + net.JoinHostPort(host, portStr) + apiV1Prefix + "/status",
+	}, nil
+}
+
+// newRegistrar picks the service directory from DISCOVERY: "consul",
+// "route53" or "webhook". It returns nil if DISCOVERY isn't set.
+// Registration relies on the health check at /api/v1/status, so it can't
+// be used with PUBLIC_STATUS=off.
+func newRegistrar(cfg Config) (Registrar, error) {
+	if cfg.Discovery == "" {
+		return nil, nil
+	}
+	if !cfg.PublicStatus {
+		return nil, fmt.Errorf("DISCOVERY needs PUBLIC_STATUS for health checks")
+	}
+	node, err := discoveryNode(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Discovery {
+	case "consul":
+		u, err := url.Parse(cfg.ConsulAddr)
+		if err != nil || u.Host == "" {
+			// Consul's own tools take a bare host:port
+			u, err = url.Parse("http://" + cfg.ConsulAddr)
+		}
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid CONSUL_HTTP_ADDR %q", cfg.ConsulAddr)
+		}
+		return consulRegistrar{endpoint: strings.TrimSuffix(u.String(), "/"), token: cfg.ConsulToken}, nil
+	case "route53":
+		creds, err := cfg.awsCredentials()
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Route53ZoneID == "" || cfg.Route53RecordName == "" {
+			return nil, fmt.Errorf("ROUTE53_ZONE_ID and ROUTE53_RECORD_NAME must be set")
+		}
+		ip, err := netip.ParseAddr(node.Host)
+		if err != nil {
+			return nil, fmt.Errorf("DISCOVERY_ADDRESS must be an IP address and port for route53, got %q", node.Host)
+		}
+		return &route53Registrar{
+			endpoint: "https://route53.amazonaws.com",
+			zoneID:   strings.TrimPrefix(cfg.Route53ZoneID, "/hostedzone/"),
+			name:     cfg.Route53RecordName,
+			ttl:      cfg.Route53TTL,
+			ip:       ip,
+			creds:    creds,
+		}, nil
+	case "webhook":
+		if u, err := url.Parse(cfg.DiscoveryWebhookURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("DISCOVERY_WEBHOOK_URL must be set to a URL for webhook discovery")
+		}
+		return webhookRegistrar{url: cfg.DiscoveryWebhookURL, secret: cfg.DiscoveryWebhookSecret}, nil
+	default:
+		return nil, fmt.Errorf("unknown DISCOVERY %q", cfg.Discovery)
+	}
+}
+
+// doDiscoveryRequest sends a request to a service directory and returns the
+// response body, or an error for anything but a 2xx response
+func doDiscoveryRequest(name string, req *http.Request) ([]byte, error) {
+	resp, err := discoveryClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s response: %w", name, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := strings.TrimSpace(string(body))
+		if len(msg) > 512 {
+			msg = msg[:512]
+		}
+		return nil, fmt.Errorf("%s returned %s: %s", name, resp.Status, msg)
+	}
+	return body, nil
+}
+
+// consulRegistrar registers with the local Consul agent, which runs the
+// health check itself
+type consulRegistrar struct {
+	endpoint string
+	token    string
+}
+
+func (c consulRegistrar) do(ctx context.Context, path string, body any) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return fmt.Errorf("failed to encode consul request: %w", err)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.endpoint+path, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	_, err = doDiscoveryRequest("consul", req)
+	return err
+}
+
+func (c consulRegistrar) Register(ctx context.Context, node DiscoveryNode) error {
+	return c.do(ctx, "/v1/agent/service/register", map[string]any{
+		"ID":      node.ID,
+		"Name":    node.Service,
+		"Address": node.Host,
+		"Port":    node.Port,
+		"Check": map[string]any{
+			"HTTP":     node.HealthURL,
+			"Interval": "10s",
+			"Timeout":  "5s",
+			// An instance that died without deregistering is cleaned up
+			"DeregisterCriticalServiceAfter": "10m",
+		},
+	})
+}
+
+// Drain puts the service in maintenance mode, which takes it out of DNS
+// and the catalog's healthy instances straight away
+func (c consulRegistrar) Drain(ctx context.Context, node DiscoveryNode) error {
+	return c.do(ctx, "/v1/agent/service/maintenance/"+url.PathEscape(node.ID)+"?enable=true&reason=draining", nil)
+}
+
+func (c consulRegistrar) Deregister(ctx context.Context, node DiscoveryNode) error {
+	return c.do(ctx, "/v1/agent/service/deregister/"+url.PathEscape(node.ID), nil)
+}
+
+// route53Registrar adds a multivalue answer record for this instance, with a
+// Route 53 health check so resolvers stop getting it if it goes down. An
+// instance that's killed outright leaves both behind, but the failing health
+// check keeps the record out of answers.
+type route53Registrar struct {
+	endpoint string
+	zoneID   string
+	name     string
+	ttl      int
+	ip       netip.Addr
+	creds    awsCredentials
+
+	// healthCheckID is the health check created by Register
+	healthCheckID string
+}
+
+const route53Namespace = "https://route53.amazonaws.com/doc/2013-04-01/"
+
+type route53HealthCheckConfig struct {
+	IPAddress        string
+	Port             int
+	Type             string
+	ResourcePath     string
+	RequestInterval  int
+	FailureThreshold int
+}
+
+type route53ResourceRecordSet struct {
+	Name             string
+	Type             string
+	SetIdentifier    string
+	MultiValueAnswer bool
+	TTL              int
+	ResourceRecords  []route53ResourceRecord `xml:"ResourceRecords>ResourceRecord"`
+	HealthCheckID    string                  `xml:"HealthCheckId,omitempty"`
+}
+
+type route53ResourceRecord struct {
+	Value string
+}
+
+func (r *route53Registrar) do(ctx context.Context, method, path string, body any) ([]byte, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = xml.Marshal(body); err != nil {
+			return nil, fmt.Errorf("failed to encode route53 request: %w", err)
+		}
+		payload = append([]byte(xml.Header), payload...)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, r.endpoint+"/2013-04-01"+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	// Route 53 is a global service signed in us-east-1
+	signAWSRequest(req, payload, "route53", "us-east-1", r.creds, time.Now())
+	return doDiscoveryRequest("route53", req)
+}
+
+// recordSet is this instance's record, which must match exactly to be
+// deleted
+func (r *route53Registrar) recordSet(node DiscoveryNode) route53ResourceRecordSet {
+	recordType := "A"
+	if r.ip.Is6() && !r.ip.Is4In6() {
+		recordType = "AAAA"
+	}
+	return route53ResourceRecordSet{
+		Name:             r.name,
+		Type:             recordType,
+		SetIdentifier:    node.ID,
+		MultiValueAnswer: true,
+		TTL:              r.ttl,
+		ResourceRecords:  []route53ResourceRecord{{Value: r.ip.Unmap().String()}},
+		HealthCheckID:    r.healthCheckID,
+	}
+}
+
+func (r *route53Registrar) changeRecord(ctx context.Context, action string, node DiscoveryNode) error {
+	type change struct {
+		Action            string
+		ResourceRecordSet route53ResourceRecordSet
+	}
+	_, err := r.do(ctx, http.MethodPost, "/hostedzone/"+r.zoneID+"/rrset", struct {
+		XMLName xml.Name `xml:"ChangeResourceRecordSetsRequest"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Changes []change `xml:"ChangeBatch>Changes>Change"`
+	}{
+		Xmlns:   route53Namespace,
+		Changes: []change{{Action: action, ResourceRecordSet: r.recordSet(node)}},
+	})
+	return err
+}
+
+func (r *route53Registrar) Register(ctx context.Context, node DiscoveryNode) error {
+	body, err := r.do(ctx, http.MethodPost, "/healthcheck", struct {
+		XMLName           xml.Name `xml:"CreateHealthCheckRequest"`
+		Xmlns             string   `xml:"xmlns,attr"`
+		CallerReference   string
+		HealthCheckConfig route53HealthCheckConfig
+	}{
+		Xmlns: route53Namespace,
+		// Unique per start, since a reference can't be reused
+		CallerReference: fmt.Sprintf("%s-%d", node.ID, time.Now().UnixNano()),
+		HealthCheckConfig: route53HealthCheckConfig{
+			IPAddress:        r.ip.Unmap().String(),
+			Port:             node.Port,
+			Type:             "HTTP",
+			ResourcePath:     apiV1Prefix + "/status",
+			RequestInterval:  30,
+			FailureThreshold: 3,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create health check: %w", err)
+	}
+	var created struct {
+		ID string `xml:"HealthCheck>Id"`
+	}
+	if err := xml.Unmarshal(body, &created); err != nil || created.ID == "" {
+		return fmt.Errorf("failed to decode route53 health check: %v", err)
+	}
+	r.healthCheckID = created.ID
+
+	if err := r.changeRecord(ctx, "UPSERT", node); err != nil {
+		return fmt.Errorf("failed to add record: %w", err)
+	}
+	return nil
+}
+
+// Drain deletes the record, so resolvers stop handing it out once their
+// cached answers expire
+func (r *route53Registrar) Drain(ctx context.Context, node DiscoveryNode) error {
+	if err := r.changeRecord(ctx, "DELETE", node); err != nil {
+		return fmt.Errorf("failed to delete record: %w", err)
+	}
+	return nil
+}
+
+// Deregister deletes the health check, which the record no longer uses
+func (r *route53Registrar) Deregister(ctx context.Context, node DiscoveryNode) error {
+	if r.healthCheckID == "" {
+		return nil
+	}
+	if _, err := r.do(ctx, http.MethodDelete, "/healthcheck/"+r.healthCheckID, nil); err != nil {
+		return fmt.Errorf("failed to delete health check: %w", err)
+	}
+	r.healthCheckID = ""
+	return nil
+}
+
+// webhookRegistrar POSTs each change to a URL, for directories without
+// built in support. The body is a DiscoveryEvent.
+type webhookRegistrar struct {
+	url string
+	// secret is sent as a bearer token, if set
+	secret string
+}
+
+// DiscoveryEvent is the body of a discovery webhook
+type DiscoveryEvent struct {
+	// Event is "register", "drain" or "deregister"
+	Event string        `json:"event"`
+	Node  DiscoveryNode `json:"node"`
+	At    time.Time     `json:"at"`
+}
+
+func (h webhookRegistrar) send(ctx context.Context, event string, node DiscoveryNode) error {
+	payload, err := json.Marshal(DiscoveryEvent{Event: event, Node: node, At: time.Now().UTC()})
+	if err != nil {
+		return fmt.Errorf("failed to encode discovery event: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.secret != "" {
+		req.Header.Set("Authorization", "Bearer "+h.secret)
+	}
+	_, err = doDiscoveryRequest("discovery webhook", req)
+	return err
+}
+
+func (h webhookRegistrar) Register(ctx context.Context, node DiscoveryNode) error {
+	return h.send(ctx, "register", node)
+}
+
+func (h webhookRegistrar) Drain(ctx context.Context, node DiscoveryNode) error {
+	return h.send(ctx, "drain", node)
+}
+
+func (h webhookRegistrar) Deregister(ctx context.Context, node DiscoveryNode) error {
+	return h.send(ctx, "deregister", node)
+}
+
+// discoveryRetryDelay is how long to wait before trying to register again
+const discoveryRetryDelay = 10 * time.Second
+
+// serve runs the server until SIGINT or SIGTERM arrives on stop, then
+// drains: the status endpoint starts failing health checks, the instance is
+// taken out of service discovery, and after DISCOVERY_DRAIN in-flight
+// requests get a few more seconds to finish before the server stops.
+func (app *App) serve(listener net.Listener, stop <-chan os.Signal) error {
+	registrar, err := newRegistrar(app.Config)
+	if err != nil {
+		return fmt.Errorf("failed to configure discovery: %w", err)
+	}
+	var node DiscoveryNode
+	if registrar != nil {
+		if node, err = discoveryNode(app.Config); err != nil {
+			return err
+		}
+	}
+
+	srv := &http.Server{Handler: app.Handler()}
+	served := make(chan error, 3)
+	var challenges *http.Server
+	var h3 *http3.Server
+	if app.certs != nil {
+		srv.TLSConfig = app.certs.TLSConfig()
+		// HTTP/3 shares the handler, and HTTPS tells browsers about it
+		if h3 = newHTTP3Server(app.Config, srv.TLSConfig, srv.Handler); h3 != nil {
+			srv.Handler = advertiseHTTP3(h3, srv.Handler)
+			go func() {
+				if err := h3.ListenAndServe(); err != http.ErrServerClosed {
+					served <- fmt.Errorf("failed to serve HTTP/3: %w", err)
+				}
+			}()
+		}
+		go func() {
+			served <- srv.ServeTLS(listener, "", "")
+		}()
+
+		// Plain HTTP is only for the CA's challenges, and redirects
+		// everything else to HTTPS
+		challenges = &http.Server{Addr: ":" + strconv.Itoa(app.Config.HTTPPort), Handler: app.certs.HTTPHandler(nil)}
+		go func() {
+			if err := challenges.ListenAndServe(); err != http.ErrServerClosed {
+				served <- fmt.Errorf("failed to serve ACME challenges: %w", err)
+			}
+		}()
+	} else {
+		go func() {
+			served <- srv.Serve(listener)
+		}()
+	}
+
+	// Register in the background, retrying until the directory answers.
+	// Serving without being registered is better than not serving.
+	registerCtx, stopRegistering := context.WithCancel(context.Background())
+	defer stopRegistering()
+	registerDone := make(chan bool, 1)
+	if registrar != nil {
+		go func() {
+			for {
+				ctx, cancel := context.WithTimeout(registerCtx, 30*time.Second)
+				err := registrar.Register(ctx, node)
+				cancel()
+				if err == nil {
+					slog.Info("Registered with service discovery", "discovery", app.Config.Discovery, "id", node.ID)
+					registerDone <- true
+					return
+				}
+				slog.Error("Failed to register with service discovery", "discovery", app.Config.Discovery, "error", err)
+				select {
+				case <-registerCtx.Done():
+					registerDone <- false
+					return
+				case <-time.After(discoveryRetryDelay):
+				}
+			}
+		}()
+	}
+
+	select {
+	case err := <-served:
+		return err
+	case sig := <-stop:
+		slog.Info("Shutting down", "signal", sig.String())
+	}
+
+	app.draining.Store(true)
+	registered := false
+	if registrar != nil {
+		stopRegistering()
+		registered = <-registerDone
+	}
+	if registered {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := registrar.Drain(ctx, node); err != nil {
+			slog.Error("Failed to drain from service discovery", "error", err)
+		}
+		cancel()
+		// Give load balancers and resolvers time to notice
+		time.Sleep(app.Config.DiscoveryDrain)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if err := srv.Shutdown(ctx); err != nil {
+		// Long-lived event streams don't finish on their own
+		srv.Close()
+	}
+	if challenges != nil {
+		challenges.Shutdown(ctx)
+	}
+	if h3 != nil {
+		h3.Shutdown(ctx)
+	}
+	cancel()
+
+	// Views from the last second of requests are still buffered
+	ctx, cancel = context.WithTimeout(context.Background(), queryTimeout)
+	if err := app.FlushPageViews(ctx); err != nil {
+		slog.Error("Failed to save page views", "error", err)
+	}
+	cancel()
+
+	if registered {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := registrar.Deregister(ctx, node); err != nil {
+			slog.Error("Failed to deregister from service discovery", "error", err)
+		} else {
+			slog.Info("Deregistered from service discovery", "id", node.ID)
+		}
+	}
+	return nil
+}
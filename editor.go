@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// EditorPage holds data for the post editor template
+type EditorPage struct {
+	Meta    PageMeta
+	IsNew   bool
+	Slug    string
+	Source  string
+	Preview *Post
+	Error   string
+	// Uploaded is the image uploaded with the "upload" action
+	Uploaded *ResponsiveImage
+	// Targets are the platforms the post can be cross-posted to
+	Targets []SyndicationTarget
+}
+
+// newPostTemplate is the starting point for a new post
+func newPostTemplate() string {
+	return fmt.Sprintf("---\ntitle: Untitled\ndate: %s\ndescription: \n---\n\n", time.Now().Format(time.DateOnly))
+}
+
+// handleEditor serves /admin/posts/new and /admin/posts/{slug}/edit. Callers
+// must wrap it with RequireRole(RoleAdmin, ...).
+func (app *App) handleEditor(w http.ResponseWriter, r *http.Request, count int, user *User) error {
+	page := EditorPage{
+		Meta: PageMeta{
+			Title: "New Post",
+			Count: count,
+			User:  user,
+
+			CSRFToken: csrfToken(r),
+		},
+		IsNew:   r.URL.Path == "/admin/posts/new",
+		Targets: syndicationTargets(app.Config),
+	}
+	// Posts are edited on the site the editor is visited on
+	site := app.siteFor(r)
+
+	// name is the post's file name without the extension, which is also its
+	// slug unless the frontmatter sets one
+	var name string
+	if !page.IsNew {
+		page.Slug = strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/admin/posts/"), "/edit")
+		post, ok := site.Blog().PostBySlug(page.Slug)
+		if !ok {
+			return NewHTTPError(fmt.Errorf("post not found: %s", page.Slug), http.StatusNotFound)
+		}
+		page.Meta.Title = "Edit " + post.Title
+		name = strings.TrimSuffix(filepath.Base(post.FileName), ".md")
+
+		source, err := os.ReadFile(post.FileName)
+		if err != nil {
+			return fmt.Errorf("failed to read post: %w", err)
+		}
+		page.Source = string(source)
+	}
+
+	if r.Method == http.MethodPost {
+		if page.IsNew {
+			page.Slug = strings.TrimSpace(r.FormValue("slug"))
+			name = page.Slug
+		}
+		// Browsers submit textareas with CRLF line endings
+		page.Source = strings.ReplaceAll(r.FormValue("source"), "\r\n", "\n")
+
+		// An uploaded image is added to the end of the post, and the post is
+		// previewed with it
+		if r.FormValue("action") == "upload" {
+			img, err := uploadImage(r, "image")
+			if err != nil {
+				page.Error = err.Error()
+				w.Header().Set("Content-Type", "text/html")
+				if err := app.render(w, r, http.StatusOK, "editor.html", page); err != nil {
+					return fmt.Errorf("failed to render editor: %w", err)
+				}
+				return nil
+			}
+			slog.InfoContext(r.Context(), "Image uploaded", "url", img.URL, "variants", len(img.Variants), "user_id", user.ID)
+			app.publishMedia()
+			app.reloadAfterUpload(r.Context())
+			page.Uploaded = &img
+			page.Source = strings.TrimRight(page.Source, "\n") + "\n\n" + img.Markdown + "\n"
+		}
+
+		post, err := app.parsePost(r.Context(), []byte(page.Source), filepath.Join(site.PostsDir, name+".md"))
+		if err != nil {
+			page.Error = err.Error()
+		} else if other, ok := site.Blog().PostBySlug(post.Slug); ok && other.FileName != post.FileName {
+			page.Error = fmt.Sprintf("the slug %q is already used by %s", post.Slug, filepath.Base(other.FileName))
+		} else if r.FormValue("action") == "save" {
+			if err := app.savePost(r.Context(), site, name, page.Source, page.IsNew); err != nil {
+				page.Error = err.Error()
+			} else {
+				slog.InfoContext(r.Context(), "Post saved", "slug", post.Slug, "user_id", user.ID)
+				app.publishMedia()
+				err := app.Publish(r.Context(), topicPostSaved, PostSavedEvent{
+					Slug:      post.Slug,
+					URL:       baseURL(r) + "/blog/" + post.Slug,
+					Syndicate: r.Form["syndicate"],
+				})
+				if err != nil {
+					return err
+				}
+				http.Redirect(w, r, "/blog/"+post.Slug, http.StatusSeeOther)
+				return nil
+			}
+		} else {
+			page.Preview = &post
+		}
+	} else if page.IsNew {
+		page.Source = newPostTemplate()
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := app.render(w, r, http.StatusOK, "editor.html", page); err != nil {
+		return fmt.Errorf("failed to render editor: %w", err)
+	}
+	return nil
+}
+
+// savePost writes a post to the site's posts directory and reloads its
+// posts. The name is the file name without its extension. The file is
+// written to a temporary name first so a failed write never leaves a
+// truncated post behind.
+func (app *App) savePost(ctx context.Context, site *Site, name, source string, isNew bool) error {
+	if !slugPattern.MatchString(name) {
+		return fmt.Errorf("slug must be lowercase letters, numbers and dashes")
+	}
+
+	path := filepath.Join(site.PostsDir, name+".md")
+	if isNew {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("a post with the slug %q already exists", name)
+		}
+	}
+
+	tmp, err := os.CreateTemp(site.PostsDir, ".tmp-"+name+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(source); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write post: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write post: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to set post permissions: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to save post: %w", err)
+	}
+
+	return app.ReloadSite(ctx, site)
+}
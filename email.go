@@ -1,17 +1,436 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
 	"net/smtp"
-	"os"
+	"net/textproto"
+	"net/url"
 	"strings"
+	"time"
 )
 
-func sendMail(to string, subject string, body string) error {
-	smtpServer := os.Getenv("SMTP_HOST")
-	fromEmail := os.Getenv("SMTP_EMAIL")
-	password := os.Getenv("SMTP_PASSWORD")
-	host, _, _ := strings.Cut(smtpServer, ":")
+// Mail is an email to send. At least one of Text and HTML must be set, and
+// clients show the HTML when there are both.
+type Mail struct {
+	To      string
+	ReplyTo string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer delivers email through a provider
+type Mailer interface {
+	// Send delivers a message. Failures the provider reports are returned
+	// as a *MailError.
+	Send(msg Mail) error
+}
+
+// MailError is a message the provider failed to deliver
+type MailError struct {
+	Provider string
+	// Permanent is set when the provider rejected the recipient, so trying
+	// again won't help
+	Permanent bool
+	Err       error
+}
+
+func (e *MailError) Error() string { return e.Provider + ": " + e.Err.Error() }
+func (e *MailError) Unwrap() error { return e.Err }
+
+// isPermanentMailError reports whether err means the address can't be
+// mailed, as opposed to a failure that might go away
+func isPermanentMailError(err error) bool {
+	var mailErr *MailError
+	return errors.As(err, &mailErr) && mailErr.Permanent
+}
+
+// errMailNotConfigured is returned when no mail provider is set up
+var errMailNotConfigured = errors.New("email is not configured")
+
+// mailClient is used by the HTTP API mailers
+var mailClient = &http.Client{Timeout: 15 * time.Second}
+
+// newMailer picks the provider from MAIL_PROVIDER: "smtp" (the default),
+// "ses", "mailgun" or "postmark". Mail is sent from MAIL_FROM, like
+// "Tulip <hello@example.com>", or SMTP_EMAIL for older configs. It returns
+// nil if SMTP is the provider and SMTP_HOST isn't set. In development email
+// is captured by devMailer unless MAIL_PROVIDER is set.
+func newMailer(cfg Config) (Mailer, error) {
+	provider := cfg.MailProvider
+	dev := provider == "" && cfg.isDevelopment()
+	if !dev && (provider == "" || provider == "smtp") && cfg.SMTPHost == "" {
+		return nil, nil
+	}
+
+	rawFrom := cfg.MailFrom
+	if rawFrom == "" {
+		rawFrom = cfg.SMTPEmail
+	}
+	if rawFrom == "" && dev {
+		rawFrom = "Tulip <tulip@localhost>"
+	}
+	if rawFrom == "" {
+		return nil, fmt.Errorf("MAIL_FROM must be set to the address email is sent from")
+	}
+	fromAddr, err := mail.ParseAddress(rawFrom)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAIL_FROM %q: %w", rawFrom, err)
+	}
+	from := fromAddr.String()
+	if cfg.MailReplyTo != "" {
+		if _, err := mail.ParseAddress(cfg.MailReplyTo); err != nil {
+			return nil, fmt.Errorf("invalid MAIL_REPLY_TO %q: %w", cfg.MailReplyTo, err)
+		}
+	}
+
+	if dev {
+		return &devMailer{from: fromAddr}, nil
+	}
+
+	switch provider {
+	case "", "smtp":
+		host, _, err := net.SplitHostPort(cfg.SMTPHost)
+		if err != nil {
+			return nil, fmt.Errorf("SMTP_HOST must include the port, like smtp.example.com:587")
+		}
+		if cfg.SMTPPassword == "" {
+			return nil, fmt.Errorf("SMTP_PASSWORD must be set when SMTP_HOST is")
+		}
+		username := cfg.SMTPEmail
+		if username == "" {
+			username = fromAddr.Address
+		}
+		return smtpMailer{
+			addr: cfg.SMTPHost,
+			from: fromAddr,
+			auth: smtp.PlainAuth("", username, cfg.SMTPPassword, host),
+		}, nil
+	case "ses":
+		creds, err := cfg.awsCredentials()
+		if err != nil {
+			return nil, err
+		}
+		region := cfg.AWSRegion
+		if region == "" {
+			return nil, fmt.Errorf("AWS_REGION must be set for SES")
+		}
+		endpoint := cfg.SESEndpoint
+		if endpoint == "" {
+			endpoint = "https://email." + region + ".amazonaws.com"
+		}
+		return sesMailer{from: from, region: region, endpoint: strings.TrimSuffix(endpoint, "/"), creds: creds}, nil
+	case "mailgun":
+		if cfg.MailgunAPIKey == "" || cfg.MailgunDomain == "" {
+			return nil, fmt.Errorf("MAILGUN_API_KEY and MAILGUN_DOMAIN must be set")
+		}
+		// EU domains use https://api.eu.mailgun.net
+		endpoint := strings.TrimSuffix(cfg.MailgunAPIURL, "/")
+		return mailgunMailer{from: from, domain: cfg.MailgunDomain, key: cfg.MailgunAPIKey, endpoint: endpoint}, nil
+	case "postmark":
+		if cfg.PostmarkServerToken == "" {
+			return nil, fmt.Errorf("POSTMARK_SERVER_TOKEN must be set")
+		}
+		endpoint := strings.TrimSuffix(cfg.PostmarkAPIURL, "/")
+		return postmarkMailer{from: from, token: cfg.PostmarkServerToken, endpoint: endpoint}, nil
+	default:
+		return nil, fmt.Errorf("unknown MAIL_PROVIDER %q", provider)
+	}
+}
+
+// renderMail builds a message from the email_<name>.html and
+// email_<name>.txt templates
+func (app *App) renderMail(to, subject, name string, data any) (Mail, error) {
+	pages, texts, err := app.templates(app.defaultSite())
+	if err != nil {
+		return Mail{}, err
+	}
+	var html, text bytes.Buffer
+	if err := pages.ExecuteTemplate(&html, "email_"+name+".html", data); err != nil {
+		return Mail{}, fmt.Errorf("failed to render %s email: %w", name, err)
+	}
+	if err := texts.ExecuteTemplate(&text, "email_"+name+".txt", data); err != nil {
+		return Mail{}, fmt.Errorf("failed to render %s email: %w", name, err)
+	}
+	return Mail{To: to, Subject: subject, HTML: html.String(), Text: text.String()}, nil
+}
+
+// sendMessage sends a message with the configured mailer. Replies go to
+// MAIL_REPLY_TO unless the message says otherwise.
+func (app *App) sendMessage(ctx context.Context, msg Mail) error {
+	if app.Mailer == nil {
+		return errMailNotConfigured
+	}
+	if msg.ReplyTo == "" {
+		msg.ReplyTo = app.Config.MailReplyTo
+	}
+	_, span := startSpan(ctx, "send email", spanClient)
+	err := app.Mailer.Send(msg)
+	span.SetError(err)
+	span.End()
+	return err
+}
+
+// smtpMailer sends through an SMTP server
+type smtpMailer struct {
+	addr string
+	from *mail.Address
+	auth smtp.Auth
+}
+
+func (m smtpMailer) Send(msg Mail) error {
+	data, err := buildMIMEMessage(m.from, msg, time.Now())
+	if err != nil {
+		return err
+	}
+
+	err = smtp.SendMail(m.addr, m.auth, m.from.Address, []string{msg.To}, data)
+	if err == nil {
+		return nil
+	}
+	// 501, 550, 551 and 553 are the server refusing the address. Other
+	// errors, like 4xx replies or failed logins, aren't about the recipient.
+	var protoErr *textproto.Error
+	permanent := errors.As(err, &protoErr) &&
+		(protoErr.Code == 501 || protoErr.Code == 550 || protoErr.Code == 551 || protoErr.Code == 553)
+	return &MailError{Provider: "smtp", Permanent: permanent, Err: err}
+}
+
+// buildMIMEMessage encodes msg for SMTP. A message with both text and HTML
+// is sent as multipart/alternative with the text first, so clients that
+// can show HTML pick it.
+func buildMIMEMessage(from *mail.Address, msg Mail, now time.Time) ([]byte, error) {
+	id, err := generateRandomToken(16)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate message id: %w", err)
+	}
+	_, domain, _ := strings.Cut(from.Address, "@")
+
+	var buf bytes.Buffer
+	header := func(name, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", name, value)
+	}
+	header("From", from.String())
+	header("To", msg.To)
+	if msg.ReplyTo != "" {
+		header("Reply-To", msg.ReplyTo)
+	}
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Date", now.Format(time.RFC1123Z))
+	header("Message-ID", "<"+id+"@"+domain+">")
+	header("MIME-Version", "1.0")
+
+	type part struct{ contentType, body string }
+	var parts []part
+	if msg.Text != "" {
+		parts = append(parts, part{"text/plain; charset=UTF-8", msg.Text})
+	}
+	if msg.HTML != "" {
+		parts = append(parts, part{"text/html; charset=UTF-8", msg.HTML})
+	}
+
+	if len(parts) == 1 {
+		header("Content-Type", parts[0].contentType)
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		if err := writeQuotedPrintable(&buf, parts[0].body); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(&buf)
+	header("Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": mw.Boundary()}))
+	buf.WriteString("\r\n")
+	for _, p := range parts {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to write message part: %w", err)
+		}
+		if err := writeQuotedPrintable(w, p.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write message: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// writeQuotedPrintable encodes body with CRLF line endings
+func writeQuotedPrintable(w io.Writer, body string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := io.WriteString(qp, strings.ReplaceAll(body, "\n", "\r\n")); err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+	if err := qp.Close(); err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+	return nil
+}
+
+// sesMailer sends with the Amazon SES v2 API
+type sesMailer struct {
+	from     string
+	region   string
+	endpoint string
+	creds    awsCredentials
+}
+
+func (m sesMailer) Send(msg Mail) error {
+	body := map[string]any{}
+	if msg.Text != "" {
+		body["Text"] = map[string]string{"Data": msg.Text, "Charset": "UTF-8"}
+	}
+	if msg.HTML != "" {
+		body["Html"] = map[string]string{"Data": msg.HTML, "Charset": "UTF-8"}
+	}
+	payload, err := json.Marshal(map[string]any{
+		"FromEmailAddress": m.from,
+		"Destination":      map[string]any{"ToAddresses": []string{msg.To}},
+		"ReplyToAddresses": replyToList(msg.ReplyTo),
+		"Content": map[string]any{
+			"Simple": map[string]any{
+				"Subject": map[string]string{"Data": msg.Subject, "Charset": "UTF-8"},
+				"Body":    body,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode email: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, m.endpoint+"/v2/email/outbound-emails", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signAWSRequest(req, payload, "ses", m.region, m.creds, time.Now())
+
+	return doMailRequest("ses", req, func(resp *http.Response, body []byte) bool {
+		// Invalid and suppressed addresses are rejected with these types.
+		// Throttling and paused sending use others.
+		errorType, _, _ := strings.Cut(resp.Header.Get("X-Amzn-Errortype"), ":")
+		return errorType == "MessageRejected" || errorType == "BadRequestException"
+	})
+}
+
+// replyToList returns the reply-to address as a list for SES, which
+// rejects an empty address
+func replyToList(replyTo string) []string {
+	if replyTo == "" {
+		return []string{}
+	}
+	return []string{replyTo}
+}
+
+// mailgunMailer sends with the Mailgun messages API
+type mailgunMailer struct {
+	from     string
+	domain   string
+	key      string
+	endpoint string
+}
+
+func (m mailgunMailer) Send(msg Mail) error {
+	form := url.Values{
+		"from":    {m.from},
+		"to":      {msg.To},
+		"subject": {msg.Subject},
+	}
+	if msg.Text != "" {
+		form.Set("text", msg.Text)
+	}
+	if msg.HTML != "" {
+		form.Set("html", msg.HTML)
+	}
+	if msg.ReplyTo != "" {
+		form.Set("h:Reply-To", msg.ReplyTo)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, m.endpoint+"/v3/"+url.PathEscape(m.domain)+"/messages", strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("api", m.key)
+
+	return doMailRequest("mailgun", req, func(resp *http.Response, body []byte) bool {
+		// Mailgun answers 400 for a bad parameter, like an invalid address
+		return resp.StatusCode == http.StatusBadRequest
+	})
+}
+
+// postmarkMailer sends with the Postmark email API
+type postmarkMailer struct {
+	from     string
+	token    string
+	endpoint string
+}
+
+func (m postmarkMailer) Send(msg Mail) error {
+	payload, err := json.Marshal(struct {
+		From          string
+		To            string
+		ReplyTo       string `json:",omitempty"`
+		Subject       string
+		TextBody      string `json:",omitempty"`
+		HtmlBody      string `json:",omitempty"`
+		MessageStream string
+	}{m.from, msg.To, msg.ReplyTo, msg.Subject, msg.Text, msg.HTML, "outbound"})
+	if err != nil {
+		return fmt.Errorf("failed to encode email: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, m.endpoint+"/email", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Postmark-Server-Token", m.token)
+
+	return doMailRequest("postmark", req, func(resp *http.Response, body []byte) bool {
+		// Error code 300 is an invalid address and 406 an inactive
+		// (bounced or unsubscribed) recipient
+		var result struct{ ErrorCode int }
+		if resp.StatusCode != http.StatusUnprocessableEntity || json.Unmarshal(body, &result) != nil {
+			return false
+		}
+		return result.ErrorCode == 300 || result.ErrorCode == 406
+	})
+}
 
-	return smtp.SendMail(smtpServer, smtp.PlainAuth("", fromEmail, password, host), fromEmail, []string{to}, []byte(fmt.Sprintf("Subject: %s\r\n%s\r\n", subject, body)))
+// doMailRequest sends a request to a mail API. Unsuccessful responses
+// become a *MailError, and permanent decides if the failure was the
+// recipient's fault.
+func doMailRequest(provider string, req *http.Request, permanent func(resp *http.Response, body []byte) bool) error {
+	resp, err := mailClient.Do(req)
+	if err != nil {
+		return &MailError{Provider: provider, Err: err}
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+	return &MailError{
+		Provider:  provider,
+		Permanent: permanent(resp, body),
+		Err:       fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body))),
+	}
 }
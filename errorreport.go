@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errorReportBufferSize is how many reports can wait to be sent before new
+// ones are dropped
+const errorReportBufferSize = 64
+
+// ErrorReport is a server error or panic to send to an error tracker.
+// Everything in it has been through scrubErrorText.
+type ErrorReport struct {
+	At        time.Time
+	RequestID string
+	Method    string
+	// URL is the page's scheme, host and path, without the query
+	URL       string
+	Host      string
+	Path      string
+	Query     string
+	UserAgent string
+	Status    int
+	// UserID is the signed in user, or 0
+	UserID int64
+	// Type is the innermost error's Go type, or "panic"
+	Type    string
+	Message string
+	// Stack is the goroutine's stack, for panics
+	Stack string
+	Panic bool
+}
+
+// ErrorReporter sends error reports to an error tracker
+type ErrorReporter interface {
+	Report(ctx context.Context, report ErrorReport) error
+}
+
+// newErrorReporter picks the error tracker from ERROR_REPORTING: "sentry"
+// or "otlp". It returns nil if ERROR_REPORTING isn't set.
+func newErrorReporter(cfg Config) (ErrorReporter, error) {
+	switch cfg.ErrorReporting {
+	case "":
+		return nil, nil
+	case "sentry":
+		return newSentryReporter(cfg)
+	case "otlp":
+		return newOTLPReporter(cfg)
+	default:
+		return nil, fmt.Errorf("unknown ERROR_REPORTING %q, expected sentry or otlp", cfg.ErrorReporting)
+	}
+}
+
+// errorReportClient sends reports to the error tracker and to
+// ERROR_WEBHOOK_URL
+var errorReportClient = &http.Client{Timeout: 10 * time.Second}
+
+// StartErrorReporter sends reports queued by reportError in the
+// background, if ERROR_REPORTING is set
+func (app *App) StartErrorReporter() error {
+	reporter, err := newErrorReporter(app.Config)
+	if err != nil || reporter == nil {
+		return err
+	}
+	app.errorReports = make(chan ErrorReport, errorReportBufferSize)
+	go func() {
+		for report := range app.errorReports {
+			ctx, cancel := context.WithTimeout(context.Background(), errorReportClient.Timeout)
+			if err := reporter.Report(ctx, report); err != nil {
+				slog.Error("Failed to report error", "error", err, "request_id", report.RequestID)
+			}
+			cancel()
+		}
+	}()
+	return nil
+}
+
+// reportError queues a server error for the error tracker. Every panic is
+// reported, and ERROR_SAMPLE_PERCENT of other errors. If the queue is full
+// the report is dropped, since it's already in the logs.
+func (app *App) reportError(r *http.Request, err error, statusCode int) {
+	if app.errorReports == nil || statusCode < http.StatusInternalServerError {
+		return
+	}
+	var panicked *panicError
+	isPanic := errors.As(err, &panicked)
+	if !isPanic && mathrand.IntN(100) >= app.Config.ErrorSamplePercent {
+		return
+	}
+
+	report := ErrorReport{
+		At:        time.Now().UTC(),
+		RequestID: RequestID(r.Context()),
+		Method:    r.Method,
+		URL:       baseURL(r) + scrubErrorText(r.URL.Path),
+		Host:      r.Host,
+		Path:      scrubErrorText(r.URL.Path),
+		Query:     scrubQuery(r.URL.Query()),
+		UserAgent: r.UserAgent(),
+		Status:    statusCode,
+		Message:   scrubErrorText(err.Error()),
+		Panic:     isPanic,
+	}
+	if user, err := app.getCurrentUser(r); err == nil {
+		report.UserID = user.ID
+	}
+	if isPanic {
+		report.Type = "panic"
+		report.Stack = string(panicked.Stack)
+	} else {
+		inner := err
+		for next := errors.Unwrap(inner); next != nil; next = errors.Unwrap(inner) {
+			inner = next
+		}
+		report.Type = fmt.Sprintf("%T", inner)
+	}
+
+	select {
+	case app.errorReports <- report:
+	default:
+		slog.Warn("Error report buffer full, dropping report", "request_id", report.RequestID)
+	}
+}
+
+// scrubPatterns match what's taken out of reports before they leave the
+// server: email addresses, API tokens, bearer credentials, and anything
+// long and random enough to be a session, magic link or reset token
+var scrubPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`),
+	regexp.MustCompile(regexp.QuoteMeta(apiTokenPrefix) + `[A-Za-z0-9]+`),
+	regexp.MustCompile(`(?i)bearer\s+\S+`),
+	regexp.MustCompile(`[A-Za-z0-9_\-]{32,}`),
+}
+
+// scrubErrorText replaces the personal data and secrets in s with
+// [redacted]
+func scrubErrorText(s string) string {
+	for _, re := range scrubPatterns {
+		s = re.ReplaceAllString(s, "[redacted]")
+	}
+	return s
+}
+
+// scrubQueryKeys are query parameters whose values are always redacted
+var scrubQueryKeys = []string{"token", "code", "key", "secret", "password", "state", "email"}
+
+// scrubQuery encodes a query string for a report, with the values of
+// scrubQueryKeys and anything scrubErrorText catches redacted
+func scrubQuery(q url.Values) string {
+	for key, values := range q {
+		for i, v := range values {
+			if slices.Contains(scrubQueryKeys, strings.ToLower(key)) {
+				values[i] = "[redacted]"
+			} else {
+				values[i] = scrubErrorText(v)
+			}
+		}
+	}
+	return q.Encode()
+}
+
+// stackFrame is one call in a goroutine's stack
+type stackFrame struct {
+	Function string
+	File     string
+	Line     int
+}
+
+// parseStack reads the frames from a stack printed by debug.Stack, innermost
+// first
+func parseStack(stack string) []stackFrame {
+	lines := strings.Split(strings.TrimSpace(stack), "\n")
+	var frames []stackFrame
+	// The first line is the goroutine, then each call is a line with the
+	// function and an indented line with where it is
+	for i := 1; i+1 < len(lines); i += 2 {
+		fn := strings.TrimPrefix(lines[i], "created by ")
+		if open := strings.LastIndex(fn, "("); open > 0 {
+			fn = fn[:open]
+		}
+		fn, _, _ = strings.Cut(fn, " in goroutine ")
+
+		loc, _, _ := strings.Cut(strings.TrimSpace(lines[i+1]), " +0x")
+		frame := stackFrame{Function: fn, File: loc}
+		if colon := strings.LastIndex(loc, ":"); colon >= 0 {
+			frame.File = loc[:colon]
+			frame.Line, _ = strconv.Atoi(loc[colon+1:])
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// postErrorReport POSTs a report body and checks for a 2xx response
+func postErrorReport(ctx context.Context, name, endpoint string, header http.Header, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := errorReportClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned %s: %s", name, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// sentryReporter sends reports to Sentry's envelope endpoint, from the
+// project's DSN
+type sentryReporter struct {
+	dsn         string
+	endpoint    string
+	auth        string
+	environment string
+	serverName  string
+}
+
+func newSentryReporter(cfg Config) (*sentryReporter, error) {
+	u, err := url.Parse(cfg.SentryDSN)
+	if err != nil || u.Scheme == "" || u.Host == "" || u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("SENTRY_DSN must be set to the project's DSN for sentry error reporting")
+	}
+	prefix, projectID := "", strings.Trim(u.Path, "/")
+	if slash := strings.LastIndex(projectID, "/"); slash >= 0 {
+		prefix, projectID = "/"+projectID[:slash], projectID[slash+1:]
+	}
+	if projectID == "" {
+		return nil, fmt.Errorf("SENTRY_DSN has no project ID")
+	}
+
+	auth := "Sentry sentry_version=7, sentry_client=tulip/1.0, sentry_key=" + u.User.Username()
+	if secret, ok := u.User.Password(); ok {
+		auth += ", sentry_secret=" + secret
+	}
+	environment := cfg.Env
+	if environment == "" {
+		environment = "production"
+	}
+	hostname, _ := os.Hostname()
+	return &sentryReporter{
+		dsn:         cfg.SentryDSN,
+		endpoint:    fmt.Sprintf("%s://%s%s/api/%s/envelope/", u.Scheme, u.Host, prefix, projectID),
+		auth:        auth,
+		environment: environment,
+		serverName:  hostname,
+	}, nil
+}
+
+// sentryFrame is a stack frame in Sentry's event format
+type sentryFrame struct {
+	Function string `json:"function"`
+	AbsPath  string `json:"abs_path,omitempty"`
+	Lineno   int    `json:"lineno,omitempty"`
+	InApp    bool   `json:"in_app"`
+}
+
+func (s *sentryReporter) Report(ctx context.Context, report ErrorReport) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Errorf("failed to generate event id: %w", err)
+	}
+	eventID := hex.EncodeToString(id)
+
+	exception := map[string]any{
+		"type":      report.Type,
+		"value":     report.Message,
+		"mechanism": map[string]any{"type": "generic", "handled": !report.Panic},
+	}
+	level := "error"
+	if report.Panic {
+		level = "fatal"
+		exception["mechanism"] = map[string]any{"type": "panic", "handled": false}
+		// The innermost calls are the recovery's own, down to the panic
+		stack := parseStack(report.Stack)
+		if i := slices.IndexFunc(stack, func(f stackFrame) bool { return f.Function == "panic" }); i >= 0 {
+			stack = stack[i+1:]
+		}
+		// Sentry wants the outermost call first
+		var frames []sentryFrame
+		for _, f := range slices.Backward(stack) {
+			frames = append(frames, sentryFrame{
+				Function: f.Function,
+				AbsPath:  f.File,
+				Lineno:   f.Line,
+				InApp:    strings.HasPrefix(f.Function, "main."),
+			})
+		}
+		exception["stacktrace"] = map[string]any{"frames": frames}
+	}
+
+	event := map[string]any{
+		"event_id":    eventID,
+		"timestamp":   report.At.Format(time.RFC3339Nano),
+		"platform":    "go",
+		"level":       level,
+		"logger":      "tulip",
+		"server_name": s.serverName,
+		"environment": s.environment,
+		"transaction": report.Method + " " + report.Path,
+		"exception":   map[string]any{"values": []any{exception}},
+		"request": map[string]any{
+			"method":       report.Method,
+			"url":          report.URL,
+			"query_string": report.Query,
+			"headers":      map[string]string{"User-Agent": report.UserAgent},
+		},
+		"tags": map[string]string{
+			"request_id": report.RequestID,
+			"status":     strconv.Itoa(report.Status),
+		},
+	}
+	if report.UserID != 0 {
+		event["user"] = map[string]string{"id": strconv.FormatInt(report.UserID, 10)}
+	}
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, part := range []any{
+		map[string]any{"event_id": eventID, "sent_at": time.Now().UTC().Format(time.RFC3339Nano), "dsn": s.dsn},
+		map[string]string{"type": "event"},
+		event,
+	} {
+		if err := enc.Encode(part); err != nil {
+			return fmt.Errorf("failed to encode sentry event: %w", err)
+		}
+	}
+	header := http.Header{
+		"Content-Type":  {"application/x-sentry-envelope"},
+		"X-Sentry-Auth": {s.auth},
+	}
+	return postErrorReport(ctx, "sentry", s.endpoint, header, body.Bytes())
+}
+
+// otlpReporter sends reports as OpenTelemetry log records, with the
+// exception semantic conventions, to an OTLP/HTTP collector
+type otlpReporter struct {
+	endpoint string
+	header   http.Header
+	service  string
+}
+
+// otlpHeaders parses OTEL_EXPORTER_OTLP_HEADERS, a comma separated list of
+// key=value pairs with URL encoded values
+func otlpHeaders(cfg Config) (http.Header, error) {
+	header := http.Header{"Content-Type": {"application/json"}}
+	for _, pair := range strings.Split(cfg.OTLPHeaders, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS entry, expected key=value")
+		}
+		value, err := url.QueryUnescape(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS value for %s", strings.TrimSpace(key))
+		}
+		header.Set(strings.TrimSpace(key), value)
+	}
+	return header, nil
+}
+
+func newOTLPReporter(cfg Config) (*otlpReporter, error) {
+	u, err := url.Parse(cfg.OTLPEndpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_ENDPOINT must be set to the collector's URL for otlp error reporting")
+	}
+	header, err := otlpHeaders(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &otlpReporter{
+		endpoint: strings.TrimSuffix(cfg.OTLPEndpoint, "/") + "/v1/logs",
+		header:   header,
+		service:  cfg.OTelServiceName,
+	}, nil
+}
+
+// otlpAttribute is a key and value in OTLP's JSON encoding
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+func otlpString(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: map[string]any{"stringValue": value}}
+}
+
+func otlpInt(key string, value int64) otlpAttribute {
+	// 64 bit integers are strings in OTLP's JSON
+	return otlpAttribute{Key: key, Value: map[string]any{"intValue": strconv.FormatInt(value, 10)}}
+}
+
+func (o *otlpReporter) Report(ctx context.Context, report ErrorReport) error {
+	severity, severityText := 17, "ERROR"
+	if report.Panic {
+		severity, severityText = 21, "FATAL"
+	}
+	attributes := []otlpAttribute{
+		otlpString("exception.type", report.Type),
+		otlpString("exception.message", report.Message),
+		otlpString("http.request.method", report.Method),
+		otlpString("server.address", report.Host),
+		otlpString("url.path", report.Path),
+		otlpString("url.query", report.Query),
+		otlpString("user_agent.original", report.UserAgent),
+		otlpInt("http.response.status_code", int64(report.Status)),
+		otlpString("request.id", report.RequestID),
+	}
+	if report.Stack != "" {
+		attributes = append(attributes, otlpString("exception.stacktrace", report.Stack))
+	}
+	if report.UserID != 0 {
+		attributes = append(attributes, otlpInt("user.id", report.UserID))
+	}
+
+	at := strconv.FormatInt(report.At.UnixNano(), 10)
+	payload := map[string]any{
+		"resourceLogs": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpAttribute{otlpString("service.name", o.service)},
+			},
+			"scopeLogs": []any{map[string]any{
+				"scope": map[string]any{"name": "tulip"},
+				"logRecords": []any{map[string]any{
+					"timeUnixNano":         at,
+					"observedTimeUnixNano": at,
+					"severityNumber":       severity,
+					"severityText":         severityText,
+					"body":                 map[string]any{"stringValue": report.Message},
+					"attributes":           attributes,
+				}},
+			}},
+		}},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode otlp logs: %w", err)
+	}
+	return postErrorReport(ctx, "otlp collector", o.endpoint, o.header, body)
+}
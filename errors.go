@@ -1,9 +1,13 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"runtime/debug"
+	"strings"
 )
 
 // ErrorPageData contains data for the error template
@@ -13,21 +17,55 @@ type ErrorPageData struct {
 	ErrorMessage string
 	ErrorDetail  string
 	StackTrace   string
+	RequestID    string
 	Count        int
 	User         *User
+	// Suggestions are posts a visitor to a missing page may have meant
+	Suggestions []Post
 }
 
-// ErrorHandler wraps an HTTP handler function to provide detailed error handling
-func ErrorHandler(h func(http.ResponseWriter, *http.Request) error) http.HandlerFunc {
+// APIError is the envelope every JSON error is sent in
+type APIError struct {
+	Error APIErrorDetail `json:"error"`
+}
+
+// APIErrorDetail describes what went wrong. Code is a stable name for the
+// status, like "not_found", for clients to switch on.
+type APIErrorDetail struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+	// Suggestions are the URLs of posts a missing page may have meant
+	Suggestions []string `json:"suggestions,omitempty"`
+}
+
+// ErrorHandler wraps an HTTP handler function to provide detailed error
+// handling. Errors are rendered as the error page, or as JSON for the API and
+// clients that prefer it.
+func (app *App) ErrorHandler(h func(http.ResponseWriter, *http.Request) error) http.HandlerFunc {
+	return app.errorHandler(h, app.handleError)
+}
+
+// APIHandler is ErrorHandler for JSON endpoints, which always get JSON
+// errors
+func (app *App) APIHandler(h func(http.ResponseWriter, *http.Request) error) http.HandlerFunc {
+	return app.errorHandler(h, app.handleAPIError)
+}
+
+// errorHandler recovers panics and hands errors to render
+func (app *App) errorHandler(h func(http.ResponseWriter, *http.Request) error, render func(http.ResponseWriter, *http.Request, error, int)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Catch any panics
 		defer func() {
 			if rec := recover(); rec != nil {
-				err, ok := rec.(error)
-				if !ok {
-					err = fmt.Errorf("panic: %v", rec)
+				// An aborted response isn't a bug, and the server expects
+				// to see it
+				if rec == http.ErrAbortHandler {
+					panic(rec)
 				}
-				handleError(w, r, err, http.StatusInternalServerError)
+				p := &panicError{Value: rec, Stack: debug.Stack()}
+				app.reportPanic(r, p)
+				render(w, r, p, http.StatusInternalServerError)
 			}
 		}()
 
@@ -37,7 +75,7 @@ func ErrorHandler(h func(http.ResponseWriter, *http.Request) error) http.Handler
 			if httpErr, ok := err.(HTTPError); ok {
 				code = httpErr.StatusCode
 			}
-			handleError(w, r, err, code)
+			render(w, r, err, code)
 		}
 	}
 }
@@ -53,6 +91,11 @@ func (e HTTPError) Error() string {
 	return e.Err.Error()
 }
 
+// Unwrap returns the underlying error
+func (e HTTPError) Unwrap() error {
+	return e.Err
+}
+
 // NewHTTPError creates a new HTTP error
 func NewHTTPError(err error, statusCode int) HTTPError {
 	return HTTPError{
@@ -61,27 +104,89 @@ func NewHTTPError(err error, statusCode int) HTTPError {
 	}
 }
 
-// handleError renders the error page with detailed information
-func handleError(w http.ResponseWriter, r *http.Request, err error, statusCode int) {
-	ctx := r.Context()
+// wantsJSON reports whether an error should be sent as JSON: for the API
+// under /api/, or when the client asks for JSON rather than HTML
+func wantsJSON(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/api/") && r.URL.Path != "/api/docs" {
+		return true
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
 
-	// Log the error
-	slog.ErrorContext(ctx, "Error handling request",
+// logError logs a failed request, and counts server errors and sends them
+// to the error tracker
+func (app *App) logError(r *http.Request, err error, statusCode int) {
+	slog.ErrorContext(r.Context(), "Error handling request",
 		"error", err.Error(),
 		"path", r.URL.Path,
 		"method", r.Method,
 		"status", statusCode,
 	)
+	if statusCode >= http.StatusInternalServerError {
+		app.RecordServerError(r.Context(), statusCode)
+		app.reportError(r, err, statusCode)
+	}
+}
+
+// errorCode names a status for APIErrorDetail, like "not_found"
+func errorCode(statusCode int) string {
+	if statusCode == http.StatusInternalServerError {
+		return "internal_error"
+	}
+	text := http.StatusText(statusCode)
+	if text == "" {
+		return "error"
+	}
+	return strings.ReplaceAll(strings.ToLower(strings.ReplaceAll(text, "-", " ")), " ", "_")
+}
+
+// handleAPIError sends an error in the APIError envelope. Server errors get
+// a generic message, since their details are for the logs.
+func (app *App) handleAPIError(w http.ResponseWriter, r *http.Request, err error, statusCode int) {
+	app.logError(r, err, statusCode)
+
+	message := err.Error()
+	if statusCode >= http.StatusInternalServerError {
+		message = strings.ToLower(http.StatusText(statusCode))
+	}
+	detail := APIErrorDetail{
+		Code:      errorCode(statusCode),
+		Message:   message,
+		RequestID: RequestID(r.Context()),
+	}
+	var notFound *notFoundError
+	if errors.As(err, &notFound) {
+		for _, post := range notFound.Suggestions {
+			detail.Suggestions = append(detail.Suggestions, baseURL(r)+"/blog/"+post.Slug)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(APIError{Error: detail})
+}
+
+// handleError renders the error page with detailed information, or sends
+// the error as JSON to clients that want it
+func (app *App) handleError(w http.ResponseWriter, r *http.Request, err error, statusCode int) {
+	if wantsJSON(r) {
+		app.handleAPIError(w, r, err, statusCode)
+		return
+	}
+
+	ctx := r.Context()
+	app.logError(r, err, statusCode)
 
 	// Get current user if logged in
 	var user *User
-	currentUser, _ := getCurrentUser(r)
+	currentUser, _ := app.getCurrentUser(r)
 	if currentUser.ID > 0 {
 		user = &currentUser
 	}
 
 	// Get page view count
-	count, _ := IncrementCounter()
+	count := app.PageViewTotal()
 
 	// Get error details
 	errorMessage := err.Error()
@@ -97,10 +202,14 @@ func handleError(w http.ResponseWriter, r *http.Request, err error, statusCode i
 		title = "Page Not Found"
 	case http.StatusBadRequest:
 		title = "Bad Request"
+	case http.StatusMethodNotAllowed:
+		title = "Method Not Allowed"
 	case http.StatusForbidden:
 		title = "Access Denied"
 	case http.StatusUnauthorized:
 		title = "Authentication Required"
+	case http.StatusTooManyRequests:
+		title = "Too Many Requests"
 	case http.StatusInternalServerError:
 		title = "Internal Server Error"
 	default:
@@ -108,23 +217,32 @@ func handleError(w http.ResponseWriter, r *http.Request, err error, statusCode i
 	}
 
 	// Render the error page
+	var notFound *notFoundError
+	errors.As(err, &notFound)
 	data := ErrorPageData{
 		Meta: PageMeta{
 			Title: title,
+
+			CSRFToken: csrfToken(r),
 		},
 		Title:        title,
 		ErrorMessage: errorMessage,
 		ErrorDetail:  errorDetail,
+		RequestID:    RequestID(ctx),
 		Count:        count,
 		User:         user,
 	}
-
-	// Set the status code
-	w.WriteHeader(statusCode)
-	w.Header().Set("Content-Type", "text/html")
+	if notFound != nil {
+		data.Suggestions = notFound.Suggestions
+	}
+	// Stacks show the code, so only admins and developers see them
+	var panicked *panicError
+	if errors.As(err, &panicked) && (app.Config.isDevelopment() || app.adminAllowed(r, user)) {
+		data.StackTrace = string(panicked.Stack)
+	}
 
 	// Try to render the error template
-	if err := tmpl.ExecuteTemplate(w, "error.html", data); err != nil {
+	if err := app.render(w, r, statusCode, "error.html", data); err != nil {
 		// If template rendering fails, fall back to a simple error message
 		slog.ErrorContext(ctx, "Failed to render error template", "error", err)
 		http.Error(w, errorMessage, statusCode)
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Event topics
+const (
+	// topicPostSaved is published with a PostSavedEvent when a post is
+	// saved in the editor
+	topicPostSaved = "post.saved"
+	// topicAudit is published with the AuditEntry for every audit log entry
+	topicAudit = "audit"
+)
+
+// eventBatchSize is how many events a consumer handles per poll
+const eventBatchSize = 100
+
+// eventMaxAttempts is how many times a consumer tries an event before it
+// gives up and moves on, so one bad event can't hold up everything after
+// it
+const eventMaxAttempts = 5
+
+// Event is something that happened, published for consumers to act on
+type Event struct {
+	ID        int64
+	Topic     string
+	Payload   json.RawMessage
+	CreatedAt time.Time
+}
+
+// EventHandler acts on an event. Events are delivered at least once, so
+// handlers have to cope with seeing one again after a failure or restart.
+type EventHandler func(ctx context.Context, e Event) error
+
+// eventConsumer is a subscriber whose progress is kept in event_offsets
+type eventConsumer struct {
+	name    string
+	topics  []string
+	handler EventHandler
+	// attempts counts failures of the event at the consumer's offset
+	attempts int
+}
+
+// PostSavedEvent is the payload of topicPostSaved
+type PostSavedEvent struct {
+	Slug string
+	URL  string
+	// Syndicate is the targets the author asked to cross-post to
+	Syndicate []string
+}
+
+// Publish records an event. It goes through DBFrom, so an event published
+// in a transaction is only delivered if the transaction commits.
+//
+// Consumers rely on events being committed in ID order, see deliverEvents,
+// so publishing locks the events table until the transaction commits where
+// the database allows concurrent writers. Transactions that publish should
+// be short.
+func (app *App) Publish(ctx context.Context, topic string, payload any) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s event: %w", topic, err)
+	}
+	return app.InTx(ctx, func(ctx context.Context) error {
+		if lock := app.Store.LockTable("events"); lock != "" {
+			if _, err := app.DBFrom(ctx).ExecContext(ctx, lock); err != nil {
+				return fmt.Errorf("failed to lock events: %w", err)
+			}
+		}
+		_, err := app.DBFrom(ctx).ExecContext(ctx,
+			"INSERT INTO events (topic, payload, created_at) VALUES (?, ?, ?)",
+			topic, string(data), time.Now().UTC(),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to publish %s event: %w", topic, err)
+		}
+
+		afterCommit(ctx, func() {
+			select {
+			case app.eventWake <- struct{}{}:
+			default:
+			}
+		})
+		return nil
+	})
+}
+
+// Subscribe adds a consumer of the topics. Each consumer keeps its own
+// offset, so a new one starts with the events still in the table. It has
+// to be called before StartEventBus.
+func (app *App) Subscribe(name string, topics []string, handler EventHandler) {
+	app.consumers = append(app.consumers, &eventConsumer{name: name, topics: topics, handler: handler})
+}
+
+// deliverEvents hands a consumer the events after its offset, saving the
+// offset after each one is handled. It returns how many it handled.
+//
+// Offsets rely on event IDs being committed in order, or an event with a
+// lower ID could commit after the consumer moved past it and never be
+// delivered. SQLite has a single writer, and Publish locks the table on
+// databases that don't.
+func (app *App) deliverEvents(ctx context.Context, c *eventConsumer) (int, error) {
+	var offset int64
+	err := app.DB.QueryRowContext(ctx, "SELECT COALESCE(MAX(last_id), 0) FROM event_offsets WHERE consumer = ?", c.name).Scan(&offset)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query offset: %w", err)
+	}
+
+	placeholders := strings.Repeat("?, ", len(c.topics)-1) + "?"
+	args := []any{offset}
+	for _, topic := range c.topics {
+		args = append(args, topic)
+	}
+	args = append(args, eventBatchSize)
+	rows, err := app.DB.QueryContext(ctx, `
+		SELECT id, topic, payload, created_at FROM events
+		WHERE id > ? AND topic IN (`+placeholders+`)
+		ORDER BY id
+		LIMIT ?
+	`, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query events: %w", err)
+	}
+	var events []Event
+	for rows.Next() {
+		var e Event
+		var payload string
+		if err := rows.Scan(&e.ID, &e.Topic, &payload, &e.CreatedAt); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan event: %w", err)
+		}
+		e.Payload = json.RawMessage(payload)
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating events: %w", err)
+	}
+
+	for i, e := range events {
+		if err := c.handler(ctx, e); err != nil {
+			c.attempts++
+			if c.attempts < eventMaxAttempts {
+				return i, fmt.Errorf("failed to handle event %d: %w", e.ID, err)
+			}
+			slog.Error("Giving up on event", "consumer", c.name, "event_id", e.ID, "topic", e.Topic, "error", err)
+		}
+		c.attempts = 0
+
+		_, err := app.DB.ExecContext(ctx, `
+			INSERT INTO event_offsets (consumer, last_id, updated_at) VALUES (?, ?, ?)
+			ON CONFLICT (consumer) DO UPDATE SET last_id = excluded.last_id, updated_at = excluded.updated_at
+		`, c.name, e.ID, time.Now().UTC())
+		if err != nil {
+			return i, fmt.Errorf("failed to save offset: %w", err)
+		}
+	}
+	return len(events), nil
+}
+
+// StartEventBus delivers events to the subscribers in the background,
+// checking every few seconds or when woken by Publish
+func (app *App) StartEventBus() {
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			for _, c := range app.consumers {
+				for {
+					n, err := app.deliverEvents(context.Background(), c)
+					if err != nil {
+						slog.Error("Failed to deliver events", "consumer", c.name, "error", err)
+					}
+					if err != nil || n < eventBatchSize {
+						break
+					}
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-app.eventWake:
+			}
+		}
+	}()
+}
+
+// subscribeConsumers adds the app's own consumers of events
+func (app *App) subscribeConsumers() {
+	app.Subscribe("syndication", []string{topicPostSaved}, app.syndicateSavedPost)
+	app.Subscribe("notifications", []string{topicAudit}, app.notifyAccountChange)
+	app.Subscribe("webmentions", []string{topicPostSaved}, app.sendWebmentions)
+}
+
+// syndicateSavedPost queues cross-posts to the targets the author picked.
+// Posts already sent to a target are left alone, so redelivery is safe.
+func (app *App) syndicateSavedPost(ctx context.Context, e Event) error {
+	var saved PostSavedEvent
+	if err := json.Unmarshal(e.Payload, &saved); err != nil {
+		return fmt.Errorf("failed to decode event: %w", err)
+	}
+	site := app.siteForURL(saved.URL)
+	for _, target := range saved.Syndicate {
+		if _, ok := syndicationTarget(app.Config, target); !ok {
+			continue
+		}
+		if err := app.QueueSyndication(ctx, site.key(saved.Slug), target, saved.URL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AccountChangeEmail holds data for the account change email templates
+type AccountChangeEmail struct {
+	Email   string
+	Action  string
+	Detail  string
+	SiteURL string
+}
+
+// accountChangeNotices are the audited changes a user is emailed about
+// when someone else makes them. Deleted users have no one to tell.
+var accountChangeNotices = []string{"user.role", "token.create", "token.revoke", "device.register", "device.update", "device.delete"}
+
+// notifyAccountChange emails users when an admin changes their account or
+// acts on their behalf
+func (app *App) notifyAccountChange(ctx context.Context, e Event) error {
+	var entry AuditEntry
+	if err := json.Unmarshal(e.Payload, &entry); err != nil {
+		return fmt.Errorf("failed to decode event: %w", err)
+	}
+	if !entry.ActingAs() || !slices.Contains(accountChangeNotices, entry.Action) {
+		return nil
+	}
+
+	msg, err := app.renderMail(entry.UserEmail, "Your Tulip account was changed", "account_change", AccountChangeEmail{
+		Email:   entry.UserEmail,
+		Action:  entry.Action,
+		Detail:  entry.Detail,
+		SiteURL: strings.TrimSuffix(app.Config.SiteURL, "/"),
+	})
+	if err != nil {
+		return err
+	}
+	// Retrying won't help when mail isn't set up or the address was
+	// rejected, and temporary failures are already retried by the outbox
+	err = app.queueMail(ctx, msg)
+	if errors.Is(err, errMailNotConfigured) || isPermanentMailError(err) {
+		slog.WarnContext(ctx, "Failed to send account change email", "user_id", entry.UserID, "error", err)
+		return nil
+	}
+	return err
+}
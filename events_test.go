@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestDeliverEvents(t *testing.T) {
+	app := newTestApp(t)
+	ctx := context.Background()
+
+	var seen []string
+	failures := map[string]int{}
+	c := &eventConsumer{name: "test", topics: []string{"a", "b"}, handler: func(ctx context.Context, e Event) error {
+		var payload string
+		if err := json.Unmarshal(e.Payload, &payload); err != nil {
+			return err
+		}
+		if failures[payload] > 0 {
+			failures[payload]--
+			return errors.New("failed")
+		}
+		seen = append(seen, payload)
+		return nil
+	}}
+	deliver := func() {
+		t.Helper()
+		for {
+			n, err := app.deliverEvents(ctx, c)
+			if err != nil || n == 0 {
+				return
+			}
+		}
+	}
+	offset := func() int64 {
+		t.Helper()
+		var id int64
+		if err := app.DB.QueryRowContext(ctx, "SELECT last_id FROM event_offsets WHERE consumer = ?", c.name).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	publish := func(topic, payload string) {
+		t.Helper()
+		if err := app.Publish(ctx, topic, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Topics the consumer didn't subscribe to are skipped
+	publish("a", "first")
+	publish("other", "ignored")
+	publish("b", "second")
+	deliver()
+	if want := []string{"first", "second"}; !slices.Equal(seen, want) {
+		t.Fatalf("delivered %q, want %q", seen, want)
+	}
+	if got := offset(); got != 3 {
+		t.Errorf("offset %d, want 3", got)
+	}
+
+	// Delivered events aren't delivered again
+	seen = nil
+	deliver()
+	if len(seen) > 0 {
+		t.Errorf("redelivered %q", seen)
+	}
+
+	// A failing event is retried, holding up the ones after it, until it
+	// succeeds
+	seen = nil
+	failures["flaky"] = 2
+	publish("a", "flaky")
+	publish("a", "after")
+	deliver()
+	deliver()
+	if len(seen) > 0 {
+		t.Fatalf("delivered %q past a failing event", seen)
+	}
+	deliver()
+	if want := []string{"flaky", "after"}; !slices.Equal(seen, want) {
+		t.Fatalf("delivered %q, want %q", seen, want)
+	}
+
+	// An event that keeps failing is given up on after eventMaxAttempts
+	seen = nil
+	failures["broken"] = eventMaxAttempts
+	publish("a", "broken")
+	publish("a", "next")
+	for range eventMaxAttempts {
+		deliver()
+	}
+	if want := []string{"next"}; !slices.Equal(seen, want) {
+		t.Fatalf("delivered %q, want %q", seen, want)
+	}
+	if got := offset(); got != 7 {
+		t.Errorf("offset %d, want 7", got)
+	}
+
+	// Events published in a transaction that's rolled back are never
+	// delivered
+	seen = nil
+	rollback := errors.New("roll back")
+	err := app.InTx(ctx, func(ctx context.Context) error {
+		if err := app.Publish(ctx, "a", "rolled back"); err != nil {
+			return err
+		}
+		return rollback
+	})
+	if err != rollback {
+		t.Fatalf("transaction returned %v", err)
+	}
+	publish("a", "committed")
+	deliver()
+	if want := []string{"committed"}; !slices.Equal(seen, want) {
+		t.Fatalf("delivered %q, want %q", seen, want)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// exportDelay is how long after a day ends before it's exported, so page
+// views still buffered at midnight are in
+const exportDelay = time.Hour
+
+// ExportConfig is where the analytics exports go
+type ExportConfig struct {
+	client *s3Client
+	prefix string
+}
+
+// exportConfig returns where exports go: EXPORT_BUCKET, with keys under
+// EXPORT_PREFIX. ok is false if exports aren't set up.
+func exportConfig(c Config) (cfg ExportConfig, ok bool, err error) {
+	if c.ExportBucket == "" {
+		return ExportConfig{}, false, nil
+	}
+	cfg = ExportConfig{prefix: c.ExportPrefix}
+	cfg.client, err = newS3Client(c, c.ExportBucket)
+	if err != nil {
+		return ExportConfig{}, false, err
+	}
+	return cfg, true, nil
+}
+
+// exportDataset is a table exported a day at a time
+type exportDataset struct {
+	Name   string
+	Fields []parquetField
+	// firstDay returns the oldest day with rows, or false if there are none
+	firstDay func(ctx context.Context, db *sql.DB) (time.Time, bool, error)
+	// query selects one day's rows, given its start and end
+	query func(ctx context.Context, db *sql.DB, start, end time.Time) (*sql.Rows, error)
+	// scan reads a row of the given day as values for Fields
+	scan func(rows *sql.Rows, day time.Time) ([]any, error)
+}
+
+// exportDatasets are the tables exported for offline analysis
+var exportDatasets = []exportDataset{
+	{
+		Name: "page_views",
+		Fields: []parquetField{
+			{Name: "path", Type: parquetString},
+			{Name: "day", Type: parquetDate},
+			{Name: "views", Type: parquetInt64},
+		},
+		firstDay: func(ctx context.Context, db *sql.DB) (time.Time, bool, error) {
+			var day sql.NullString
+			if err := db.QueryRowContext(ctx, "SELECT MIN(day) FROM page_views").Scan(&day); err != nil || !day.Valid {
+				return time.Time{}, false, err
+			}
+			t, err := time.Parse(time.DateOnly, day.String)
+			return t, err == nil, err
+		},
+		query: func(ctx context.Context, db *sql.DB, start, end time.Time) (*sql.Rows, error) {
+			return db.QueryContext(ctx, "SELECT path, count FROM page_views WHERE day = ? ORDER BY path", start.Format(time.DateOnly))
+		},
+		scan: func(rows *sql.Rows, day time.Time) ([]any, error) {
+			var path string
+			var views int64
+			if err := rows.Scan(&path, &views); err != nil {
+				return nil, err
+			}
+			// The day is the partition, but is kept in the rows too so files
+			// can be read on their own
+			return []any{path, day, views}, nil
+		},
+	},
+	{
+		Name: "device_metrics",
+		Fields: []parquetField{
+			{Name: "device_id", Type: parquetInt64},
+			{Name: "bucket", Type: parquetTimestamp},
+			{Name: "samples", Type: parquetInt64},
+			{Name: "cpu_percent", Type: parquetDouble},
+			{Name: "memory_percent", Type: parquetDouble},
+			{Name: "disk_percent", Type: parquetDouble},
+			{Name: "uptime_seconds", Type: parquetInt64},
+		},
+		firstDay: func(ctx context.Context, db *sql.DB) (time.Time, bool, error) {
+			// Not MIN(bucket), which SQLite returns as text
+			var bucket time.Time
+			err := db.QueryRowContext(ctx, "SELECT bucket FROM device_metrics ORDER BY bucket LIMIT 1").Scan(&bucket)
+			if errors.Is(err, sql.ErrNoRows) {
+				return time.Time{}, false, nil
+			}
+			return bucket, err == nil, err
+		},
+		query: func(ctx context.Context, db *sql.DB, start, end time.Time) (*sql.Rows, error) {
+			return db.QueryContext(ctx, `
+				SELECT device_id, bucket, samples, cpu_percent, memory_percent, disk_percent, uptime_seconds
+				FROM device_metrics
+				WHERE bucket >= ? AND bucket < ?
+				ORDER BY device_id, bucket
+			`, start, end)
+		},
+		scan: func(rows *sql.Rows, day time.Time) ([]any, error) {
+			var deviceID, samples, uptime int64
+			var bucket time.Time
+			var cpu, memory, disk float64
+			if err := rows.Scan(&deviceID, &bucket, &samples, &cpu, &memory, &disk, &uptime); err != nil {
+				return nil, err
+			}
+			return []any{deviceID, bucket, samples, cpu, memory, disk, uptime}, nil
+		},
+	},
+}
+
+// exportKey is where a day of a dataset is uploaded. The day=YYYY-MM-DD
+// directories are Hive style partitions, which DuckDB and Athena read as a
+// column.
+func exportKey(prefix, dataset string, day time.Time) string {
+	d := day.Format(time.DateOnly)
+	return prefix + dataset + "/day=" + d + "/" + dataset + "-" + d + ".parquet"
+}
+
+// exportDay uploads one day of a dataset as a Parquet file and returns how
+// many rows it had. Days without rows aren't uploaded.
+func (app *App) exportDay(ctx context.Context, cfg ExportConfig, ds exportDataset, day time.Time) (int, error) {
+	rows, err := ds.query(ctx, app.DB, day, day.AddDate(0, 0, 1))
+	if err != nil {
+		return 0, fmt.Errorf("failed to query %s: %w", ds.Name, err)
+	}
+	defer rows.Close()
+
+	var records [][]any
+	for rows.Next() {
+		record, err := ds.scan(rows, day)
+		if err != nil {
+			return 0, fmt.Errorf("failed to scan %s row: %w", ds.Name, err)
+		}
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating %s rows: %w", ds.Name, err)
+	}
+	if len(records) == 0 {
+		return 0, nil
+	}
+
+	file, err := writeParquet(ds.Fields, records)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode %s: %w", ds.Name, err)
+	}
+	key := exportKey(cfg.prefix, ds.Name, day)
+	if err := cfg.client.Put(key, file, http.Header{"Content-Type": {"application/vnd.apache.parquet"}}); err != nil {
+		return 0, fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	return len(records), nil
+}
+
+// exportDataset uploads each finished day of a dataset that hasn't been
+// exported yet, oldest first. A day is only exported once, so rows that
+// arrive after it's exported aren't included.
+func (app *App) exportDataset(ctx context.Context, cfg ExportConfig, ds exportDataset, now time.Time) error {
+	first, ok, err := ds.firstDay(ctx, app.DB)
+	if err != nil {
+		return fmt.Errorf("failed to find oldest %s: %w", ds.Name, err)
+	} else if !ok {
+		return nil
+	}
+
+	exported := make(map[string]bool)
+	rows, err := app.DB.QueryContext(ctx, "SELECT day FROM exports WHERE dataset = ?", ds.Name)
+	if err != nil {
+		return fmt.Errorf("failed to query exports: %w", err)
+	}
+	for rows.Next() {
+		var day string
+		if err := rows.Scan(&day); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan export row: %w", err)
+		}
+		exported[day] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating export rows: %w", err)
+	}
+
+	y, m, d := first.UTC().Date()
+	for day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC); !day.AddDate(0, 0, 1).Add(exportDelay).After(now); day = day.AddDate(0, 0, 1) {
+		if exported[day.Format(time.DateOnly)] {
+			continue
+		}
+		count, err := app.exportDay(ctx, cfg, ds, day)
+		if err != nil {
+			return err
+		}
+		_, err = app.DB.ExecContext(ctx,
+			"INSERT INTO exports (dataset, day, row_count, exported_at) VALUES (?, ?, ?, ?)",
+			ds.Name, day.Format(time.DateOnly), count, now,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to record export: %w", err)
+		}
+		if count > 0 {
+			slog.Info("Exported data", "dataset", ds.Name, "day", day.Format(time.DateOnly), "rows", count)
+		}
+	}
+	return nil
+}
+
+// ExportAnalytics exports the finished days of every dataset. A dataset
+// that fails doesn't hold up the others.
+func (app *App) ExportAnalytics(ctx context.Context, cfg ExportConfig, now time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+
+	var errs []error
+	for _, ds := range exportDatasets {
+		if err := app.exportDataset(ctx, cfg, ds, now); err != nil {
+			errs = append(errs, fmt.Errorf("%s export: %w", ds.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
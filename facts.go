@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// factsSchemaVersion is the version of DeviceFacts agents should report.
+// Bump it when a change would break older readers, and keep accepting the
+// versions in supportedFactsVersions while agents catch up.
+const factsSchemaVersion = 1
+
+var supportedFactsVersions = map[int]bool{1: true}
+
+// errDeviceNotFound is returned for devices that don't exist or belong to
+// someone else
+var errDeviceNotFound = errors.New("device not found")
+
+const (
+	maxFactsBytes      = 2 << 20 // 2 MiB
+	maxFactsInterfaces = 256
+	maxFactsPackages   = 20000
+)
+
+// DeviceFacts is the inventory an agent reports for a device
+type DeviceFacts struct {
+	SchemaVersion int              `json:"schema_version"`
+	Hardware      HardwareFacts    `json:"hardware"`
+	OS            OSFacts          `json:"os"`
+	Interfaces    []InterfaceFacts `json:"network_interfaces"`
+	Packages      []PackageFacts   `json:"packages"`
+}
+
+// HardwareFacts describes the machine
+type HardwareFacts struct {
+	Vendor       string `json:"vendor"`
+	Model        string `json:"model"`
+	Serial       string `json:"serial"`
+	Architecture string `json:"architecture"`
+	CPUModel     string `json:"cpu_model"`
+	CPUCores     int    `json:"cpu_cores"`
+	MemoryBytes  int64  `json:"memory_bytes"`
+}
+
+// Memory returns the memory size for display, like "16 GiB"
+func (h HardwareFacts) Memory() string {
+	if h.MemoryBytes <= 0 {
+		return ""
+	}
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	size, i := float64(h.MemoryBytes), 0
+	for size >= 1024 && i < len(units)-1 {
+		size /= 1024
+		i++
+	}
+	return strings.TrimSuffix(fmt.Sprintf("%.1f", size), ".0") + " " + units[i]
+}
+
+// OSFacts describes the operating system
+type OSFacts struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Kernel  string `json:"kernel"`
+}
+
+// InterfaceFacts describes a network interface
+type InterfaceFacts struct {
+	Name      string   `json:"name"`
+	MAC       string   `json:"mac"`
+	Addresses []string `json:"addresses"`
+}
+
+// PackageFacts is an installed package
+type PackageFacts struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// Manager is the package manager it came from, like "apt" or "brew"
+	Manager string `json:"manager"`
+}
+
+// Validate checks the facts against the schema
+func (f DeviceFacts) Validate() error {
+	if !supportedFactsVersions[f.SchemaVersion] {
+		return fmt.Errorf("unsupported schema_version %d, expected %d", f.SchemaVersion, factsSchemaVersion)
+	}
+	if f.OS.Name == "" {
+		return fmt.Errorf("os.name is required")
+	}
+	if f.Hardware.CPUCores < 0 || f.Hardware.MemoryBytes < 0 {
+		return fmt.Errorf("hardware.cpu_cores and hardware.memory_bytes can't be negative")
+	}
+	if len(f.Interfaces) > maxFactsInterfaces {
+		return fmt.Errorf("too many network_interfaces, the limit is %d", maxFactsInterfaces)
+	}
+	for i, iface := range f.Interfaces {
+		if iface.Name == "" {
+			return fmt.Errorf("network_interfaces[%d].name is required", i)
+		}
+	}
+	if len(f.Packages) > maxFactsPackages {
+		return fmt.Errorf("too many packages, the limit is %d", maxFactsPackages)
+	}
+	for i, pkg := range f.Packages {
+		if pkg.Name == "" {
+			return fmt.Errorf("packages[%d].name is required", i)
+		}
+	}
+	return nil
+}
+
+// GetDevice returns one of a user's devices
+func (app *App) GetDevice(ctx context.Context, userID, deviceID int64) (Device, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var device Device
+	var tags string
+	var lastSeenAt sql.NullTime
+	err := app.DB.QueryRowContext(ctx, `
+		SELECT id, user_id, hostname, COALESCE(NULLIF(name, ''), hostname), device_type, notes, tags, created_at, os, arch, ip, last_seen_at,
+			config_version, config_failed_version, config_error
+		FROM devices
+		WHERE id = ? AND user_id = ?
+	`, deviceID, userID).Scan(&device.ID, &device.UserID, &device.Hostname, &device.Name, &device.DeviceType, &device.Notes, &tags, &device.CreatedAt,
+		&device.OS, &device.Architecture, &device.IP, &lastSeenAt, &device.ConfigVersion, &device.ConfigFailedVersion, &device.ConfigError)
+	if err == sql.ErrNoRows {
+		return Device{}, errDeviceNotFound
+	} else if err != nil {
+		return Device{}, fmt.Errorf("failed to query device: %w", err)
+	}
+	device.Tags = strings.Fields(tags)
+	device.LastSeenAt = lastSeenAt.Time
+	return device, nil
+}
+
+// SaveDeviceFacts replaces the facts reported for a device
+func (app *App) SaveDeviceFacts(ctx context.Context, deviceID int64, facts DeviceFacts) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	data, err := json.Marshal(facts)
+	if err != nil {
+		return fmt.Errorf("failed to encode facts: %w", err)
+	}
+	_, err = app.DB.ExecContext(ctx, `
+		INSERT INTO device_facts (device_id, schema_version, facts, reported_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(device_id) DO UPDATE SET
+			schema_version = excluded.schema_version,
+			facts = excluded.facts,
+			reported_at = excluded.reported_at
+	`, deviceID, facts.SchemaVersion, string(data), time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to save facts: %w", err)
+	}
+	return nil
+}
+
+// GetDeviceFacts returns the facts last reported for a device and when they
+// were reported. ok is false if the device hasn't reported any.
+func (app *App) GetDeviceFacts(ctx context.Context, deviceID int64) (facts DeviceFacts, reportedAt time.Time, ok bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var data string
+	err = app.DB.QueryRowContext(ctx, "SELECT facts, reported_at FROM device_facts WHERE device_id = ?", deviceID).Scan(&data, &reportedAt)
+	if err == sql.ErrNoRows {
+		return DeviceFacts{}, time.Time{}, false, nil
+	} else if err != nil {
+		return DeviceFacts{}, time.Time{}, false, fmt.Errorf("failed to query facts: %w", err)
+	}
+	if err := json.Unmarshal([]byte(data), &facts); err != nil {
+		return DeviceFacts{}, time.Time{}, false, fmt.Errorf("failed to decode facts: %w", err)
+	}
+	return facts, reportedAt, true, nil
+}
+
+// SearchDevicePackages returns a device's installed packages whose name
+// contains the query, sorted by name. The packages are filtered here rather
+// than in SQL since SQLite and Postgres query JSON differently.
+func (app *App) SearchDevicePackages(ctx context.Context, deviceID int64, query string) ([]PackageFacts, error) {
+	facts, _, ok, err := app.GetDeviceFacts(ctx, deviceID)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	query = strings.ToLower(query)
+	var packages []PackageFacts
+	for _, pkg := range facts.Packages {
+		if strings.Contains(strings.ToLower(pkg.Name), query) {
+			packages = append(packages, pkg)
+		}
+	}
+	slices.SortFunc(packages, func(a, b PackageFacts) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return packages, nil
+}
+
+// deviceIDFromPath parses the device ID out of paths like /devices/{id}/facts
+func deviceIDFromPath(path, prefix string) (int64, error) {
+	rest := strings.TrimPrefix(path, prefix)
+	idPart, _, _ := strings.Cut(rest, "/")
+	id, err := strconv.ParseInt(idPart, 10, 64)
+	if err != nil {
+		return 0, NewHTTPError(fmt.Errorf("page not found: %s", path), http.StatusNotFound)
+	}
+	return id, nil
+}
+
+// handleReportFacts stores the facts an agent reports for a device with
+// PUT /api/devices/{id}/facts
+func (app *App) handleReportFacts(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPut {
+		return NewHTTPError(fmt.Errorf("method not allowed"), http.StatusMethodNotAllowed)
+	}
+	auth, err := app.authenticateRequest(w, r)
+	if err != nil {
+		return err
+	}
+	if err := requireScope(auth, "devices:write"); err != nil {
+		return err
+	}
+	deviceID, err := deviceIDFromPath(r.URL.Path, "/api/devices/")
+	if err != nil {
+		return err
+	}
+	if _, err := app.GetDevice(r.Context(), auth.User.ID, deviceID); errors.Is(err, errDeviceNotFound) {
+		return NewHTTPError(err, http.StatusNotFound)
+	} else if err != nil {
+		return err
+	}
+
+	var facts DeviceFacts
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFactsBytes)).Decode(&facts); err != nil {
+		return NewHTTPError(fmt.Errorf("invalid facts: %w", err), http.StatusBadRequest)
+	}
+	if err := facts.Validate(); err != nil {
+		return NewHTTPError(fmt.Errorf("invalid facts: %w", err), http.StatusUnprocessableEntity)
+	}
+	if err := app.SaveDeviceFacts(r.Context(), deviceID, facts); err != nil {
+		return err
+	}
+	if err := app.AuditActingAs(r.Context(), auth, "device.facts", fmt.Sprintf("device %d", deviceID)); err != nil {
+		return err
+	}
+
+	slog.InfoContext(r.Context(), "Device facts reported", "device_id", deviceID, "packages", len(facts.Packages))
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// FactsPage holds data for the device facts explorer template
+type FactsPage struct {
+	Meta       PageMeta
+	Device     Device
+	Facts      DeviceFacts
+	ReportedAt time.Time
+	Reported   bool
+	// Query filters the package list
+	Query    string
+	Packages []PackageFacts
+}
+
+// handleDeviceFacts renders the facts explorer at /devices/{id}/facts.
+// Callers must make sure the user is logged in.
+func (app *App) handleDeviceFacts(w http.ResponseWriter, r *http.Request, count int, user *User) error {
+	deviceID, err := deviceIDFromPath(r.URL.Path, "/devices/")
+	if err != nil {
+		return err
+	}
+	device, err := app.GetDevice(r.Context(), user.ID, deviceID)
+	if errors.Is(err, errDeviceNotFound) {
+		return NewHTTPError(err, http.StatusNotFound)
+	} else if err != nil {
+		return err
+	}
+
+	page := FactsPage{
+		Meta: PageMeta{
+			Title: device.Name + " facts",
+			Count: count,
+			User:  user,
+
+			CSRFToken: csrfToken(r),
+		},
+		Device: device,
+		Query:  strings.TrimSpace(r.URL.Query().Get("q")),
+	}
+	page.Facts, page.ReportedAt, page.Reported, err = app.GetDeviceFacts(r.Context(), deviceID)
+	if err != nil {
+		return err
+	}
+	if page.Reported {
+		if page.Packages, err = app.SearchDevicePackages(r.Context(), deviceID, page.Query); err != nil {
+			return err
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := app.render(w, r, http.StatusOK, "facts.html", page); err != nil {
+		return fmt.Errorf("failed to render facts page: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Flag gates a feature, either for everyone or for a percentage of visitors
+type Flag struct {
+	Name        string
+	Description string
+	Enabled     bool
+	// Rollout is the percentage of visitors who see the feature when enabled
+	Rollout   int
+	UpdatedAt time.Time
+}
+
+// knownFlags are the flags the code checks, with their defaults. The flags
+// table only stores changes made from the admin page.
+var knownFlags = []Flag{
+	{Name: "passkeys", Description: "Passkey sign in and registration", Enabled: true, Rollout: 100},
+	{Name: "push_notifications", Description: "The new post notification button on the blog", Enabled: true, Rollout: 100},
+	{Name: "plugin_funcs", Description: "Template functions provided by WASM plugins", Enabled: true, Rollout: 100},
+}
+
+// flagCacheDuration is how long flags are cached before being reread, so
+// changes made on one replica reach the others
+const flagCacheDuration = 30 * time.Second
+
+// ListFlags returns all known flags with their current settings
+func (app *App) ListFlags(ctx context.Context) ([]Flag, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	rows, err := app.DB.QueryContext(ctx, "SELECT name, enabled, rollout, updated_at FROM flags")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query flags: %w", err)
+	}
+	defer rows.Close()
+
+	stored := map[string]Flag{}
+	for rows.Next() {
+		var f Flag
+		if err := rows.Scan(&f.Name, &f.Enabled, &f.Rollout, &f.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan flag row: %w", err)
+		}
+		stored[f.Name] = f
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating flag rows: %w", err)
+	}
+
+	flags := make([]Flag, len(knownFlags))
+	for i, f := range knownFlags {
+		if s, ok := stored[f.Name]; ok {
+			f.Enabled, f.Rollout, f.UpdatedAt = s.Enabled, s.Rollout, s.UpdatedAt
+		}
+		flags[i] = f
+	}
+	return flags, nil
+}
+
+// SetFlag changes a flag's settings
+func (app *App) SetFlag(ctx context.Context, name string, enabled bool, rollout int) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := app.DB.ExecContext(ctx, `
+		INSERT INTO flags (name, enabled, rollout, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET enabled = excluded.enabled, rollout = excluded.rollout, updated_at = excluded.updated_at
+	`, name, enabled, rollout, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to update flag: %w", err)
+	}
+
+	// Reread on the next check
+	app.flags.mu.Lock()
+	app.flags.loadedAt = time.Time{}
+	app.flags.mu.Unlock()
+	return nil
+}
+
+// currentFlags returns the cached flags, rereading them when stale. If the
+// database can't be read the previous settings, or the defaults, are used.
+func (app *App) currentFlags() map[string]Flag {
+	app.flags.mu.Lock()
+	defer app.flags.mu.Unlock()
+
+	if app.flags.byName != nil && time.Since(app.flags.loadedAt) < flagCacheDuration {
+		return app.flags.byName
+	}
+
+	flags, err := app.ListFlags(context.Background())
+	if err != nil {
+		slog.Error("Failed to load feature flags", "error", err)
+		if app.flags.byName != nil {
+			return app.flags.byName
+		}
+		flags = knownFlags
+	}
+
+	h := sha256.New()
+	app.flags.byName = make(map[string]Flag, len(flags))
+	for _, f := range flags {
+		app.flags.byName[f.Name] = f
+		fmt.Fprintf(h, "%s:%t:%d;", f.Name, f.Enabled, f.Rollout)
+	}
+	app.flags.hash = hex.EncodeToString(h.Sum(nil))
+	app.flags.loadedAt = time.Now()
+	return app.flags.byName
+}
+
+// currentFlagsHash returns the hash of the flag settings, refreshing the flags if needed
+func (app *App) currentFlagsHash() string {
+	app.currentFlags()
+	app.flags.mu.Lock()
+	defer app.flags.mu.Unlock()
+	return app.flags.hash
+}
+
+// FlagEnabled reports whether a flag is on for subject, a stable identifier
+// for the visitor. Partial rollouts hash the subject so each visitor gets a
+// consistent answer; with no subject they're treated as off.
+func (app *App) FlagEnabled(name, subject string) bool {
+	f, ok := app.currentFlags()[name]
+	if !ok {
+		slog.Warn("Unknown feature flag", "flag", name)
+		return false
+	}
+	if !f.Enabled {
+		return false
+	}
+	if f.Rollout >= 100 {
+		return true
+	}
+	if f.Rollout <= 0 || subject == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(name + ":" + subject))
+	return int(binary.BigEndian.Uint32(sum[:4])%100) < f.Rollout
+}
+
+// flagSubject identifies the visitor for percentage rollouts: the user when
+// logged in, otherwise the browser's CSRF token
+func flagSubject(user *User, csrfToken string) string {
+	if user != nil {
+		return "user:" + strconv.FormatInt(user.ID, 10)
+	}
+	if csrfToken != "" {
+		return "browser:" + csrfToken
+	}
+	return ""
+}
+
+// flagFor is the template function for checking a flag for the page's visitor
+func (app *App) flagFor(meta PageMeta, name string) bool {
+	return app.FlagEnabled(name, flagSubject(meta.User, meta.CSRFToken))
+}
+
+// requestFlagEnabled checks a flag for the visitor making the request
+func (app *App) requestFlagEnabled(r *http.Request, user *User, name string) bool {
+	return app.FlagEnabled(name, flagSubject(user, csrfToken(r)))
+}
+
+// handleFlags returns every flag's value for the visitor
+func (app *App) handleFlags(w http.ResponseWriter, r *http.Request, user *User) error {
+	values := map[string]bool{}
+	for _, f := range knownFlags {
+		values[f.Name] = app.requestFlagEnabled(r, user, f.Name)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return writeJSON(w, values)
+}
+
+// handleAdminSetFlag updates a flag from the admin page
+func (app *App) handleAdminSetFlag(w http.ResponseWriter, r *http.Request, user *User) error {
+	name := r.FormValue("name")
+	if _, ok := app.currentFlags()[name]; !ok {
+		return NewHTTPError(fmt.Errorf("unknown flag %q", name), http.StatusBadRequest)
+	}
+	rollout, err := strconv.Atoi(r.FormValue("rollout"))
+	if err != nil || rollout < 0 || rollout > 100 {
+		return NewHTTPError(fmt.Errorf("rollout must be a percentage from 0 to 100"), http.StatusBadRequest)
+	}
+	enabled := r.FormValue("enabled") == "on"
+
+	if err := app.SetFlag(r.Context(), name, enabled, rollout); err != nil {
+		return err
+	}
+
+	if err := app.Audit(r.Context(), *user, nil, "flag.set", fmt.Sprintf("%s enabled=%t rollout=%d%%", name, enabled, rollout)); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// frontmatterKeys are the keys a post's frontmatter may set
+var frontmatterKeys = []string{"title", "date", "description", "image", "slug", "layout"}
+
+// postLayouts are the values layout may take, the first being the default.
+// A wide post gets more room for code and images, and a page has no date.
+var postLayouts = []string{"post", "wide", "page"}
+
+// FrontmatterError is everything wrong with a post's frontmatter, so it can
+// all be fixed in one go
+type FrontmatterError struct {
+	Problems []string
+}
+
+func (e *FrontmatterError) Error() string {
+	return "invalid frontmatter: " + strings.Join(e.Problems, "; ")
+}
+
+// ContentProblem is a post file that couldn't be published
+type ContentProblem struct {
+	FileName string
+	// Problems has one entry per thing to fix
+	Problems []string
+}
+
+// contentProblem describes why a post file failed to load
+func contentProblem(file string, err error) ContentProblem {
+	problem := ContentProblem{FileName: filepath.Base(file)}
+	if fm, ok := err.(*FrontmatterError); ok {
+		problem.Problems = fm.Problems
+	} else {
+		problem.Problems = []string{err.Error()}
+	}
+	return problem
+}
+
+// decodeFrontmatter parses a post's frontmatter and checks it against the
+// schema: title and date are required, only known keys are allowed, the date
+// must be a YYYY-MM-DD date or RFC 3339 time and layout one of postLayouts.
+// Lines are counted from the top of the file.
+func decodeFrontmatter(data []byte) (Post, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return Post{}, &FrontmatterError{Problems: []string{err.Error()}}
+	}
+
+	var post Post
+	var problems []string
+	// dateSet is whether there's a date, even an invalid one
+	dateSet := false
+	var root *yaml.Node
+	if len(doc.Content) > 0 {
+		root = doc.Content[0]
+	}
+	if root != nil && root.Kind != yaml.MappingNode {
+		return Post{}, &FrontmatterError{Problems: []string{"frontmatter must be a list of key: value lines"}}
+	}
+
+	seen := make(map[string]bool)
+	if root != nil {
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			key, value := root.Content[i], root.Content[i+1]
+			// The opening --- is the first line of the file
+			line := key.Line + 1
+			if seen[key.Value] {
+				problems = append(problems, fmt.Sprintf("line %d: %s is set more than once", line, key.Value))
+				continue
+			}
+			seen[key.Value] = true
+
+			if !slices.Contains(frontmatterKeys, key.Value) {
+				problems = append(problems, fmt.Sprintf("line %d: unknown key %q, expected one of %s", line, key.Value, strings.Join(frontmatterKeys, ", ")))
+				continue
+			}
+			if value.Kind != yaml.ScalarNode {
+				problems = append(problems, fmt.Sprintf("line %d: %s must be a single value", line, key.Value))
+				continue
+			}
+
+			switch key.Value {
+			case "title":
+				post.Title = strings.TrimSpace(value.Value)
+			case "description":
+				post.Description = value.Value
+			case "image":
+				post.Image = value.Value
+			case "slug":
+				post.Slug = value.Value
+				if post.Slug != "" && !slugPattern.MatchString(post.Slug) {
+					problems = append(problems, fmt.Sprintf("line %d: slug %q must be lowercase letters, numbers and dashes", line, post.Slug))
+				}
+			case "date":
+				if value.Value == "" {
+					break
+				}
+				dateSet = true
+				if err := value.Decode(&post.Date); err != nil {
+					problems = append(problems, fmt.Sprintf("line %d: date %q isn't a YYYY-MM-DD date or RFC 3339 time", line, value.Value))
+				}
+			case "layout":
+				post.Layout = value.Value
+				if post.Layout != "" && !slices.Contains(postLayouts, post.Layout) {
+					problems = append(problems, fmt.Sprintf("line %d: layout %q must be one of %s", line, post.Layout, strings.Join(postLayouts, ", ")))
+				}
+			}
+		}
+	}
+
+	if post.Title == "" {
+		problems = append(problems, "title is required")
+	}
+	if !dateSet {
+		problems = append(problems, "date is required")
+	}
+	if len(problems) > 0 {
+		return Post{}, &FrontmatterError{Problems: problems}
+	}
+
+	if post.Layout == "" {
+		post.Layout = postLayouts[0]
+	}
+	return post, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// guardedPrefixes are the paths protected by the admin guard
+var guardedPrefixes = []string{"/admin", "/stats", "/debug"}
+
+// AdminGuardConfig is an extra layer of protection for admin routes that works
+// independently of session auth
+type AdminGuardConfig struct {
+	// AllowedNets restricts access to these networks when non-empty
+	AllowedNets []netip.Prefix
+	// Username and Password enable HTTP basic auth when both are set
+	Username string
+	Password string
+}
+
+// loadAdminGuardConfig parses the guard config from ADMIN_ALLOW_CIDRS (e.g.
+// "10.0.0.0/8,203.0.113.7/32") and ADMIN_BASIC_AUTH ("user:password")
+func loadAdminGuardConfig(c Config) (AdminGuardConfig, error) {
+	var cfg AdminGuardConfig
+
+	for _, cidr := range c.AdminAllowCIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return AdminGuardConfig{}, fmt.Errorf("invalid ADMIN_ALLOW_CIDRS entry %q: %w", cidr, err)
+		}
+		cfg.AllowedNets = append(cfg.AllowedNets, prefix.Masked())
+	}
+
+	if auth := c.AdminBasicAuth; auth != "" {
+		username, password, ok := strings.Cut(auth, ":")
+		if !ok || username == "" || password == "" {
+			return AdminGuardConfig{}, fmt.Errorf("ADMIN_BASIC_AUTH must be in the form user:password")
+		}
+		cfg.Username, cfg.Password = username, password
+	}
+
+	return cfg, nil
+}
+
+// isGuardedPath reports whether the path falls under one of the guarded prefixes
+func isGuardedPath(path string) bool {
+	for _, prefix := range guardedPrefixes {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminGuard wraps a handler so requests to guarded paths must come from an
+// allowed network and pass basic auth, when those are configured. It runs
+// before session auth, so a stolen session cookie alone isn't enough.
+// Admin actions elsewhere, like the API, check the guard themselves, see
+// App.checkAdminGuard.
+func AdminGuard(cfg AdminGuardConfig, h func(http.ResponseWriter, *http.Request) error) func(http.ResponseWriter, *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if !isGuardedPath(r.URL.Path) {
+			return h(w, r)
+		}
+		if err := adminGuardError(cfg, r); err != nil {
+			return guardFailed(w, err)
+		}
+		return h(w, r)
+	}
+}
+
+// adminGuardError returns why the request doesn't pass the guard, or nil if
+// it does
+func adminGuardError(cfg AdminGuardConfig, r *http.Request) error {
+	if len(cfg.AllowedNets) > 0 {
+		ip := clientIP(r)
+		allowed := false
+		for _, prefix := range cfg.AllowedNets {
+			if ip.IsValid() && prefix.Contains(ip.Unmap()) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			slog.WarnContext(r.Context(), "Blocked admin request from disallowed address", "ip", ip.String(), "path", r.URL.Path)
+			return NewHTTPError(fmt.Errorf("access from your network is not allowed"), http.StatusForbidden)
+		}
+	}
+
+	if cfg.Username != "" {
+		username, password, ok := r.BasicAuth()
+		userOK := subtle.ConstantTimeCompare([]byte(username), []byte(cfg.Username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(password), []byte(cfg.Password)) == 1
+		if !ok || !userOK || !passOK {
+			return NewHTTPError(fmt.Errorf("admin credentials required"), http.StatusUnauthorized)
+		}
+	}
+	return nil
+}
+
+// guardFailed asks for basic auth credentials if they were what was missing
+func guardFailed(w http.ResponseWriter, err error) error {
+	var httpErr HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="tulip admin", charset="UTF-8"`)
+	}
+	return err
+}
+
+// checkAdminGuard applies the admin guard to a request that uses admin
+// rights outside the guarded paths, like RequireRole(RoleAdmin, ...), the
+// API's admin actions and X-Acting-As. API tokens can't be sent along with
+// basic auth, so with ADMIN_BASIC_AUTH set those actions need a session.
+func (app *App) checkAdminGuard(w http.ResponseWriter, r *http.Request) error {
+	if err := adminGuardError(app.Config.AdminGuard, r); err != nil {
+		return guardFailed(w, err)
+	}
+	return nil
+}
+
+// adminAllowed reports whether the user is an admin and the request passes
+// the admin guard, for pages that only show admins more
+func (app *App) adminAllowed(r *http.Request, user *User) bool {
+	return isAdmin(user) && adminGuardError(app.Config.AdminGuard, r) == nil
+}
+
+// clientIP returns the address of the client. Behind a reverse proxy (set
+// TRUST_PROXY=true) the last X-Forwarded-For entry is used, since that's the
+// one added by our own proxy and can't be spoofed by the client.
+func clientIP(r *http.Request) netip.Addr {
+	if info := requestInfoFrom(r.Context()); info != nil && info.TrustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			parts := strings.Split(forwarded, ",")
+			if ip, err := netip.ParseAddr(strings.TrimSpace(parts[len(parts)-1])); err == nil {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip, _ := netip.ParseAddr(host)
+	return ip
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strconv"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newHTTP3Server serves handler over HTTP/3 on HTTPS_PORT's UDP port, with
+// the same certificates as HTTPS. It returns nil if HTTP3 isn't set.
+func newHTTP3Server(cfg Config, tlsConfig *tls.Config, handler http.Handler) *http3.Server {
+	if !cfg.HTTP3 || tlsConfig == nil {
+		return nil
+	}
+	return &http3.Server{
+		Addr:      ":" + strconv.Itoa(cfg.HTTPSPort),
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+	}
+}
+
+// advertiseHTTP3 adds an Alt-Svc header to HTTP/1.1 and HTTP/2 responses,
+// so browsers switch to HTTP/3 for the next request
+func advertiseHTTP3(h3 *http3.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			// Fails until the UDP listener is up, and then there's
+			// nothing to advertise yet
+			_ = h3.SetQUICHeaders(w.Header())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
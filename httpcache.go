@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// templatesHash identifies the embedded templates so cached pages are
+// invalidated when a deploy changes the layout
+var templatesHash = func() string {
+	h := sha256.New()
+	_ = fs.WalkDir(tmplFS, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(tmplFS, path)
+		if err != nil {
+			return err
+		}
+		h.Write([]byte(path))
+		h.Write(content)
+		return nil
+	})
+	return hex.EncodeToString(h.Sum(nil))
+}()
+
+// pageETag builds a weak ETag for a rendered page from the hash of its
+// content. The user and CSRF token are included because the nav and forms
+// differ per browser, and the plugins because they can change rendered
+// output. The page view counter is deliberately left out, so a revalidated
+// page may show a slightly stale count.
+func (app *App) pageETag(r *http.Request, contentHash string, user *User) string {
+	var userID int64
+	if user != nil {
+		userID = user.ID
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%s:%s:%s:%d:%s", contentHash, templatesHash, pluginsHash, app.currentFlagsHash(), userID, csrfToken(r))))
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// postsHash combines the hashes of all posts, for pages that list them
+func postsHash(posts []Post) string {
+	h := sha256.New()
+	for _, post := range posts {
+		h.Write([]byte(post.Hash))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// postsModTime returns the most recent modification time across posts
+func postsModTime(posts []Post) time.Time {
+	var latest time.Time
+	for _, post := range posts {
+		if post.ModTime.After(latest) {
+			latest = post.ModTime
+		}
+	}
+	return latest
+}
+
+// checkNotModified sets the caching headers for a page and reports whether the
+// client already has the current version, in which case a 304 has been written
+// and the caller should return without rendering.
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	// Pages vary by user, so only the browser may keep a copy and it must
+	// revalidate on every use
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	// If-None-Match takes precedence over If-Modified-Since
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if !etagMatches(match, etag) {
+			return false
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+
+	if since := r.Header.Get("If-Modified-Since"); since != "" && !modified.IsZero() {
+		t, err := http.ParseTime(since)
+		if err != nil || modified.Truncate(time.Second).After(t) {
+			return false
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+
+	return false
+}
+
+// etagMatches checks an If-None-Match header value against an ETag using weak
+// comparison
+func etagMatches(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
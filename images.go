@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// imagesDir is the directory under mediaDir that uploads are saved to
+	imagesDir = "images"
+	// maxImageUpload is the largest image file that can be uploaded
+	maxImageUpload = 20 << 20
+	// maxImagePixels stops small files that decode to huge images from
+	// using up memory while they're resized
+	maxImagePixels = 50_000_000
+	// imageDefaultWidth is the variant used as the src, for browsers that
+	// don't pick from the srcset. It fills the post column on most screens.
+	imageDefaultWidth = 960
+	// imageSizes tells browsers how wide post images are shown, so they can
+	// pick a variant before layout. It matches .blog-body's width.
+	imageSizes = "(max-width: 800px) 100vw, 760px"
+)
+
+// imageWidths are the widths uploaded images are resized to. Only widths
+// smaller than the original are made.
+var imageWidths = []int{480, 960, 1600}
+
+// ResponsiveImage is an image in the media directory and the variants it
+// was resized to
+type ResponsiveImage struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	// Variants are the resized copies, narrowest first
+	Variants []ImageVariant `json:"variants"`
+	// Markdown embeds the image in a post
+	Markdown string `json:"markdown"`
+}
+
+// ImageVariant is a resized copy of an image
+type ImageVariant struct {
+	URL   string `json:"url"`
+	Width int    `json:"width"`
+}
+
+// Src returns the URL to use as the image's src: the variant closest to
+// imageDefaultWidth without going over, or the original
+func (img ResponsiveImage) Src() string {
+	src := img.URL
+	for _, v := range img.Variants {
+		if v.Width <= imageDefaultWidth {
+			src = v.URL
+		}
+	}
+	return src
+}
+
+// SrcSet returns the image's srcset, or "" if it has no variants
+func (img ResponsiveImage) SrcSet() string {
+	if len(img.Variants) == 0 {
+		return ""
+	}
+	var parts []string
+	for _, v := range img.Variants {
+		parts = append(parts, fmt.Sprintf("%s %dw", v.URL, v.Width))
+	}
+	parts = append(parts, fmt.Sprintf("%s %dw", img.URL, img.Width))
+	return strings.Join(parts, ", ")
+}
+
+// imageVariantName returns the file name of an image's variant at a width.
+// Variants of PNGs stay PNGs, to keep transparency, and the rest are JPEGs.
+func imageVariantName(name string, width int) string {
+	ext := path.Ext(name)
+	variantExt := ".jpg"
+	if strings.EqualFold(ext, ".png") {
+		variantExt = ".png"
+	}
+	return fmt.Sprintf("%s-%dw%s", strings.TrimSuffix(name, ext), width, variantExt)
+}
+
+// lookupImage returns the size and variants of an image linked as
+// /media/..., or false if src isn't a readable image in the media directory
+func lookupImage(src string) (ResponsiveImage, bool) {
+	u, err := url.Parse(src)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return ResponsiveImage{}, false
+	}
+	name, ok := strings.CutPrefix(path.Clean(u.Path), "/media/")
+	if !ok {
+		return ResponsiveImage{}, false
+	}
+	f, err := os.Open(filepath.Join(mediaDir, filepath.FromSlash(name)))
+	if err != nil {
+		return ResponsiveImage{}, false
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return ResponsiveImage{}, false
+	}
+
+	img := ResponsiveImage{
+		URL:      "/media/" + name,
+		Width:    cfg.Width,
+		Height:   cfg.Height,
+		Variants: []ImageVariant{},
+		Markdown: fmt.Sprintf("![](/media/%s)", name),
+	}
+	for _, width := range imageWidths {
+		if width >= cfg.Width {
+			break
+		}
+		variant := imageVariantName(name, width)
+		if _, err := os.Stat(filepath.Join(mediaDir, filepath.FromSlash(variant))); err == nil {
+			img.Variants = append(img.Variants, ImageVariant{URL: "/media/" + variant, Width: width})
+		}
+	}
+	return img, true
+}
+
+// imageFileName turns an uploaded file's name into a safe one, with a hash
+// of the contents so a new upload never replaces an image that's cached
+func imageFileName(upload string, data []byte, format string) string {
+	base := strings.TrimSuffix(path.Base(strings.ReplaceAll(upload, `\`, "/")), path.Ext(upload))
+	var b strings.Builder
+	for _, r := range strings.ToLower(base) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case b.Len() > 0 && !strings.HasSuffix(b.String(), "-"):
+			b.WriteByte('-')
+		}
+	}
+	name := strings.Trim(b.String(), "-")
+	if len(name) > 60 {
+		name = strings.Trim(name[:60], "-")
+	}
+	if name == "" {
+		name = "image"
+	}
+
+	ext := "." + format
+	if format == "jpeg" {
+		ext = ".jpg"
+	}
+	sum := sha256.Sum256(data)
+	return name + "-" + hex.EncodeToString(sum[:4]) + ext
+}
+
+// saveImage stores an uploaded image in the media directory and resizes it
+// to each of imageWidths that's smaller than it. GIFs aren't resized, since
+// they may be animated.
+func saveImage(upload string, data []byte) (ResponsiveImage, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return ResponsiveImage{}, NewHTTPError(fmt.Errorf("unsupported image, upload a JPEG, PNG, GIF or WebP"), http.StatusUnprocessableEntity)
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return ResponsiveImage{}, NewHTTPError(fmt.Errorf("image is too large, at %dx%d", cfg.Width, cfg.Height), http.StatusUnprocessableEntity)
+	}
+
+	name := path.Join(imagesDir, imageFileName(upload, data, format))
+	if err := os.MkdirAll(filepath.Join(mediaDir, imagesDir), 0755); err != nil {
+		return ResponsiveImage{}, fmt.Errorf("failed to create images directory: %w", err)
+	}
+	if err := writeMediaFile(name, data); err != nil {
+		return ResponsiveImage{}, err
+	}
+
+	if format != "gif" && cfg.Width > imageWidths[0] {
+		src, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return ResponsiveImage{}, NewHTTPError(fmt.Errorf("failed to decode image: %w", err), http.StatusUnprocessableEntity)
+		}
+		for _, width := range imageWidths {
+			if width >= cfg.Width {
+				break
+			}
+			height := max(1, cfg.Height*width/cfg.Width)
+			dst := image.NewRGBA(image.Rect(0, 0, width, height))
+			draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+
+			variant := imageVariantName(name, width)
+			var buf bytes.Buffer
+			if path.Ext(variant) == ".png" {
+				err = png.Encode(&buf, dst)
+			} else {
+				err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+			}
+			if err != nil {
+				return ResponsiveImage{}, fmt.Errorf("failed to encode %dw variant: %w", width, err)
+			}
+			if err := writeMediaFile(variant, buf.Bytes()); err != nil {
+				return ResponsiveImage{}, err
+			}
+		}
+	}
+
+	img, ok := lookupImage("/media/" + name)
+	if !ok {
+		return ResponsiveImage{}, fmt.Errorf("failed to read back image %s", name)
+	}
+	return img, nil
+}
+
+// writeMediaFile writes a file in the media directory. It's written to a
+// temporary name first so a half written image is never served.
+func writeMediaFile(name string, data []byte) error {
+	p := filepath.Join(mediaDir, filepath.FromSlash(name))
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write media: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write media: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to write media: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return fmt.Errorf("failed to write media: %w", err)
+	}
+	return nil
+}
+
+// uploadImage saves the image in a multipart form field, see saveImage
+func uploadImage(r *http.Request, field string) (ResponsiveImage, error) {
+	file, header, err := r.FormFile(field)
+	var tooLarge *http.MaxBytesError
+	if errors.Is(err, http.ErrMissingFile) {
+		return ResponsiveImage{}, NewHTTPError(fmt.Errorf("choose an image to upload"), http.StatusBadRequest)
+	} else if errors.As(err, &tooLarge) {
+		return ResponsiveImage{}, NewHTTPError(fmt.Errorf("image is larger than %d MB", maxImageUpload>>20), http.StatusRequestEntityTooLarge)
+	} else if err != nil {
+		return ResponsiveImage{}, NewHTTPError(fmt.Errorf("invalid upload: %w", err), http.StatusBadRequest)
+	}
+	defer file.Close()
+	if header.Size > maxImageUpload {
+		return ResponsiveImage{}, NewHTTPError(fmt.Errorf("image is larger than %d MB", maxImageUpload>>20), http.StatusRequestEntityTooLarge)
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return ResponsiveImage{}, fmt.Errorf("failed to read upload: %w", err)
+	}
+	return saveImage(header.Filename, data)
+}
+
+// reloadAfterUpload reloads posts after an image is uploaded, since a post
+// may already link to it and is rendered with the image's size and variants
+func (app *App) reloadAfterUpload(ctx context.Context) {
+	if err := app.ReloadPosts(ctx); err != nil {
+		slog.ErrorContext(ctx, "Failed to reload posts after upload", "error", err)
+	}
+}
+
+// handleAPIMedia uploads an image at POST /api/v1/media, from the file
+// field of a multipart form. Only admins can upload, since images are
+// published with the posts.
+func (app *App) handleAPIMedia(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return NewHTTPError(fmt.Errorf("method not allowed"), http.StatusMethodNotAllowed)
+	}
+	auth, err := app.authenticateRequest(w, r)
+	if err != nil {
+		return err
+	}
+	if err := requireScope(auth, "media:write"); err != nil {
+		return err
+	}
+	if !isAdmin(&auth.User) {
+		return NewHTTPError(fmt.Errorf("only admins can upload images"), http.StatusForbidden)
+	}
+	if err := app.checkAdminGuard(w, r); err != nil {
+		return err
+	}
+
+	// Room for the rest of the form on top of the image
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageUpload+1<<20)
+	img, err := uploadImage(r, "file")
+	if err != nil {
+		return err
+	}
+	slog.InfoContext(r.Context(), "Image uploaded", "url", img.URL, "variants", len(img.Variants), "user_id", auth.Actor.ID)
+	app.publishMedia()
+	app.reloadAfterUpload(r.Context())
+
+	w.Header().Set("Location", img.URL)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	return writeJSON(w, img)
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Job is background work run on a schedule
+type Job struct {
+	// Name is used in the JOB_SCHEDULE_ variable and the jobs table
+	Name string
+	// Schedule is the default schedule, see parseSchedule
+	Schedule string
+	// Timeout cancels a run that takes longer
+	Timeout time.Duration
+	// Jitter delays each run by up to this much, so instances sharing a
+	// database don't all start at the same moment
+	Jitter time.Duration
+	Run    func(ctx context.Context, app *App, now time.Time) error
+}
+
+// jobs are the scheduled jobs, with schedules overridden by
+// JOB_SCHEDULE_<NAME>
+var jobs = []Job{
+	{
+		Name: "cleanup", Schedule: "@hourly", Timeout: 10 * time.Minute, Jitter: time.Minute,
+		Run: func(ctx context.Context, app *App, now time.Time) error {
+			return app.CleanupExpiredData(ctx)
+		},
+	},
+	{
+		Name: "retention", Schedule: "30 * * * *", Timeout: 30 * time.Minute, Jitter: 5 * time.Minute,
+		Run: func(ctx context.Context, app *App, now time.Time) error {
+			cfg, err := retentionConfig(app.Config)
+			if err != nil {
+				return err
+			}
+			return app.EnforceRetention(ctx, cfg, now)
+		},
+	},
+	{
+		Name: "syndication", Schedule: "* * * * *", Timeout: 5 * time.Minute, Jitter: 10 * time.Second,
+		Run: func(ctx context.Context, app *App, now time.Time) error {
+			return app.SyndicatePending(ctx, now)
+		},
+	},
+	{
+		Name: "digests", Schedule: "@hourly", Timeout: 10 * time.Minute, Jitter: time.Minute,
+		Run: func(ctx context.Context, app *App, now time.Time) error {
+			return app.SendDueDigests(ctx, now)
+		},
+	},
+	{
+		Name: "exports", Schedule: "15 * * * *", Timeout: 10 * time.Minute, Jitter: time.Minute,
+		Run: func(ctx context.Context, app *App, now time.Time) error {
+			cfg, ok, err := exportConfig(app.Config)
+			if err != nil || !ok {
+				return err
+			}
+			return app.ExportAnalytics(ctx, cfg, now)
+		},
+	},
+}
+
+// jobSchedules returns each job's schedule, the default overridden by
+// JOB_SCHEDULE_<NAME> like JOB_SCHEDULE_DIGESTS="0 7 * * *". A job set to
+// "off" isn't in the map.
+func jobSchedules(c Config) (map[string]cronSchedule, error) {
+	schedules := make(map[string]cronSchedule)
+	for _, job := range jobs {
+		expr := job.Schedule
+		if v, ok := c.JobSchedules[job.Name]; ok {
+			expr = v
+		}
+		if expr == "off" {
+			continue
+		}
+		s, err := parseSchedule(expr)
+		if err != nil {
+			return nil, fmt.Errorf("JOB_SCHEDULE_%s: %w", strings.ToUpper(job.Name), err)
+		}
+		schedules[job.Name] = s
+	}
+	for name := range c.JobSchedules {
+		if !slices.ContainsFunc(jobs, func(j Job) bool { return j.Name == name }) {
+			return nil, fmt.Errorf("unknown job JOB_SCHEDULE_%s", strings.ToUpper(name))
+		}
+	}
+	return schedules, nil
+}
+
+// scheduledJob is a job this instance runs
+type scheduledJob struct {
+	Job
+	schedule cronSchedule
+	// next is when this instance next runs it, in Unix nanoseconds
+	next atomic.Int64
+}
+
+// StartJobs runs each job that isn't switched off on its schedule
+func (app *App) StartJobs() error {
+	schedules, err := jobSchedules(app.Config)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		s, ok := schedules[job.Name]
+		if !ok {
+			continue
+		}
+		sj := &scheduledJob{Job: job, schedule: s}
+		app.jobs = append(app.jobs, sj)
+
+		go func() {
+			for {
+				next := sj.schedule.Next(time.Now())
+				if sj.Jitter > 0 {
+					next = next.Add(rand.N(sj.Jitter))
+				}
+				sj.next.Store(next.UnixNano())
+				time.Sleep(time.Until(next))
+				app.runJob(context.Background(), sj.Job)
+			}
+		}()
+	}
+	return nil
+}
+
+// runJob runs a job once, unless a run is already going here or on another
+// instance, and records how it went in the jobs table
+func (app *App) runJob(ctx context.Context, job Job) {
+	ctx, span := app.startTrace(ctx, "job "+job.Name, otlpString("job.name", job.Name))
+	defer span.End()
+
+	started := time.Now()
+	claimed, err := app.claimJob(ctx, job, started)
+	if err != nil {
+		slog.Error("Failed to start job", "job", job.Name, "error", err)
+		return
+	} else if !claimed {
+		slog.Info("Job is still running, skipping this run", "job", job.Name)
+		return
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, job.Timeout)
+	err = job.Run(runCtx, app, started)
+	cancel()
+	duration := time.Since(started)
+	if err != nil {
+		slog.Error("Job failed", "job", job.Name, "error", err, "duration_ms", duration.Milliseconds())
+	}
+	span.SetError(err)
+
+	if err := app.finishJob(ctx, job, started, duration, err); err != nil {
+		slog.Error("Failed to record job run", "job", job.Name, "error", err)
+	}
+}
+
+// claimJob marks a job as running, or returns false if it already is. A
+// run that's gone on longer than its timeout is taken to have died with
+// its instance, so it doesn't hold the job up forever.
+func (app *App) claimJob(ctx context.Context, job Job, now time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := app.DB.ExecContext(ctx, "INSERT INTO jobs (name) VALUES (?) ON CONFLICT (name) DO NOTHING", job.Name)
+	if err != nil {
+		return false, fmt.Errorf("failed to add job: %w", err)
+	}
+	res, err := app.DB.ExecContext(ctx,
+		"UPDATE jobs SET running_since = ? WHERE name = ? AND (running_since IS NULL OR running_since < ?)",
+		now, job.Name, now.Add(-job.Timeout),
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim job: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to claim job: %w", err)
+	}
+	return n == 1, nil
+}
+
+// finishJob records the end of a run claimed by claimJob
+func (app *App) finishJob(ctx context.Context, job Job, started time.Time, duration time.Duration, runErr error) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), queryTimeout)
+	defer cancel()
+
+	var lastError string
+	var failed int
+	succeeded := sql.NullTime{Time: started, Valid: true}
+	if runErr != nil {
+		lastError, failed, succeeded = runErr.Error(), 1, sql.NullTime{}
+	}
+	_, err := app.DB.ExecContext(ctx, `
+		UPDATE jobs SET
+			running_since = NULL,
+			last_started_at = ?,
+			last_duration_ms = ?,
+			last_error = ?,
+			last_success_at = COALESCE(?, last_success_at),
+			runs = runs + 1,
+			failures = failures + ?
+		WHERE name = ?
+	`, started, duration.Milliseconds(), lastError, succeeded, failed, job.Name)
+	if err != nil {
+		return fmt.Errorf("failed to update job: %w", err)
+	}
+	return nil
+}
+
+// JobStatus is how a job has been doing, for the admin jobs page
+type JobStatus struct {
+	Name     string
+	Schedule string
+	// Off is set for jobs switched off with JOB_SCHEDULE_<NAME>=off
+	Off bool
+	// NextRun is when this instance next runs the job
+	NextRun      time.Time
+	RunningSince time.Time
+	LastStarted  time.Time
+	LastDuration time.Duration
+	LastError    string
+	LastSuccess  time.Time
+	Runs         int
+	Failures     int
+}
+
+// Health sums up the job's status in a word
+func (s JobStatus) Health() string {
+	switch {
+	case s.Off:
+		return "off"
+	case !s.RunningSince.IsZero():
+		return "running"
+	case s.LastStarted.IsZero():
+		return "waiting"
+	case s.LastError != "":
+		return "failing"
+	default:
+		return "ok"
+	}
+}
+
+// ListJobs returns the status of every job, in the order they're defined
+func (app *App) ListJobs(ctx context.Context) ([]JobStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	rows, err := app.DB.QueryContext(ctx, `
+		SELECT name, running_since, last_started_at, last_duration_ms, last_error, last_success_at, runs, failures
+		FROM jobs
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %w", err)
+	}
+	defer rows.Close()
+
+	recorded := make(map[string]JobStatus)
+	for rows.Next() {
+		var s JobStatus
+		var running, started, success sql.NullTime
+		var durationMS int64
+		if err := rows.Scan(&s.Name, &running, &started, &durationMS, &s.LastError, &success, &s.Runs, &s.Failures); err != nil {
+			return nil, fmt.Errorf("failed to scan job: %w", err)
+		}
+		s.RunningSince, s.LastStarted, s.LastSuccess = running.Time, started.Time, success.Time
+		s.LastDuration = time.Duration(durationMS) * time.Millisecond
+		recorded[s.Name] = s
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating jobs: %w", err)
+	}
+
+	var statuses []JobStatus
+	for _, job := range jobs {
+		s := recorded[job.Name]
+		s.Name = job.Name
+		s.Off = true
+		if v, ok := app.Config.JobSchedules[job.Name]; ok {
+			s.Schedule = v
+		} else {
+			s.Schedule = job.Schedule
+		}
+		if i := slices.IndexFunc(app.jobs, func(sj *scheduledJob) bool { return sj.Name == job.Name }); i >= 0 {
+			s.Off = false
+			if next := app.jobs[i].next.Load(); next > 0 {
+				s.NextRun = time.Unix(0, next).UTC()
+			}
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, nil
+}
+
+// JobsPage holds data for the jobs template
+type JobsPage struct {
+	Meta PageMeta
+	Jobs []JobStatus
+}
+
+// handleAdminJobs shows how the scheduled jobs are doing and runs one on
+// demand. Callers must wrap it with RequireRole(RoleAdmin, ...).
+func (app *App) handleAdminJobs(w http.ResponseWriter, r *http.Request, count int, user *User) error {
+	switch {
+	case r.URL.Path == "/admin/jobs" && r.Method == http.MethodGet:
+	case r.URL.Path == "/admin/jobs/run" && r.Method == http.MethodPost:
+		name := r.FormValue("name")
+		i := slices.IndexFunc(app.jobs, func(sj *scheduledJob) bool { return sj.Name == name })
+		if i < 0 {
+			return NewHTTPError(fmt.Errorf("no scheduled job %q", name), http.StatusNotFound)
+		}
+		if err := app.Audit(r.Context(), *user, nil, "job.run", name); err != nil {
+			return err
+		}
+		// The run outlives the request, and shows up on the page once it
+		// has claimed the job
+		go app.runJob(context.Background(), app.jobs[i].Job)
+		http.Redirect(w, r, "/admin/jobs", http.StatusSeeOther)
+		return nil
+	default:
+		return app.notFound(w, r)
+	}
+
+	statuses, err := app.ListJobs(r.Context())
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html")
+	data := JobsPage{
+		Meta: PageMeta{
+			Title: "Jobs",
+			Count: count,
+			User:  user,
+
+			CSRFToken: csrfToken(r),
+		},
+		Jobs: statuses,
+	}
+	if err := app.render(w, r, http.StatusOK, "jobs.html", data); err != nil {
+		return fmt.Errorf("failed to render jobs page: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor systemd passes to activated services
+const listenFDsStart = 3
+
+// newListener picks where the server listens, in order of preference:
+//
+//   - a socket inherited from systemd socket activation (LISTEN_FDS)
+//   - a Unix domain socket at LISTEN_SOCKET, with SOCKET_MODE permissions
+//   - TCP on PORT, or HTTPS_PORT with ACME_DOMAINS
+func newListener(cfg Config) (net.Listener, error) {
+	if l, err := systemdListener(); l != nil || err != nil {
+		// Like LISTEN_SOCKET, see Config.validate
+		if l != nil && l.Addr().Network() == "unix" && !cfg.TrustProxy {
+			l.Close()
+			return nil, fmt.Errorf("the socket passed in by systemd is a Unix socket, which needs TRUST_PROXY")
+		}
+		return l, err
+	}
+
+	if cfg.ListenSocket != "" {
+		return unixListener(cfg.ListenSocket, cfg.SocketMode)
+	}
+
+	port := strconv.Itoa(cfg.Port)
+	if len(cfg.ACMEDomains) > 0 {
+		port = strconv.Itoa(cfg.HTTPSPort)
+	}
+	l, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on port %s: %w", port, err)
+	}
+	slog.Info("Listening on TCP", "port", port)
+	return l, nil
+}
+
+// systemdListener returns the socket passed in by systemd, or nil if the
+// process wasn't socket activated
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	if n > 1 {
+		slog.Warn("Multiple sockets passed by systemd, using the first", "count", n)
+	}
+
+	// Don't pass the sockets on to any child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(uintptr(listenFDsStart), "systemd-socket")
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use systemd socket: %w", err)
+	}
+	// FileListener dups the descriptor
+	f.Close()
+
+	slog.Info("Listening on systemd socket", "addr", l.Addr().String())
+	return l, nil
+}
+
+// unixListener listens on a Unix domain socket, replacing a stale socket file
+// left behind by a previous run
+func unixListener(path, mode string) (net.Listener, error) {
+	perm := os.FileMode(0660)
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SOCKET_MODE %q: %w", mode, err)
+		}
+		perm = os.FileMode(m)
+	}
+
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		// Only remove the socket if nothing is serving on it
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is already in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to check socket path: %w", err)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+
+	slog.Info("Listening on Unix socket", "path", path, "mode", fmt.Sprintf("%#o", perm))
+	return l, nil
+}
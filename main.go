@@ -2,42 +2,54 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
+	"flag"
 	"fmt"
 	"html/template"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
 	_ "github.com/mattn/go-sqlite3"
-	"github.com/yuin/goldmark"
-	"gopkg.in/yaml.v3"
 )
 
-//go:embed tmpl/*.html
+//go:embed tmpl/*.html tmpl/*.txt
 var tmplFS embed.FS
-var tmpl *template.Template
 
 // Post represents a blog post with frontmatter
 type Post struct {
-	Title    string    `yaml:"title"`
-	Date     time.Time `yaml:"date"`
-	Content  template.HTML
-	Slug     string
-	FileName string
+	Title       string    `yaml:"title"`
+	Date        time.Time `yaml:"date"`
+	Description string    `yaml:"description"`
+	Image       string    `yaml:"image"`
+	Slug        string    `yaml:"slug"`   // defaults to the file name
+	Layout      string    `yaml:"layout"` // one of postLayouts
+	Content     template.HTML
+	FileName    string
+	Hash        string
+	ModTime     time.Time
 }
 
 // PageData is the common data structure for page templates
 type PageData struct {
-	Posts   []Post
-	Post    Post
-	Devices []Device
-	Meta    PageMeta
+	Posts []Post
+	Post  Post
+	Meta  PageMeta
+
+	// Mentions are the approved webmentions of Post
+	Mentions []Webmention
 }
 
 type PageMeta struct {
@@ -45,73 +57,217 @@ type PageMeta struct {
 	Count int
 	NoNav bool
 	User  *User
+
+	// CSRFToken must be included in forms that POST
+	CSRFToken string
+
+	// Used for Open Graph and Twitter card tags
+	Description  string
+	Image        string
+	CanonicalURL string
 }
 
+const siteDescription = "A small site with a blog, built with Go 🌷"
+
 func main() {
 	_ = godotenv.Load() // it's ok if there's no .env
 
 	// Setup structured logging
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	logger := slog.New(contextHandler{slog.NewJSONHandler(os.Stdout, nil)})
 	slog.SetDefault(logger)
 
-	// Initialize database
-	if err := InitDB(); err != nil {
-		slog.Error("Failed to initialize database", "error", err)
-		panic(1)
+	// Settings come from the environment and an optional YAML file
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "YAML `file` of settings, by environment variable name")
+	printConfigFlag := flag.Bool("print-config", false, "print the settings with secrets redacted, and exit")
+	flag.Parse()
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		slog.Error("Invalid config", "error", err)
+		os.Exit(1)
+	}
+	if *printConfigFlag {
+		if err := printConfig(os.Stdout, config); err != nil {
+			slog.Error("Failed to print config", "error", err)
+			os.Exit(1)
+		}
+		return
 	}
-	defer DB.Close()
 
-	// Run cleanup routine for expired sessions and magic links periodically
-	go func() {
-		for {
-			if err := CleanupExpiredData(); err != nil {
-				slog.Error("Failed to cleanup expired data", "error", err)
-			}
-			time.Sleep(1 * time.Hour)
+	// `tulip preflight` checks the environment without starting the server
+	if flag.Arg(0) == "preflight" {
+		if !preflight(os.Stdout, config) {
+			os.Exit(1)
+		}
+		return
+	}
+	// `tulip sync-media` publishes the media directory to MEDIA_BUCKET
+	if flag.Arg(0) == "sync-media" {
+		if err := syncMediaCommand(config, flag.Args()[1:]); err != nil {
+			slog.Error("Failed to sync media", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+	// `tulip backup` backs up the database to BACKUP_BUCKET now
+	if flag.Arg(0) == "backup" {
+		if err := backupCommand(config); err != nil {
+			slog.Error("Failed to back up database", "error", err)
+			os.Exit(1)
 		}
-	}()
+		return
+	}
+	slog.Info("Loaded config", "file", *configPath, "settings", config)
+	if !preflight(os.Stderr, config) {
+		slog.Error("Preflight checks failed, see the hints above")
+		panic(1)
+	}
 
-	// Load blog posts
-	posts, err := loadPosts("./blog")
-	if err != nil {
-		slog.Error("Failed to load posts", "error", err)
+	// Login sessions live in SQLite unless configured otherwise
+	if err := loadSessionPolicy(config); err != nil {
+		slog.Error("Failed to configure sessions", "error", err)
+		panic(1)
 	}
 
-	// Parse templates with a function map for template definitions
-	tmpl = template.New("").Funcs(template.FuncMap{
-		"formatDate": func(t time.Time) string {
-			return t.Format("January 2, 2006")
-		},
-	})
+	// Sign in with GitHub or Google when configured
+	loadOAuthProviders(config)
+
+	// Configure markdown rendering and code highlighting
+	if err := initMarkdown(config.HighlightStyle); err != nil {
+		slog.Error("Failed to initialize markdown", "error", err)
+		panic(1)
+	}
+
+	// Load WASM plugins before anything that renders content
+	if err := loadPlugins(context.Background(), config.PluginsDir); err != nil {
+		slog.Error("Failed to load plugins", "error", err)
+		panic(1)
+	}
+
+	documentAPI()
+
+	app, err := NewApp(config)
+	if err != nil {
+		slog.Error("Failed to start app", "error", err)
+		panic(1)
+	}
+	defer app.DB.Close()
+	if err := app.Start(); err != nil {
+		slog.Error("Failed to start background work", "error", err)
+		panic(1)
+	}
 
-	// Parse all templates
-	tmpl, err = tmpl.ParseFS(tmplFS, "tmpl/*.html")
+	// Start server
+	listener, err := newListener(config)
 	if err != nil {
-		slog.Error("Failed to parse templates", "error", err)
+		slog.Error("Failed to listen", "error", err)
 		panic(1)
 	}
+	slog.Info("Server starting", "addr", listener.Addr().String())
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	if err := app.serve(listener, stop); err != nil {
+		slog.Error("Server stopped", "error", err)
+		return
+	}
+	slog.Info("Server stopped")
+}
+
+// Handler returns the site's routes, with request logging and session
+// refreshing in front of them
+func (app *App) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	// Progressive web app files, kept out of the root handler so they
+	// don't count as page views
+	mux.HandleFunc("/manifest.webmanifest", app.ErrorHandler(handleManifest))
+	mux.HandleFunc("/icon.svg", app.ErrorHandler(handleIcon))
+	mux.HandleFunc("/media/", app.ErrorHandler(handleMedia))
+	mux.HandleFunc("/sw.js", app.ErrorHandler(app.handleServiceWorker))
+	mux.HandleFunc("/challenge/", app.ErrorHandler(app.handleChallenge))
+	mux.HandleFunc("/push/subscribe", app.ErrorHandler(CSRFProtect(nil, app.handlePushSubscription)))
+	mux.HandleFunc("/push/unsubscribe", app.ErrorHandler(CSRFProtect(nil, app.handlePushSubscription)))
+	if app.Config.isDevelopment() {
+		mux.HandleFunc("/dev/mailbox", app.ErrorHandler(app.handleDevMailbox))
+		mux.HandleFunc("/dev/mailbox/", app.ErrorHandler(app.handleDevMailbox))
+	}
+	// Live device status for the devices page, which isn't a page view
+	mux.HandleFunc("/devices/events", app.ErrorHandler(app.handleDeviceEvents))
+	// Uploaded avatars, which don't count as views either
+	mux.HandleFunc("/avatars/", app.ErrorHandler(app.handleAvatar))
+	// View count badges for other sites to embed, which don't count as views
+	mux.HandleFunc("/badge/", app.ErrorHandler(app.handleBadge))
+	// Webmentions are posted by other sites, so they have no CSRF token
+	mux.HandleFunc("/webmention", app.ErrorHandler(app.handleWebmention))
+	// Files for crawlers and discovery, see wellKnownHandlers
+	mux.HandleFunc("/robots.txt", app.ErrorHandler(app.handleRobotsTxt))
+	mux.HandleFunc("/humans.txt", app.ErrorHandler(app.handleHumansTxt))
+	mux.HandleFunc("/.well-known/", app.ErrorHandler(app.handleWellKnown))
+
+	// API documentation
+	mux.HandleFunc("/api/openapi.json", app.ErrorHandler(handleOpenAPI))
 
-	// HTTP handlers with error handling
-	http.HandleFunc("/", ErrorHandler(func(w http.ResponseWriter, r *http.Request) error {
-		ctx := r.Context()
+	// The versioned JSON API, which always answers with JSON. Requests with
+	// an API token don't rely on cookies.
+	mux.HandleFunc(apiV1Prefix+"/", app.APIHandler(CSRFProtect(hasBearerToken, app.handleAPIV1)))
 
+	// HTTP handlers with error handling. Only the pages siteRoute serves
+	// check the CSRF token, since the rest go to the upstream.
+	mux.HandleFunc("/", app.ErrorHandler(IssueCSRFToken(AdminGuard(app.Config.AdminGuard, func(w http.ResponseWriter, r *http.Request) (err error) {
 		// Get current user if logged in
 		var user *User
-		currentUser, err := getCurrentUser(r)
+		currentUser, err := app.getCurrentUser(r)
 		if err == nil {
 			user = &currentUser
 		}
 
-		// Increment counter
-		count, err := IncrementCounter()
-		if err != nil {
-			return fmt.Errorf("failed to update counter: %w", err)
+		// Record the view once the page is served, so paths that aren't
+		// pages, like 404 probes and redirects, don't end up in page_views.
+		// Short links count their own clicks, see handleShortlink. Pages
+		// show the total including their own view.
+		count := app.PageViewTotal() + 1
+		rec := &statusRecorder{ResponseWriter: w}
+		w = rec
+		defer func() {
+			if err == nil && rec.status >= 200 && rec.status < 300 {
+				app.RecordPageView(r.URL.Path)
+			}
+		}()
+
+		serve := app.siteRoute(w, r, user, count)
+		if serve == nil {
+			// Forward anything else to the upstream when proxying. The
+			// upstream protects itself against CSRF.
+			if app.upstream != nil {
+				app.upstream.ServeHTTP(w, r)
+				return nil
+			}
+
+			// 404 for anything else
+			return app.notFound(w, r)
+		}
+
+		// Requests with an API token don't rely on cookies
+		if !hasBearerToken(r) {
+			if err := checkCSRF(r); err != nil {
+				return err
+			}
 		}
+		return serve()
+	}))))
 
-		slog.InfoContext(ctx, "Page view", "count", count, "path", r.URL.Path, "method", r.Method)
+	return app.traceRequests(RequestLogger(app.Config.TrustProxy, app.trackLatency(Compress(app.RefreshSessions(mux)))))
+}
+
+// siteRoute returns the handler for a page this site serves, or nil if the
+// request falls through to the upstream or a 404
+func (app *App) siteRoute(w http.ResponseWriter, r *http.Request, user *User, count int) func() error {
+	// The site's posts as of this request
+	site := app.siteFor(r)
+	blog := site.Blog()
 
-		// Homepage
-		if r.URL.Path == "/" {
+	// Homepage
+	if r.URL.Path == "/" {
+		return func() error {
 			w.Header().Set("Content-Type", "text/html")
 			data := PageData{
 				Meta: PageMeta{
@@ -119,28 +275,46 @@ func main() {
 					Title: "My Site",
 					NoNav: true, // Homepage has its own layout
 					User:  user,
+
+					Description:  siteDescription,
+					CanonicalURL: canonicalURL(r),
+
+					CSRFToken: csrfToken(r),
 				},
 			}
-			if err := tmpl.ExecuteTemplate(w, "home.html", data); err != nil {
+			if err := app.render(w, r, http.StatusOK, "home.html", data); err != nil {
 				return fmt.Errorf("failed to render home page: %w", err)
 			}
 			return nil
 		}
+	}
 
-		// Login page
-		if r.URL.Path == "/login" {
+	// Login page
+	if r.URL.Path == "/login" {
+		return func() error {
 			if r.Method == http.MethodPost {
-				return handleLoginWithError(w, r)
+				return app.handleLoginWithError(w, r)
+			}
+
+			challenge, err := loginChallenge.Issue(app.challengeKey, app.Config.ChallengePOW)
+			if err != nil {
+				return err
 			}
 
 			w.Header().Set("Content-Type", "text/html")
-			if err := tmpl.ExecuteTemplate(w, "login.html", LoginPage{
-				Status: r.URL.Query().Get("status"),
-				Error:  r.URL.Query().Get("error"),
+			if err := app.render(w, r, http.StatusOK, "login.html", LoginPage{
+				Status:    r.URL.Query().Get("status"),
+				Error:     r.URL.Query().Get("error"),
+				Providers: loginProviders(),
+				Challenge: challenge,
 				Meta: PageMeta{
 					Title: "Login",
 					Count: count,
 					User:  user,
+
+					CanonicalURL: canonicalURL(r),
+
+					CSRFToken: csrfToken(r),
 				},
 			},
 			); err != nil {
@@ -148,49 +322,189 @@ func main() {
 			}
 			return nil
 		}
+	}
+
+	// Short links, which count their own clicks
+	if strings.HasPrefix(r.URL.Path, shortlinkPrefix) {
+		return func() error {
+			return app.handleShortlink(w, r)
+		}
+	}
+
+	// Search
+	if r.URL.Path == "/search" {
+		return func() error {
+			return app.handleSearch(w, r, blog.Search, count, user)
+		}
+	}
+
+	// Admin dashboard
+	if r.URL.Path == "/admin" || strings.HasPrefix(r.URL.Path, "/admin/") {
+		return func() error {
+			return app.RequireRole(RoleAdmin, func(w http.ResponseWriter, r *http.Request) error {
+				return app.handleAdmin(w, r, count, user)
+			})(w, r)
+		}
+	}
+
+	// API documentation viewer
+	if r.URL.Path == "/api" || r.URL.Path == "/api/docs" {
+		return func() error {
+			return app.handleAPIDocs(w, r, count, user)
+		}
+	}
+
+	// Per-post view stats
+	if r.URL.Path == "/stats" {
+		return func() error {
+			return app.RequireRole(RoleAdmin, func(w http.ResponseWriter, r *http.Request) error {
+				return app.handleStats(w, r, blog.Posts, count, user)
+			})(w, r)
+		}
+	}
+
+	// Login verification
+	if r.URL.Path == "/login/verify" {
+		return func() error {
+			return app.WithRequestTx(app.handleLoginVerifyWithError)(w, r)
+		}
+	}
+
+	// Second factor after a login link or OAuth
+	if r.URL.Path == "/login/2fa" {
+		return func() error {
+			return app.handleTwoFactorLogin(w, r, count)
+		}
+	}
+
+	// Account settings - protected, only for logged-in users
+	if r.URL.Path == "/settings" || strings.HasPrefix(r.URL.Path, "/settings/") {
+		return func() error {
+			if user == nil {
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+				return nil
+			}
+			return app.handleSettings(w, r, count, user)
+		}
+	}
+
+	// OAuth sign in
+	if strings.HasPrefix(r.URL.Path, "/auth/") {
+		return func() error {
+			return app.handleOAuth(w, r)
+		}
+	}
+
+	// Feature flag values for the visitor
+	if r.URL.Path == "/api/flags" {
+		return func() error {
+			return app.handleFlags(w, r, user)
+		}
+	}
+
+	// Passkeys can be switched off with the passkeys flag
+	if (strings.HasPrefix(r.URL.Path, "/login/passkey/") || r.URL.Path == "/passkeys" || strings.HasPrefix(r.URL.Path, "/passkeys/")) &&
+		!app.requestFlagEnabled(r, user, "passkeys") {
+		return func() error {
+			return NewHTTPError(fmt.Errorf("page not found: %s", r.URL.Path), http.StatusNotFound)
+		}
+	}
 
-		// Login verification
-		if r.URL.Path == "/login/verify" {
-			return handleLoginVerifyWithError(w, r)
+	// Passkey login
+	if r.URL.Path == "/login/passkey/begin" {
+		return func() error {
+			return app.handlePasskeyLoginBegin(w, r)
 		}
+	}
+	if r.URL.Path == "/login/passkey/finish" {
+		return func() error {
+			return app.handlePasskeyLoginFinish(w, r)
+		}
+	}
+
+	// Passkey management - protected, only for logged-in users
+	if r.URL.Path == "/passkeys" || strings.HasPrefix(r.URL.Path, "/passkeys/") {
+		return func() error {
+			if user == nil {
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+				return nil
+			}
+			return app.handlePasskeys(w, r, count, user)
+		}
+	}
 
-		// Logout
-		if r.URL.Path == "/logout" && r.Method == http.MethodPost {
-			return handleLogoutWithError(w, r)
+	// Logout
+	if r.URL.Path == "/logout" && r.Method == http.MethodPost {
+		return func() error {
+			return app.handleLogoutWithError(w, r)
 		}
+	}
+
+	// Blog index
+	if r.URL.Path == "/blog" || r.URL.Path == "/blog/" {
+		return func() error {
+			if checkNotModified(w, r, app.pageETag(r, blog.Hash, user), blog.ModTime) {
+				return nil
+			}
 
-		// Blog index
-		if r.URL.Path == "/blog" || r.URL.Path == "/blog/" {
 			w.Header().Set("Content-Type", "text/html")
 			data := PageData{
 				Meta: PageMeta{
 					Title: "Blog",
 					Count: count,
 					User:  user,
+
+					Description:  siteDescription,
+					CanonicalURL: canonicalURL(r),
+
+					CSRFToken: csrfToken(r),
 				},
-				Posts: posts,
+				Posts: blog.Posts,
 			}
-			if err := tmpl.ExecuteTemplate(w, "blog.html", data); err != nil {
+			if err := app.render(w, r, http.StatusOK, "blog.html", data); err != nil {
 				return fmt.Errorf("failed to render blog index: %w", err)
 			}
 			return nil
 		}
+	}
+
+	// Blog post
+	if strings.HasPrefix(r.URL.Path, "/blog/") {
+		slug := strings.TrimPrefix(r.URL.Path, "/blog/")
+		for _, post := range blog.Posts {
+			if post.Slug == slug {
+				return func() error {
+					mentions, err := app.PostWebmentions(r.Context(), site.key(post.Slug))
+					if err != nil {
+						return err
+					}
+					// New mentions change the page as much as edits do
+					mentionsHash, modified := webmentionsVersion(mentions)
+					if post.ModTime.After(modified) {
+						modified = post.ModTime
+					}
+					w.Header().Set("Link", "<"+baseURL(r)+"/webmention>; rel=\"webmention\"")
+					if checkNotModified(w, r, app.pageETag(r, post.Hash+":"+mentionsHash, user), modified) {
+						return nil
+					}
 
-		// Blog post
-		if strings.HasPrefix(r.URL.Path, "/blog/") {
-			slug := strings.TrimPrefix(r.URL.Path, "/blog/")
-			for _, post := range posts {
-				if post.Slug == slug {
 					w.Header().Set("Content-Type", "text/html")
 					data := PageData{
 						Meta: PageMeta{
 							Title: post.Title,
 							Count: count,
 							User:  user,
+
+							Description:  post.Description,
+							Image:        absoluteURL(r, post.Image),
+							CanonicalURL: canonicalURL(r),
+
+							CSRFToken: csrfToken(r),
 						},
-						Post: post,
+						Post:     post,
+						Mentions: mentions,
 					}
-					if err := tmpl.ExecuteTemplate(w, "blog.html", data); err != nil {
+					if err := app.render(w, r, http.StatusOK, "post.html", data); err != nil {
 						return fmt.Errorf("failed to render blog post: %w", err)
 					}
 					return nil
@@ -198,124 +512,559 @@ func main() {
 			}
 		}
 
-		// Devices page - protected, only for logged-in users
-		if r.URL.Path == "/devices" {
-			// Require authentication
+		// Keep old links working after a post's slug changes
+		if newSlug, ok, err := app.SlugRedirect(r.Context(), site, slug); err != nil {
+			return func() error { return err }
+		} else if ok {
+			return func() error {
+				http.Redirect(w, r, "/blog/"+newSlug, http.StatusMovedPermanently)
+				return nil
+			}
+		}
+	}
+
+	// Device API, for agents with an API token or a logged-in browser.
+	// These paths predate /api/v1 and are kept for existing agents.
+	if r.URL.Path == "/api/devices" || strings.HasPrefix(r.URL.Path, "/api/devices/") {
+		return func() error {
+			return app.handleDeviceAPI(w, r)
+		}
+	}
+
+	// Device facts explorer - protected, only for logged-in users
+	if strings.HasPrefix(r.URL.Path, "/devices/") && strings.HasSuffix(r.URL.Path, "/facts") {
+		return func() error {
 			if user == nil {
 				http.Redirect(w, r, "/login", http.StatusSeeOther)
 				return nil
 			}
+			return app.handleDeviceFacts(w, r, count, user)
+		}
+	}
 
-			// Insert sample devices for new users
-			err = InsertSampleDevices(user.ID)
-			if err != nil {
-				return fmt.Errorf("failed to insert sample devices: %w", err)
+	// Agent config for a device or a tag
+	if strings.HasPrefix(r.URL.Path, "/devices/") && strings.HasSuffix(r.URL.Path, "/config") {
+		return func() error {
+			if user == nil {
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+				return nil
 			}
+			return app.handleAgentConfig(w, r, count, user)
+		}
+	}
 
-			// Get devices for this user
-			devices, err := GetDevices(user.ID)
-			if err != nil {
-				return fmt.Errorf("failed to get devices: %w", err)
+	// Renaming, tagging and deleting devices
+	if strings.HasPrefix(r.URL.Path, "/devices/") && (strings.HasSuffix(r.URL.Path, "/edit") || strings.HasSuffix(r.URL.Path, "/delete")) {
+		return func() error {
+			if user == nil {
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+				return nil
 			}
+			return app.handleDeviceEdit(w, r, count, user)
+		}
+	}
 
-			w.Header().Set("Content-Type", "text/html")
-			data := PageData{
-				Meta: PageMeta{
-					Title: "Your Devices",
-					Count: count,
-					User:  user,
-				},
-				Devices: devices,
+	// Devices page - protected, only for logged-in users
+	if r.URL.Path == "/devices" {
+		return func() error {
+			// Require authentication
+			if user == nil {
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+				return nil
 			}
 
-			if err := tmpl.ExecuteTemplate(w, "devices.html", data); err != nil {
-				return fmt.Errorf("failed to render devices page: %w", err)
-			}
-			return nil
+			return app.handleDevices(w, r, count, user)
 		}
+	}
 
-		// 404 for anything else
-		return NewHTTPError(fmt.Errorf("page not found: %s", r.URL.Path), http.StatusNotFound)
-	}))
+	return nil
+}
 
-	// Start server
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
-	slog.Info("Server starting", "port", port)
-	slog.Error("Server stopped", "error", http.ListenAndServe(":"+port, nil))
+// documentAPI describes the JSON endpoints for /api/openapi.json
+func documentAPI() {
+	apiSpec.Add(http.MethodPost, "/push/subscribe", APIOperation{
+		Summary:     "Subscribe to new post notifications",
+		Description: "Stores a subscription from PushManager.subscribe. It's linked to the user when logged in. Anonymous subscriptions need a token from /challenge/push in X-Challenge, and a proof of work nonce in X-Challenge-Nonce if it asks for one.",
+		Tag:         "push",
+		Request:     PushSubscription{},
+		Responses: map[int]APIResponse{
+			http.StatusNoContent:  {Description: "Subscribed"},
+			http.StatusBadRequest: {Description: "Invalid subscription"},
+			http.StatusForbidden:  {Description: "Missing or invalid CSRF token or challenge"},
+		},
+		CSRF: true,
+	})
+	apiSpec.Add(http.MethodGet, "/challenge/push", APIOperation{
+		Summary:     "Get a push subscription challenge",
+		Description: "Returns a single use token. If bits is set, find a nonce where SHA-256 of \"token:nonce\" starts with that many zero bits.",
+		Tag:         "push",
+		Responses: map[int]APIResponse{
+			http.StatusOK: {Description: "A challenge", Body: ChallengeToken{}},
+		},
+	})
+	apiSpec.Add(http.MethodPost, "/push/unsubscribe", APIOperation{
+		Summary: "Unsubscribe from new post notifications",
+		Tag:     "push",
+		Request: PushSubscription{},
+		Responses: map[int]APIResponse{
+			http.StatusNoContent:  {Description: "Unsubscribed"},
+			http.StatusBadRequest: {Description: "Invalid subscription"},
+			http.StatusForbidden:  {Description: "Missing or invalid CSRF token"},
+		},
+		CSRF: true,
+	})
+
+	apiSpec.Add(http.MethodPost, "/login/passkey/begin", APIOperation{
+		Summary:     "Start a passkey login",
+		Description: "Returns options for navigator.credentials.get. The challenge is valid for five minutes.",
+		Tag:         "auth",
+		Responses: map[int]APIResponse{
+			http.StatusOK:        {Description: "PublicKeyCredentialRequestOptions with base64url encoded binary fields"},
+			http.StatusForbidden: {Description: "Missing or invalid CSRF token"},
+		},
+		CSRF: true,
+	})
+	apiSpec.Add(http.MethodPost, "/login/passkey/finish", APIOperation{
+		Summary:     "Finish a passkey login",
+		Description: "Verifies the assertion and sets the session cookie. Binary fields are base64url encoded.",
+		Tag:         "auth",
+		Request:     passkeyAssertion{},
+		Responses: map[int]APIResponse{
+			http.StatusNoContent:       {Description: "Logged in"},
+			http.StatusBadRequest:      {Description: "Malformed assertion or expired challenge"},
+			http.StatusUnauthorized:    {Description: "Unknown passkey or invalid signature"},
+			http.StatusForbidden:       {Description: "Missing or invalid CSRF token"},
+			http.StatusTooManyRequests: {Description: "Too many attempts from this address"},
+		},
+		CSRF: true,
+	})
+	apiSpec.Add(http.MethodPost, "/passkeys/register/begin", APIOperation{
+		Summary:     "Start registering a passkey",
+		Description: "Returns options for navigator.credentials.create. Requires a logged in session.",
+		Tag:         "auth",
+		Responses: map[int]APIResponse{
+			http.StatusOK:        {Description: "PublicKeyCredentialCreationOptions with base64url encoded binary fields"},
+			http.StatusForbidden: {Description: "Missing or invalid CSRF token"},
+		},
+		CSRF: true,
+	})
+	apiSpec.Add(http.MethodPost, "/passkeys/register/finish", APIOperation{
+		Summary:     "Finish registering a passkey",
+		Description: "Stores the credential's public key from getPublicKey(). Binary fields are base64url encoded.",
+		Tag:         "auth",
+		Request:     passkeyRegistration{},
+		Responses: map[int]APIResponse{
+			http.StatusNoContent:  {Description: "Registered"},
+			http.StatusBadRequest: {Description: "Malformed credential, unsupported algorithm or expired challenge"},
+			http.StatusForbidden:  {Description: "Missing or invalid CSRF token"},
+		},
+		CSRF: true,
+	})
+
+	apiSpec.Add(http.MethodGet, "/api/v1/posts", APIOperation{
+		Summary:     "List posts",
+		Description: "Returns every published post, newest first, without its HTML.",
+		Tag:         "posts",
+		Responses: map[int]APIResponse{
+			http.StatusOK: {Description: "The posts", Body: []APIPost{}},
+		},
+	})
+	apiSpec.Add(http.MethodGet, "/api/v1/posts/{slug}", APIOperation{
+		Summary: "Get a post",
+		Tag:     "posts",
+		Responses: map[int]APIResponse{
+			http.StatusOK:       {Description: "The post with its rendered HTML", Body: APIPost{}},
+			http.StatusNotFound: {Description: "No such post"},
+		},
+	})
+	apiSpec.Add(http.MethodGet, "/api/v1/status", APIOperation{
+		Summary:     "Get the site's health",
+		Description: "For external status pages. Needs no login, is limited to 60 requests a minute per client, and can be turned off with PUBLIC_STATUS=off.",
+		Tag:         "status",
+		Responses: map[int]APIResponse{
+			http.StatusOK:                 {Description: "The site's health", Body: SiteStatus{}},
+			http.StatusServiceUnavailable: {Description: "The database is unreachable or the server is shutting down", Body: SiteStatus{}},
+			http.StatusNotFound:           {Description: "The status endpoint is turned off"},
+			http.StatusTooManyRequests:    {Description: "Rate limited, see Retry-After"},
+		},
+	})
+	apiSpec.Add(http.MethodGet, "/api/v1/me", APIOperation{
+		Summary:     "Get your profile",
+		Description: "Works with any API token, whatever its scopes.",
+		Tag:         "users",
+		Responses: map[int]APIResponse{
+			http.StatusOK:           {Description: "Your profile", Body: APIUser{}},
+			http.StatusUnauthorized: {Description: "Not logged in or invalid API token"},
+		},
+	})
+	apiSpec.Add(http.MethodPost, "/api/v1/media", APIOperation{
+		Summary:     "Upload an image",
+		Description: fmt.Sprintf("Send the image as the file field of a multipart/form-data body, up to %d MB. JPEG, PNG and WebP images are resized to each of %v pixels wide that's narrower than the original. Posts that embed the image with the returned markdown get the variants and the image's size. Admins only.", maxImageUpload>>20, imageWidths),
+		Tag:         "media",
+		Responses: map[int]APIResponse{
+			http.StatusCreated:               {Description: "The image and its variants", Body: ResponsiveImage{}},
+			http.StatusBadRequest:            {Description: "No file field"},
+			http.StatusUnauthorized:          {Description: "Not logged in or invalid API token"},
+			http.StatusForbidden:             {Description: "Not an admin, or missing CSRF token or token scope"},
+			http.StatusRequestEntityTooLarge: {Description: "The image is too large"},
+			http.StatusUnprocessableEntity:   {Description: "Not a JPEG, PNG, GIF or WebP image, or too many pixels"},
+		},
+		CSRF:  true,
+		Scope: "media:write",
+	})
+	apiSpec.Add(http.MethodGet, "/api/v1/devices", APIOperation{
+		Summary: "List your devices",
+		Tag:     "devices",
+		Responses: map[int]APIResponse{
+			http.StatusOK:           {Description: "Your devices", Body: []APIDevice{{}}},
+			http.StatusUnauthorized: {Description: "Not logged in or invalid API token"},
+			http.StatusForbidden:    {Description: "Token is missing the devices:read scope"},
+		},
+		Scope: "devices:read",
+	})
+	apiSpec.Add(http.MethodPost, "/api/v1/devices/register", APIOperation{
+		Summary:     "Register a device",
+		Description: "Adds a device for the machine the agent runs on, or updates the one you already have with that hostname. ip defaults to the address the request came from.",
+		Tag:         "devices",
+		Request:     DeviceRegistration{Hostname: "build-01", Type: "linux", OS: "Debian 12", Arch: "amd64"},
+		Responses: map[int]APIResponse{
+			http.StatusOK:                  {Description: "The registered device", Body: APIDevice{}},
+			http.StatusBadRequest:          {Description: "Malformed JSON"},
+			http.StatusUnauthorized:        {Description: "Not logged in or invalid API token"},
+			http.StatusForbidden:           {Description: "Missing CSRF token or token scope"},
+			http.StatusUnprocessableEntity: {Description: "Missing hostname or invalid ip"},
+		},
+		CSRF:  true,
+		Scope: "devices:write",
+	})
+	apiSpec.Add(http.MethodPost, "/api/v1/devices/{id}/heartbeat", APIOperation{
+		Summary:     "Send a device heartbeat",
+		Description: fmt.Sprintf("Marks the device as seen now. Devices show as online for %s after their last heartbeat. The body is optional, and ip defaults to the address the request came from.", deviceOnlineWindow),
+		Tag:         "devices",
+		Request:     DeviceHeartbeat{},
+		Responses: map[int]APIResponse{
+			http.StatusNoContent:           {Description: "Heartbeat recorded"},
+			http.StatusUnauthorized:        {Description: "Not logged in or invalid API token"},
+			http.StatusForbidden:           {Description: "Missing CSRF token or token scope"},
+			http.StatusNotFound:            {Description: "No such device"},
+			http.StatusUnprocessableEntity: {Description: "Invalid ip"},
+		},
+		CSRF:  true,
+		Scope: "devices:write",
+	})
+	apiSpec.Add(http.MethodGet, "/api/v1/devices/{id}/config", APIOperation{
+		Summary:     "Get a device's agent config",
+		Description: "Returns the newest config saved for the device, or else for one of its tags, or else the defaults. If the agent reported the newest version as failing, the version it last applied is sent with rolled_back set until a new one is saved. Send If-None-Match with the ETag to poll cheaply.",
+		Tag:         "devices",
+		Responses: map[int]APIResponse{
+			http.StatusOK:           {Description: "The config to apply", Body: APIAgentConfig{Source: "default", Config: defaultAgentConfig}},
+			http.StatusNotModified:  {Description: "The config hasn't changed"},
+			http.StatusUnauthorized: {Description: "Not logged in or invalid API token"},
+			http.StatusForbidden:    {Description: "Token is missing the devices:read scope"},
+			http.StatusNotFound:     {Description: "No such device"},
+		},
+		Scope: "devices:read",
+	})
+	apiSpec.Add(http.MethodPost, "/api/v1/devices/{id}/config/status", APIOperation{
+		Summary:     "Report applying an agent config",
+		Description: "Send the version the agent applied, with an empty error, or the version it couldn't apply and why. A failed version isn't sent to the device again.",
+		Tag:         "devices",
+		Request:     AgentConfigStatus{Version: 3},
+		Responses: map[int]APIResponse{
+			http.StatusNoContent:           {Description: "Status recorded"},
+			http.StatusBadRequest:          {Description: "Malformed JSON"},
+			http.StatusUnauthorized:        {Description: "Not logged in or invalid API token"},
+			http.StatusForbidden:           {Description: "Missing CSRF token or token scope"},
+			http.StatusNotFound:            {Description: "No such device"},
+			http.StatusUnprocessableEntity: {Description: "Invalid version or error too long"},
+		},
+		CSRF:  true,
+		Scope: "devices:write",
+	})
+	apiSpec.Add(http.MethodPatch, "/api/v1/devices/{id}", APIOperation{
+		Summary:     "Rename, tag or annotate a device",
+		Description: "Only the fields you send are changed. An empty name goes back to the hostname. Tags are lowercase letters, numbers, dots, dashes, underscores and colons.",
+		Tag:         "devices",
+		Request:     DeviceUpdate{},
+		Responses: map[int]APIResponse{
+			http.StatusOK:                  {Description: "The updated device", Body: APIDevice{}},
+			http.StatusBadRequest:          {Description: "Malformed JSON"},
+			http.StatusUnauthorized:        {Description: "Not logged in or invalid API token"},
+			http.StatusForbidden:           {Description: "Missing CSRF token or token scope"},
+			http.StatusNotFound:            {Description: "No such device"},
+			http.StatusUnprocessableEntity: {Description: "Invalid name, notes or tags"},
+		},
+		CSRF:  true,
+		Scope: "devices:write",
+	})
+	apiSpec.Add(http.MethodDelete, "/api/v1/devices/{id}", APIOperation{
+		Summary:     "Delete a device",
+		Description: "Deletes the device and its facts. An agent that registers again gets a new device.",
+		Tag:         "devices",
+		Responses: map[int]APIResponse{
+			http.StatusNoContent:    {Description: "Deleted"},
+			http.StatusUnauthorized: {Description: "Not logged in or invalid API token"},
+			http.StatusForbidden:    {Description: "Missing CSRF token or token scope"},
+			http.StatusNotFound:     {Description: "No such device"},
+		},
+		CSRF:  true,
+		Scope: "devices:write",
+	})
+	apiSpec.Add(http.MethodPut, "/api/v1/devices/{id}/facts", APIOperation{
+		Summary:     "Report a device's facts",
+		Description: "Replaces the hardware, OS, network and package inventory for one of your devices. schema_version must be 1.",
+		Tag:         "devices",
+		Request:     DeviceFacts{SchemaVersion: factsSchemaVersion},
+		Responses: map[int]APIResponse{
+			http.StatusNoContent:           {Description: "Facts stored"},
+			http.StatusBadRequest:          {Description: "Malformed JSON"},
+			http.StatusUnauthorized:        {Description: "Not logged in or invalid API token"},
+			http.StatusForbidden:           {Description: "Missing CSRF token or token scope"},
+			http.StatusNotFound:            {Description: "No such device"},
+			http.StatusUnprocessableEntity: {Description: "Facts don't match the schema"},
+		},
+		CSRF:  true,
+		Scope: "devices:write",
+	})
+	apiSpec.Add(http.MethodPost, "/api/v1/devices/{id}/metrics", APIOperation{
+		Summary:     "Report a device's metrics",
+		Description: fmt.Sprintf("Records a sample of CPU, memory and disk use and uptime, and counts as a heartbeat. Samples are averaged over %s, so agents can report as often as they like.", metricsBucket),
+		Tag:         "devices",
+		Request:     DeviceMetrics{},
+		Responses: map[int]APIResponse{
+			http.StatusNoContent:           {Description: "Metrics recorded"},
+			http.StatusBadRequest:          {Description: "Malformed JSON"},
+			http.StatusUnauthorized:        {Description: "Not logged in or invalid API token"},
+			http.StatusForbidden:           {Description: "Missing CSRF token or token scope"},
+			http.StatusNotFound:            {Description: "No such device"},
+			http.StatusUnprocessableEntity: {Description: "A percentage is out of range"},
+		},
+		CSRF:  true,
+		Scope: "devices:write",
+	})
+	apiSpec.Add(http.MethodGet, "/api/v1/devices/{id}/metrics", APIOperation{
+		Summary:     "Get a device's metrics",
+		Description: fmt.Sprintf("Returns the last %s of metrics, one point per %s, oldest first.", metricsWindow, metricsBucket),
+		Tag:         "devices",
+		Responses: map[int]APIResponse{
+			http.StatusOK:           {Description: "The device's metrics", Body: []MetricsPoint{}},
+			http.StatusUnauthorized: {Description: "Not logged in or invalid API token"},
+			http.StatusForbidden:    {Description: "Token is missing the devices:read scope"},
+			http.StatusNotFound:     {Description: "No such device"},
+		},
+		Scope: "devices:read",
+	})
+	apiSpec.Add(http.MethodGet, "/badge/views.json", APIOperation{
+		Summary:     "Get the site's view count",
+		Description: "Also available as an SVG badge at /badge/views.svg, with an optional label parameter. Cross-origin reads are allowed from BADGE_ORIGINS.",
+		Tag:         "badges",
+		Responses: map[int]APIResponse{
+			http.StatusOK: {Description: "Views of every page", Body: BadgeViews{}},
+		},
+	})
+	apiSpec.Add(http.MethodGet, "/badge/posts/{slug}.json", APIOperation{
+		Summary:     "Get a post's view count",
+		Description: "Also available as an SVG badge at /badge/posts/{slug}.svg, with an optional label parameter.",
+		Tag:         "badges",
+		Responses: map[int]APIResponse{
+			http.StatusOK:       {Description: "Views of the post", Body: BadgeViews{Slug: "hello-world", Title: "Hello, world", LastWeek: new(int)}},
+			http.StatusNotFound: {Description: "No such post"},
+		},
+	})
+	apiSpec.Add(http.MethodGet, "/api/v1/flags", APIOperation{
+		Summary:     "Get feature flags",
+		Description: "Returns whether each feature flag is on for the caller. Percentage rollouts are per user, or per browser when logged out.",
+		Tag:         "flags",
+		Responses: map[int]APIResponse{
+			http.StatusOK: {Description: "Flag values by name", Body: map[string]bool{}},
+		},
+	})
 }
 
 // loadPosts reads all markdown files from the blog directory
-func loadPosts(dir string) ([]Post, error) {
+func (app *App) loadPosts(ctx context.Context, dir string) ([]Post, []ContentProblem, error) {
 	// Create blog directory if it doesn't exist
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
 		if err := os.Mkdir(dir, 0755); err != nil {
-			return nil, fmt.Errorf("failed to create blog directory: %w", err)
+			return nil, nil, fmt.Errorf("failed to create blog directory: %w", err)
 		}
 	}
 
 	// Find all markdown files
 	files, err := filepath.Glob(filepath.Join(dir, "*.md"))
 	if err != nil {
-		return nil, fmt.Errorf("failed to glob files: %w", err)
+		return nil, nil, fmt.Errorf("failed to glob files: %w", err)
+	}
+
+	start := time.Now()
+
+	// Read and convert posts with a bounded pool of workers. Each worker writes
+	// to its own slot so the result doesn't depend on scheduling.
+	results := make([]*Post, len(files))
+	errs := make([]error, len(files))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(runtime.NumCPU(), len(files)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i], errs[i] = app.loadPost(ctx, files[i])
+			}
+		}()
 	}
+	for i := range files {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
 
 	var posts []Post
-	for _, file := range files {
-		content, err := os.ReadFile(file)
-		if err != nil {
-			slog.Error("Failed to read post", "file", file, "error", err)
+	var problems []ContentProblem
+	for i, post := range results {
+		if errs[i] != nil {
+			slog.Error("Failed to load post", "file", files[i], "error", errs[i])
+			problems = append(problems, contentProblem(files[i], errs[i]))
 			continue
 		}
+		posts = append(posts, *post)
+	}
 
-		post, err := parsePost(content, file)
-		if err != nil {
-			slog.Error("Failed to parse post", "file", file, "error", err)
-			continue
+	// Sort posts by date, newest first, falling back to the slug so posts
+	// published on the same day always come out in the same order
+	sort.Slice(posts, func(i, j int) bool {
+		if !posts[i].Date.Equal(posts[j].Date) {
+			return posts[i].Date.After(posts[j].Date)
 		}
+		return posts[i].Slug < posts[j].Slug
+	})
 
-		posts = append(posts, post)
+	stats, err := app.GetPostCacheStats(ctx)
+	if err != nil {
+		slog.Error("Failed to get post cache stats", "error", err)
 	}
+	slog.Info("Loaded posts",
+		"count", len(posts),
+		"files", len(files),
+		"duration", time.Since(start).String(),
+		"cache_hits", stats.Hits,
+		"cache_misses", stats.Misses,
+		"problems", len(problems),
+	)
 
-	// Sort posts by date, newest first
-	sort.Slice(posts, func(i, j int) bool {
-		return posts[i].Date.After(posts[j].Date)
-	})
+	return posts, problems, nil
+}
+
+// loadPost reads and parses a single post file
+func (app *App) loadPost(ctx context.Context, file string) (*Post, error) {
+	ctx, span := startSpan(ctx, "load post", spanInternal, otlpString("file.path", file))
+	defer span.End()
 
-	return posts, nil
+	content, err := os.ReadFile(file)
+	if err != nil {
+		span.SetError(err)
+		return nil, fmt.Errorf("failed to read post: %w", err)
+	}
+
+	post, err := app.parsePost(ctx, content, file)
+	span.SetError(err)
+	if err != nil {
+		return nil, err
+	}
+
+	if info, err := os.Stat(file); err == nil {
+		post.ModTime = info.ModTime()
+	}
+
+	return &post, nil
 }
 
 // parsePost extracts frontmatter and converts markdown to HTML
-func parsePost(content []byte, filename string) (Post, error) {
+func (app *App) parsePost(ctx context.Context, content []byte, filename string) (Post, error) {
 	// Check for frontmatter delimiter
 	parts := bytes.SplitN(content, []byte("---\n"), 3)
 	if len(parts) < 3 {
 		return Post{}, fmt.Errorf("invalid frontmatter format in %s", filename)
 	}
 
-	// Parse frontmatter
-	var post Post
-	if err := yaml.Unmarshal(parts[1], &post); err != nil {
-		return Post{}, fmt.Errorf("failed to parse frontmatter: %w", err)
+	// Parse and check the frontmatter before spending time on the markdown
+	post, err := decodeFrontmatter(parts[1])
+	if err != nil {
+		return Post{}, err
 	}
 
 	// Convert markdown to HTML
-	var buf bytes.Buffer
-	if err := goldmark.Convert(parts[2], &buf); err != nil {
-		return Post{}, fmt.Errorf("failed to convert markdown: %w", err)
+	html, err := app.renderMarkdown(ctx, parts[2])
+	if err != nil {
+		return Post{}, err
+	}
+	html, err = applyContentPlugins(html)
+	if err != nil {
+		return Post{}, err
 	}
 
-	// Set slug from filename
-	base := filepath.Base(filename)
-	post.Slug = strings.TrimSuffix(base, filepath.Ext(base))
+	// Set slug from filename unless the frontmatter overrides it
+	if post.Slug == "" {
+		base := filepath.Base(filename)
+		post.Slug = strings.TrimSuffix(base, filepath.Ext(base))
+	}
 	post.FileName = filename
-	post.Content = template.HTML(buf.String())
+	post.Content = template.HTML(html)
+	sum := sha256.Sum256(content)
+	post.Hash = hex.EncodeToString(sum[:])
+
+	// Fall back to the start of the post for the description
+	if post.Description == "" {
+		post.Description = truncate(plainText(html), 160)
+	}
 
 	return post, nil
 }
 
+// baseURL returns the scheme and host the request was made to
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// canonicalURL returns the absolute URL of the requested page without its query
+func canonicalURL(r *http.Request) string {
+	return baseURL(r) + r.URL.Path
+}
+
+// absoluteURL resolves a site-relative path like /images/a.png against the
+// request's host, leaving absolute URLs and empty strings untouched
+func absoluteURL(r *http.Request, path string) string {
+	if path == "" || strings.Contains(path, "://") {
+		return path
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return baseURL(r) + path
+}
+
+// formatDate formats a date for templates, like "January 2, 2006"
+func formatDate(t time.Time) string {
+	return t.Format("January 2, 2006")
+}
+
+// truncate shortens s to at most n runes, breaking at a word boundary
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	cut := string(runes[:n])
+	if i := strings.LastIndex(cut, " "); i > 0 {
+		cut = cut[:i]
+	}
+	return cut + "…"
+}
+
 // LoginPage holds data for the login page template
 type LoginPage struct {
 	Meta      PageMeta
@@ -323,6 +1072,9 @@ type LoginPage struct {
 	Error     string
 	LoggedIn  bool
 	UserEmail string
+	Providers []*OAuthProvider
+	// Challenge guards the email form against bots
+	Challenge ChallengeToken
 }
 
 // getLoginPageData extracts query parameters and user data for the login page
@@ -334,6 +1086,8 @@ func getLoginPageData(r *http.Request, count int, user *User) LoginPage {
 			Title: "Login",
 			Count: count,
 			User:  user,
+
+			CSRFToken: csrfToken(r),
 		},
 	}
 
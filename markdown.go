@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"strconv"
+
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/yuin/goldmark"
+	highlighting "github.com/yuin/goldmark-highlighting/v2"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+const defaultHighlightStyle = "github"
+
+// markdown is the goldmark pipeline used to render posts
+var markdown goldmark.Markdown
+
+// resolvedImagesKey collects what responsiveImages found for each image in a
+// post, since the rendered HTML depends on it, see renderMarkdown
+var resolvedImagesKey = parser.NewContextKey()
+
+// highlightCSS holds the stylesheet for the chosen code highlighting theme
+var highlightCSS template.CSS
+
+// initMarkdown configures the markdown renderer and code highlighting theme.
+// The theme is set by HIGHLIGHT_STYLE and can be any chroma style name.
+func initMarkdown(style string) error {
+	if _, ok := styles.Registry[style]; !ok {
+		slog.Warn("Unknown highlight style, using default", "style", style, "default", defaultHighlightStyle)
+		style = defaultHighlightStyle
+	}
+
+	// Emit CSS classes instead of inline styles so the theme stylesheet is
+	// served once per page rather than repeated on every token
+	markdown = goldmark.New(
+		goldmark.WithExtensions(
+			highlighting.NewHighlighting(
+				highlighting.WithStyle(style),
+				highlighting.WithFormatOptions(chromahtml.WithClasses(true)),
+			),
+		),
+		// Headings get an id from their text, like "why-go" for "Why Go?",
+		// numbered when a post repeats a heading
+		goldmark.WithParserOptions(
+			parser.WithAutoHeadingID(),
+			parser.WithASTTransformers(util.Prioritized(responsiveImages{}, 100)),
+		),
+		goldmark.WithRendererOptions(renderer.WithNodeRenderers(util.Prioritized(headingAnchors{}, 100))),
+	)
+
+	var buf bytes.Buffer
+	formatter := chromahtml.New(chromahtml.WithClasses(true))
+	if err := formatter.WriteCSS(&buf, styles.Get(style)); err != nil {
+		return fmt.Errorf("failed to generate highlight css: %w", err)
+	}
+	highlightCSS = template.CSS(buf.String())
+
+	return nil
+}
+
+// headingAnchors renders headings with a link to themselves, which the post
+// page turns into a copy link button. The link has no text so it stays out
+// of descriptions and the search index, and the # is added by CSS.
+type headingAnchors struct{}
+
+func (headingAnchors) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindHeading, renderHeading)
+}
+
+func renderHeading(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	n := node.(*ast.Heading)
+	if entering {
+		fmt.Fprintf(w, "<h%d", n.Level)
+		if n.Attributes() != nil {
+			html.RenderAttributes(w, node, html.HeadingAttributeFilter)
+		}
+		_ = w.WriteByte('>')
+		return ast.WalkContinue, nil
+	}
+
+	if id, ok := n.AttributeString("id"); ok {
+		if id, ok := id.([]byte); ok {
+			fmt.Fprintf(w, `<a class="heading-anchor" href="#%s" aria-label="Link to this section"></a>`, util.EscapeHTML(id))
+		}
+	}
+	fmt.Fprintf(w, "</h%d>\n", n.Level)
+	return ast.WalkContinue, nil
+}
+
+// responsiveImages rewrites images in the media directory to their resized
+// variants, with a srcset so browsers can pick the size they need. They get
+// their width and height too, so the page doesn't shift as they load.
+type responsiveImages struct{}
+
+func (responsiveImages) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	ast.Walk(doc, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		n, ok := node.(*ast.Image)
+		if !entering || !ok {
+			return ast.WalkContinue, nil
+		}
+		dest := string(n.Destination)
+		img, ok := lookupImage(dest)
+		resolved, _ := pc.Get(resolvedImagesKey).([]string)
+		pc.Set(resolvedImagesKey, append(resolved, fmt.Sprintf("%s %t %dx%d %s", dest, ok, img.Width, img.Height, img.SrcSet())))
+		if !ok {
+			return ast.WalkContinue, nil
+		}
+		n.Destination = []byte(img.Src())
+		n.SetAttributeString("width", []byte(strconv.Itoa(img.Width)))
+		n.SetAttributeString("height", []byte(strconv.Itoa(img.Height)))
+		if srcset := img.SrcSet(); srcset != "" {
+			n.SetAttributeString("srcset", []byte(srcset))
+			n.SetAttributeString("sizes", []byte(imageSizes))
+		}
+		n.SetAttributeString("loading", []byte("lazy"))
+		n.SetAttributeString("decoding", []byte("async"))
+		return ast.WalkSkipChildren, nil
+	})
+}
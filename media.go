@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// mediaDir holds images and other files that posts link to as /media/...
+const mediaDir = "./blog/media"
+
+// mediaCacheControl is set on synced media. File names aren't content
+// hashed, so changed files have to be picked up within a day.
+const mediaCacheControl = "public, max-age=86400"
+
+// mediaSyncWorkers is how many uploads and deletes run at once
+const mediaSyncWorkers = 8
+
+// handleMedia serves files from the media directory
+func handleMedia(w http.ResponseWriter, r *http.Request) error {
+	name := strings.TrimPrefix(r.URL.Path, "/media/")
+	if name == "" || strings.HasSuffix(name, "/") || strings.HasPrefix(path.Base(name), ".") {
+		return NewHTTPError(fmt.Errorf("page not found: %s", r.URL.Path), http.StatusNotFound)
+	}
+	f, err := http.Dir(mediaDir).Open(path.Clean("/" + name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return NewHTTPError(fmt.Errorf("page not found: %s", r.URL.Path), http.StatusNotFound)
+	} else if err != nil {
+		return fmt.Errorf("failed to open media: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat media: %w", err)
+	}
+	if info.IsDir() {
+		return NewHTTPError(fmt.Errorf("page not found: %s", r.URL.Path), http.StatusNotFound)
+	}
+
+	w.Header().Set("Cache-Control", mediaCacheControl)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	return nil
+}
+
+// mediaSyncConfig returns where media is published: MEDIA_BUCKET, with keys
+// under MEDIA_PREFIX. ok is false if publishing isn't set up.
+func mediaSyncConfig(cfg Config) (client *s3Client, prefix string, ok bool, err error) {
+	if cfg.MediaBucket == "" {
+		return nil, "", false, nil
+	}
+	client, err = newS3Client(cfg, cfg.MediaBucket)
+	if err != nil {
+		return nil, "", false, err
+	}
+	return client, cfg.MediaPrefix, true, nil
+}
+
+// MediaSyncResult counts what a sync changed
+type MediaSyncResult struct {
+	Uploaded  int
+	Deleted   int
+	Unchanged int
+}
+
+// mediaSyncMu stops publishes from syncing over each other
+var mediaSyncMu sync.Mutex
+
+// syncMedia makes the bucket match the media directory. Files are compared
+// by MD5, which S3 reports as the ETag of objects uploaded in one piece, so
+// only new and changed files are uploaded. Objects under prefix with no
+// local file are deleted. With dryRun nothing is changed.
+func syncMedia(client *s3Client, prefix string, dryRun bool) (MediaSyncResult, error) {
+	mediaSyncMu.Lock()
+	defer mediaSyncMu.Unlock()
+
+	local := map[string]string{}
+	err := filepath.WalkDir(mediaDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && p != mediaDir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(mediaDir, p)
+		if err != nil {
+			return err
+		}
+		local[prefix+filepath.ToSlash(rel)] = p
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return MediaSyncResult{}, fmt.Errorf("failed to read media: %w", err)
+	}
+
+	objects, err := client.List(prefix)
+	if err != nil {
+		return MediaSyncResult{}, err
+	}
+	remote := map[string]string{}
+	for _, o := range objects {
+		remote[o.Key] = strings.Trim(o.ETag, `"`)
+	}
+
+	var result MediaSyncResult
+	var jobs []func() error
+	for key, p := range local {
+		sum, err := fileMD5(p)
+		if err != nil {
+			return MediaSyncResult{}, err
+		}
+		if remote[key] == sum {
+			result.Unchanged++
+			continue
+		}
+		result.Uploaded++
+		if dryRun {
+			slog.Info("Would upload media", "key", key)
+		}
+		jobs = append(jobs, func() error {
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return fmt.Errorf("failed to read media: %w", err)
+			}
+			contentType := mime.TypeByExtension(path.Ext(key))
+			if contentType == "" {
+				contentType = http.DetectContentType(data)
+			}
+			return client.Put(key, data, http.Header{
+				"Content-Type":  {contentType},
+				"Cache-Control": {mediaCacheControl},
+			})
+		})
+	}
+	for key := range remote {
+		if _, ok := local[key]; ok {
+			continue
+		}
+		result.Deleted++
+		if dryRun {
+			slog.Info("Would delete media", "key", key)
+		}
+		jobs = append(jobs, func() error {
+			return client.Delete(key)
+		})
+	}
+	if dryRun {
+		return result, nil
+	}
+
+	// Run the uploads and deletes with a bounded pool of workers
+	queue := make(chan func() error)
+	var mu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	for range min(mediaSyncWorkers, len(jobs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				if err := job(); err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+
+	return result, errors.Join(errs...)
+}
+
+// fileMD5 returns the hex MD5 of a file's contents
+func fileMD5(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", fmt.Errorf("failed to read media: %w", err)
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to read media: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// publishMedia syncs media in the background after a post is saved, if
+// publishing is set up
+func (app *App) publishMedia() {
+	client, prefix, ok, err := mediaSyncConfig(app.Config)
+	if err != nil {
+		slog.Error("Failed to configure media sync", "error", err)
+		return
+	} else if !ok {
+		return
+	}
+	go func() {
+		result, err := syncMedia(client, prefix, false)
+		if err != nil {
+			slog.Error("Failed to sync media", "error", err)
+			return
+		}
+		slog.Info("Synced media", "uploaded", result.Uploaded, "deleted", result.Deleted, "unchanged", result.Unchanged)
+	}()
+}
+
+// syncMediaCommand handles `tulip sync-media [-dry-run]`
+func syncMediaCommand(cfg Config, args []string) error {
+	flags := flag.NewFlagSet("sync-media", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "show what would change without changing it")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	client, prefix, ok, err := mediaSyncConfig(cfg)
+	if err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("MEDIA_BUCKET is not set")
+	}
+	result, err := syncMedia(client, prefix, *dryRun)
+	if err != nil {
+		return err
+	}
+	slog.Info("Synced media", "uploaded", result.Uploaded, "deleted", result.Deleted, "unchanged", result.Unchanged, "dry_run", *dryRun)
+	return nil
+}
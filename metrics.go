@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metricsBucket is the resolution metrics are stored at. Samples in the
+// same bucket are averaged, so agents can report as often as they like.
+const metricsBucket = 5 * time.Minute
+
+// metricsWindow is how much history the devices page charts
+const metricsWindow = 24 * time.Hour
+
+// DeviceMetrics is a sample an agent reports. The percentages are of the
+// whole machine, and disk is the root filesystem.
+type DeviceMetrics struct {
+	CPUPercent    float64 `json:"cpu_percent"`
+	MemoryPercent float64 `json:"memory_percent"`
+	DiskPercent   float64 `json:"disk_percent"`
+	UptimeSeconds int64   `json:"uptime_seconds"`
+}
+
+// Validate checks the percentages are percentages
+func (m DeviceMetrics) Validate() error {
+	for _, v := range []struct {
+		name  string
+		value float64
+	}{
+		{"cpu_percent", m.CPUPercent},
+		{"memory_percent", m.MemoryPercent},
+		{"disk_percent", m.DiskPercent},
+	} {
+		if v.value < 0 || v.value > 100 {
+			return fmt.Errorf("%s must be between 0 and 100", v.name)
+		}
+	}
+	if m.UptimeSeconds < 0 {
+		return fmt.Errorf("uptime_seconds can't be negative")
+	}
+	return nil
+}
+
+// MetricsPoint is a device's metrics averaged over one bucket
+type MetricsPoint struct {
+	Time          time.Time `json:"time"`
+	CPUPercent    float64   `json:"cpu_percent"`
+	MemoryPercent float64   `json:"memory_percent"`
+	DiskPercent   float64   `json:"disk_percent"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+}
+
+// MetricsSeries is a device's recent metrics, oldest first
+type MetricsSeries []MetricsPoint
+
+// Latest returns the most recent point
+func (s MetricsSeries) Latest() MetricsPoint {
+	return s[len(s)-1]
+}
+
+// CPU, Memory and Disk return one metric across the series, for charts
+func (s MetricsSeries) CPU() []float64 {
+	return s.values(func(p MetricsPoint) float64 { return p.CPUPercent })
+}
+
+func (s MetricsSeries) Memory() []float64 {
+	return s.values(func(p MetricsPoint) float64 { return p.MemoryPercent })
+}
+
+func (s MetricsSeries) Disk() []float64 {
+	return s.values(func(p MetricsPoint) float64 { return p.DiskPercent })
+}
+
+func (s MetricsSeries) values(metric func(MetricsPoint) float64) []float64 {
+	values := make([]float64, len(s))
+	for i, p := range s {
+		values[i] = metric(p)
+	}
+	return values
+}
+
+// RecordMetrics adds a sample to its bucket, keeping a running average.
+// Uptime is a counter, so the bucket keeps the latest value.
+func (app *App) RecordMetrics(ctx context.Context, deviceID int64, m DeviceMetrics, now time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := app.DBFrom(ctx).ExecContext(ctx, `
+		INSERT INTO device_metrics (device_id, bucket, samples, cpu_percent, memory_percent, disk_percent, uptime_seconds)
+		VALUES (?, ?, 1, ?, ?, ?, ?)
+		ON CONFLICT (device_id, bucket) DO UPDATE SET
+			cpu_percent = (device_metrics.cpu_percent * device_metrics.samples + excluded.cpu_percent) / (device_metrics.samples + 1),
+			memory_percent = (device_metrics.memory_percent * device_metrics.samples + excluded.memory_percent) / (device_metrics.samples + 1),
+			disk_percent = (device_metrics.disk_percent * device_metrics.samples + excluded.disk_percent) / (device_metrics.samples + 1),
+			uptime_seconds = excluded.uptime_seconds,
+			samples = device_metrics.samples + 1
+	`, deviceID, now.UTC().Truncate(metricsBucket), m.CPUPercent, m.MemoryPercent, m.DiskPercent, m.UptimeSeconds)
+	if err != nil {
+		return fmt.Errorf("failed to record metrics: %w", err)
+	}
+	return nil
+}
+
+// GetDeviceMetrics returns the metrics of each of a user's devices since a
+// time, keyed by device ID. Devices that haven't reported any are left out.
+func (app *App) GetDeviceMetrics(ctx context.Context, userID int64, since time.Time) (map[int64]MetricsSeries, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	rows, err := app.DB.QueryContext(ctx, `
+		SELECT m.device_id, m.bucket, m.cpu_percent, m.memory_percent, m.disk_percent, m.uptime_seconds
+		FROM device_metrics m
+		JOIN devices d ON d.id = m.device_id
+		WHERE d.user_id = ? AND m.bucket >= ?
+		ORDER BY m.device_id, m.bucket
+	`, userID, since.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query metrics: %w", err)
+	}
+	defer rows.Close()
+
+	metrics := map[int64]MetricsSeries{}
+	for rows.Next() {
+		var deviceID int64
+		var p MetricsPoint
+		if err := rows.Scan(&deviceID, &p.Time, &p.CPUPercent, &p.MemoryPercent, &p.DiskPercent, &p.UptimeSeconds); err != nil {
+			return nil, fmt.Errorf("failed to scan metrics row: %w", err)
+		}
+		metrics[deviceID] = append(metrics[deviceID], p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating metrics rows: %w", err)
+	}
+
+	return metrics, nil
+}
+
+// sparkline draws percentages as a small inline SVG line chart
+func sparkline(values []float64) template.HTML {
+	const width, height = 120, 24
+	if len(values) == 0 {
+		return ""
+	}
+	if len(values) == 1 {
+		values = append(values, values[0])
+	}
+
+	points := make([]string, len(values))
+	for i, v := range values {
+		x := float64(i) * width / float64(len(values)-1)
+		y := height - v*height/100
+		points[i] = strconv.FormatFloat(x, 'f', 1, 64) + "," + strconv.FormatFloat(y, 'f', 1, 64)
+	}
+	return template.HTML(fmt.Sprintf(
+		`<svg class="sparkline" width="%d" height="%d" viewBox="0 0 %d %d" preserveAspectRatio="none" aria-hidden="true"><polyline points="%s"/></svg>`,
+		width, height, width, height, strings.Join(points, " "),
+	))
+}
+
+// formatUptime shortens an uptime to its largest unit, like "3d" or "5h"
+func formatUptime(seconds int64) string {
+	d := time.Duration(seconds) * time.Second
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	}
+}
+
+// handleDeviceMetrics records a sample with POST /api/devices/{id}/metrics,
+// which also counts as a heartbeat, and returns the last day of metrics
+// with GET
+func (app *App) handleDeviceMetrics(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost && r.Method != http.MethodGet {
+		return NewHTTPError(fmt.Errorf("method not allowed"), http.StatusMethodNotAllowed)
+	}
+	auth, err := app.authenticateRequest(w, r)
+	if err != nil {
+		return err
+	}
+	deviceID, err := deviceIDFromPath(r.URL.Path, "/api/devices/")
+	if err != nil {
+		return err
+	}
+
+	if r.Method == http.MethodGet {
+		if err := requireScope(auth, "devices:read"); err != nil {
+			return err
+		}
+		if _, err := app.GetDevice(r.Context(), auth.User.ID, deviceID); errors.Is(err, errDeviceNotFound) {
+			return NewHTTPError(err, http.StatusNotFound)
+		} else if err != nil {
+			return err
+		}
+		metrics, err := app.GetDeviceMetrics(r.Context(), auth.User.ID, time.Now().Add(-metricsWindow))
+		if err != nil {
+			return err
+		}
+		series := metrics[deviceID]
+		if series == nil {
+			series = MetricsSeries{}
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		return writeJSON(w, series)
+	}
+
+	if err := requireScope(auth, "devices:write"); err != nil {
+		return err
+	}
+	var sample DeviceMetrics
+	if err := readJSON(w, r, &sample); err != nil {
+		return err
+	}
+	if err := sample.Validate(); err != nil {
+		return NewHTTPError(fmt.Errorf("invalid metrics: %w", err), http.StatusUnprocessableEntity)
+	}
+
+	now := time.Now()
+	ip := clientIP(r).String()
+	err = app.InTx(r.Context(), func(ctx context.Context) error {
+		if err := app.RecordHeartbeat(ctx, auth.User.ID, deviceID, ip, now); err != nil {
+			return err
+		}
+		return app.RecordMetrics(ctx, deviceID, sample, now)
+	})
+	if errors.Is(err, errDeviceNotFound) {
+		return NewHTTPError(err, http.StatusNotFound)
+	} else if err != nil {
+		return err
+	}
+	app.deviceSeen(auth.User.ID, deviceID, ip, now)
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
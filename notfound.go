@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// maxSuggestions is how many posts a 404 page offers at most
+const maxSuggestions = 3
+
+// routeMethods are the pages that only answer some methods, so any other
+// method gets a 405 instead of a 404. Keep it in step with the handlers.
+var routeMethods = map[string][]string{
+	"/logout": {http.MethodPost},
+
+	"/admin":                     {http.MethodGet},
+	"/admin/sessions/revoke":     {http.MethodPost},
+	"/admin/users/delete":        {http.MethodPost},
+	"/admin/users/role":          {http.MethodPost},
+	"/admin/digest":              {http.MethodPost},
+	"/admin/flags":               {http.MethodPost},
+	"/admin/syndication/retry":   {http.MethodPost},
+	"/admin/outbox/retry":        {http.MethodPost},
+	"/admin/outbox/delete":       {http.MethodPost},
+	"/admin/webmentions/approve": {http.MethodPost},
+	"/admin/webmentions/delete":  {http.MethodPost},
+	"/admin/shortlinks":          {http.MethodGet},
+	"/admin/shortlinks/create":   {http.MethodPost},
+	"/admin/shortlinks/expire":   {http.MethodPost},
+	"/admin/jobs":                {http.MethodGet},
+	"/admin/jobs/run":            {http.MethodPost},
+
+	"/passkeys":                 {http.MethodGet},
+	"/passkeys/register/begin":  {http.MethodPost},
+	"/passkeys/register/finish": {http.MethodPost},
+	"/passkeys/delete":          {http.MethodPost},
+
+	"/settings":                     {http.MethodGet},
+	"/settings/profile":             {http.MethodPost},
+	"/settings/2fa/setup":           {http.MethodPost},
+	"/settings/2fa/enable":          {http.MethodPost},
+	"/settings/2fa/disable":         {http.MethodPost},
+	"/settings/sessions":            {http.MethodGet},
+	"/settings/sessions/revoke":     {http.MethodPost},
+	"/settings/sessions/revoke-all": {http.MethodPost},
+	"/settings/tokens":              {http.MethodGet},
+	"/settings/tokens/create":       {http.MethodPost},
+	"/settings/tokens/revoke":       {http.MethodPost},
+	"/settings/account":             {http.MethodGet},
+	"/settings/account/export":      {http.MethodGet},
+	"/settings/account/delete":      {http.MethodPost},
+}
+
+// notFoundError is a missing page, with the posts the visitor may have
+// meant
+type notFoundError struct {
+	Path string
+	// Suggestions are the closest posts by slug, best first
+	Suggestions []Post
+}
+
+func (e *notFoundError) Error() string {
+	return fmt.Sprintf("page not found: %s", e.Path)
+}
+
+// methodNotAllowed is a 405 that tells the client which methods the path
+// does take
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, allowed []string) error {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	return NewHTTPError(fmt.Errorf("%s isn't allowed for %s, use %s", r.Method, r.URL.Path, strings.Join(allowed, " or ")), http.StatusMethodNotAllowed)
+}
+
+// notFound is the response for a path no handler took: a 405 if the path
+// exists but not for this method, otherwise a 404 suggesting posts whose
+// slug is close to the last part of the path
+func (app *App) notFound(w http.ResponseWriter, r *http.Request) error {
+	if allowed, ok := routeMethods[r.URL.Path]; ok {
+		return methodNotAllowed(w, r, allowed)
+	}
+	return NewHTTPError(&notFoundError{
+		Path:        r.URL.Path,
+		Suggestions: suggestPosts(app.siteFor(r).Blog().Posts, path.Base(r.URL.Path)),
+	}, http.StatusNotFound)
+}
+
+// suggestPosts returns the posts whose slug is within a few edits of name.
+// Longer names are allowed more typos.
+func suggestPosts(posts []Post, name string) []Post {
+	name = strings.ToLower(name)
+	if name == "" || name == "/" || name == "." {
+		return nil
+	}
+	limit := max(2, len(name)/3)
+
+	type match struct {
+		post     Post
+		distance int
+	}
+	var matches []match
+	for _, post := range posts {
+		if d := editDistance(name, post.Slug); d <= limit {
+			matches = append(matches, match{post, d})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].distance < matches[j].distance
+	})
+
+	var suggestions []Post
+	for _, m := range matches[:min(len(matches), maxSuggestions)] {
+		suggestions = append(suggestions, m.post)
+	}
+	return suggestions
+}
+
+// editDistance is the Levenshtein distance between two strings: the number
+// of single character insertions, deletions and substitutions to turn one
+// into the other
+func editDistance(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	prev := make([]int, len(t)+1)
+	cur := make([]int, len(t)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		cur[0] = i
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(t)]
+}
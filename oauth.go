@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
+)
+
+const (
+	oauthCookieName = "tulip_oauth"
+	oauthCookieAge  = 10 * 60 // 10 minutes in seconds
+)
+
+// OAuthProvider is an external identity provider users can sign in with
+type OAuthProvider struct {
+	Name  string
+	Label string
+
+	config oauth2.Config
+	// identify returns the account's stable ID and verified email address
+	identify func(ctx context.Context, client *http.Client) (oauthIdentity, error)
+}
+
+// oauthIdentity is an account at a provider
+type oauthIdentity struct {
+	Subject string
+	Email   string
+}
+
+// oauthProviders are the providers with credentials configured, by name
+var oauthProviders = map[string]*OAuthProvider{}
+
+// loadOAuthProviders enables each provider whose client ID and secret are
+// set, e.g. GITHUB_CLIENT_ID and GITHUB_CLIENT_SECRET
+func loadOAuthProviders(cfg Config) {
+	candidates := []*OAuthProvider{
+		{
+			Name:  "github",
+			Label: "GitHub",
+			config: oauth2.Config{
+				ClientID:     cfg.GitHubClientID,
+				ClientSecret: cfg.GitHubClientSecret,
+				Endpoint:     endpoints.GitHub,
+				Scopes:       []string{"read:user", "user:email"},
+			},
+			identify: identifyGitHub,
+		},
+		{
+			Name:  "google",
+			Label: "Google",
+			config: oauth2.Config{
+				ClientID:     cfg.GoogleClientID,
+				ClientSecret: cfg.GoogleClientSecret,
+				Endpoint:     endpoints.Google,
+				Scopes:       []string{"openid", "email"},
+			},
+			identify: identifyGoogle,
+		},
+	}
+
+	for _, p := range candidates {
+		if p.config.ClientID == "" || p.config.ClientSecret == "" {
+			continue
+		}
+		oauthProviders[p.Name] = p
+		slog.Info("OAuth provider enabled", "provider", p.Name)
+	}
+}
+
+// loginProviders returns the enabled providers for the login page
+func loginProviders() []*OAuthProvider {
+	providers := make([]*OAuthProvider, 0, len(oauthProviders))
+	for _, p := range oauthProviders {
+		providers = append(providers, p)
+	}
+	sort.Slice(providers, func(i, j int) bool { return providers[i].Name < providers[j].Name })
+	return providers
+}
+
+// configFor returns the provider's config with the callback URL for this host
+func (p *OAuthProvider) configFor(r *http.Request) *oauth2.Config {
+	config := p.config
+	config.RedirectURL = baseURL(r) + "/auth/" + p.Name + "/callback"
+	return &config
+}
+
+// getJSON fetches a JSON document with the provider's authenticated client
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch %s: %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", url, err)
+	}
+	return nil
+}
+
+// identifyGitHub looks up the user's ID and primary verified email
+func identifyGitHub(ctx context.Context, client *http.Client) (oauthIdentity, error) {
+	var user struct {
+		ID int64 `json:"id"`
+	}
+	if err := getJSON(ctx, client, "https://api.github.com/user", &user); err != nil {
+		return oauthIdentity{}, err
+	}
+
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON(ctx, client, "https://api.github.com/user/emails", &emails); err != nil {
+		return oauthIdentity{}, err
+	}
+	for _, e := range emails {
+		if e.Primary && e.Verified {
+			return oauthIdentity{Subject: strconv.FormatInt(user.ID, 10), Email: e.Email}, nil
+		}
+	}
+	return oauthIdentity{}, fmt.Errorf("github account has no verified primary email")
+}
+
+// identifyGoogle looks up the user's ID and verified email
+func identifyGoogle(ctx context.Context, client *http.Client) (oauthIdentity, error) {
+	var info struct {
+		Subject       string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := getJSON(ctx, client, "https://openidconnect.googleapis.com/v1/userinfo", &info); err != nil {
+		return oauthIdentity{}, err
+	}
+	if info.Email == "" || !info.EmailVerified {
+		return oauthIdentity{}, fmt.Errorf("google account has no verified email")
+	}
+	return oauthIdentity{Subject: info.Subject, Email: info.Email}, nil
+}
+
+// LinkOAuthIdentity returns the user linked to a provider account. Accounts
+// seen for the first time are linked to the user with the same email,
+// creating them if needed. Callers run it in a transaction, see InTx, so a
+// user is never created without the link.
+func (app *App) LinkOAuthIdentity(ctx context.Context, provider string, identity oauthIdentity) (User, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	db := app.DBFrom(ctx)
+	var userID int64
+	err := db.QueryRowContext(ctx,
+		"SELECT user_id FROM oauth_identities WHERE provider = ? AND subject = ?",
+		provider, identity.Subject,
+	).Scan(&userID)
+	if err == nil {
+		return app.GetUserByID(ctx, userID)
+	} else if err != sql.ErrNoRows {
+		return User{}, fmt.Errorf("failed to query oauth identity: %w", err)
+	}
+
+	user, err := app.CreateOrGetUser(ctx, identity.Email)
+	if err != nil {
+		return User{}, err
+	}
+	_, err = db.ExecContext(ctx,
+		"INSERT INTO oauth_identities (provider, subject, user_id, email) VALUES (?, ?, ?, ?)",
+		provider, identity.Subject, user.ID, identity.Email,
+	)
+	if err != nil {
+		return User{}, fmt.Errorf("failed to link oauth identity: %w", err)
+	}
+	return user, nil
+}
+
+// handleOAuth serves /auth/{provider}/start and /auth/{provider}/callback
+func (app *App) handleOAuth(w http.ResponseWriter, r *http.Request) error {
+	name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/auth/"), "/")
+	provider, ok := oauthProviders[name]
+	if !ok || (action != "start" && action != "callback") {
+		return NewHTTPError(fmt.Errorf("page not found: %s", r.URL.Path), http.StatusNotFound)
+	}
+
+	if action == "start" {
+		return handleOAuthStart(w, r, provider)
+	}
+	return app.handleOAuthCallback(w, r, provider)
+}
+
+// handleOAuthStart sends the browser to the provider, remembering the state
+// and PKCE verifier in a short-lived cookie
+func handleOAuthStart(w http.ResponseWriter, r *http.Request, provider *OAuthProvider) error {
+	state, err := generateRandomToken(16)
+	if err != nil {
+		return fmt.Errorf("failed to generate oauth state: %w", err)
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthCookieName,
+		Value:    state + "." + verifier,
+		Path:     "/auth/" + provider.Name,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   oauthCookieAge,
+	})
+
+	url := provider.configFor(r).AuthCodeURL(state, oauth2.S256ChallengeOption(verifier))
+	http.Redirect(w, r, url, http.StatusFound)
+	return nil
+}
+
+// handleOAuthCallback finishes the authorization code flow and logs the
+// user in
+func (app *App) handleOAuthCallback(w http.ResponseWriter, r *http.Request, provider *OAuthProvider) error {
+	ctx := r.Context()
+
+	if err := app.checkRateLimit(w, r, verifyIPLimit, clientIP(r).String()); err != nil {
+		return err
+	}
+
+	fail := func(err error) error {
+		slog.ErrorContext(ctx, "OAuth login failed", "provider", provider.Name, "error", err)
+		http.Redirect(w, r, "/login?error=oauth_failed", http.StatusSeeOther)
+		return nil
+	}
+
+	// The state cookie is single use
+	cookie, err := r.Cookie(oauthCookieName)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthCookieName,
+		Path:     "/auth/" + provider.Name,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+	})
+	if err != nil {
+		return fail(fmt.Errorf("missing oauth state cookie"))
+	}
+	state, verifier, _ := strings.Cut(cookie.Value, ".")
+	if subtle.ConstantTimeCompare([]byte(state), []byte(r.URL.Query().Get("state"))) != 1 {
+		return fail(fmt.Errorf("oauth state mismatch"))
+	}
+	if errCode := r.URL.Query().Get("error"); errCode != "" {
+		return fail(fmt.Errorf("provider returned %s", errCode))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	config := provider.configFor(r)
+	token, err := config.Exchange(ctx, r.URL.Query().Get("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		return fail(fmt.Errorf("failed to exchange code: %w", err))
+	}
+	identity, err := provider.identify(ctx, config.Client(ctx, token))
+	if err != nil {
+		return fail(err)
+	}
+
+	// Linking the account and starting the session succeed or fail together
+	err = app.InTx(r.Context(), func(ctx context.Context) error {
+		user, err := app.LinkOAuthIdentity(ctx, provider.Name, identity)
+		if err != nil {
+			return err
+		}
+		return app.completeLogin(w, r.WithContext(ctx), user, provider.Name)
+	})
+	if err != nil {
+		return fail(err)
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// APIOperation describes a JSON endpoint for the OpenAPI document. Request
+// and response bodies are given as example values, and their schemas are
+// derived from the Go types and json tags.
+type APIOperation struct {
+	Summary     string
+	Description string
+	Tag         string
+	// Request is the JSON request body, or nil
+	Request any
+	// Responses maps status codes to a description and an optional body
+	Responses map[int]APIResponse
+	// CSRF marks endpoints that need the X-CSRF-Token header
+	CSRF bool
+	// Scope is the API token scope needed, for endpoints that accept tokens
+	Scope string
+}
+
+// APIResponse is a single documented response
+type APIResponse struct {
+	Description string
+	Body        any
+}
+
+// body returns the response's body, which for errors defaults to the
+// APIError envelope
+func (resp APIResponse) body(status int) any {
+	if resp.Body == nil && status >= http.StatusBadRequest {
+		return APIError{}
+	}
+	return resp.Body
+}
+
+// APISpec collects the documented endpoints. Handlers register their
+// endpoints next to where their routes are registered, so the document stays
+// in sync with the code.
+type APISpec struct {
+	mu  sync.Mutex
+	ops map[string]map[string]APIOperation
+}
+
+// apiSpec is the OpenAPI document served at /api/openapi.json
+var apiSpec = &APISpec{ops: map[string]map[string]APIOperation{}}
+
+// Add documents an endpoint
+func (s *APISpec) Add(method, path string, op APIOperation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ops[path] == nil {
+		s.ops[path] = map[string]APIOperation{}
+	}
+	s.ops[path][strings.ToLower(method)] = op
+}
+
+// APIEndpoint is a documented endpoint, for the docs page
+type APIEndpoint struct {
+	Method    string
+	Path      string
+	Operation APIOperation
+	Request   string
+	Responses []APIEndpointResponse
+}
+
+// APIEndpointResponse is a documented response, for the docs page
+type APIEndpointResponse struct {
+	Status      int
+	Description string
+	Schema      string
+}
+
+// Endpoints returns the documented endpoints sorted by path then method
+func (s *APISpec) Endpoints() []APIEndpoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var endpoints []APIEndpoint
+	for path, methods := range s.ops {
+		for method, op := range methods {
+			endpoint := APIEndpoint{
+				Method:    strings.ToUpper(method),
+				Path:      path,
+				Operation: op,
+			}
+			if op.Request != nil {
+				endpoint.Request = indentJSON(jsonSchema(reflect.TypeOf(op.Request)))
+			}
+			for status, resp := range op.Responses {
+				r := APIEndpointResponse{Status: status, Description: resp.Description}
+				if body := resp.body(status); body != nil {
+					r.Schema = indentJSON(jsonSchema(reflect.TypeOf(body)))
+				}
+				endpoint.Responses = append(endpoint.Responses, r)
+			}
+			sort.Slice(endpoint.Responses, func(i, j int) bool {
+				return endpoint.Responses[i].Status < endpoint.Responses[j].Status
+			})
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].Path != endpoints[j].Path {
+			return endpoints[i].Path < endpoints[j].Path
+		}
+		return endpoints[i].Method < endpoints[j].Method
+	})
+	return endpoints
+}
+
+// Document builds the OpenAPI 3 document
+func (s *APISpec) Document(serverURL string) map[string]any {
+	paths := map[string]any{}
+	for _, endpoint := range s.Endpoints() {
+		op := endpoint.Operation
+		doc := map[string]any{
+			"summary":     op.Summary,
+			"operationId": operationID(endpoint.Method, endpoint.Path),
+		}
+		if op.Description != "" {
+			doc["description"] = op.Description
+		}
+		if op.Tag != "" {
+			doc["tags"] = []string{op.Tag}
+		}
+		var parameters []any
+		if op.CSRF {
+			description := "The CSRF token from the tulip_csrf cookie"
+			if op.Scope != "" {
+				description += ", not needed with an API token"
+			}
+			parameters = append(parameters, map[string]any{
+				"name":        csrfHeaderName,
+				"in":          "header",
+				"required":    op.Scope == "",
+				"description": description,
+				"schema":      map[string]any{"type": "string"},
+			})
+		}
+		if op.Scope != "" {
+			// Endpoints that take tokens all authenticate with
+			// authenticateRequest, which handles X-Acting-As
+			parameters = append(parameters, map[string]any{
+				"name":        actingAsHeader,
+				"in":          "header",
+				"required":    false,
+				"description": "Admins only: the ID of a user to act as. Tokens need the admin:act-as scope.",
+				"schema":      map[string]any{"type": "integer"},
+			})
+		}
+		if parameters != nil {
+			doc["parameters"] = parameters
+		}
+		if op.Scope != "" {
+			doc["security"] = []any{
+				map[string]any{"session": []string{}},
+				map[string]any{"token": []string{op.Scope}},
+			}
+		}
+		if op.Request != nil {
+			doc["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": jsonSchema(reflect.TypeOf(op.Request))},
+				},
+			}
+		}
+
+		responses := map[string]any{}
+		for status, resp := range op.Responses {
+			r := map[string]any{"description": resp.Description}
+			if body := resp.body(status); body != nil {
+				r["content"] = map[string]any{
+					"application/json": map[string]any{"schema": jsonSchema(reflect.TypeOf(body))},
+				}
+			}
+			responses[strconv.Itoa(status)] = r
+		}
+		doc["responses"] = responses
+
+		if paths[endpoint.Path] == nil {
+			paths[endpoint.Path] = map[string]any{}
+		}
+		paths[endpoint.Path].(map[string]any)[strings.ToLower(endpoint.Method)] = doc
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "Tulip API",
+			"version": "1.0.0",
+		},
+		"servers": []any{map[string]any{"url": serverURL}},
+		"paths":   paths,
+		"components": map[string]any{
+			"securitySchemes": map[string]any{
+				"session": map[string]any{
+					"type": "apiKey",
+					"in":   "cookie",
+					"name": sessionCookieName,
+				},
+				"token": map[string]any{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "A personal access token from /settings/tokens",
+				},
+			},
+		},
+		"security": []any{map[string]any{}, map[string]any{"session": []string{}}},
+	}
+}
+
+// operationID turns "POST /push/subscribe" into "postPushSubscribe"
+func operationID(method, path string) string {
+	id := strings.ToLower(method)
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool {
+		return r == '/' || r == '-' || r == '_' || r == '{' || r == '}' || r == '.'
+	}) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+// jsonSchema describes a Go type the way encoding/json would serialize it
+func jsonSchema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		if t.PkgPath() == "time" && t.Name() == "Time" {
+			return map[string]any{"type": "string", "format": "date-time"}
+		}
+		properties := map[string]any{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = jsonSchema(field.Type)
+		}
+		return map[string]any{"type": "object", "properties": properties}
+	}
+	return map[string]any{}
+}
+
+// indentJSON formats a value for display
+func indentJSON(v any) string {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// handleOpenAPI serves the OpenAPI document
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(apiSpec.Document(baseURL(r))); err != nil {
+		return fmt.Errorf("failed to write openapi document: %w", err)
+	}
+	return nil
+}
+
+// APIDocsPage holds data for the API docs template
+type APIDocsPage struct {
+	Meta      PageMeta
+	Endpoints []APIEndpoint
+}
+
+// handleAPIDocs renders a human readable view of the OpenAPI document
+func (app *App) handleAPIDocs(w http.ResponseWriter, r *http.Request, count int, user *User) error {
+	w.Header().Set("Content-Type", "text/html")
+	data := APIDocsPage{
+		Meta: PageMeta{
+			Title: "API",
+			Count: count,
+			User:  user,
+
+			CanonicalURL: canonicalURL(r),
+
+			CSRFToken: csrfToken(r),
+		},
+		Endpoints: apiSpec.Endpoints(),
+	}
+	if err := app.render(w, r, http.StatusOK, "apidocs.html", data); err != nil {
+		return fmt.Errorf("failed to render api docs: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+)
+
+// Outbox statuses
+const (
+	outboxPending = "pending"
+	outboxSent    = "sent"
+	outboxFailed  = "failed"
+)
+
+const (
+	// outboxMaxAttempts is how many times an email is tried before it's
+	// marked failed and needs a manual retry
+	outboxMaxAttempts = 6
+	// outboxRetryDelay doubles after each attempt, so the last try is about
+	// 15 minutes after the first, around when a login link expires
+	outboxRetryDelay = 30 * time.Second
+	// outboxBatch is how many emails the worker sends per pass
+	outboxBatch = 50
+)
+
+// OutboxMail is an email in the outbox
+type OutboxMail struct {
+	ID            int64
+	Mail          Mail
+	Status        string
+	Attempts      int
+	LastError     string
+	NextAttemptAt time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// queueMail stores msg in the outbox and tries to send it right away.
+// Temporary failures are retried in the background, so only a permanent
+// failure, like a rejected address, is returned.
+func (app *App) queueMail(ctx context.Context, msg Mail) error {
+	if app.Mailer == nil {
+		return errMailNotConfigured
+	}
+
+	// The first retry is scheduled up front so the worker leaves the email
+	// alone while it's sent here
+	now := time.Now()
+	var id int64
+	err := app.DB.QueryRowContext(ctx, `
+		INSERT INTO email_outbox (recipient, reply_to, subject, text_body, html_body, status, next_attempt_at, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`, msg.To, msg.ReplyTo, msg.Subject, msg.Text, msg.HTML, outboxPending, now.Add(outboxRetryDelay), now, now).Scan(&id)
+	if err != nil {
+		return fmt.Errorf("failed to queue email: %w", err)
+	}
+
+	sendErr := app.sendMessage(ctx, msg)
+	if err := app.recordOutboxAttempt(ctx, id, 0, sendErr, now); err != nil {
+		return err
+	}
+	if isPermanentMailError(sendErr) {
+		return sendErr
+	}
+	if sendErr != nil {
+		slog.Warn("Email will be retried", "outbox_id", id, "error", sendErr)
+	}
+	return nil
+}
+
+// recordOutboxAttempt updates an email after trying to send it. Sent emails
+// have their bodies cleared, since login emails contain working links.
+func (app *App) recordOutboxAttempt(ctx context.Context, id int64, attempts int, sendErr error, now time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	attempts++
+	var err error
+	switch {
+	case sendErr == nil:
+		_, err = app.DB.ExecContext(ctx, `
+			UPDATE email_outbox SET status = ?, attempts = ?, last_error = '', text_body = '', html_body = '', updated_at = ?
+			WHERE id = ?
+		`, outboxSent, attempts, now, id)
+	case isPermanentMailError(sendErr) || attempts >= outboxMaxAttempts:
+		_, err = app.DB.ExecContext(ctx, `
+			UPDATE email_outbox SET status = ?, attempts = ?, last_error = ?, updated_at = ?
+			WHERE id = ?
+		`, outboxFailed, attempts, sendErr.Error(), now, id)
+	default:
+		// Back off exponentially between attempts
+		next := now.Add(outboxRetryDelay << (attempts - 1))
+		_, err = app.DB.ExecContext(ctx, `
+			UPDATE email_outbox SET attempts = ?, last_error = ?, next_attempt_at = ?, updated_at = ?
+			WHERE id = ?
+		`, attempts, sendErr.Error(), next, now, id)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update outbox: %w", err)
+	}
+	return nil
+}
+
+const outboxColumns = "id, recipient, reply_to, subject, text_body, html_body, status, attempts, last_error, next_attempt_at, created_at, updated_at"
+
+// scanOutboxMail reads a row of outboxColumns
+func scanOutboxMail(row interface{ Scan(...any) error }) (OutboxMail, error) {
+	var m OutboxMail
+	err := row.Scan(&m.ID, &m.Mail.To, &m.Mail.ReplyTo, &m.Mail.Subject, &m.Mail.Text, &m.Mail.HTML,
+		&m.Status, &m.Attempts, &m.LastError, &m.NextAttemptAt, &m.CreatedAt, &m.UpdatedAt)
+	return m, err
+}
+
+// SendQueuedMail sends every email in the outbox that's due
+func (app *App) SendQueuedMail(ctx context.Context, now time.Time) error {
+	if app.Mailer == nil {
+		return nil
+	}
+
+	// Only the query is bounded, a slow mail server shouldn't cut the batch short
+	qctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	rows, err := app.DB.QueryContext(qctx,
+		"SELECT "+outboxColumns+" FROM email_outbox WHERE status = ? AND next_attempt_at <= ? ORDER BY next_attempt_at LIMIT ?",
+		outboxPending, now, outboxBatch,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to query outbox: %w", err)
+	}
+	var due []OutboxMail
+	for rows.Next() {
+		m, err := scanOutboxMail(rows)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan outbox row: %w", err)
+		}
+		due = append(due, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating outbox rows: %w", err)
+	}
+
+	if len(due) == 0 {
+		return nil
+	}
+	ctx, span := app.startTrace(ctx, "send queued email", otlpInt("email.count", int64(len(due))))
+	defer span.End()
+	for _, m := range due {
+		sendErr := app.sendMessage(ctx, m.Mail)
+		if sendErr != nil {
+			slog.Error("Failed to send queued email", "outbox_id", m.ID, "attempt", m.Attempts+1, "error", sendErr)
+		}
+		if err := app.recordOutboxAttempt(ctx, m.ID, m.Attempts, sendErr, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartMailWorker sends queued email in the background, checking every
+// 10 seconds or when woken by RetryOutboxMail
+func (app *App) StartMailWorker() {
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		for {
+			if err := app.SendQueuedMail(context.Background(), time.Now()); err != nil {
+				slog.Error("Failed to send queued email", "error", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-app.outboxWake:
+			}
+		}
+	}()
+}
+
+// ListOutbox returns emails that haven't been sent, failed ones first
+func (app *App) ListOutbox(ctx context.Context, limit int) ([]OutboxMail, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	rows, err := app.DB.QueryContext(ctx, `
+		SELECT `+outboxColumns+`
+		FROM email_outbox
+		WHERE status != ?
+		ORDER BY status = ? DESC, updated_at DESC
+		LIMIT ?
+	`, outboxSent, outboxFailed, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query outbox: %w", err)
+	}
+	defer rows.Close()
+
+	var mails []OutboxMail
+	for rows.Next() {
+		m, err := scanOutboxMail(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan outbox row: %w", err)
+		}
+		mails = append(mails, m)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating outbox rows: %w", err)
+	}
+	return mails, nil
+}
+
+// errOutboxNotFound is returned for emails that aren't in the outbox or
+// aren't failed
+var errOutboxNotFound = errors.New("email not found")
+
+// RetryOutboxMail puts a failed email back in the queue
+func (app *App) RetryOutboxMail(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	result, err := app.DB.ExecContext(ctx, `
+		UPDATE email_outbox SET status = ?, attempts = 0, next_attempt_at = ?, updated_at = ?
+		WHERE id = ? AND status = ?
+	`, outboxPending, time.Now(), time.Now(), id, outboxFailed)
+	if err != nil {
+		return fmt.Errorf("failed to retry email: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to retry email: %w", err)
+	} else if n == 0 {
+		return errOutboxNotFound
+	}
+
+	select {
+	case app.outboxWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// DeleteOutboxMail discards a failed email
+func (app *App) DeleteOutboxMail(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	result, err := app.DB.ExecContext(ctx, "DELETE FROM email_outbox WHERE id = ? AND status = ?", id, outboxFailed)
+	if err != nil {
+		return fmt.Errorf("failed to delete email: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to delete email: %w", err)
+	} else if n == 0 {
+		return errOutboxNotFound
+	}
+	return nil
+}
+
+// handleAdminOutbox retries or discards a failed email
+func (app *App) handleAdminOutbox(w http.ResponseWriter, r *http.Request, user *User) error {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		return NewHTTPError(fmt.Errorf("invalid email id"), http.StatusBadRequest)
+	}
+
+	action := app.RetryOutboxMail
+	if r.URL.Path == "/admin/outbox/delete" {
+		action = app.DeleteOutboxMail
+	}
+	if err := action(r.Context(), id); errors.Is(err, errOutboxNotFound) {
+		return NewHTTPError(err, http.StatusNotFound)
+	} else if err != nil {
+		return err
+	}
+
+	if err := app.Audit(r.Context(), *user, nil, "outbox."+path.Base(r.URL.Path), fmt.Sprintf("email %d", id)); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+	return nil
+}
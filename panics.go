@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// panicError is a panic recovered from a handler, with the stack it was
+// raised on
+type panicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// Unwrap returns the panic value if it's an error
+func (e *panicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// PanicReport is the body of an error webhook, sent for each panic
+type PanicReport struct {
+	RequestID string    `json:"request_id"`
+	At        time.Time `json:"at"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	Path      string    `json:"path"`
+	// UserID is the signed in user, or 0
+	UserID int64  `json:"user_id,omitempty"`
+	Panic  string `json:"panic"`
+	Stack  string `json:"stack"`
+}
+
+// reportPanic logs a panic with its stack and sends it to
+// ERROR_WEBHOOK_URL, if it's set. The request isn't held up by the webhook.
+func (app *App) reportPanic(r *http.Request, p *panicError) {
+	report := PanicReport{
+		RequestID: RequestID(r.Context()),
+		At:        time.Now().UTC(),
+		Method:    r.Method,
+		Host:      r.Host,
+		Path:      r.URL.Path,
+		Panic:     fmt.Sprint(p.Value),
+		Stack:     string(p.Stack),
+	}
+	if user, err := app.getCurrentUser(r); err == nil {
+		report.UserID = user.ID
+	}
+	slog.ErrorContext(r.Context(), "Panic handling request", "panic", report.Panic, "path", report.Path, "stack", report.Stack)
+
+	if app.Config.ErrorWebhookURL == "" {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), errorReportClient.Timeout)
+		defer cancel()
+		if err := app.sendPanicReport(ctx, report); err != nil {
+			slog.Error("Failed to send panic report", "error", err, "request_id", report.RequestID)
+		}
+	}()
+}
+
+// sendPanicReport POSTs a report to ERROR_WEBHOOK_URL, with
+// ERROR_WEBHOOK_SECRET as a bearer token if it's set
+func (app *App) sendPanicReport(ctx context.Context, report PanicReport) error {
+	payload, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to encode panic report: %w", err)
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	if app.Config.ErrorWebhookSecret != "" {
+		header.Set("Authorization", "Bearer "+app.Config.ErrorWebhookSecret)
+	}
+	return postErrorReport(ctx, "error webhook", app.Config.ErrorWebhookURL, header, payload)
+}
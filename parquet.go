@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// parquetType is a column type a Parquet file can be written with
+type parquetType int
+
+const (
+	parquetString parquetType = iota
+	parquetInt64
+	parquetDouble
+	// parquetDate is a day, written from a time.Time's UTC date
+	parquetDate
+	// parquetTimestamp is a UTC time in milliseconds
+	parquetTimestamp
+)
+
+// parquetField is one column of a Parquet file. Every column is required,
+// so values can't be null.
+type parquetField struct {
+	Name string
+	Type parquetType
+}
+
+// Parquet's Thrift enums, from parquet.thrift
+const (
+	parquetPhysicalInt32     = 1
+	parquetPhysicalInt64     = 2
+	parquetPhysicalDouble    = 5
+	parquetPhysicalByteArray = 6
+
+	parquetConvertedUTF8            = 0
+	parquetConvertedDate            = 6
+	parquetConvertedTimestampMillis = 9
+
+	parquetEncodingPlain = 0
+	parquetEncodingRLE   = 3
+	parquetCodecGzip     = 2
+	parquetDataPage      = 0
+)
+
+// writeParquet encodes rows as a Parquet file with one row group and one
+// gzipped, plain encoded page per column. It's only as much of the format
+// as exporting tables needs, and is read by DuckDB, Athena and pyarrow.
+// Each row has a value per field, of the Go type for the field's type:
+// string, int64, float64 or time.Time.
+func writeParquet(fields []parquetField, rows [][]any) ([]byte, error) {
+	var file bytes.Buffer
+	file.WriteString("PAR1")
+
+	var chunks thriftList
+	var totalSize int64
+	for i, field := range fields {
+		values, err := parquetPlain(field, rows, i)
+		if err != nil {
+			return nil, err
+		}
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		zw.Write(values)
+		if err := zw.Close(); err != nil {
+			return nil, fmt.Errorf("failed to compress %s column: %w", field.Name, err)
+		}
+
+		header := thriftStruct{
+			{1, thriftI32(parquetDataPage)},
+			{2, thriftI32(len(values))},
+			{3, thriftI32(compressed.Len())},
+			{5, thriftStruct{
+				{1, thriftI32(len(rows))},
+				{2, thriftI32(parquetEncodingPlain)},
+				{3, thriftI32(parquetEncodingRLE)},
+				{4, thriftI32(parquetEncodingRLE)},
+			}},
+		}.encode()
+
+		offset := int64(file.Len())
+		file.Write(header)
+		file.Write(compressed.Bytes())
+		uncompressed := int64(len(header) + len(values))
+		totalSize += uncompressed
+
+		physical, _ := parquetPhysicalType(field.Type)
+		chunks = append(chunks, thriftStruct{
+			{2, thriftI64(offset)},
+			{3, thriftStruct{
+				{1, thriftI32(physical)},
+				{2, thriftList{thriftI32(parquetEncodingPlain), thriftI32(parquetEncodingRLE)}},
+				{3, thriftList{thriftString(field.Name)}},
+				{4, thriftI32(parquetCodecGzip)},
+				{5, thriftI64(len(rows))},
+				{6, thriftI64(uncompressed)},
+				{7, thriftI64(int64(len(header) + compressed.Len()))},
+				{9, thriftI64(offset)},
+			}},
+		})
+	}
+
+	schema := thriftList{thriftStruct{
+		{4, thriftString("schema")},
+		{5, thriftI32(len(fields))},
+	}}
+	for _, field := range fields {
+		physical, converted := parquetPhysicalType(field.Type)
+		element := thriftStruct{
+			{1, thriftI32(physical)},
+			// Required
+			{3, thriftI32(0)},
+			{4, thriftString(field.Name)},
+		}
+		if converted >= 0 {
+			element = append(element, thriftField{6, thriftI32(converted)})
+		}
+		schema = append(schema, element)
+	}
+
+	rowGroups := thriftList{}
+	if len(fields) > 0 {
+		rowGroups = append(rowGroups, thriftStruct{
+			{1, chunks},
+			{2, thriftI64(totalSize)},
+			{3, thriftI64(len(rows))},
+		})
+	}
+	footer := thriftStruct{
+		{1, thriftI32(1)},
+		{2, schema},
+		{3, thriftI64(len(rows))},
+		{4, rowGroups},
+		{6, thriftString("tulip")},
+	}.encode()
+
+	file.Write(footer)
+	binary.Write(&file, binary.LittleEndian, uint32(len(footer)))
+	file.WriteString("PAR1")
+	return file.Bytes(), nil
+}
+
+// parquetPhysicalType returns the type a column is stored as and how it's
+// to be read, or -1 if it's read as stored
+func parquetPhysicalType(t parquetType) (physical, converted int) {
+	switch t {
+	case parquetString:
+		return parquetPhysicalByteArray, parquetConvertedUTF8
+	case parquetDouble:
+		return parquetPhysicalDouble, -1
+	case parquetDate:
+		return parquetPhysicalInt32, parquetConvertedDate
+	case parquetTimestamp:
+		return parquetPhysicalInt64, parquetConvertedTimestampMillis
+	default:
+		return parquetPhysicalInt64, -1
+	}
+}
+
+// parquetPlain encodes column i of rows with Parquet's plain encoding
+func parquetPlain(field parquetField, rows [][]any, i int) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, row := range rows {
+		value := row[i]
+		ok := true
+		switch field.Type {
+		case parquetString:
+			var s string
+			if s, ok = value.(string); ok {
+				binary.Write(&buf, binary.LittleEndian, uint32(len(s)))
+				buf.WriteString(s)
+			}
+		case parquetInt64:
+			var n int64
+			if n, ok = value.(int64); ok {
+				binary.Write(&buf, binary.LittleEndian, n)
+			}
+		case parquetDouble:
+			var f float64
+			if f, ok = value.(float64); ok {
+				binary.Write(&buf, binary.LittleEndian, math.Float64bits(f))
+			}
+		case parquetDate:
+			var t time.Time
+			if t, ok = value.(time.Time); ok {
+				y, m, d := t.UTC().Date()
+				days := time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / (24 * 60 * 60)
+				binary.Write(&buf, binary.LittleEndian, int32(days))
+			}
+		case parquetTimestamp:
+			var t time.Time
+			if t, ok = value.(time.Time); ok {
+				binary.Write(&buf, binary.LittleEndian, t.UnixMilli())
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("invalid value %v (%T) for parquet column %s", value, value, field.Name)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// The Thrift compact protocol, which Parquet's metadata is written in.
+// Only the types Parquet's metadata uses are here.
+
+const (
+	thriftTypeI32    = 5
+	thriftTypeI64    = 6
+	thriftTypeBinary = 8
+	thriftTypeList   = 9
+	thriftTypeStruct = 12
+)
+
+// thriftValue is a value that can be written with the compact protocol
+type thriftValue interface {
+	thriftType() byte
+	appendTo(b []byte) []byte
+}
+
+type (
+	thriftI32    int32
+	thriftI64    int64
+	thriftString string
+	thriftList   []thriftValue
+	// thriftStruct's fields must be in increasing id order
+	thriftStruct []thriftField
+)
+
+type thriftField struct {
+	ID    int16
+	Value thriftValue
+}
+
+func (thriftI32) thriftType() byte    { return thriftTypeI32 }
+func (thriftI64) thriftType() byte    { return thriftTypeI64 }
+func (thriftString) thriftType() byte { return thriftTypeBinary }
+func (thriftList) thriftType() byte   { return thriftTypeList }
+func (thriftStruct) thriftType() byte { return thriftTypeStruct }
+
+func (v thriftI32) appendTo(b []byte) []byte {
+	return binary.AppendUvarint(b, uint64(uint32((int32(v)<<1)^(int32(v)>>31))))
+}
+
+func (v thriftI64) appendTo(b []byte) []byte {
+	return binary.AppendUvarint(b, uint64((int64(v)<<1)^(int64(v)>>63)))
+}
+
+func (v thriftString) appendTo(b []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func (v thriftList) appendTo(b []byte) []byte {
+	// An empty list's element type doesn't matter
+	elemType := byte(thriftTypeStruct)
+	if len(v) > 0 {
+		elemType = v[0].thriftType()
+	}
+	if len(v) < 15 {
+		b = append(b, byte(len(v))<<4|elemType)
+	} else {
+		b = append(b, 0xf0|elemType)
+		b = binary.AppendUvarint(b, uint64(len(v)))
+	}
+	for _, elem := range v {
+		b = elem.appendTo(b)
+	}
+	return b
+}
+
+func (v thriftStruct) appendTo(b []byte) []byte {
+	var last int16
+	for _, f := range v {
+		if delta := f.ID - last; delta > 0 && delta <= 15 {
+			b = append(b, byte(delta)<<4|f.Value.thriftType())
+		} else {
+			b = append(b, f.Value.thriftType())
+			b = thriftI32(f.ID).appendTo(b)
+		}
+		b = f.Value.appendTo(b)
+		last = f.ID
+	}
+	// Stop
+	return append(b, 0)
+}
+
+func (v thriftStruct) encode() []byte {
+	return v.appendTo(nil)
+}
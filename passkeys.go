@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Passkeys use WebAuthn with "none" attestation. Browsers hand us the
+// credential's public key as SPKI DER through getPublicKey(), so there's no
+// CBOR to decode, and assertions are verified with the standard library.
+
+const passkeyChallengeDuration = 5 * time.Minute
+
+// COSE algorithm identifiers offered to authenticators
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+)
+
+var b64url = base64.RawURLEncoding
+
+// Passkey is a registered WebAuthn credential
+type Passkey struct {
+	ID           int64
+	UserID       int64
+	CredentialID string
+	PublicKey    []byte
+	Algorithm    int
+	SignCount    uint32
+	Name         string
+	CreatedAt    time.Time
+	LastUsedAt   sql.NullTime
+}
+
+// PasskeysPage holds data for the passkeys template
+type PasskeysPage struct {
+	Meta     PageMeta
+	Passkeys []Passkey
+}
+
+// relyingParty returns the WebAuthn RP ID and expected origin for the site
+// the request is for. They come from SITE_URL and the sites' hosts rather
+// than the request, since Host and X-Forwarded-Proto are up to the client.
+// In development without SITE_URL the request's host is used.
+func (app *App) relyingParty(r *http.Request) (string, string, error) {
+	site := app.siteFor(r)
+	u, err := url.Parse(app.Config.SiteURL)
+	switch {
+	case app.Config.SiteURL == "" && app.Config.isDevelopment():
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return host, baseURL(r), nil
+	case app.Config.SiteURL == "" || err != nil:
+		return "", "", NewHTTPError(fmt.Errorf("passkeys need SITE_URL to be set"), http.StatusServiceUnavailable)
+	case site.Name != "":
+		return site.Host, u.Scheme + "://" + site.Host, nil
+	}
+	return strings.ToLower(u.Hostname()), u.Scheme + "://" + strings.ToLower(u.Host), nil
+}
+
+// CreatePasskeyChallenge stores a single-use challenge. userID is 0 for
+// login challenges.
+func (app *App) CreatePasskeyChallenge(ctx context.Context, userID int64) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	challenge, err := generateRandomToken(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate challenge: %w", err)
+	}
+
+	var owner *int64
+	if userID != 0 {
+		owner = &userID
+	}
+	_, err = app.DB.ExecContext(ctx,
+		"INSERT INTO webauthn_challenges (challenge, user_id, expires_at) VALUES (?, ?, ?)",
+		challenge, owner, time.Now().Add(passkeyChallengeDuration),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to store challenge: %w", err)
+	}
+	return challenge, nil
+}
+
+// ConsumePasskeyChallenge deletes a challenge and reports whether it was
+// valid for the user
+func (app *App) ConsumePasskeyChallenge(ctx context.Context, challenge string, userID int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var owner sql.NullInt64
+	var expiresAt time.Time
+	err := app.DB.QueryRowContext(ctx,
+		"DELETE FROM webauthn_challenges WHERE challenge = ? RETURNING user_id, expires_at",
+		challenge,
+	).Scan(&owner, &expiresAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to consume challenge: %w", err)
+	}
+	return owner.Int64 == userID && time.Now().Before(expiresAt), nil
+}
+
+// GetPasskeys returns the user's passkeys, newest first
+func (app *App) GetPasskeys(ctx context.Context, userID int64) ([]Passkey, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	rows, err := app.DB.QueryContext(ctx, `
+		SELECT id, user_id, credential_id, public_key, algorithm, sign_count, name, created_at, last_used_at
+		FROM webauthn_credentials
+		WHERE user_id = ?
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query passkeys: %w", err)
+	}
+	defer rows.Close()
+
+	var passkeys []Passkey
+	for rows.Next() {
+		var p Passkey
+		err := rows.Scan(&p.ID, &p.UserID, &p.CredentialID, &p.PublicKey, &p.Algorithm, &p.SignCount, &p.Name, &p.CreatedAt, &p.LastUsedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan passkey row: %w", err)
+		}
+		passkeys = append(passkeys, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating passkey rows: %w", err)
+	}
+	return passkeys, nil
+}
+
+// getPasskeyByCredentialID looks up a passkey for login
+func (app *App) getPasskeyByCredentialID(ctx context.Context, credentialID string) (Passkey, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var p Passkey
+	err := app.DB.QueryRowContext(ctx, `
+		SELECT id, user_id, credential_id, public_key, algorithm, sign_count, name, created_at, last_used_at
+		FROM webauthn_credentials
+		WHERE credential_id = ?
+	`, credentialID).Scan(&p.ID, &p.UserID, &p.CredentialID, &p.PublicKey, &p.Algorithm, &p.SignCount, &p.Name, &p.CreatedAt, &p.LastUsedAt)
+	if err == sql.ErrNoRows {
+		return Passkey{}, fmt.Errorf("unknown passkey")
+	} else if err != nil {
+		return Passkey{}, fmt.Errorf("failed to query passkey: %w", err)
+	}
+	return p, nil
+}
+
+// SavePasskey stores a newly registered passkey
+func (app *App) SavePasskey(ctx context.Context, p Passkey) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := app.DB.ExecContext(ctx, `
+		INSERT INTO webauthn_credentials (user_id, credential_id, public_key, algorithm, sign_count, name, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, p.UserID, p.CredentialID, p.PublicKey, p.Algorithm, p.SignCount, p.Name, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to save passkey: %w", err)
+	}
+	return nil
+}
+
+// DeletePasskey removes one of the user's passkeys
+func (app *App) DeletePasskey(ctx context.Context, userID, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := app.DB.ExecContext(ctx, "DELETE FROM webauthn_credentials WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete passkey: %w", err)
+	}
+	return nil
+}
+
+// clientData is the parsed clientDataJSON from the browser
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// verifyClientData checks the ceremony type and origin and returns the
+// challenge the browser signed
+func verifyClientData(raw []byte, ceremony, origin string) (string, error) {
+	var data clientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return "", fmt.Errorf("invalid client data: %w", err)
+	}
+	if data.Type != ceremony {
+		return "", fmt.Errorf("unexpected ceremony %q", data.Type)
+	}
+	if data.Origin != origin {
+		return "", fmt.Errorf("unexpected origin %q", data.Origin)
+	}
+	challenge, err := b64url.DecodeString(data.Challenge)
+	if err != nil {
+		return "", fmt.Errorf("invalid challenge encoding: %w", err)
+	}
+	return string(challenge), nil
+}
+
+// verifyAuthenticatorData checks the RP ID hash and user presence flag and
+// returns the signature counter
+func verifyAuthenticatorData(authData []byte, rpID string) (uint32, error) {
+	if len(authData) < 37 {
+		return 0, fmt.Errorf("authenticator data too short")
+	}
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	if !bytes.Equal(authData[:32], rpIDHash[:]) {
+		return 0, fmt.Errorf("passkey belongs to a different site")
+	}
+	const userPresent = 0x01
+	if authData[32]&userPresent == 0 {
+		return 0, fmt.Errorf("user presence not confirmed")
+	}
+	return binary.BigEndian.Uint32(authData[33:37]), nil
+}
+
+// verifyPasskeySignature checks an assertion signature over the
+// authenticator data and client data hash
+func verifyPasskeySignature(p Passkey, authData, clientDataJSON, signature []byte) error {
+	key, err := x509.ParsePKIXPublicKey(p.PublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid stored public key: %w", err)
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authData...), clientDataHash[:]...)
+	digest := sha256.Sum256(signed)
+
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		if p.Algorithm == coseES256 && ecdsa.VerifyASN1(key, digest[:], signature) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if p.Algorithm == coseRS256 && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+			return nil
+		}
+	case ed25519.PublicKey:
+		if p.Algorithm == coseEdDSA && ed25519.Verify(key, signed, signature) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid passkey signature")
+}
+
+// checkSignCount rejects an assertion whose signature counter didn't
+// increase. Authenticators that keep a counter must increase it, otherwise
+// the key may have been cloned.
+func checkSignCount(p Passkey, signCount uint32) error {
+	if p.SignCount != 0 && signCount <= p.SignCount {
+		return fmt.Errorf("passkey rejected")
+	}
+	return nil
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return fmt.Errorf("failed to write json: %w", err)
+	}
+	return nil
+}
+
+// readJSON decodes a small JSON request body
+func readJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(v); err != nil {
+		return NewHTTPError(fmt.Errorf("invalid request: %w", err), http.StatusBadRequest)
+	}
+	return nil
+}
+
+// handlePasskeys serves the passkey management page and registration API at
+// /passkeys. Callers must make sure the user is logged in.
+func (app *App) handlePasskeys(w http.ResponseWriter, r *http.Request, count int, user *User) error {
+	switch {
+	case r.URL.Path == "/passkeys" && r.Method == http.MethodGet:
+		passkeys, err := app.GetPasskeys(r.Context(), user.ID)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "text/html")
+		data := PasskeysPage{
+			Meta: PageMeta{
+				Title: "Passkeys",
+				Count: count,
+				User:  user,
+
+				CSRFToken: csrfToken(r),
+			},
+			Passkeys: passkeys,
+		}
+		if err := app.render(w, r, http.StatusOK, "passkeys.html", data); err != nil {
+			return fmt.Errorf("failed to render passkeys page: %w", err)
+		}
+		return nil
+	case r.URL.Path == "/passkeys/register/begin" && r.Method == http.MethodPost:
+		return app.handlePasskeyRegisterBegin(w, r, user)
+	case r.URL.Path == "/passkeys/register/finish" && r.Method == http.MethodPost:
+		return app.handlePasskeyRegisterFinish(w, r, user)
+	case r.URL.Path == "/passkeys/delete" && r.Method == http.MethodPost:
+		id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if err != nil {
+			return NewHTTPError(fmt.Errorf("invalid passkey id: %w", err), http.StatusBadRequest)
+		}
+		if err := app.DeletePasskey(r.Context(), user.ID, id); err != nil {
+			return err
+		}
+		slog.InfoContext(r.Context(), "Passkey deleted", "user_id", user.ID, "passkey_id", id)
+		http.Redirect(w, r, "/passkeys", http.StatusSeeOther)
+		return nil
+	}
+
+	return app.notFound(w, r)
+}
+
+// handlePasskeyRegisterBegin returns PublicKeyCredentialCreationOptions
+func (app *App) handlePasskeyRegisterBegin(w http.ResponseWriter, r *http.Request, user *User) error {
+	rpID, _, err := app.relyingParty(r)
+	if err != nil {
+		return err
+	}
+	challenge, err := app.CreatePasskeyChallenge(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+
+	passkeys, err := app.GetPasskeys(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+	exclude := []map[string]any{}
+	for _, p := range passkeys {
+		exclude = append(exclude, map[string]any{"type": "public-key", "id": p.CredentialID})
+	}
+
+	return writeJSON(w, map[string]any{
+		"challenge": b64url.EncodeToString([]byte(challenge)),
+		"rp":        map[string]any{"id": rpID, "name": "Tulip"},
+		"user": map[string]any{
+			"id":          b64url.EncodeToString([]byte(strconv.FormatInt(user.ID, 10))),
+			"name":        user.Email,
+			"displayName": user.Email,
+		},
+		"pubKeyCredParams": []map[string]any{
+			{"type": "public-key", "alg": coseES256},
+			{"type": "public-key", "alg": coseEdDSA},
+			{"type": "public-key", "alg": coseRS256},
+		},
+		"excludeCredentials": exclude,
+		"authenticatorSelection": map[string]any{
+			"residentKey":      "required",
+			"userVerification": "preferred",
+		},
+		"attestation": "none",
+		"timeout":     passkeyChallengeDuration.Milliseconds(),
+	})
+}
+
+// passkeyRegistration is what the browser sends after navigator.credentials.create
+type passkeyRegistration struct {
+	ID                string `json:"id"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AuthenticatorData string `json:"authenticatorData"`
+	PublicKey         string `json:"publicKey"`
+	Algorithm         int    `json:"publicKeyAlgorithm"`
+	Name              string `json:"name"`
+}
+
+// handlePasskeyRegisterFinish verifies and stores a new passkey
+func (app *App) handlePasskeyRegisterFinish(w http.ResponseWriter, r *http.Request, user *User) error {
+	var reg passkeyRegistration
+	if err := readJSON(w, r, &reg); err != nil {
+		return err
+	}
+
+	clientDataJSON, err1 := b64url.DecodeString(reg.ClientDataJSON)
+	authData, err2 := b64url.DecodeString(reg.AuthenticatorData)
+	publicKey, err3 := b64url.DecodeString(reg.PublicKey)
+	if err := errors.Join(err1, err2, err3); err != nil || reg.ID == "" {
+		return NewHTTPError(fmt.Errorf("invalid passkey encoding"), http.StatusBadRequest)
+	}
+
+	rpID, origin, err := app.relyingParty(r)
+	if err != nil {
+		return err
+	}
+	challenge, err := verifyClientData(clientDataJSON, "webauthn.create", origin)
+	if err != nil {
+		return NewHTTPError(err, http.StatusBadRequest)
+	}
+	ok, err := app.ConsumePasskeyChallenge(r.Context(), challenge, user.ID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return NewHTTPError(fmt.Errorf("passkey challenge expired, please try again"), http.StatusBadRequest)
+	}
+	signCount, err := verifyAuthenticatorData(authData, rpID)
+	if err != nil {
+		return NewHTTPError(err, http.StatusBadRequest)
+	}
+
+	if reg.Algorithm != coseES256 && reg.Algorithm != coseEdDSA && reg.Algorithm != coseRS256 {
+		return NewHTTPError(fmt.Errorf("unsupported passkey algorithm %d", reg.Algorithm), http.StatusBadRequest)
+	}
+	if _, err := x509.ParsePKIXPublicKey(publicKey); err != nil {
+		return NewHTTPError(fmt.Errorf("invalid passkey public key: %w", err), http.StatusBadRequest)
+	}
+
+	name := strings.TrimSpace(reg.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+	err = app.SavePasskey(r.Context(), Passkey{
+		UserID:       user.ID,
+		CredentialID: reg.ID,
+		PublicKey:    publicKey,
+		Algorithm:    reg.Algorithm,
+		SignCount:    signCount,
+		Name:         truncate(name, 60),
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.InfoContext(r.Context(), "Passkey registered", "user_id", user.ID)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handlePasskeyLoginBegin returns PublicKeyCredentialRequestOptions. No
+// credentials are listed, so the browser offers any passkey for this site.
+func (app *App) handlePasskeyLoginBegin(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return NewHTTPError(fmt.Errorf("method not allowed"), http.StatusMethodNotAllowed)
+	}
+
+	rpID, _, err := app.relyingParty(r)
+	if err != nil {
+		return err
+	}
+	challenge, err := app.CreatePasskeyChallenge(r.Context(), 0)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, map[string]any{
+		"challenge":        b64url.EncodeToString([]byte(challenge)),
+		"rpId":             rpID,
+		"userVerification": "preferred",
+		"timeout":          passkeyChallengeDuration.Milliseconds(),
+	})
+}
+
+// passkeyAssertion is what the browser sends after navigator.credentials.get
+type passkeyAssertion struct {
+	ID                string `json:"id"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+}
+
+// handlePasskeyLoginFinish verifies an assertion and logs the user in
+func (app *App) handlePasskeyLoginFinish(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return NewHTTPError(fmt.Errorf("method not allowed"), http.StatusMethodNotAllowed)
+	}
+	if err := app.checkRateLimit(w, r, verifyIPLimit, clientIP(r).String()); err != nil {
+		return err
+	}
+
+	var assertion passkeyAssertion
+	if err := readJSON(w, r, &assertion); err != nil {
+		return err
+	}
+
+	clientDataJSON, err1 := b64url.DecodeString(assertion.ClientDataJSON)
+	authData, err2 := b64url.DecodeString(assertion.AuthenticatorData)
+	signature, err3 := b64url.DecodeString(assertion.Signature)
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return NewHTTPError(fmt.Errorf("invalid passkey encoding"), http.StatusBadRequest)
+	}
+
+	rpID, origin, err := app.relyingParty(r)
+	if err != nil {
+		return err
+	}
+	challenge, err := verifyClientData(clientDataJSON, "webauthn.get", origin)
+	if err != nil {
+		return NewHTTPError(err, http.StatusBadRequest)
+	}
+	ok, err := app.ConsumePasskeyChallenge(r.Context(), challenge, 0)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return NewHTTPError(fmt.Errorf("passkey challenge expired, please try again"), http.StatusBadRequest)
+	}
+	signCount, err := verifyAuthenticatorData(authData, rpID)
+	if err != nil {
+		return NewHTTPError(err, http.StatusUnauthorized)
+	}
+
+	passkey, err := app.getPasskeyByCredentialID(r.Context(), assertion.ID)
+	if err != nil {
+		return NewHTTPError(err, http.StatusUnauthorized)
+	}
+	if err := verifyPasskeySignature(passkey, authData, clientDataJSON, signature); err != nil {
+		return NewHTTPError(err, http.StatusUnauthorized)
+	}
+	if err := checkSignCount(passkey, signCount); err != nil {
+		slog.WarnContext(r.Context(), "Passkey counter went backwards", "user_id", passkey.UserID, "passkey_id", passkey.ID)
+		return NewHTTPError(err, http.StatusUnauthorized)
+	}
+
+	user, err := app.GetUserByID(r.Context(), passkey.UserID)
+	if err != nil {
+		return err
+	}
+
+	// The new counter is only kept if the login goes through
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+	err = app.InTx(ctx, func(ctx context.Context) error {
+		_, err := app.DBFrom(ctx).ExecContext(ctx,
+			"UPDATE webauthn_credentials SET sign_count = ?, last_used_at = ? WHERE id = ?",
+			signCount, time.Now(), passkey.ID,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update passkey: %w", err)
+		}
+		return app.startSession(w, r.WithContext(ctx), user)
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.InfoContext(r.Context(), "User logged in", "user_id", user.ID, "email", user.Email, "method", "passkey")
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
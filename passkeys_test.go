@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http/httptest"
+	"testing"
+)
+
+// Assertion vectors from a test authenticator for example.com: flags UP and
+// UV, sign count 7, signed over testAuthData and testClientData
+var (
+	testAuthData   = mustBase64("o3mm9u6vuaVeN4wRgDTidR5oL6ufLTCrE9ISVYbOGUcFAAAABw==")
+	testClientData = []byte(`{"type":"webauthn.get","challenge":"dGVzdC1jaGFsbGVuZ2U","origin":"https://example.com","crossOrigin":false}`)
+)
+
+var testPasskeys = []struct {
+	name      string
+	algorithm int
+	publicKey string
+	signature string
+}{
+	{
+		name:      "ES256",
+		algorithm: coseES256,
+		publicKey: "MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAE5fBJ9kn5ozwk18nKHq+e2mbDMZUyCJoQjuM0xfbc4dtWVxyXah1Gz46ZymJuC+OiMufV7dGEK8nWz+Ijg+lB2w==",
+		signature: "MEUCIEldg49IEoaHpUUn+ea0QKLjan0tcrrL0sAXMWFKu0GfAiEAsdbmOMM25I9z/6BTJgL8RgjRV3jH2GSsawFajyU4740=",
+	},
+	{
+		name:      "RS256",
+		algorithm: coseRS256,
+		publicKey: "MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAsyU1s77M0MCLVju/zgvHCx3s/MPEdEzWhJ6V21q28caAEe+DgW4NMn5aCGjL3H5CmwC1hY3uXtAmsmlSYr0r/Yt9Q7eQ6k9vLlry4RjY+TXy6DDdMc01sE4KWwStYyIny+FT2ZZ0l4f5sZkAEFsVlgX34bHjW8PsGOm/Pa9affEML4vyCGcXmFdHFUQ5mY4V3NMHdFLWbhzSG4oniTUNAEyQZ/G2BPEa6zml6sI//D7gOuWIQvMtCZjTI/D+et+bYiG9BuFViRogZmYe6fSu3bxQoL/FQujPrVfkj67MxiPA/3Gl8gaCG2rssNalPLKW/y40B9EO8phy0VhqyZNBgQIDAQAB",
+		signature: "AZP5Oajerzwl2YJaxTVpK14SPjaEOIGLoEN1JwEMe3UQbDvIUMfcMyYAqvx+grpkgN8V8Y2rcTCYdXTDXlFolpsJVKdzH1rJXxsCGIMXN3M5RkQ75649ssojDd42e/Qgp41yKR3TxGWcvKBtFFvZh8ha7jdjbN4Rj39KoID9Z7w9TFDAJB016WxjxfeiIt2D6oMDuYnP+6etrFrUU085Gth+x6Ctck/FiPQYlcT1x1aMrXJg+uF7R5Mhtl8uAg1gBjVsbdziKJkVnDGX4nv91ZtVwfmlR9sJZKCGr5xb86i6CTLacRXZ+la8wJ2UJqAwG++WO4tA6evJyhpoGmi4tw==",
+	},
+	{
+		name:      "EdDSA",
+		algorithm: coseEdDSA,
+		publicKey: "MCowBQYDK2VwAyEAgvKo3NmU+UCKiiHcv0kfG4gscD3ztJbDcFnooqqxGvk=",
+		signature: "bUPmQJkIYDvnJ0xylZDKEzQmBOSJ2SVXMfBwR11OolSVqygObTpc8InZY6fwa1tYu5Y6ND1y5RNNJUGDdU6dCw==",
+	},
+}
+
+func mustBase64(s string) []byte {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestVerifyPasskeySignature(t *testing.T) {
+	tampered := append([]byte{}, testAuthData...)
+	tampered[36]++
+
+	for _, tt := range testPasskeys {
+		t.Run(tt.name, func(t *testing.T) {
+			p := Passkey{PublicKey: mustBase64(tt.publicKey), Algorithm: tt.algorithm}
+			signature := mustBase64(tt.signature)
+			if err := verifyPasskeySignature(p, testAuthData, testClientData, signature); err != nil {
+				t.Errorf("valid assertion rejected: %v", err)
+			}
+			if err := verifyPasskeySignature(p, tampered, testClientData, signature); err == nil {
+				t.Error("assertion with changed authenticator data accepted")
+			}
+			otherClientData := []byte(`{"type":"webauthn.get","challenge":"b3RoZXI","origin":"https://example.com"}`)
+			if err := verifyPasskeySignature(p, testAuthData, otherClientData, signature); err == nil {
+				t.Error("assertion with changed client data accepted")
+			}
+			p.Algorithm = 0
+			if err := verifyPasskeySignature(p, testAuthData, testClientData, signature); err == nil {
+				t.Error("assertion for a different algorithm accepted")
+			}
+		})
+	}
+}
+
+func TestVerifyClientData(t *testing.T) {
+	tests := []struct {
+		name     string
+		ceremony string
+		origin   string
+		wantErr  bool
+	}{
+		{name: "valid", ceremony: "webauthn.get", origin: "https://example.com"},
+		{name: "wrong origin", ceremony: "webauthn.get", origin: "https://evil.example", wantErr: true},
+		{name: "wrong scheme", ceremony: "webauthn.get", origin: "http://example.com", wantErr: true},
+		{name: "wrong ceremony", ceremony: "webauthn.create", origin: "https://example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			challenge, err := verifyClientData(testClientData, tt.ceremony, tt.origin)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if challenge != "test-challenge" {
+				t.Errorf("challenge = %q, want %q", challenge, "test-challenge")
+			}
+		})
+	}
+}
+
+func TestVerifyAuthenticatorData(t *testing.T) {
+	withFlags := func(flags byte) []byte {
+		data := append([]byte{}, testAuthData...)
+		data[32] = flags
+		return data
+	}
+	otherRP := sha256.Sum256([]byte("evil.example"))
+
+	tests := []struct {
+		name     string
+		authData []byte
+		rpID     string
+		wantErr  bool
+	}{
+		{name: "valid", authData: testAuthData, rpID: "example.com"},
+		{name: "wrong RP ID", authData: testAuthData, rpID: "evil.example", wantErr: true},
+		{name: "wrong rpIdHash", authData: append(otherRP[:], testAuthData[32:]...), rpID: "example.com", wantErr: true},
+		{name: "missing UP flag", authData: withFlags(0x04), rpID: "example.com", wantErr: true},
+		{name: "too short", authData: testAuthData[:36], rpID: "example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signCount, err := verifyAuthenticatorData(tt.authData, tt.rpID)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if signCount != 7 {
+				t.Errorf("sign count = %d, want 7", signCount)
+			}
+		})
+	}
+}
+
+func TestCheckSignCount(t *testing.T) {
+	tests := []struct {
+		name    string
+		stored  uint32
+		got     uint32
+		wantErr bool
+	}{
+		{name: "no counter", stored: 0, got: 0},
+		{name: "first use", stored: 0, got: 7},
+		{name: "increased", stored: 6, got: 7},
+		{name: "repeated", stored: 7, got: 7, wantErr: true},
+		{name: "went backwards", stored: 8, got: 7, wantErr: true},
+		{name: "reset to zero", stored: 8, got: 0, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSignCount(Passkey{SignCount: tt.stored}, tt.got)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkSignCount(%d, %d) error = %v, want error %t", tt.stored, tt.got, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRelyingParty(t *testing.T) {
+	cfg := Config{
+		SiteURL: "https://Example.com",
+		Sites:   map[string]string{"project": "host=project.example.com,posts=./project"},
+	}
+	sites, err := parseSites(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{Config: cfg, sites: sites}
+
+	tests := []struct {
+		name       string
+		host       string
+		wantRPID   string
+		wantOrigin string
+	}{
+		{name: "default site", host: "example.com", wantRPID: "example.com", wantOrigin: "https://example.com"},
+		{name: "other site", host: "project.example.com", wantRPID: "project.example.com", wantOrigin: "https://project.example.com"},
+		{name: "unknown host", host: "evil.example", wantRPID: "example.com", wantOrigin: "https://example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "http://"+tt.host+"/passkeys/login/finish", nil)
+			r.Header.Set("X-Forwarded-Proto", "http")
+			rpID, origin, err := app.relyingParty(r)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rpID != tt.wantRPID || origin != tt.wantOrigin {
+				t.Errorf("relyingParty = %q, %q, want %q, %q", rpID, origin, tt.wantRPID, tt.wantOrigin)
+			}
+		})
+	}
+
+	t.Run("no SITE_URL", func(t *testing.T) {
+		app := &App{Config: Config{}, sites: []*Site{{}}}
+		r := httptest.NewRequest("POST", "http://example.com/passkeys/login/finish", nil)
+		if _, _, err := app.relyingParty(r); err == nil {
+			t.Error("expected an error without SITE_URL outside development")
+		}
+	})
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// Plugins are WASM modules loaded from the plugins directory at startup. They
+// run sandboxed: no filesystem, network, environment or clock beyond what WASI
+// provides by default, a memory cap and a time limit per call.
+//
+// A plugin talks to tulip through its exports. All strings are UTF-8 and are
+// passed as a pointer and length into the plugin's memory. Results are
+// returned packed into a uint64 as ptr<<32 | len.
+//
+//	alloc(len u32) u32                 memory for tulip to write an input into
+//	transform(ptr, len u32) u64        rewrites the rendered HTML of every post
+//	tmpl_<name>(ptr, len u32) u64      template function <name>, taking and
+//	                                   returning a string
+//
+// Template function output is inserted into pages unescaped, so only install
+// plugins you trust to produce safe HTML.
+const (
+	pluginAllocExport     = "alloc"
+	pluginTransformExport = "transform"
+	pluginFuncPrefix      = "tmpl_"
+
+	// pluginMemoryLimitPages caps plugin memory at 64MB (64KB pages)
+	pluginMemoryLimitPages = 1024
+	pluginCallTimeout      = 2 * time.Second
+)
+
+// Plugin is a loaded WASM module. Module instances aren't safe for concurrent
+// use, so calls are serialized.
+type Plugin struct {
+	Name  string
+	Funcs []string
+
+	mu        sync.Mutex
+	module    api.Module
+	alloc     api.Function
+	transform api.Function
+}
+
+var (
+	// plugins are applied in file name order
+	plugins []*Plugin
+
+	// pluginsHash identifies the loaded plugins so cached pages are
+	// invalidated when they change
+	pluginsHash string
+)
+
+// loadPlugins compiles and instantiates every .wasm file in dir, which is
+// set by PLUGINS_DIR. A missing directory means no plugins.
+func loadPlugins(ctx context.Context, dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.wasm"))
+	if err != nil {
+		return fmt.Errorf("failed to list plugins: %w", err)
+	}
+	sort.Strings(paths)
+	if len(paths) == 0 {
+		pluginsHash = hex.EncodeToString(sha256.New().Sum(nil))
+		return nil
+	}
+
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(pluginMemoryLimitPages).
+		WithCloseOnContextDone(true))
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
+		return fmt.Errorf("failed to set up wasi: %w", err)
+	}
+
+	h := sha256.New()
+	for _, path := range paths {
+		code, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read plugin %s: %w", path, err)
+		}
+		h.Write([]byte(filepath.Base(path)))
+		h.Write(code)
+
+		plugin, err := loadPlugin(ctx, runtime, path, code)
+		if err != nil {
+			return err
+		}
+		plugins = append(plugins, plugin)
+		slog.Info("Loaded plugin", "name", plugin.Name, "transform", plugin.transform != nil, "funcs", plugin.Funcs)
+	}
+	pluginsHash = hex.EncodeToString(h.Sum(nil))
+
+	return nil
+}
+
+// loadPlugin instantiates a single plugin module
+func loadPlugin(ctx context.Context, runtime wazero.Runtime, path string, code []byte) (*Plugin, error) {
+	name := strings.TrimSuffix(filepath.Base(path), ".wasm")
+
+	compiled, err := runtime.CompileModule(ctx, code)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile plugin %s: %w", name, err)
+	}
+
+	// Plugins are libraries, so _start isn't run. Reactor modules get their
+	// _initialize export called instead.
+	config := wazero.NewModuleConfig().
+		WithName(name).
+		WithStartFunctions().
+		WithStderr(os.Stderr)
+	module, err := runtime.InstantiateModule(ctx, compiled, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to instantiate plugin %s: %w", name, err)
+	}
+	if init := module.ExportedFunction("_initialize"); init != nil {
+		if _, err := init.Call(ctx); err != nil {
+			return nil, fmt.Errorf("failed to initialize plugin %s: %w", name, err)
+		}
+	}
+
+	plugin := &Plugin{
+		Name:      name,
+		module:    module,
+		alloc:     module.ExportedFunction(pluginAllocExport),
+		transform: module.ExportedFunction(pluginTransformExport),
+	}
+	if plugin.alloc == nil {
+		return nil, fmt.Errorf("plugin %s does not export %s", name, pluginAllocExport)
+	}
+	for export := range compiled.ExportedFunctions() {
+		if fn, ok := strings.CutPrefix(export, pluginFuncPrefix); ok && fn != "" {
+			plugin.Funcs = append(plugin.Funcs, fn)
+		}
+	}
+	sort.Strings(plugin.Funcs)
+
+	return plugin, nil
+}
+
+// call passes input to an exported function and returns its output
+func (p *Plugin) call(fn api.Function, input string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), pluginCallTimeout)
+	defer cancel()
+
+	results, err := p.alloc.Call(ctx, uint64(len(input)))
+	if err != nil {
+		return "", fmt.Errorf("plugin %s failed to allocate: %w", p.Name, err)
+	}
+	ptr := uint32(results[0])
+	if !p.module.Memory().WriteString(ptr, input) {
+		return "", fmt.Errorf("plugin %s returned an invalid buffer", p.Name)
+	}
+
+	results, err = fn.Call(ctx, uint64(ptr), uint64(len(input)))
+	if err != nil {
+		return "", fmt.Errorf("plugin %s failed: %w", p.Name, err)
+	}
+	outPtr, outLen := uint32(results[0]>>32), uint32(results[0])
+	output, ok := p.module.Memory().Read(outPtr, outLen)
+	if !ok {
+		return "", fmt.Errorf("plugin %s returned an out of range result", p.Name)
+	}
+
+	// Copy out, since the plugin may reuse the buffer
+	return string(output), nil
+}
+
+// applyContentPlugins runs rendered post HTML through each plugin's transform
+func applyContentPlugins(html string) (string, error) {
+	for _, plugin := range plugins {
+		if plugin.transform == nil {
+			continue
+		}
+		var err error
+		html, err = plugin.call(plugin.transform, html)
+		if err != nil {
+			return "", err
+		}
+	}
+	return html, nil
+}
+
+// addPluginFuncs adds the template functions registered by plugins to funcs
+func (app *App) addPluginFuncs(funcs template.FuncMap) error {
+	for _, plugin := range plugins {
+		for _, name := range plugin.Funcs {
+			if _, ok := funcs[name]; ok {
+				return fmt.Errorf("plugin %s redefines template function %s", plugin.Name, name)
+			}
+			fn := plugin.module.ExportedFunction(pluginFuncPrefix + name)
+			funcs[name] = func(arg string) (template.HTML, error) {
+				if !app.FlagEnabled("plugin_funcs", "") {
+					return template.HTML(template.HTMLEscapeString(arg)), nil
+				}
+				output, err := plugin.call(fn, arg)
+				return template.HTML(output), err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+)
+
+// renderVersion is mixed into post cache keys. Bump it whenever the markdown
+// pipeline changes in a way that alters the generated HTML.
+const renderVersion = "3"
+
+// PostCacheStats describes how the rendered post cache performed
+type PostCacheStats struct {
+	Hits    int64
+	Misses  int64
+	Entries int
+}
+
+var postCacheHits, postCacheMisses atomic.Int64
+
+// renderMarkdown converts a post body to HTML, reusing the cached HTML from a
+// previous load when the content and the images it links to haven't changed
+func (app *App) renderMarkdown(ctx context.Context, source []byte) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	// Parsing looks up the post's images in the media directory, and an
+	// image that was uploaded or resized since renders differently. Only
+	// rendering, with its code highlighting, is skipped on a hit.
+	pc := parser.NewContext()
+	doc := markdown.Parser().Parse(text.NewReader(source), parser.WithContext(pc))
+	h := sha256.New()
+	h.Write([]byte(renderVersion + "\n"))
+	h.Write(source)
+	resolved, _ := pc.Get(resolvedImagesKey).([]string)
+	for _, img := range resolved {
+		h.Write([]byte("\x00" + img))
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	var html string
+	err := app.DB.QueryRowContext(ctx, "SELECT html FROM post_cache WHERE hash = ?", hash).Scan(&html)
+	if err == nil {
+		postCacheHits.Add(1)
+		_, err = app.DB.ExecContext(ctx, "UPDATE post_cache SET last_used_at = ? WHERE hash = ?", time.Now(), hash)
+		if err != nil {
+			return "", fmt.Errorf("failed to touch post cache entry: %w", err)
+		}
+		return html, nil
+	} else if err != sql.ErrNoRows {
+		return "", fmt.Errorf("failed to query post cache: %w", err)
+	}
+
+	postCacheMisses.Add(1)
+	var buf bytes.Buffer
+	if err := markdown.Renderer().Render(&buf, source, doc); err != nil {
+		return "", fmt.Errorf("failed to render markdown: %w", err)
+	}
+	html = buf.String()
+
+	_, err = app.DB.ExecContext(ctx,
+		`INSERT INTO post_cache (hash, html, last_used_at) VALUES (?, ?, ?)
+		ON CONFLICT (hash) DO UPDATE SET html = excluded.html, last_used_at = excluded.last_used_at`,
+		hash, html, time.Now(),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to store post cache entry: %w", err)
+	}
+
+	return html, nil
+}
+
+// PrunePostCache removes cached HTML that wasn't used since the given time.
+// Every site shares the cache, so it's only safe once all of them have
+// loaded since then, see ReloadPosts.
+func (app *App) PrunePostCache(ctx context.Context, since time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := app.DB.ExecContext(ctx, "DELETE FROM post_cache WHERE last_used_at < ?", since)
+	if err != nil {
+		return fmt.Errorf("failed to prune post cache: %w", err)
+	}
+	return nil
+}
+
+// GetPostCacheStats returns hit and miss counts since startup along with the
+// number of cached posts
+func (app *App) GetPostCacheStats(ctx context.Context) (PostCacheStats, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	stats := PostCacheStats{
+		Hits:   postCacheHits.Load(),
+		Misses: postCacheMisses.Load(),
+	}
+	err := app.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM post_cache").Scan(&stats.Entries)
+	if err != nil {
+		return PostCacheStats{}, fmt.Errorf("failed to count post cache entries: %w", err)
+	}
+	return stats, nil
+}
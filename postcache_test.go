@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Every site shares the post cache, so reloading shouldn't drop another
+// site's entries, only ones for posts that changed
+func TestPrunePostCache(t *testing.T) {
+	t.Setenv("SITES_TWO", "host=two.example,posts=two")
+	app := newTestApp(t)
+	ctx := context.Background()
+
+	writePost := func(dir, body string) {
+		t.Helper()
+		post := "---\ntitle: Post\ndate: 2025-05-25\n---\n\n" + body + "\n"
+		if err := os.WriteFile(filepath.Join(dir, "post.md"), []byte(post), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries := func() int {
+		t.Helper()
+		stats, err := app.GetPostCacheStats(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stats.Entries
+	}
+	reload := func() {
+		t.Helper()
+		if err := app.ReloadPosts(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writePost("blog", "The first site.")
+	writePost("two", "The second site.")
+	reload()
+	if got := entries(); got != 2 {
+		t.Fatalf("%d entries after loading both sites, want 2", got)
+	}
+
+	misses := postCacheMisses.Load()
+	reload()
+	if got := entries(); got != 2 {
+		t.Errorf("%d entries after reloading, want 2", got)
+	}
+	if got := postCacheMisses.Load() - misses; got != 0 {
+		t.Errorf("%d misses reloading unchanged posts, want 0", got)
+	}
+
+	// An edited post's old HTML is dropped
+	writePost("two", "The second site, edited.")
+	reload()
+	if got := entries(); got != 2 {
+		t.Errorf("%d entries after an edit, want 2", got)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// blogDir is where post markdown files live
+const blogDir = "./blog"
+
+// Blog holds the loaded posts and everything derived from them. A new Blog is
+// built on every reload and swapped in whole, so a request always sees a
+// consistent set of posts, validators and search index.
+type Blog struct {
+	Posts   []Post
+	Hash    string
+	ModTime time.Time
+	Search  *SearchIndex
+	// Conflicts are posts that were skipped because another post already
+	// uses their slug
+	Conflicts []SlugConflict
+	// Problems are post files that couldn't be loaded, most often because
+	// their frontmatter doesn't fit the schema in decodeFrontmatter
+	Problems []ContentProblem
+}
+
+// SlugConflict is a post that couldn't be served because its slug is taken
+type SlugConflict struct {
+	Slug     string
+	FileName string
+	// Winner is the file the slug was given to
+	Winner string
+}
+
+// ReloadPosts reloads every site's posts, see ReloadSite. Once they've all
+// loaded, cached HTML none of them used is dropped, which is what posts
+// that were edited or deleted leave behind.
+func (app *App) ReloadPosts(ctx context.Context) error {
+	start := time.Now()
+	var errs []error
+	for _, site := range app.sites {
+		if err := app.ReloadSite(ctx, site); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		// A site that failed to load didn't use its entries
+		return errors.Join(errs...)
+	}
+	if err := app.PrunePostCache(ctx, start); err != nil {
+		slog.Error("Failed to prune post cache", "error", err)
+	}
+	return nil
+}
+
+// ReloadSite reads all of a site's posts from its directory and replaces
+// its current Blog
+func (app *App) ReloadSite(ctx context.Context, site *Site) error {
+	ctx, span := app.startTrace(ctx, "reload posts", otlpString("site.name", site.Name))
+	defer span.End()
+
+	site.reloadMu.Lock()
+	defer site.reloadMu.Unlock()
+
+	posts, problems, err := app.loadPosts(ctx, site.PostsDir)
+	if err != nil {
+		err = fmt.Errorf("failed to load posts from %s: %w", site.PostsDir, err)
+		span.SetError(err)
+		return err
+	}
+	span.SetAttributes(otlpInt("posts.count", int64(len(posts))))
+
+	posts, conflicts := dedupeSlugs(posts)
+	for _, c := range conflicts {
+		slog.Error("Duplicate post slug, skipping post", "slug", c.Slug, "file", c.FileName, "kept", c.Winner)
+	}
+	if err := app.recordSlugs(ctx, site, posts); err != nil {
+		slog.Error("Failed to record post slugs", "error", err)
+	}
+
+	site.blog.Store(&Blog{
+		Posts:     posts,
+		Hash:      postsHash(posts),
+		ModTime:   postsModTime(posts),
+		Search:    app.NewSearchIndex(ctx, posts),
+		Conflicts: conflicts,
+		Problems:  problems,
+	})
+	return nil
+}
+
+// dedupeSlugs drops posts whose slug is already taken. A post whose file
+// name matches the slug wins, otherwise the first file by name does, so the
+// choice doesn't change between reloads.
+func dedupeSlugs(posts []Post) ([]Post, []SlugConflict) {
+	owners := make(map[string]string)
+	for _, post := range posts {
+		owner, ok := owners[post.Slug]
+		if !ok || (!ownsSlug(owner, post.Slug) && (ownsSlug(post.FileName, post.Slug) || post.FileName < owner)) {
+			owners[post.Slug] = post.FileName
+		}
+	}
+
+	var kept []Post
+	var conflicts []SlugConflict
+	for _, post := range posts {
+		if owners[post.Slug] == post.FileName {
+			kept = append(kept, post)
+			continue
+		}
+		conflicts = append(conflicts, SlugConflict{Slug: post.Slug, FileName: post.FileName, Winner: owners[post.Slug]})
+	}
+	return kept, conflicts
+}
+
+// ownsSlug reports whether a post file is named after the slug
+func ownsSlug(fileName, slug string) bool {
+	return strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName)) == slug
+}
+
+// recordSlugs remembers each file's slug, adding a redirect from the old
+// slug when it has changed since the last load. File names and slugs are
+// stored keyed to the site, see Site.key.
+func (app *App) recordSlugs(ctx context.Context, site *Site, posts []Post) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	tx, err := app.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, post := range posts {
+		name, slug := site.key(filepath.Base(post.FileName)), site.key(post.Slug)
+		var old string
+		err := tx.QueryRowContext(ctx, "SELECT slug FROM post_slugs WHERE file_name = ?", name).Scan(&old)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("failed to query post slug: %w", err)
+		}
+		if old == slug {
+			continue
+		}
+
+		if old != "" {
+			if err := addSlugRedirect(ctx, tx, old, slug); err != nil {
+				return err
+			}
+			slog.Info("Post slug changed", "file", name, "from", site.unkey(old), "to", post.Slug)
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO post_slugs (file_name, slug) VALUES (?, ?)
+			ON CONFLICT(file_name) DO UPDATE SET slug = excluded.slug
+		`, name, slug)
+		if err != nil {
+			return fmt.Errorf("failed to save post slug: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit post slugs: %w", err)
+	}
+	return nil
+}
+
+// addSlugRedirect sends an old slug to a new one. Earlier redirects to the
+// old slug are pointed straight at the new one, and a redirect away from the
+// new slug is dropped now that it's in use again.
+func addSlugRedirect(ctx context.Context, tx *sql.Tx, old, slug string) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM slug_redirects WHERE old_slug = ?", slug); err != nil {
+		return fmt.Errorf("failed to delete slug redirect: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE slug_redirects SET new_slug = ? WHERE new_slug = ?", slug, old); err != nil {
+		return fmt.Errorf("failed to update slug redirects: %w", err)
+	}
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO slug_redirects (old_slug, new_slug, created_at) VALUES (?, ?, ?)
+		ON CONFLICT(old_slug) DO UPDATE SET new_slug = excluded.new_slug, created_at = excluded.created_at
+	`, old, slug, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to add slug redirect: %w", err)
+	}
+	return nil
+}
+
+// SlugRedirect returns the current slug for a site's post that used to be
+// served under an old one
+func (app *App) SlugRedirect(ctx context.Context, site *Site, old string) (string, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var slug string
+	err := app.DB.QueryRowContext(ctx, "SELECT new_slug FROM slug_redirects WHERE old_slug = ?", site.key(old)).Scan(&slug)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, fmt.Errorf("failed to query slug redirect: %w", err)
+	}
+	return site.unkey(slug), true, nil
+}
+
+// PostBySlug returns the post with the given slug
+func (b *Blog) PostBySlug(slug string) (Post, bool) {
+	for _, post := range b.Posts {
+		if post.Slug == slug {
+			return post, true
+		}
+	}
+	return Post{}, false
+}
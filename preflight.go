@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// PreflightStatus is the outcome of a preflight check
+type PreflightStatus string
+
+const (
+	PreflightOK   PreflightStatus = "ok"
+	PreflightWarn PreflightStatus = "warn"
+	PreflightFail PreflightStatus = "FAIL"
+	PreflightSkip PreflightStatus = "skip"
+)
+
+// PreflightResult is one row of the preflight summary
+type PreflightResult struct {
+	Name   string
+	Status PreflightStatus
+	Detail string
+	// Hint says how to fix a warning or failure
+	Hint string
+}
+
+// preflightChecks run before the server starts, in order
+var preflightChecks = []func(Config) []PreflightResult{
+	checkDataDirs,
+	checkDatabase,
+	checkPort,
+	checkMail,
+	checkMediaBucket,
+	checkBackupBucket,
+	checkExportBucket,
+	checkRetention,
+	checkReplica,
+	checkEncryptionKey,
+}
+
+// runPreflight runs every check and reports whether any failed
+func runPreflight(cfg Config) ([]PreflightResult, bool) {
+	var results []PreflightResult
+	ok := true
+	for _, check := range preflightChecks {
+		for _, result := range check(cfg) {
+			if result.Status == PreflightFail {
+				ok = false
+			}
+			results = append(results, result)
+		}
+	}
+	return results, ok
+}
+
+// printPreflight writes the results as a table, with hints for anything
+// that needs attention
+func printPreflight(w io.Writer, results []PreflightResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tSTATUS\tDETAIL")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Name, r.Status, r.Detail)
+	}
+	tw.Flush()
+
+	for _, r := range results {
+		if r.Hint != "" && (r.Status == PreflightFail || r.Status == PreflightWarn) {
+			fmt.Fprintf(w, "%s %s: %s\n", r.Status, r.Name, r.Hint)
+		}
+	}
+}
+
+// checkDataDirs makes sure the directories the server writes to exist and
+// are writable
+func checkDataDirs(cfg Config) []PreflightResult {
+	type dir struct {
+		name, path string
+	}
+	dirs := []dir{{"blog dir", blogDir}}
+	if cfg.DatabaseURL == "" {
+		dirs = append([]dir{{"database dir", filepath.Dir(databasePath())}}, dirs...)
+	}
+
+	var results []PreflightResult
+	for _, dir := range dirs {
+		result := PreflightResult{Name: dir.name, Status: PreflightOK, Detail: dir.path}
+		if err := checkWritable(dir.path); err != nil {
+			result.Status = PreflightFail
+			result.Detail = err.Error()
+			result.Hint = fmt.Sprintf("create %s and make it writable by uid %d", dir.path, os.Getuid())
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// checkDatabase makes sure Postgres is reachable when DATABASE_URL is set.
+// SQLite only needs its directory, which checkDataDirs looks at.
+func checkDatabase(cfg Config) []PreflightResult {
+	result := PreflightResult{Name: "database", Status: PreflightOK}
+	s, err := newStore(cfg)
+	if err != nil {
+		result.Status = PreflightFail
+		result.Detail = err.Error()
+		result.Hint = "set DATABASE_URL to a postgres:// URL, or leave it unset to use SQLite"
+		return []PreflightResult{result}
+	}
+	result.Detail = s.String()
+	if _, ok := s.(postgresStore); !ok {
+		return []PreflightResult{result}
+	}
+
+	db, err := s.Open()
+	if err == nil {
+		defer db.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err = db.PingContext(ctx)
+	}
+	if err != nil {
+		result.Status = PreflightFail
+		result.Detail = err.Error()
+		result.Hint = "check DATABASE_URL and that the database accepts connections from this host"
+	}
+	return []PreflightResult{result}
+}
+
+// checkWritable creates and removes a file in dir. A missing blog directory
+// is created on startup, so only its parent has to exist.
+func checkWritable(dir string) error {
+	info, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return checkWritable(filepath.Dir(dir))
+	} else if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	f, err := os.CreateTemp(dir, ".preflight-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, errors.Unwrap(err))
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkPort makes sure the server will be able to listen
+func checkPort(cfg Config) []PreflightResult {
+	result := PreflightResult{Name: "listen", Status: PreflightOK}
+	switch {
+	case os.Getenv("LISTEN_FDS") != "":
+		result.Status = PreflightSkip
+		result.Detail = "socket passed in by systemd"
+	case cfg.ListenSocket != "":
+		path := cfg.ListenSocket
+		result.Detail = path
+		if err := checkWritable(filepath.Dir(path)); err != nil {
+			result.Status = PreflightFail
+			result.Detail = err.Error()
+			result.Hint = "LISTEN_SOCKET must be in a directory the server can write to"
+		}
+	case len(cfg.ACMEDomains) > 0:
+		// HTTPS is served on HTTPS_PORT, and HTTP_PORT answers the CA's
+		// challenges
+		results := []PreflightResult{
+			checkTCPPort("listen https", cfg.HTTPSPort, "HTTPS_PORT"),
+			checkTCPPort("listen http", cfg.HTTPPort, "HTTP_PORT"),
+		}
+		if cfg.HTTP3 {
+			results = append(results, checkUDPPort("listen http3", cfg.HTTPSPort, "HTTPS_PORT"))
+		}
+		return results
+	default:
+		return []PreflightResult{checkTCPPort("listen", cfg.Port, "PORT")}
+	}
+	return []PreflightResult{result}
+}
+
+// checkTCPPort makes sure nothing else is listening on port, which is set
+// by the env var setting
+func checkTCPPort(name string, port int, setting string) PreflightResult {
+	result := PreflightResult{Name: name, Status: PreflightOK}
+	addr := ":" + strconv.Itoa(port)
+	result.Detail = "tcp " + addr
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		result.Status = PreflightFail
+		result.Detail = err.Error()
+		result.Hint = "stop whatever is using the port, or set " + setting + " to a free one"
+		return result
+	}
+	l.Close()
+	return result
+}
+
+// checkUDPPort makes sure nothing else is bound to port for QUIC
+func checkUDPPort(name string, port int, setting string) PreflightResult {
+	result := PreflightResult{Name: name, Status: PreflightOK}
+	addr := ":" + strconv.Itoa(port)
+	result.Detail = "udp " + addr
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		result.Status = PreflightFail
+		result.Detail = err.Error()
+		result.Hint = "stop whatever is using the port, or set " + setting + " to a free one"
+		return result
+	}
+	conn.Close()
+	return result
+}
+
+// checkMail makes sure login emails can be sent
+func checkMail(cfg Config) []PreflightResult {
+	result := PreflightResult{Name: "email", Status: PreflightOK}
+	m, err := newMailer(cfg)
+	switch {
+	case err != nil:
+		result.Status = PreflightFail
+		result.Detail = err.Error()
+		result.Hint = "fix the settings for MAIL_PROVIDER, or unset it to use SMTP"
+	case m == nil:
+		result.Status = PreflightWarn
+		result.Detail = "no mail provider is configured"
+		result.Hint = "set SMTP_HOST, SMTP_EMAIL and SMTP_PASSWORD, or MAIL_PROVIDER, or nobody will get login links"
+	default:
+		if _, ok := m.(*devMailer); ok {
+			result.Detail = "development, saved to " + devMailDir
+			break
+		}
+		sm, ok := m.(smtpMailer)
+		if !ok {
+			result.Detail = cfg.MailProvider
+			break
+		}
+		result.Detail = "smtp " + sm.addr
+		conn, err := net.DialTimeout("tcp", sm.addr, 5*time.Second)
+		if err != nil {
+			// The mail server may come back, so don't refuse to start
+			result.Status = PreflightWarn
+			result.Detail = err.Error()
+			result.Hint = "check SMTP_HOST and that outbound connections to it are allowed"
+			break
+		}
+		conn.Close()
+	}
+	return []PreflightResult{result}
+}
+
+// checkMediaBucket makes sure media can be published, if a bucket is set
+func checkMediaBucket(cfg Config) []PreflightResult {
+	result := PreflightResult{Name: "media bucket", Status: PreflightOK}
+	client, prefix, ok, err := mediaSyncConfig(cfg)
+	switch {
+	case err != nil:
+		result.Status = PreflightFail
+		result.Detail = err.Error()
+		result.Hint = "set the AWS credentials for MEDIA_BUCKET, or unset it"
+	case !ok:
+		result.Status = PreflightSkip
+		result.Detail = "MEDIA_BUCKET is not set"
+	default:
+		result.Detail = client.bucket + "/" + prefix
+		if err := client.Ping(prefix); err != nil {
+			// Publishing retries on the next save, so don't refuse to start
+			result.Status = PreflightWarn
+			result.Detail = err.Error()
+			result.Hint = "check MEDIA_BUCKET, AWS_REGION, S3_ENDPOINT and that the credentials can list the bucket"
+		}
+	}
+	return []PreflightResult{result}
+}
+
+// checkBackupBucket makes sure the database can be backed up, if a bucket
+// is set
+func checkBackupBucket(cfg Config) []PreflightResult {
+	result := PreflightResult{Name: "backup bucket", Status: PreflightOK}
+	backup, ok, err := backupConfig(cfg)
+	switch {
+	case err != nil:
+		result.Status = PreflightFail
+		result.Detail = err.Error()
+		result.Hint = "fix the BACKUP_ settings and AWS credentials, or unset BACKUP_BUCKET"
+	case !ok:
+		result.Status = PreflightSkip
+		result.Detail = "BACKUP_BUCKET is not set"
+	case cfg.DatabaseURL != "":
+		result.Status = PreflightWarn
+		result.Detail = "backups only cover SQLite, DATABASE_URL is set"
+		result.Hint = "back up Postgres with its own tools, or unset BACKUP_BUCKET"
+	default:
+		result.Detail = fmt.Sprintf("%s/%s every %s, keeping %d", backup.client.bucket, backup.prefix, backup.interval, backup.keep)
+		if err := backup.client.Ping(backup.prefix); err != nil {
+			// A failed backup is retried on the next interval
+			result.Status = PreflightWarn
+			result.Detail = err.Error()
+			result.Hint = "check BACKUP_BUCKET, AWS_REGION, S3_ENDPOINT and that the credentials can list the bucket"
+		}
+	}
+	return []PreflightResult{result}
+}
+
+// checkExportBucket makes sure analytics can be exported, if a bucket is
+// set
+func checkExportBucket(cfg Config) []PreflightResult {
+	result := PreflightResult{Name: "export bucket", Status: PreflightOK}
+	export, ok, err := exportConfig(cfg)
+	switch {
+	case err != nil:
+		result.Status = PreflightFail
+		result.Detail = err.Error()
+		result.Hint = "fix the EXPORT_ settings and AWS credentials, or unset EXPORT_BUCKET"
+	case !ok:
+		result.Status = PreflightSkip
+		result.Detail = "EXPORT_BUCKET is not set"
+	default:
+		result.Detail = fmt.Sprintf("%s/%s", export.client.bucket, export.prefix)
+		if err := export.client.Ping(export.prefix); err != nil {
+			// A failed export is retried on the next run
+			result.Status = PreflightWarn
+			result.Detail = err.Error()
+			result.Hint = "check EXPORT_BUCKET, AWS_REGION, S3_ENDPOINT and that the credentials can list the bucket"
+		}
+	}
+	return []PreflightResult{result}
+}
+
+// checkRetention makes sure the retention periods parse, and that expired
+// data can be archived if an archive bucket is set
+func checkRetention(cfg Config) []PreflightResult {
+	result := PreflightResult{Name: "retention", Status: PreflightOK}
+	retention, err := retentionConfig(cfg)
+	if err != nil {
+		result.Status = PreflightFail
+		result.Detail = err.Error()
+		result.Hint = "fix the RETENTION_ and ARCHIVE_ settings"
+		return []PreflightResult{result}
+	}
+
+	var kept []string
+	for _, p := range retention.Policies {
+		if p.Keep == 0 {
+			kept = append(kept, p.Name+" forever")
+		} else {
+			kept = append(kept, fmt.Sprintf("%s %dd", p.Name, int(p.Keep.Hours()/24)))
+		}
+	}
+	result.Detail = strings.Join(kept, ", ")
+	if retention.archive == nil {
+		result.Detail += ", not archived"
+	} else if err := retention.archive.Ping(retention.archivePrefix); err != nil {
+		// Nothing is deleted until it's archived, so this only delays cleanup
+		result.Status = PreflightWarn
+		result.Detail = err.Error()
+		result.Hint = "check ARCHIVE_BUCKET, AWS_REGION, S3_ENDPOINT and that the credentials can list the bucket"
+	} else {
+		result.Detail += ", archived to " + retention.archive.bucket + "/" + retention.archivePrefix
+	}
+	return []PreflightResult{result}
+}
+
+// checkReplica makes sure litestream is there to replicate the database,
+// if a replica is set
+func checkReplica(cfg Config) []PreflightResult {
+	result := PreflightResult{Name: "replica", Status: PreflightOK}
+	replica, ok, err := replicaConfig(cfg)
+	switch {
+	case err != nil:
+		result.Status = PreflightFail
+		result.Detail = err.Error()
+		result.Hint = "install litestream or set LITESTREAM_PATH, or unset REPLICA_URL"
+	case !ok:
+		result.Status = PreflightSkip
+		result.Detail = "REPLICA_URL is not set"
+	default:
+		result.Detail = redactURL(replica.URL) + " with " + replica.Litestream
+	}
+	return []PreflightResult{result}
+}
+
+// checkEncryptionKey makes sure secrets in the database can be read
+func checkEncryptionKey(cfg Config) []PreflightResult {
+	result := PreflightResult{Name: "encryption key", Status: PreflightOK, Detail: "ENCRYPTION_KEY is set"}
+	if _, err := encryptionAEAD(cfg.EncryptionKey); errors.Is(err, errNoEncryptionKey) {
+		result.Status = PreflightWarn
+		result.Detail = err.Error()
+		result.Hint = "two-factor authentication is unavailable until ENCRYPTION_KEY is set"
+	} else if err != nil {
+		result.Status = PreflightFail
+		result.Detail = err.Error()
+		result.Hint = "generate one with: openssl rand -hex 32"
+	}
+	return []PreflightResult{result}
+}
+
+// preflight runs the checks and prints the summary to w. It reports whether
+// the server can start.
+func preflight(w io.Writer, cfg Config) bool {
+	results, ok := runPreflight(cfg)
+	printPreflight(w, results)
+	return ok
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // time zones for servers without a zoneinfo database
+	"unicode/utf8"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// maxDisplayNameLength is the longest display name, in characters
+	maxDisplayNameLength = 80
+	// maxAvatarUpload is the largest avatar file that can be uploaded
+	maxAvatarUpload = 5 << 20
+	// avatarSize is the width and height uploaded avatars are cropped and
+	// resized to
+	avatarSize = 256
+)
+
+// Avatar sources, in users.avatar
+const (
+	avatarNone     = ""
+	avatarGravatar = "gravatar"
+	avatarUpload   = "upload"
+)
+
+// Name is what the site calls the user: their display name, or their email
+// if they haven't set one
+func (u *User) Name() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return u.Email
+}
+
+// Location returns the user's time zone, or UTC if they haven't set one
+func (u *User) Location() *time.Location {
+	if u == nil || u.TimeZone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(u.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// AvatarURL returns the user's picture, or "" if they haven't picked one
+func (u *User) AvatarURL() string {
+	switch u.Avatar {
+	case avatarGravatar:
+		sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(u.Email))))
+		return "https://www.gravatar.com/avatar/" + hex.EncodeToString(sum[:]) + "?s=64&d=identicon"
+	case avatarUpload:
+		return "/avatars/" + strconv.FormatInt(u.ID, 10) + "?v=" + u.AvatarHash
+	}
+	return ""
+}
+
+// inZone shows a time in the user's time zone, for templates
+func inZone(user *User, t time.Time) time.Time {
+	return t.In(user.Location())
+}
+
+// Profile is what a user can change about how the site shows them
+type Profile struct {
+	DisplayName string
+	TimeZone    string
+	Avatar      string
+}
+
+// UpdateProfile saves the user's profile. Switching away from an uploaded
+// avatar deletes it.
+func (app *App) UpdateProfile(ctx context.Context, userID int64, profile Profile) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := app.DBFrom(ctx).ExecContext(ctx, `
+		UPDATE users SET display_name = ?, time_zone = ?, avatar = ?,
+			avatar_image = CASE WHEN ? = 'upload' THEN avatar_image END,
+			avatar_hash = CASE WHEN ? = 'upload' THEN avatar_hash ELSE '' END
+		WHERE id = ?
+	`, profile.DisplayName, profile.TimeZone, profile.Avatar, profile.Avatar, profile.Avatar, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update profile: %w", err)
+	}
+	app.userCache.Invalidate(ctx, strconv.FormatInt(userID, 10))
+	return nil
+}
+
+// SetAvatarImage stores an avatar the user uploaded, already resized by
+// resizeAvatar, and makes it their avatar
+func (app *App) SetAvatarImage(ctx context.Context, userID int64, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	sum := sha256.Sum256(data)
+	_, err := app.DBFrom(ctx).ExecContext(ctx, "UPDATE users SET avatar = ?, avatar_image = ?, avatar_hash = ? WHERE id = ?",
+		avatarUpload, data, hex.EncodeToString(sum[:8]), userID)
+	if err != nil {
+		return fmt.Errorf("failed to save avatar: %w", err)
+	}
+	app.userCache.Invalidate(ctx, strconv.FormatInt(userID, 10))
+	return nil
+}
+
+// GetAvatarImage returns the user's uploaded avatar, or errUserNotFound if
+// they don't have one
+func (app *App) GetAvatarImage(ctx context.Context, userID int64) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var data []byte
+	err := app.DB.QueryRowContext(ctx, "SELECT avatar_image FROM users WHERE id = ? AND avatar = ?", userID, avatarUpload).Scan(&data)
+	if err == sql.ErrNoRows || (err == nil && len(data) == 0) {
+		return nil, errUserNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get avatar: %w", err)
+	}
+	return data, nil
+}
+
+// updateProfile saves the profile form on the settings page. It returns a
+// message for the user if something in the form was wrong.
+func (app *App) updateProfile(r *http.Request, user *User) (string, error) {
+	profile := Profile{
+		DisplayName: strings.TrimSpace(r.FormValue("display_name")),
+		TimeZone:    strings.TrimSpace(r.FormValue("time_zone")),
+		Avatar:      r.FormValue("avatar"),
+	}
+	if utf8.RuneCountInString(profile.DisplayName) > maxDisplayNameLength {
+		return fmt.Sprintf("Display names can be at most %d characters.", maxDisplayNameLength), nil
+	}
+	if profile.TimeZone != "" {
+		if _, err := time.LoadLocation(profile.TimeZone); err != nil || profile.TimeZone == "Local" {
+			return fmt.Sprintf("%q isn't a time zone. Use a name like Europe/London.", profile.TimeZone), nil
+		}
+	}
+
+	// Choosing a file means using it, whichever option is picked
+	var avatar []byte
+	file, header, err := r.FormFile("avatar_image")
+	switch {
+	case err == nil:
+		defer file.Close()
+		if header.Size > maxAvatarUpload {
+			return fmt.Sprintf("Avatars can be at most %d MB.", maxAvatarUpload>>20), nil
+		}
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read upload: %w", err)
+		}
+		if avatar, err = resizeAvatar(data); err != nil {
+			return err.Error(), nil
+		}
+		profile.Avatar = avatarUpload
+	case !errors.Is(err, http.ErrMissingFile):
+		return "", NewHTTPError(fmt.Errorf("invalid upload: %w", err), http.StatusBadRequest)
+	}
+	switch profile.Avatar {
+	case avatarNone, avatarGravatar:
+	case avatarUpload:
+		if avatar == nil && user.Avatar != avatarUpload {
+			return "Choose an image to upload.", nil
+		}
+	default:
+		return "", NewHTTPError(fmt.Errorf("invalid avatar %q", profile.Avatar), http.StatusBadRequest)
+	}
+
+	return "", app.InTx(r.Context(), func(ctx context.Context) error {
+		if err := app.UpdateProfile(ctx, user.ID, profile); err != nil {
+			return err
+		}
+		if avatar != nil {
+			return app.SetAvatarImage(ctx, user.ID, avatar)
+		}
+		return nil
+	})
+}
+
+// resizeAvatar crops an uploaded image to a square from its center and
+// resizes it to avatarSize, as a JPEG. Transparent parts become white.
+func resizeAvatar(data []byte) ([]byte, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("unsupported image, upload a JPEG, PNG, GIF or WebP")
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return nil, fmt.Errorf("image is too large, at %dx%d", cfg.Width, cfg.Height)
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	b := src.Bounds()
+	side := min(b.Dx(), b.Dy())
+	crop := image.Rect(0, 0, side, side).Add(b.Min).Add(image.Pt((b.Dx()-side)/2, (b.Dy()-side)/2))
+	dst := image.NewRGBA(image.Rect(0, 0, avatarSize, avatarSize))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Over, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85}); err != nil {
+		return nil, fmt.Errorf("failed to encode avatar: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// handleAvatar serves an uploaded avatar at /avatars/ID. Avatars are only
+// shown to their owner and admins, so only they can fetch one.
+func (app *App) handleAvatar(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/avatars/"), 10, 64)
+	if err != nil {
+		return NewHTTPError(fmt.Errorf("page not found: %s", r.URL.Path), http.StatusNotFound)
+	}
+	user, err := app.getCurrentUser(r)
+	if err != nil || (user.ID != id && !app.adminAllowed(r, &user)) {
+		return NewHTTPError(fmt.Errorf("page not found: %s", r.URL.Path), http.StatusNotFound)
+	}
+
+	data, err := app.GetAvatarImage(r.Context(), id)
+	if errors.Is(err, errUserNotFound) {
+		return NewHTTPError(fmt.Errorf("page not found: %s", r.URL.Path), http.StatusNotFound)
+	} else if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	w.Header().Set("Content-Type", "image/jpeg")
+	// The URL changes with the image, see AvatarURL
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:8])+`"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	return nil
+}
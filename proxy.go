@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const defaultProxyTimeout = 30 * time.Second
+
+// newUpstreamProxy returns a reverse proxy for paths this site doesn't handle,
+// so it can sit in front of an existing server while routes are migrated over.
+// It's configured with PROXY_UPSTREAM (e.g. https://old.example.com) and
+// PROXY_TIMEOUT, and returns nil when no upstream is set.
+func (app *App) newUpstreamProxy() (*httputil.ReverseProxy, error) {
+	upstream := app.Config.ProxyUpstream
+	if upstream == "" {
+		return nil, nil
+	}
+
+	target, err := url.Parse(upstream)
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		return nil, fmt.Errorf("invalid PROXY_UPSTREAM %q", upstream)
+	}
+	timeout := app.Config.ProxyTimeout
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.SetXForwarded()
+
+			// The upstream has its own sessions, don't leak ours to it
+			pr.Out.Header.Del("Cookie")
+			for _, cookie := range pr.In.Cookies() {
+				if cookie.Name != sessionCookieName && cookie.Name != csrfCookieName {
+					pr.Out.AddCookie(cookie)
+				}
+			}
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			// Keep redirects on this host rather than bouncing readers to the upstream
+			if location := resp.Header.Get("Location"); location != "" {
+				resp.Header.Set("Location", rewriteLocation(location, target, resp.Request))
+			}
+			return nil
+		},
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout: 10 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: timeout,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   16,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			app.handleError(w, r, NewHTTPError(fmt.Errorf("upstream request failed: %w", err), http.StatusBadGateway), http.StatusBadGateway)
+		},
+	}
+
+	slog.Info("Proxying unmatched paths", "upstream", target.String(), "timeout", timeout.String())
+	return proxy, nil
+}
+
+// rewriteLocation points absolute redirects to the upstream back at the host
+// the client originally used
+func rewriteLocation(location string, target *url.URL, out *http.Request) string {
+	u, err := url.Parse(location)
+	if err != nil || !strings.EqualFold(u.Host, target.Host) {
+		return location
+	}
+
+	u.Host = out.Header.Get("X-Forwarded-Host")
+	u.Scheme = out.Header.Get("X-Forwarded-Proto")
+	if u.Host == "" || u.Scheme == "" {
+		return location
+	}
+	return u.String()
+}
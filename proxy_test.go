@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Pages this site serves check the CSRF token, while everything else goes
+// to the upstream untouched, since it protects itself
+func TestUpstreamCSRF(t *testing.T) {
+	var proxied []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.Method+" "+r.URL.Path)
+		io.WriteString(w, "upstream")
+	}))
+	defer upstream.Close()
+	t.Setenv("PROXY_UPSTREAM", upstream.URL)
+	app := newTestApp(t)
+
+	tests := []struct {
+		method  string
+		path    string
+		status  int
+		proxied bool
+	}{
+		{http.MethodGet, "/old/page", http.StatusOK, true},
+		{http.MethodPost, "/old/form", http.StatusOK, true},
+		{http.MethodDelete, "/old/item", http.StatusOK, true},
+		{http.MethodGet, "/blog", http.StatusOK, false},
+		{http.MethodPost, "/s/x", http.StatusForbidden, false},
+		{http.MethodPost, "/settings", http.StatusForbidden, false},
+		{http.MethodPost, "/logout", http.StatusForbidden, false},
+	}
+	handler := app.Handler()
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			proxied = nil
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			if tt.proxied && (len(proxied) != 1 || proxied[0] != tt.method+" "+tt.path) {
+				t.Errorf("upstream got %q, want %s %s", proxied, tt.method, tt.path)
+			} else if !tt.proxied && len(proxied) > 0 {
+				t.Errorf("upstream got %q, want nothing", proxied)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// offlinePostCount is how many of the newest posts the service worker caches
+const offlinePostCount = 10
+
+// webManifest is served at /manifest.webmanifest so readers can install the site
+var webManifest = map[string]any{
+	"name":             "Tulip",
+	"short_name":       "Tulip",
+	"description":      siteDescription,
+	"start_url":        "/",
+	"scope":            "/",
+	"display":          "standalone",
+	"background_color": "#ffffff",
+	"theme_color":      "#f6f8fa",
+	"icons": []map[string]string{
+		{"src": "/icon.svg", "sizes": "any", "type": "image/svg+xml", "purpose": "any"},
+	},
+}
+
+const iconSVG = `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 100 100"><text y=".9em" font-size="90">🌷</text></svg>`
+
+// serviceWorker precaches the main pages and newest posts, serves pages
+// network-first with the cache as an offline fallback, and shows push
+// notifications for new posts. The cache name changes whenever posts do.
+var serviceWorker = template.Must(template.New("sw.js").Parse(`const CACHE = "tulip-{{.Version}}";
+const PRECACHE = {{.URLs}};
+
+self.addEventListener("install", (event) => {
+  event.waitUntil(caches.open(CACHE).then((cache) => cache.addAll(PRECACHE)));
+  self.skipWaiting();
+});
+
+self.addEventListener("activate", (event) => {
+  event.waitUntil(
+    caches.keys().then((keys) =>
+      Promise.all(keys.filter((key) => key !== CACHE).map((key) => caches.delete(key)))
+    )
+  );
+  self.clients.claim();
+});
+
+self.addEventListener("fetch", (event) => {
+  const url = new URL(event.request.url);
+  if (event.request.method !== "GET" || url.origin !== self.location.origin) {
+    return;
+  }
+  event.respondWith(
+    fetch(event.request)
+      .then((response) => {
+        if (response.ok && (url.pathname === "/" || url.pathname.startsWith("/blog"))) {
+          const copy = response.clone();
+          caches.open(CACHE).then((cache) => cache.put(event.request, copy));
+        }
+        return response;
+      })
+      .catch(() => caches.match(event.request))
+  );
+});
+
+self.addEventListener("push", (event) => {
+  const data = event.data ? event.data.json() : {};
+  event.waitUntil(
+    self.registration.showNotification(data.title || "Tulip", {
+      body: data.body || "There's a new post on the blog",
+      icon: "/icon.svg",
+      data: { url: data.url || "/blog" },
+    })
+  );
+});
+
+self.addEventListener("notificationclick", (event) => {
+  event.notification.close();
+  event.waitUntil(self.clients.openWindow(event.notification.data.url));
+});
+`))
+
+// handleManifest serves the web app manifest
+func handleManifest(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "application/manifest+json")
+	if err := json.NewEncoder(w).Encode(webManifest); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// handleIcon serves the app icon
+func handleIcon(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	_, err := w.Write([]byte(iconSVG))
+	return err
+}
+
+// handleServiceWorker serves the service worker generated for the current posts
+func (app *App) handleServiceWorker(w http.ResponseWriter, r *http.Request) error {
+	blog := app.siteFor(r).Blog()
+
+	urls := []string{"/", "/blog"}
+	for i, post := range blog.Posts {
+		if i == offlinePostCount {
+			break
+		}
+		urls = append(urls, "/blog/"+post.Slug)
+	}
+	urlsJSON, err := json.Marshal(urls)
+	if err != nil {
+		return fmt.Errorf("failed to encode precache urls: %w", err)
+	}
+
+	var buf bytes.Buffer
+	err = serviceWorker.Execute(&buf, map[string]string{
+		"Version": blog.Hash[:12],
+		"URLs":    string(urlsJSON),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to render service worker: %w", err)
+	}
+
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// PushSubscription is a browser push endpoint as sent by PushManager.subscribe
+type PushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// handlePushSubscription stores or removes a push subscription
+func (app *App) handlePushSubscription(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return NewHTTPError(fmt.Errorf("method not allowed"), http.StatusMethodNotAllowed)
+	}
+
+	var sub PushSubscription
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&sub); err != nil {
+		return NewHTTPError(fmt.Errorf("invalid subscription: %w", err), http.StatusBadRequest)
+	}
+	if !strings.HasPrefix(sub.Endpoint, "https://") {
+		return NewHTTPError(fmt.Errorf("invalid subscription endpoint"), http.StatusBadRequest)
+	}
+
+	if r.URL.Path == "/push/unsubscribe" {
+		if err := app.DeletePushSubscription(r.Context(), sub.Endpoint); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	if sub.Keys.P256dh == "" || sub.Keys.Auth == "" {
+		return NewHTTPError(fmt.Errorf("subscription is missing keys"), http.StatusBadRequest)
+	}
+
+	// Anonymous subscriptions need a challenge, so they can't be created
+	// in bulk
+	var userID *int64
+	if user, err := app.getCurrentUser(r); err == nil {
+		userID = &user.ID
+	} else if err := pushChallenge.Check(r, app.DB, app.challengeKey); errors.Is(err, errChallengeFailed) {
+		return NewHTTPError(err, http.StatusForbidden)
+	} else if err != nil {
+		return err
+	}
+
+	if err := app.SavePushSubscription(r.Context(), sub, userID); err != nil {
+		return err
+	}
+
+	slog.InfoContext(r.Context(), "Push subscription saved")
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// SavePushSubscription stores a push subscription, updating its keys if the
+// endpoint is already known
+func (app *App) SavePushSubscription(ctx context.Context, sub PushSubscription, userID *int64) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := app.DB.ExecContext(ctx, `
+		INSERT INTO push_subscriptions (endpoint, p256dh, auth, user_id, created_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (endpoint) DO UPDATE SET
+			p256dh = excluded.p256dh,
+			auth = excluded.auth,
+			user_id = COALESCE(excluded.user_id, push_subscriptions.user_id)
+	`, sub.Endpoint, sub.Keys.P256dh, sub.Keys.Auth, userID, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to save push subscription: %w", err)
+	}
+	return nil
+}
+
+// DeletePushSubscription removes a push subscription by endpoint
+func (app *App) DeletePushSubscription(ctx context.Context, endpoint string) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := app.DB.ExecContext(ctx, "DELETE FROM push_subscriptions WHERE endpoint = ?", endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to delete push subscription: %w", err)
+	}
+	return nil
+}
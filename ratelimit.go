@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket that holds up to Burst tokens and refills
+// completely over Per
+type RateLimit struct {
+	Name  string
+	Burst float64
+	Per   time.Duration
+}
+
+var (
+	// loginEmailLimit caps magic link emails sent to one address
+	loginEmailLimit = RateLimit{Name: "login-email", Burst: 5, Per: time.Hour}
+	// loginIPLimit caps magic link requests from one client
+	loginIPLimit = RateLimit{Name: "login-ip", Burst: 20, Per: time.Hour}
+	// verifyIPLimit caps token guesses from one client
+	verifyIPLimit = RateLimit{Name: "verify-ip", Burst: 30, Per: time.Hour}
+)
+
+// rateLimitMu serializes bucket updates so concurrent requests can't both
+// spend the last token
+var rateLimitMu sync.Mutex
+
+// Allow takes a token from the bucket for key. When the bucket is empty it
+// returns false and how long until the next token is available. Buckets are
+// stored in the database so limits survive restarts.
+func (l RateLimit) Allow(ctx context.Context, db *sql.DB, key string) (bool, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	rateLimitMu.Lock()
+	defer rateLimitMu.Unlock()
+
+	bucket := l.Name + ":" + key
+	now := time.Now().UTC()
+	rate := l.Burst / l.Per.Seconds()
+
+	tokens := l.Burst
+	var updatedAt time.Time
+	err := db.QueryRowContext(ctx, "SELECT tokens, updated_at FROM rate_limits WHERE bucket = ?", bucket).Scan(&tokens, &updatedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return false, 0, fmt.Errorf("failed to read rate limit: %w", err)
+	}
+	if err == nil {
+		tokens = math.Min(l.Burst, tokens+now.Sub(updatedAt).Seconds()*rate)
+	}
+
+	if tokens < 1 {
+		wait := time.Duration((1 - tokens) / rate * float64(time.Second))
+		return false, wait, nil
+	}
+
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO rate_limits (bucket, tokens, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT (bucket) DO UPDATE SET tokens = excluded.tokens, updated_at = excluded.updated_at
+	`, bucket, tokens-1, now)
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to update rate limit: %w", err)
+	}
+	return true, 0, nil
+}
+
+// checkRateLimit takes a token from the limit's bucket for key, failing with
+// 429 Too Many Requests when it's empty
+func (app *App) checkRateLimit(w http.ResponseWriter, r *http.Request, limit RateLimit, key string) error {
+	ok, wait, err := limit.Allow(r.Context(), app.DB, key)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	slog.WarnContext(r.Context(), "Rate limited", "limit", limit.Name, "ip", clientIP(r).String(), "retry_after", seconds)
+	return NewHTTPError(fmt.Errorf("too many attempts, please try again in %s", formatWait(wait)), http.StatusTooManyRequests)
+}
+
+// formatWait rounds a wait up to whole minutes for display
+func formatWait(d time.Duration) string {
+	minutes := int(math.Ceil(d.Minutes()))
+	if minutes <= 1 {
+		return "a minute"
+	}
+	return strconv.Itoa(minutes) + " minutes"
+}
+
+// normalizeEmail lowercases an email so differently cased addresses share a
+// rate limit bucket
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitAllow(t *testing.T) {
+	app := newTestApp(t)
+	ctx := context.Background()
+	limit := RateLimit{Name: "test", Burst: 3, Per: time.Hour}
+
+	allow := func(key string) (bool, time.Duration) {
+		t.Helper()
+		ok, wait, err := limit.Allow(ctx, app.DB, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok, wait
+	}
+	// age moves the bucket's last update back to simulate time passing
+	age := func(key string, d time.Duration) {
+		t.Helper()
+		_, err := app.DB.Exec("UPDATE rate_limits SET updated_at = ? WHERE bucket = ?", time.Now().UTC().Add(-d), limit.Name+":"+key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := range 3 {
+		if ok, _ := allow("a"); !ok {
+			t.Fatalf("request %d denied, want the burst allowed", i+1)
+		}
+	}
+	ok, wait := allow("a")
+	if ok {
+		t.Fatal("request past the burst allowed")
+	}
+	if want := limit.Per / 3; wait < want-time.Second || wait > want {
+		t.Errorf("wait %v, want about %v", wait, want)
+	}
+
+	// Keys have their own buckets
+	if ok, _ := allow("b"); !ok {
+		t.Error("another key denied")
+	}
+
+	// A token refills after Per/Burst
+	age("a", limit.Per/3)
+	if ok, _ := allow("a"); !ok {
+		t.Error("request denied after a token refilled")
+	}
+	if ok, _ := allow("a"); ok {
+		t.Error("second request allowed after one token refilled")
+	}
+
+	// A long idle bucket refills only up to the burst
+	age("a", 10*limit.Per)
+	for i := range 3 {
+		if ok, _ := allow("a"); !ok {
+			t.Fatalf("request %d after idling denied", i+1)
+		}
+	}
+	if ok, _ := allow("a"); ok {
+		t.Error("bucket refilled past the burst")
+	}
+}
+
+func TestCheckRateLimit(t *testing.T) {
+	app := newTestApp(t)
+	limit := RateLimit{Name: "test", Burst: 1, Per: 10 * time.Minute}
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	w := httptest.NewRecorder()
+	if err := app.checkRateLimit(w, r, limit, "a"); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	err := app.checkRateLimit(w, r, limit, "a")
+	var httpErr HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("second request: %v, want 429", err)
+	}
+	if got := w.Header().Get("Retry-After"); got != "600" {
+		t.Errorf("Retry-After %q, want 600", got)
+	}
+	if want := "too many attempts, please try again in 10 minutes"; httpErr.Err.Error() != want {
+		t.Errorf("message %q, want %q", httpErr.Err, want)
+	}
+}
+
+func TestFormatWait(t *testing.T) {
+	tests := []struct {
+		wait time.Duration
+		want string
+	}{
+		{0, "a minute"},
+		{10 * time.Second, "a minute"},
+		{time.Minute, "a minute"},
+		{61 * time.Second, "2 minutes"},
+		{20 * time.Minute, "20 minutes"},
+	}
+	for _, tt := range tests {
+		if got := formatWait(tt.wait); got != tt.want {
+			t.Errorf("formatWait(%v) = %q, want %q", tt.wait, got, tt.want)
+		}
+	}
+}
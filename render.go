@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	texttemplate "text/template"
+)
+
+// embeddedTemplates returns the templates built into the binary
+func embeddedTemplates() fs.FS {
+	sub, err := fs.Sub(tmplFS, "tmpl")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// parseTemplates parses a site's page and email templates with the
+// functions they use. The pages in the site's TemplatesDir replace the ones
+// of the same name in fsys.
+func (app *App) parseTemplates(site *Site, fsys fs.FS) (*template.Template, *texttemplate.Template, error) {
+	funcs := template.FuncMap{
+		"siteTitle": func() string {
+			return site.Title
+		},
+		"formatDate": formatDate,
+		"highlightCSS": func() template.CSS {
+			return highlightCSS
+		},
+		"csrfField":       csrfField,
+		"sparkline":       sparkline,
+		"formatUptime":    formatUptime,
+		"challengeFields": challengeFields,
+		"isAdmin":         isAdmin,
+		"inZone":          inZone,
+		"flag":            app.flagFor,
+		// The VAPID key browsers need to create a push subscription, or
+		// empty if push isn't configured
+		"vapidPublicKey": func() string {
+			return app.Config.VAPIDPublicKey
+		},
+	}
+	if err := app.addPluginFuncs(funcs); err != nil {
+		return nil, nil, fmt.Errorf("failed to register plugin template functions: %w", err)
+	}
+
+	pages, err := template.New("").Funcs(funcs).ParseFS(fsys, "*.html")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse templates: %w", err)
+	}
+	if site.TemplatesDir != "" {
+		overrides := os.DirFS(site.TemplatesDir)
+		if names, _ := fs.Glob(overrides, "*.html"); len(names) > 0 {
+			if pages, err = pages.ParseFS(overrides, "*.html"); err != nil {
+				return nil, nil, fmt.Errorf("failed to parse templates in %s: %w", site.TemplatesDir, err)
+			}
+		}
+	}
+	text, err := texttemplate.New("").Funcs(texttemplate.FuncMap{"formatDate": formatDate}).ParseFS(fsys, "*.txt")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse email templates: %w", err)
+	}
+	return pages, text, nil
+}
+
+// templates returns a site's page and email templates. In development
+// they're parsed from disk on every call, so an edit shows up on the next
+// page load without a restart.
+func (app *App) templates(site *Site) (*template.Template, *texttemplate.Template, error) {
+	dir := app.Config.templatesDir()
+	if dir == "" {
+		return site.pages, site.text, nil
+	}
+	return app.parseTemplates(site, os.DirFS(dir))
+}
+
+// render executes one of the request's site's page templates into a buffer
+// and only then writes it with the status code, so a template that fails
+// part way through becomes an error page instead of half a page
+func (app *App) render(w http.ResponseWriter, r *http.Request, status int, name string, data any) error {
+	pages, _, err := app.templates(app.siteFor(r))
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	_, span := startSpan(r.Context(), "render "+name, spanInternal, otlpString("template.name", name))
+	err = pages.ExecuteTemplate(&buf, name, data)
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		return err
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	w.WriteHeader(status)
+	// If this fails the client has gone, and it's too late for an error page
+	_, _ = buf.WriteTo(w)
+	return nil
+}
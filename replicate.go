@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// replicaRestartDelay is how long the supervisor waits before restarting
+// litestream after it exits, doubling up to replicaMaxRestartDelay
+const (
+	replicaRestartDelay    = time.Second
+	replicaMaxRestartDelay = time.Minute
+)
+
+// ReplicaConfig is where the SQLite database's WAL is continuously copied.
+// Replication is done by litestream (https://litestream.io), which the
+// server runs and restarts if it exits.
+type ReplicaConfig struct {
+	// URL is the replica, e.g. s3://bucket/tulip.db
+	URL string
+	// Litestream is the path to the litestream binary
+	Litestream string
+	// RestoreTimestamp restores the database as of this time rather than
+	// the latest, for point-in-time recovery
+	RestoreTimestamp time.Time
+}
+
+// replicaConfig returns REPLICA_URL, the litestream binary at
+// LITESTREAM_PATH (by default litestream on the PATH) and
+// RESTORE_TIMESTAMP. ok is false if replication isn't set up.
+func replicaConfig(c Config) (cfg ReplicaConfig, ok bool, err error) {
+	if c.ReplicaURL == "" {
+		return ReplicaConfig{}, false, nil
+	}
+	if c.DatabaseURL != "" {
+		return ReplicaConfig{}, false, fmt.Errorf("REPLICA_URL only works with SQLite, DATABASE_URL is set")
+	}
+
+	cfg = ReplicaConfig{URL: c.ReplicaURL, RestoreTimestamp: c.RestoreTimestamp}
+	cfg.Litestream, err = exec.LookPath(c.LitestreamPath)
+	if err != nil {
+		return ReplicaConfig{}, false, fmt.Errorf("REPLICA_URL is set but litestream wasn't found: %w", err)
+	}
+	return cfg, true, nil
+}
+
+// restoreReplica restores the database from the replica when there's no
+// database file yet, as on a new disk after losing the old one. An existing
+// database is never overwritten, so to restore to a point in time move the
+// file aside and set RESTORE_TIMESTAMP.
+func restoreReplica(ctx context.Context, cfg ReplicaConfig, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		if !cfg.RestoreTimestamp.IsZero() {
+			slog.Warn("RESTORE_TIMESTAMP is set but the database already exists, not restoring", "path", path)
+		}
+		return nil
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to check database: %w", err)
+	}
+
+	args := []string{"restore", "-if-replica-exists", "-o", path}
+	if !cfg.RestoreTimestamp.IsZero() {
+		args = append(args, "-timestamp", cfg.RestoreTimestamp.UTC().Format(time.RFC3339))
+	}
+	args = append(args, cfg.URL)
+
+	start := time.Now()
+	cmd := exec.CommandContext(ctx, cfg.Litestream, args...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to restore database from %s: %w", redactURL(cfg.URL), err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		slog.Info("Nothing to restore from the replica, starting with an empty database", "replica", redactURL(cfg.URL))
+		return nil
+	}
+	slog.Info("Restored database from replica", "replica", redactURL(cfg.URL), "duration", time.Since(start).String())
+	return nil
+}
+
+// superviseReplication runs litestream replicate for the database until
+// ctx is done, restarting it with a backoff whenever it exits
+func superviseReplication(ctx context.Context, cfg ReplicaConfig, path string) {
+	delay := replicaRestartDelay
+	for {
+		start := time.Now()
+		cmd := exec.CommandContext(ctx, cfg.Litestream, "replicate", path, cfg.URL)
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		stopWithParent(cmd)
+		err := cmd.Run()
+		if ctx.Err() != nil {
+			return
+		}
+
+		// A run that lasted a while was healthy, so start the backoff over
+		if time.Since(start) > replicaMaxRestartDelay {
+			delay = replicaRestartDelay
+		}
+		slog.Error("Replication stopped, restarting", "error", err, "in", delay.String())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, replicaMaxRestartDelay)
+	}
+}
+
+// StartReplication continuously replicates the SQLite database when
+// REPLICA_URL is set
+func (app *App) StartReplication() error {
+	cfg, ok, err := replicaConfig(app.Config)
+	if err != nil || !ok {
+		return err
+	}
+	s, isSQLite := app.Store.(sqliteStore)
+	if !isSQLite {
+		return nil
+	}
+	slog.Info("Replicating database", "replica", redactURL(cfg.URL))
+	go superviseReplication(context.Background(), cfg, s.path)
+	return nil
+}
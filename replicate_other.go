@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "os/exec"
+
+// stopWithParent is only supported on Linux, elsewhere litestream is
+// stopped when the server shuts down cleanly
+func stopWithParent(cmd *exec.Cmd) {}
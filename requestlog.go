@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// Incoming request IDs are only trusted if they look like an ID
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type requestInfoKey struct{}
+
+// requestInfo is per-request state shared between the logging middleware and
+// the handlers it wraps
+type requestInfo struct {
+	ID     string
+	UserID int64
+	// ActingAsID is the user an admin is acting as, see actAs
+	ActingAsID int64
+	// TrustProxy is whether X-Forwarded-For can be believed, see clientIP
+	TrustProxy bool
+}
+
+// requestInfoFrom returns the request info stored in the context, if any
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// RequestID returns the ID of the request the context belongs to
+func RequestID(ctx context.Context) string {
+	if info := requestInfoFrom(ctx); info != nil {
+		return info.ID
+	}
+	return ""
+}
+
+// setRequestUser records the logged-in user for the access log
+func setRequestUser(r *http.Request, userID int64) {
+	if info := requestInfoFrom(r.Context()); info != nil {
+		info.UserID = userID
+	}
+}
+
+// setRequestActingAs records the user an admin is acting as for the access log
+func setRequestActingAs(r *http.Request, userID int64) {
+	if info := requestInfoFrom(r.Context()); info != nil {
+		info.ActingAsID = userID
+	}
+}
+
+// statusRecorder captures the status code and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Flush supports streaming responses
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// RequestLogger assigns every request an ID, taken from X-Request-ID when the
+// client or proxy sent a valid one, and writes one access log line per
+// request. trustProxy is TRUST_PROXY, see clientIP.
+func RequestLogger(trustProxy bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			var err error
+			id, err = generateRandomToken(8)
+			if err != nil {
+				slog.Error("Failed to generate request ID", "error", err)
+			}
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		info := &requestInfo{ID: id, TrustProxy: trustProxy}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		attrs := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+			"remote_ip", clientIP(r).String(),
+			"user_agent", r.UserAgent(),
+		}
+		if info.UserID != 0 {
+			attrs = append(attrs, "user_id", info.UserID)
+		}
+		if info.ActingAsID != 0 {
+			attrs = append(attrs, "acting_as_user_id", info.ActingAsID)
+		}
+		slog.InfoContext(r.Context(), "Request", attrs...)
+	})
+}
+
+// contextHandler adds the request ID and trace ID to every log record made
+// with a request context, so all log lines for a request can be correlated
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if span := spanFrom(ctx); span != nil {
+		record.AddAttrs(slog.String("trace_id", span.TraceID()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
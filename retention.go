@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// archiveInterval is how often expired data is archived and deleted
+
+// RetentionPolicy is how long one kind of data is kept
+type RetentionPolicy struct {
+	// Name is used in the RETENTION_ variable and in archive keys
+	Name  string
+	Table string
+	// Column is the row's age. dateOnly columns hold days, like
+	// page_views.day, and are compared as strings.
+	Column   string
+	dateOnly bool
+	// Where narrows which rows expire, like only emails that were sent
+	Where string
+	// Keep is how long rows are kept, or 0 to keep them forever
+	Keep time.Duration
+}
+
+// retentionPolicies are the defaults, overridden with RETENTION_<NAME>
+var retentionPolicies = []RetentionPolicy{
+	{Name: "audit_log", Table: "audit_log", Column: "created_at", Keep: 365 * 24 * time.Hour},
+	{Name: "page_views", Table: "page_views", Column: "day", dateOnly: true, Keep: 90 * 24 * time.Hour},
+	{Name: "device_metrics", Table: "device_metrics", Column: "bucket", Keep: 7 * 24 * time.Hour},
+	{Name: "events", Table: "events", Column: "created_at", Keep: 7 * 24 * time.Hour},
+	{Name: "emails", Table: "email_outbox", Column: "updated_at", Where: "status = '" + outboxSent + "'", Keep: 14 * 24 * time.Hour},
+}
+
+// RetentionConfig is how long data is kept and where it's archived
+type RetentionConfig struct {
+	Policies []RetentionPolicy
+	// archive is nil unless ARCHIVE_BUCKET is set, in which case expired
+	// rows are uploaded there before they're deleted
+	archive       *s3Client
+	archivePrefix string
+}
+
+// parseRetention parses a retention period: a number of days like "30d",
+// a Go duration, or "forever" (or 0) to keep data forever
+func parseRetention(v string) (time.Duration, error) {
+	if v == "forever" || v == "0" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("invalid number of days %q", v)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < time.Hour {
+		return 0, fmt.Errorf("invalid retention %q, expected days like 30d, a duration of at least 1h, or forever", v)
+	}
+	return d, nil
+}
+
+// retentionPeriods returns the retention policies, each default overridden
+// by RETENTION_<NAME> like RETENTION_AUDIT_LOG=730d
+func retentionPeriods(c Config) ([]RetentionPolicy, error) {
+	var policies []RetentionPolicy
+	for _, policy := range retentionPolicies {
+		if v, ok := c.Retention[policy.Name]; ok {
+			keep, err := parseRetention(v)
+			if err != nil {
+				return nil, fmt.Errorf("RETENTION_%s: %w", strings.ToUpper(policy.Name), err)
+			}
+			policy.Keep = keep
+		}
+		policies = append(policies, policy)
+	}
+	for name := range c.Retention {
+		if !slices.ContainsFunc(retentionPolicies, func(p RetentionPolicy) bool { return p.Name == name }) {
+			return nil, fmt.Errorf("unknown retention policy RETENTION_%s", strings.ToUpper(name))
+		}
+	}
+	return policies, nil
+}
+
+// retentionConfig returns the retention policies and where expired rows are
+// archived: ARCHIVE_BUCKET, with keys under ARCHIVE_PREFIX
+func retentionConfig(c Config) (RetentionConfig, error) {
+	policies, err := retentionPeriods(c)
+	if err != nil {
+		return RetentionConfig{}, err
+	}
+	cfg := RetentionConfig{Policies: policies, archivePrefix: c.ArchivePrefix}
+	if c.ArchiveBucket != "" {
+		cfg.archive, err = newS3Client(c, c.ArchiveBucket)
+		if err != nil {
+			return RetentionConfig{}, err
+		}
+	}
+	return cfg, nil
+}
+
+// expiredWhere returns the condition and argument that select the
+// policy's expired rows
+func (p RetentionPolicy) expiredWhere(now time.Time) (string, any) {
+	cutoff := now.UTC().Add(-p.Keep)
+	where := p.Column + " < ?"
+	if p.Where != "" {
+		where += " AND " + p.Where
+	}
+	if p.dateOnly {
+		return where, cutoff.Format(time.DateOnly)
+	}
+	return where, cutoff
+}
+
+// archiveRows uploads the policy's expired rows to the archive bucket as
+// gzipped NDJSON, one object per run, and returns how many there were
+func (app *App) archiveRows(ctx context.Context, cfg RetentionConfig, p RetentionPolicy, now time.Time) (int, error) {
+	where, cutoff := p.expiredWhere(now)
+	rows, err := app.DB.QueryContext(ctx, "SELECT * FROM "+p.Table+" WHERE "+where, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query expired %s: %w", p.Name, err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s columns: %w", p.Name, err)
+	}
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	enc := json.NewEncoder(zw)
+	count := 0
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return 0, fmt.Errorf("failed to scan expired %s: %w", p.Name, err)
+		}
+		row := make(map[string]any, len(columns))
+		for i, column := range columns {
+			// Text comes back as bytes from some drivers
+			if b, ok := values[i].([]byte); ok {
+				row[column] = string(b)
+			} else {
+				row[column] = values[i]
+			}
+		}
+		if err := enc.Encode(row); err != nil {
+			return 0, fmt.Errorf("failed to encode expired %s: %w", p.Name, err)
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating expired %s: %w", p.Name, err)
+	}
+	if err := zw.Close(); err != nil {
+		return 0, fmt.Errorf("failed to compress expired %s: %w", p.Name, err)
+	}
+	if count == 0 {
+		return 0, nil
+	}
+
+	key := cfg.archivePrefix + p.Name + "/" + p.Name + "-" + now.UTC().Format(backupKeyTime) + ".ndjson.gz"
+	if err := cfg.archive.Put(key, compressed.Bytes(), http.Header{"Content-Type": {"application/gzip"}}); err != nil {
+		return 0, fmt.Errorf("failed to upload archive: %w", err)
+	}
+	return count, nil
+}
+
+// enforceRetention archives and deletes one policy's expired rows. Rows
+// are only deleted once they're safely in the archive, if there is one.
+// The cutoff is fixed for the run, so rows that expire between the two
+// steps wait for the next one.
+func (app *App) enforceRetention(ctx context.Context, cfg RetentionConfig, p RetentionPolicy, now time.Time) error {
+	if p.Keep == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	archived := 0
+	if cfg.archive != nil {
+		var err error
+		archived, err = app.archiveRows(ctx, cfg, p, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	where, cutoff := p.expiredWhere(now)
+	result, err := app.DB.ExecContext(ctx, "DELETE FROM "+p.Table+" WHERE "+where, cutoff)
+	if err != nil {
+		return fmt.Errorf("failed to delete expired %s: %w", p.Name, err)
+	}
+	if deleted, _ := result.RowsAffected(); deleted > 0 {
+		slog.Info("Deleted expired data", "policy", p.Name, "deleted", deleted, "archived", archived)
+	}
+	return nil
+}
+
+// EnforceRetention archives and deletes data older than its policy allows.
+// A policy that fails doesn't hold up the others.
+func (app *App) EnforceRetention(ctx context.Context, cfg RetentionConfig, now time.Time) error {
+	var errs []error
+	for _, p := range cfg.Policies {
+		if err := app.enforceRetention(ctx, cfg, p, now); err != nil {
+			errs = append(errs, fmt.Errorf("%s retention: %w", p.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// s3Client talks to an S3 compatible bucket. It covers the few calls the
+// server needs, signed with SigV4.
+type s3Client struct {
+	bucket string
+	region string
+	// endpoint is set for S3 compatible services like R2 or MinIO, which
+	// are addressed path style
+	endpoint string
+	creds    awsCredentials
+	client   *http.Client
+}
+
+// s3Object is an object in a bucket listing
+type s3Object struct {
+	Key  string
+	ETag string
+	Size int64
+}
+
+// newS3Client configures a client for bucket from AWS_REGION (default
+// us-east-1), the AWS credentials and S3_ENDPOINT
+func newS3Client(cfg Config, bucket string) (*s3Client, error) {
+	creds, err := cfg.awsCredentials()
+	if err != nil {
+		return nil, err
+	}
+	region := cfg.AWSRegion
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &s3Client{
+		bucket:   bucket,
+		region:   region,
+		endpoint: strings.TrimSuffix(cfg.S3Endpoint, "/"),
+		creds:    creds,
+		client:   &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// objectURL returns the URL for a key, with each path segment escaped the
+// way SigV4 expects
+func (c *s3Client) objectURL(key string, query url.Values) string {
+	segments := strings.Split(key, "/")
+	for i, s := range segments {
+		segments[i] = awsEscape(s)
+	}
+	path := strings.Join(segments, "/")
+
+	u := "https://" + c.bucket + ".s3." + c.region + ".amazonaws.com/" + path
+	if c.endpoint != "" {
+		u = c.endpoint + "/" + c.bucket + "/" + path
+	}
+	if len(query) > 0 {
+		u += "?" + awsCanonicalQuery(query)
+	}
+	return u
+}
+
+// do sends a signed request and returns the response for 2xx statuses.
+// Anything else is returned as an error with S3's message.
+func (c *s3Client) do(method, key string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.objectURL(key, query), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	signAWSRequest(req, body, "s3", c.region, c.creds, time.Now())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// Put uploads an object. header can set Content-Type, Cache-Control and
+// x-amz-meta- values.
+func (c *s3Client) Put(key string, body []byte, header http.Header) error {
+	resp, err := c.do(http.MethodPut, key, nil, body, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Delete removes an object
+func (c *s3Client) Delete(key string) error {
+	resp, err := c.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// List returns every object whose key starts with prefix
+func (c *s3Client) List(prefix string) ([]s3Object, error) {
+	var objects []s3Object
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		resp, err := c.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents              []s3Object
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode bucket listing: %w", err)
+		}
+
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated {
+			return objects, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// Ping checks that objects under prefix can be listed
+func (c *s3Client) Ping(prefix string) error {
+	resp, err := c.do(http.MethodGet, "", url.Values{"list-type": {"2"}, "prefix": {prefix}, "max-keys": {"1"}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Search result types
+const (
+	searchTypePost   = "post"
+	searchTypePage   = "page"
+	searchTypeDevice = "device"
+	searchTypeUser   = "user"
+)
+
+// SearchResult is a single entry shown on the search page
+type SearchResult struct {
+	Type    string
+	Title   string
+	URL     string
+	Snippet string
+	score   int
+}
+
+// SearchPage holds data for the search page template
+type SearchPage struct {
+	Meta    PageMeta
+	Query   string
+	Results []SearchResult
+}
+
+// searchDoc is an indexed document that is visible to everyone
+type searchDoc struct {
+	Type  string
+	Title string
+	URL   string
+	Body  string
+}
+
+// SearchIndex holds the public documents (posts and static pages). Posts are
+// stored in an SQLite FTS5 table for ranked full-text search; on Postgres, or
+// if the sqlite driver was built without FTS5, they are matched in memory
+// instead. Devices
+// and users are queried from the database at search time so results always
+// reflect the current state and the caller's permissions.
+type SearchIndex struct {
+	app  *App
+	docs []searchDoc
+	fts  bool
+}
+
+// staticPages lists the site pages that are searchable
+var staticPages = []searchDoc{
+	{Type: searchTypePage, Title: "Home", URL: "/", Body: "Tulip home page with the page view counter"},
+	{Type: searchTypePage, Title: "Blog", URL: "/blog", Body: "All blog posts, newest first"},
+	{Type: searchTypePage, Title: "Login", URL: "/login", Body: "Log in to Tulip with a magic link sent to your email address"},
+	{Type: searchTypePage, Title: "Your Devices", URL: "/devices", Body: "List of the devices registered to your account"},
+}
+
+var htmlTagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// NewSearchIndex builds a search index from the loaded posts and static pages
+func (app *App) NewSearchIndex(ctx context.Context, posts []Post) *SearchIndex {
+	idx := &SearchIndex{app: app}
+	idx.docs = append(idx.docs, staticPages...)
+
+	if err := app.indexPosts(ctx, posts); err != nil {
+		slog.Warn("Full-text search unavailable, matching posts in memory", "error", err)
+		for _, post := range posts {
+			idx.docs = append(idx.docs, searchDoc{
+				Type:  searchTypePost,
+				Title: post.Title,
+				URL:   "/blog/" + post.Slug,
+				Body:  plainText(string(post.Content)),
+			})
+		}
+		return idx
+	}
+
+	idx.fts = true
+	return idx
+}
+
+// indexPosts replaces the contents of the posts_fts table with the given posts
+func (app *App) indexPosts(ctx context.Context, posts []Post) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	if !app.Store.FullTextSearch() {
+		return fmt.Errorf("%s has no full-text index", app.Store)
+	}
+	_, err := app.DB.ExecContext(ctx, `CREATE VIRTUAL TABLE IF NOT EXISTS posts_fts USING fts5(
+		slug UNINDEXED,
+		title,
+		body,
+		tokenize = 'porter unicode61'
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create posts_fts table: %w", err)
+	}
+
+	tx, err := app.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM posts_fts"); err != nil {
+		return fmt.Errorf("failed to clear posts_fts: %w", err)
+	}
+	for _, post := range posts {
+		_, err := tx.ExecContext(ctx,
+			"INSERT INTO posts_fts (slug, title, body) VALUES (?, ?, ?)",
+			post.Slug, post.Title, plainText(string(post.Content)),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to index post %s: %w", post.Slug, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// searchPosts runs a ranked full-text query against posts_fts. Titles are
+// weighted above bodies and each term also matches as a prefix.
+func (app *App) searchPosts(ctx context.Context, terms []string) ([]SearchResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"*`
+	}
+
+	rows, err := app.DB.QueryContext(ctx, `
+		SELECT slug, title, snippet(posts_fts, 2, '', '', '…', 24)
+		FROM posts_fts
+		WHERE posts_fts MATCH ?
+		ORDER BY bm25(posts_fts, 0, 10.0, 1.0)
+		LIMIT 50
+	`, strings.Join(quoted, " "))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query posts_fts: %w", err)
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		var slug string
+		result := SearchResult{Type: searchTypePost}
+		if err := rows.Scan(&slug, &result.Title, &result.Snippet); err != nil {
+			return nil, fmt.Errorf("failed to scan search row: %w", err)
+		}
+		result.URL = "/blog/" + slug
+		results = append(results, result)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating search rows: %w", err)
+	}
+
+	return results, nil
+}
+
+// Search returns results matching every term in the query. Device results are
+// limited to the user's own devices, and users are only searched when
+// showUsers is set, for admins, see App.adminAllowed.
+func (idx *SearchIndex) Search(ctx context.Context, query string, user *User, showUsers bool) ([]SearchResult, error) {
+	terms := strings.Fields(strings.ToLower(query))
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	var results []SearchResult
+	for _, doc := range idx.docs {
+		if result, ok := matchDoc(doc, terms); ok {
+			results = append(results, result)
+		}
+	}
+
+	if user != nil {
+		devices, err := idx.app.GetDevices(ctx, user.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search devices: %w", err)
+		}
+		for _, device := range devices {
+			doc := searchDoc{
+				Type:  searchTypeDevice,
+				Title: device.Hostname,
+				URL:   "/devices",
+				Body:  device.DeviceType + " " + device.Notes,
+			}
+			if result, ok := matchDoc(doc, terms); ok {
+				results = append(results, result)
+			}
+		}
+	}
+
+	if showUsers {
+		users, err := idx.app.SearchUsers(ctx, query)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search users: %w", err)
+		}
+		for _, u := range users {
+			results = append(results, SearchResult{
+				Type:    searchTypeUser,
+				Title:   u.Email,
+				Snippet: "Joined " + u.CreatedAt.Format("January 2, 2006"),
+				score:   1,
+			})
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].score > results[j].score
+	})
+
+	// Ranked post matches come first, followed by everything else
+	if idx.fts {
+		posts, err := idx.app.searchPosts(ctx, terms)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search posts: %w", err)
+		}
+		results = append(posts, results...)
+	}
+
+	return results, nil
+}
+
+// matchDoc checks that every term appears in the document and scores it,
+// weighting title matches above body matches
+func matchDoc(doc searchDoc, terms []string) (SearchResult, bool) {
+	title := strings.ToLower(doc.Title)
+	body := strings.ToLower(doc.Body)
+
+	score := 0
+	for _, term := range terms {
+		inTitle := strings.Count(title, term)
+		inBody := strings.Count(body, term)
+		if inTitle == 0 && inBody == 0 {
+			return SearchResult{}, false
+		}
+		score += inTitle*10 + inBody
+	}
+
+	return SearchResult{
+		Type:    doc.Type,
+		Title:   doc.Title,
+		URL:     doc.URL,
+		Snippet: snippet(doc.Body, terms[0]),
+		score:   score,
+	}, true
+}
+
+// snippet returns a short piece of text around the first occurrence of term
+func snippet(text, term string) string {
+	const radius = 80
+
+	i := strings.Index(strings.ToLower(text), term)
+	if i < 0 {
+		i = 0
+	}
+	start := max(i-radius, 0)
+	end := min(i+len(term)+radius, len(text))
+
+	// Avoid cutting through a multi-byte character
+	for start > 0 && !isRuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !isRuneStart(text[end]) {
+		end++
+	}
+
+	s := strings.TrimSpace(text[start:end])
+	if start > 0 {
+		s = "…" + s
+	}
+	if end < len(text) {
+		s += "…"
+	}
+	return s
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+// plainText strips HTML tags and collapses whitespace
+func plainText(s string) string {
+	s = htmlTagPattern.ReplaceAllString(s, " ")
+	return strings.Join(strings.Fields(html.UnescapeString(s)), " ")
+}
+
+// handleSearch renders the search page
+func (app *App) handleSearch(w http.ResponseWriter, r *http.Request, idx *SearchIndex, count int, user *User) error {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	results, err := idx.Search(r.Context(), query, user, app.adminAllowed(r, user))
+	if err != nil {
+		return fmt.Errorf("failed to search: %w", err)
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	data := SearchPage{
+		Meta: PageMeta{
+			Title: "Search",
+			Count: count,
+			User:  user,
+
+			CanonicalURL: canonicalURL(r),
+
+			CSRFToken: csrfToken(r),
+		},
+		Query:   query,
+		Results: results,
+	}
+	if err := app.render(w, r, http.StatusOK, "search.html", data); err != nil {
+		return fmt.Errorf("failed to render search page: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// errNoEncryptionKey is returned when ENCRYPTION_KEY isn't set
+var errNoEncryptionKey = errors.New("ENCRYPTION_KEY is not set")
+
+// encryptionAEAD returns the cipher for secrets stored in the database. The
+// key is derived from secret, ENCRYPTION_KEY, which must be at least 32
+// characters.
+func encryptionAEAD(secret string) (cipher.AEAD, error) {
+	if secret == "" {
+		return nil, errNoEncryptionKey
+	}
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("ENCRYPTION_KEY must be at least 32 characters")
+	}
+
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptSecret seals plaintext with AES-GCM under the key, prefixing the
+// random nonce
+func encryptSecret(key string, plaintext []byte) ([]byte, error) {
+	aead, err := encryptionAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// decryptSecret opens a value sealed by encryptSecret
+func decryptSecret(key string, sealed []byte) ([]byte, error) {
+	aead, err := encryptionAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted secret is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secret: %w", err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,954 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// sessionTouchInterval limits how often a session's last seen time and
+// expiry are written, so browsing doesn't write on every request
+const sessionTouchInterval = time.Minute
+
+// SessionPolicy controls how long sessions last and how often their tokens
+// change
+type SessionPolicy struct {
+	// IdleTimeout ends a session after this long without activity
+	IdleTimeout time.Duration
+	// MaxLifetime ends a session this long after login, however active
+	MaxLifetime time.Duration
+	// RotateInterval is how often an active session gets a new token
+	RotateInterval time.Duration
+	// RotateGrace is how long a replaced token keeps working, so requests
+	// already in flight with it don't get logged out
+	RotateGrace time.Duration
+}
+
+// sessionPolicy is set from the config by loadSessionPolicy
+var sessionPolicy SessionPolicy
+
+// newSessionPolicy checks SESSION_IDLE_TIMEOUT, SESSION_MAX_LIFETIME,
+// SESSION_ROTATE_INTERVAL and SESSION_ROTATE_GRACE
+func newSessionPolicy(cfg Config) (SessionPolicy, error) {
+	p := SessionPolicy{
+		IdleTimeout:    cfg.SessionIdleTimeout,
+		MaxLifetime:    cfg.SessionMaxLifetime,
+		RotateInterval: cfg.SessionRotateInterval,
+		RotateGrace:    cfg.SessionRotateGrace,
+	}
+	if p.IdleTimeout <= 0 || p.MaxLifetime <= 0 || p.RotateInterval <= 0 || p.RotateGrace <= 0 {
+		return SessionPolicy{}, fmt.Errorf("the SESSION_ durations must be positive")
+	}
+	if p.IdleTimeout > p.MaxLifetime {
+		return SessionPolicy{}, fmt.Errorf("SESSION_IDLE_TIMEOUT can't be longer than SESSION_MAX_LIFETIME")
+	}
+	return p, nil
+}
+
+// loadSessionPolicy sets how long sessions last from the config
+func loadSessionPolicy(cfg Config) error {
+	var err error
+	sessionPolicy, err = newSessionPolicy(cfg)
+	return err
+}
+
+// expiry returns when a session started at createdAt and active at now ends
+func (p SessionPolicy) expiry(createdAt, now time.Time) time.Time {
+	expiresAt := now.Add(p.IdleTimeout)
+	if limit := createdAt.Add(p.MaxLifetime); limit.Before(expiresAt) {
+		return limit
+	}
+	return expiresAt
+}
+
+// SessionClient describes the browser a session was started from
+type SessionClient struct {
+	UserAgent string
+	IP        string
+}
+
+var (
+	errInvalidSession = errors.New("invalid session")
+	errSessionExpired = errors.New("session expired")
+	// errNotRevocable is returned by stores that can't end a single session
+	errNotRevocable = errors.New("sessions in this store can't be revoked individually")
+)
+
+// SessionStore keeps login sessions. The default stores them in the database; for
+// deployments with several replicas behind a load balancer they can live in
+// Redis or in signed cookies instead.
+type SessionStore interface {
+	// Create starts a session and returns the token for the cookie. Stores
+	// in the database join the request's transaction, see DBFrom.
+	Create(ctx context.Context, userID int64, client SessionClient) (string, error)
+	// Lookup returns the session for a token
+	Lookup(ctx context.Context, token string) (Session, error)
+	// Touch records activity on the session and moves its expiry. It
+	// returns the token to use from now on, which only changes for stores
+	// that keep the session in the token itself.
+	Touch(ctx context.Context, token string, now, expiresAt time.Time) (string, error)
+	// Rotate replaces the session's token, like Touch. The old token keeps
+	// working for the policy's grace period.
+	Rotate(ctx context.Context, token string, now, expiresAt time.Time) (string, error)
+	// Delete ends the session with the given token
+	Delete(ctx context.Context, token string) error
+	// DeleteByID ends the session with the given ID, as shown by List
+	DeleteByID(ctx context.Context, id string) error
+	// DeleteForUser ends all of a user's sessions. Stores in the database
+	// join the caller's transaction, see DBFrom.
+	DeleteForUser(ctx context.Context, userID int64) error
+	// List returns all active sessions
+	List(ctx context.Context) ([]Session, error)
+	// Cleanup removes expired sessions
+	Cleanup(ctx context.Context) error
+}
+
+// newSessionStore picks the session backend from SESSION_STORE: "sqlite"
+// (the default), "redis" using REDIS_URL, or "cookie" signed with
+// SESSION_SECRET
+func (app *App) newSessionStore() (SessionStore, error) {
+	switch store := app.Config.SessionStore; store {
+	case "", "sqlite":
+		return sqliteSessionStore{app: app}, nil
+	case "redis":
+		// rediss:// URLs connect with TLS
+		opts, err := redis.ParseURL(app.Config.RedisURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+		}
+		client := redis.NewClient(opts)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := client.Ping(ctx).Err(); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("failed to reach redis: %w", err)
+		}
+		return &redisSessionStore{client: client}, nil
+	case "cookie":
+		secret := app.Config.SessionSecret
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("SESSION_SECRET must be at least 32 characters for cookie sessions")
+		}
+		return cookieSessionStore{app: app, secret: []byte(secret)}, nil
+	default:
+		return nil, fmt.Errorf("unknown SESSION_STORE %q", store)
+	}
+}
+
+// sqliteSessionStore keeps sessions in the sessions table
+type sqliteSessionStore struct {
+	app *App
+}
+
+func (s sqliteSessionStore) Create(ctx context.Context, userID int64, client SessionClient) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	token, err := generateRandomToken(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	now := time.Now()
+	_, err = s.app.DBFrom(ctx).ExecContext(ctx,
+		"INSERT INTO sessions (user_id, token, user_agent, ip, last_seen_at, rotated_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		userID, token, client.UserAgent, client.IP, now, now, sessionPolicy.expiry(now, now),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to create session: %w", err)
+	}
+	return token, nil
+}
+
+// sqliteSessionColumns are scanned by scanSQLiteSession
+const sqliteSessionColumns = "id, user_id, user_agent, ip, created_at, last_seen_at, rotated_at, expires_at"
+
+// scanSQLiteSession reads a row of sqliteSessionColumns
+func scanSQLiteSession(row interface{ Scan(...any) error }) (Session, error) {
+	var session Session
+	var id int64
+	var lastSeen, rotated sql.NullTime
+	err := row.Scan(&id, &session.UserID, &session.UserAgent, &session.IP, &session.CreatedAt, &lastSeen, &rotated, &session.ExpiresAt)
+	if err != nil {
+		return Session{}, err
+	}
+	session.ID = strconv.FormatInt(id, 10)
+	session.LastSeenAt = session.CreatedAt
+	if lastSeen.Valid {
+		session.LastSeenAt = lastSeen.Time
+	}
+	session.RotatedAt = session.CreatedAt
+	if rotated.Valid {
+		session.RotatedAt = rotated.Time
+	}
+	return session, nil
+}
+
+// Lookup is cached, see Cache, since every page a logged in user views
+// looks up their session
+func (s sqliteSessionStore) Lookup(ctx context.Context, token string) (Session, error) {
+	session, err := s.app.sessionCache.Get(ctx, token, func(ctx context.Context) (Session, error) {
+		return s.lookup(ctx, token)
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	// A replaced token only works for the grace period, so it isn't kept
+	if session.Superseded {
+		s.app.sessionCache.Invalidate(ctx, token)
+	}
+
+	if time.Now().After(session.ExpiresAt) {
+		s.app.sessionCache.Invalidate(ctx, token)
+		_, _ = s.app.DB.ExecContext(ctx, "DELETE FROM sessions WHERE token = ?", token)
+		return Session{}, errSessionExpired
+	}
+	return session, nil
+}
+
+func (s sqliteSessionStore) lookup(ctx context.Context, token string) (Session, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	session, err := scanSQLiteSession(s.app.DB.QueryRowContext(ctx, "SELECT "+sqliteSessionColumns+" FROM sessions WHERE token = ?", token))
+	if err == sql.ErrNoRows {
+		// A token replaced moments ago is still good during the grace period
+		session, err = scanSQLiteSession(s.app.DB.QueryRowContext(ctx,
+			"SELECT "+sqliteSessionColumns+" FROM sessions WHERE previous_token = ? AND previous_expires_at > ?",
+			token, time.Now(),
+		))
+		session.Superseded = true
+	}
+	if err == sql.ErrNoRows {
+		return Session{}, errInvalidSession
+	} else if err != nil {
+		return Session{}, fmt.Errorf("failed to query session: %w", err)
+	}
+	return session, nil
+}
+
+func (s sqliteSessionStore) Touch(ctx context.Context, token string, now, expiresAt time.Time) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := s.app.DB.ExecContext(ctx, "UPDATE sessions SET last_seen_at = ?, expires_at = ? WHERE token = ?", now, expiresAt, token)
+	if err != nil {
+		return "", fmt.Errorf("failed to update session: %w", err)
+	}
+	s.app.sessionCache.Invalidate(ctx, token)
+	return token, nil
+}
+
+func (s sqliteSessionStore) Rotate(ctx context.Context, token string, now, expiresAt time.Time) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	newToken, err := generateRandomToken(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	result, err := s.app.DB.ExecContext(ctx, `
+		UPDATE sessions
+		SET previous_token = token, previous_expires_at = ?, token = ?, rotated_at = ?, last_seen_at = ?, expires_at = ?
+		WHERE token = ?
+	`, now.Add(sessionPolicy.RotateGrace), newToken, now, now, expiresAt, token)
+	if err != nil {
+		return "", fmt.Errorf("failed to rotate session: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return "", fmt.Errorf("failed to rotate session: %w", err)
+	} else if n == 0 {
+		return "", errInvalidSession
+	}
+	s.app.sessionCache.Invalidate(ctx, token)
+	return newToken, nil
+}
+
+func (s sqliteSessionStore) Delete(ctx context.Context, token string) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	// A token replaced within the grace period still ends the session. This
+	// joins the request's transaction, see DBFrom, since logging in ends the
+	// previous session.
+	if _, err := s.app.DBFrom(ctx).ExecContext(ctx, "DELETE FROM sessions WHERE token = ? OR previous_token = ?", token, token); err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+	// The token may have been replaced, leaving the session cached under
+	// a token this can't see
+	s.app.sessionCache.Clear(ctx)
+	return nil
+}
+
+func (s sqliteSessionStore) DeleteByID(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	if _, err := s.app.DB.ExecContext(ctx, "DELETE FROM sessions WHERE id = ?", id); err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+	s.app.sessionCache.Clear(ctx)
+	return nil
+}
+
+func (s sqliteSessionStore) DeleteForUser(ctx context.Context, userID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	if _, err := s.app.DBFrom(ctx).ExecContext(ctx, "DELETE FROM sessions WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to delete sessions: %w", err)
+	}
+	s.app.sessionCache.Clear(ctx)
+	return nil
+}
+
+func (s sqliteSessionStore) List(ctx context.Context) ([]Session, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	rows, err := s.app.DB.QueryContext(ctx,
+		"SELECT "+sqliteSessionColumns+" FROM sessions WHERE expires_at > ?",
+		time.Now(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		session, err := scanSQLiteSession(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan session row: %w", err)
+		}
+		sessions = append(sessions, session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating session rows: %w", err)
+	}
+	return sessions, nil
+}
+
+func (s sqliteSessionStore) Cleanup(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	if _, err := s.app.DB.ExecContext(ctx, "DELETE FROM sessions WHERE expires_at < ?", time.Now()); err != nil {
+		return fmt.Errorf("failed to delete expired sessions: %w", err)
+	}
+	return nil
+}
+
+// redisSessionStore keeps sessions in Redis, keyed by a hash of the token so
+// the tokens themselves are never stored. A set of session IDs allows
+// listing them.
+type redisSessionStore struct {
+	client *redis.Client
+}
+
+const (
+	redisSessionPrefix = "tulip:session:"
+	redisSessionSet    = "tulip:sessions"
+)
+
+// sessionID derives a session's public ID from its token
+func sessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:16])
+}
+
+// redisSession is the JSON stored for each session
+type redisSession struct {
+	UserID    int64  `json:"user_id"`
+	Created   int64  `json:"created"`
+	Expires   int64  `json:"expires"`
+	LastSeen  int64  `json:"last_seen"`
+	Rotated   int64  `json:"rotated"`
+	UserAgent string `json:"user_agent"`
+	IP        string `json:"ip"`
+	// ReplacedBy is the ID of the session's new key after a rotation. The
+	// old key is kept for the grace period.
+	ReplacedBy string `json:"replaced_by,omitempty"`
+}
+
+// ttl returns how long until expiresAt, at least a second
+func ttl(now, expiresAt time.Time) time.Duration {
+	return max(expiresAt.Sub(now).Truncate(time.Second), time.Second)
+}
+
+// stored converts a session back to its stored form
+func (s Session) stored() redisSession {
+	return redisSession{
+		UserID:    s.UserID,
+		Created:   s.CreatedAt.Unix(),
+		Expires:   s.ExpiresAt.Unix(),
+		LastSeen:  s.LastSeenAt.Unix(),
+		Rotated:   s.RotatedAt.Unix(),
+		UserAgent: s.UserAgent,
+		IP:        s.IP,
+	}
+}
+
+func (s *redisSessionStore) Create(ctx context.Context, userID int64, client SessionClient) (string, error) {
+	token, err := generateRandomToken(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	now := time.Now()
+	id := sessionID(token)
+	expiresAt := sessionPolicy.expiry(now, now)
+	value, err := json.Marshal(redisSession{
+		UserID:    userID,
+		Created:   now.Unix(),
+		Expires:   expiresAt.Unix(),
+		LastSeen:  now.Unix(),
+		Rotated:   now.Unix(),
+		UserAgent: client.UserAgent,
+		IP:        client.IP,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode session: %w", err)
+	}
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, redisSessionPrefix+id, value, ttl(now, expiresAt))
+		pipe.SAdd(ctx, redisSessionSet, id)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create session: %w", err)
+	}
+	return token, nil
+}
+
+// parse decodes a stored session value, also returning the ID it was
+// replaced by if it's been rotated. Sessions created before client details
+// were recorded are stored as "user_id created expires".
+func (s *redisSessionStore) parse(id, value string) (Session, string, error) {
+	var stored redisSession
+	if strings.HasPrefix(value, "{") {
+		if err := json.Unmarshal([]byte(value), &stored); err != nil {
+			return Session{}, "", fmt.Errorf("invalid session value: %w", err)
+		}
+	} else {
+		if _, err := fmt.Sscanf(value, "%d %d %d", &stored.UserID, &stored.Created, &stored.Expires); err != nil {
+			return Session{}, "", fmt.Errorf("invalid session value: %w", err)
+		}
+		stored.LastSeen = stored.Created
+	}
+	if stored.Rotated == 0 {
+		stored.Rotated = stored.Created
+	}
+	return Session{
+		ID:         id,
+		UserID:     stored.UserID,
+		UserAgent:  stored.UserAgent,
+		IP:         stored.IP,
+		CreatedAt:  time.Unix(stored.Created, 0),
+		LastSeenAt: time.Unix(stored.LastSeen, 0),
+		RotatedAt:  time.Unix(stored.Rotated, 0),
+		ExpiresAt:  time.Unix(stored.Expires, 0),
+		Superseded: stored.ReplacedBy != "",
+	}, stored.ReplacedBy, nil
+}
+
+func (s *redisSessionStore) Lookup(ctx context.Context, token string) (Session, error) {
+	id := sessionID(token)
+	value, err := s.client.Get(ctx, redisSessionPrefix+id).Result()
+	if errors.Is(err, redis.Nil) {
+		return Session{}, errInvalidSession
+	} else if err != nil {
+		return Session{}, fmt.Errorf("failed to query session: %w", err)
+	}
+	session, replacedBy, err := s.parse(id, value)
+	if err != nil {
+		return Session{}, err
+	}
+
+	// A replaced token only works while the session it moved to exists,
+	// so revoking the session ends both
+	if replacedBy != "" {
+		exists, err := s.client.Exists(ctx, redisSessionPrefix+replacedBy).Result()
+		if err != nil {
+			return Session{}, fmt.Errorf("failed to check session: %w", err)
+		}
+		if exists == 0 {
+			return Session{}, errInvalidSession
+		}
+	}
+	return session, nil
+}
+
+func (s *redisSessionStore) Touch(ctx context.Context, token string, now, expiresAt time.Time) (string, error) {
+	session, err := s.Lookup(ctx, token)
+	if err != nil {
+		return "", err
+	}
+	session.LastSeenAt, session.ExpiresAt = now, expiresAt
+	value, err := json.Marshal(session.stored())
+	if err != nil {
+		return "", fmt.Errorf("failed to encode session: %w", err)
+	}
+	// XX so a session deleted in the meantime isn't brought back
+	if err := s.client.SetXX(ctx, redisSessionPrefix+session.ID, value, ttl(now, expiresAt)).Err(); err != nil {
+		return "", fmt.Errorf("failed to update session: %w", err)
+	}
+	return token, nil
+}
+
+// Rotate moves the session to a key for the new token. The old key points
+// at the new one until the grace period is up.
+func (s *redisSessionStore) Rotate(ctx context.Context, token string, now, expiresAt time.Time) (string, error) {
+	session, err := s.Lookup(ctx, token)
+	if err != nil {
+		return "", err
+	}
+	newToken, err := generateRandomToken(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	newID := sessionID(newToken)
+
+	session.LastSeenAt, session.RotatedAt, session.ExpiresAt = now, now, expiresAt
+	value, err := json.Marshal(session.stored())
+	if err != nil {
+		return "", fmt.Errorf("failed to encode session: %w", err)
+	}
+	old := session.stored()
+	old.ReplacedBy = newID
+	oldValue, err := json.Marshal(old)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode session: %w", err)
+	}
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, redisSessionPrefix+newID, value, ttl(now, expiresAt))
+		pipe.SAdd(ctx, redisSessionSet, newID)
+		pipe.SetXX(ctx, redisSessionPrefix+session.ID, oldValue, ttl(now, now.Add(sessionPolicy.RotateGrace)))
+		pipe.SRem(ctx, redisSessionSet, session.ID)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to rotate session: %w", err)
+	}
+	return newToken, nil
+}
+
+func (s *redisSessionStore) Delete(ctx context.Context, token string) error {
+	return s.DeleteByID(ctx, sessionID(token))
+}
+
+func (s *redisSessionStore) DeleteByID(ctx context.Context, id string) error {
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, redisSessionPrefix+id)
+		pipe.SRem(ctx, redisSessionSet, id)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+	return nil
+}
+
+func (s *redisSessionStore) DeleteForUser(ctx context.Context, userID int64) error {
+	sessions, err := s.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if session.UserID != userID {
+			continue
+		}
+		if err := s.DeleteByID(ctx, session.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *redisSessionStore) List(ctx context.Context) ([]Session, error) {
+	ids, err := s.client.SMembers(ctx, redisSessionSet).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = redisSessionPrefix + id
+	}
+	values, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+
+	var sessions []Session
+	for i, v := range values {
+		// Expired by Redis, Cleanup drops it from the set
+		value, ok := v.(string)
+		if !ok {
+			continue
+		}
+		session, _, err := s.parse(ids[i], value)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+func (s *redisSessionStore) Cleanup(ctx context.Context) error {
+	ids, err := s.client.SMembers(ctx, redisSessionSet).Result()
+	if err != nil {
+		return fmt.Errorf("failed to list sessions: %w", err)
+	}
+	for _, id := range ids {
+		exists, err := s.client.Exists(ctx, redisSessionPrefix+id).Result()
+		if err != nil {
+			return fmt.Errorf("failed to check session: %w", err)
+		}
+		if exists == 0 {
+			if err := s.client.SRem(ctx, redisSessionSet, id).Err(); err != nil {
+				return fmt.Errorf("failed to remove expired session: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// refreshSession records activity on the session with the given token,
+// sliding its expiry and rotating its token when they're due. It returns
+// the session's token, which may have changed, and its new expiry if it
+// was refreshed.
+func (app *App) refreshSession(ctx context.Context, token string, now time.Time) (newToken string, expiresAt time.Time, refreshed bool, err error) {
+	session, err := app.Sessions.Lookup(ctx, token)
+	if err != nil {
+		return "", time.Time{}, false, err
+	}
+
+	expiresAt = sessionPolicy.expiry(session.CreatedAt, now)
+	if !expiresAt.After(now) {
+		// Past the maximum lifetime
+		if err := app.Sessions.Delete(ctx, token); err != nil {
+			return "", time.Time{}, false, err
+		}
+		return "", time.Time{}, false, errSessionExpired
+	}
+	switch {
+	case session.Superseded:
+		// Requests with a token that's just been replaced leave the
+		// session be, the response that replaced it has the new one
+		return token, session.ExpiresAt, false, nil
+	case now.Sub(session.RotatedAt) > sessionPolicy.RotateInterval:
+		newToken, err = app.Sessions.Rotate(ctx, token, now, expiresAt)
+	case now.Sub(session.LastSeenAt) > sessionTouchInterval:
+		newToken, err = app.Sessions.Touch(ctx, token, now, expiresAt)
+	default:
+		return token, session.ExpiresAt, false, nil
+	}
+	if err != nil {
+		return "", time.Time{}, false, err
+	}
+	return newToken, expiresAt, true, nil
+}
+
+// RefreshSessions keeps active sessions alive. The session cookie is
+// reissued whenever the session's expiry moves or its token is rotated, and
+// handlers further down see the current token.
+func (app *App) RefreshSessions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(sessionCookieName)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, expiresAt, refreshed, err := app.refreshSession(r.Context(), cookie.Value, time.Now())
+		switch {
+		case errors.Is(err, errInvalidSession) || errors.Is(err, errSessionExpired):
+			clearSessionCookie(w)
+		case err != nil:
+			slog.ErrorContext(r.Context(), "Failed to refresh session", "error", err)
+		case refreshed:
+			setSessionCookie(w, token, expiresAt)
+			if token != cookie.Value {
+				replaceRequestCookie(r, sessionCookieName, token)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// replaceRequestCookie changes the value of a cookie sent with the request
+func replaceRequestCookie(r *http.Request, name, value string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name == name {
+			cookie.Value = value
+		}
+		r.AddCookie(cookie)
+	}
+}
+
+// sessionsRevocable reports whether the store can list sessions and end
+// them one at a time from the list
+func (app *App) sessionsRevocable() bool {
+	_, ok := app.Sessions.(cookieSessionStore)
+	return !ok
+}
+
+// cookieSessionStore keeps sessions in the cookie. The token is the user
+// ID, expiry, login time and issue time signed with SESSION_SECRET, so any
+// replica sharing the secret can verify it. Only ended sessions are kept on
+// the server, in revoked_sessions, until their tokens would have expired.
+// Sessions can't be listed, and replaced tokens stay valid until they
+// expire or the session ends; rotating the secret logs everyone out.
+type cookieSessionStore struct {
+	app    *App
+	secret []byte
+}
+
+// cookieSessionID identifies a login across the tokens issued for it
+func cookieSessionID(userID int64, createdAt time.Time) string {
+	return sessionID(strconv.FormatInt(userID, 10) + ":" + strconv.FormatInt(createdAt.Unix(), 10))
+}
+
+// revokedUserKey is the revoked_sessions row that ends every session of a
+// user that started before it
+func revokedUserKey(userID int64) string {
+	return "user:" + strconv.FormatInt(userID, 10)
+}
+
+// revoke records that the sessions under key ended. Tokens issued before
+// now are all expired after the maximum lifetime, so the row isn't needed
+// after that.
+func (s cookieSessionStore) revoke(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	now := time.Now().UTC()
+	_, err := s.app.DBFrom(ctx).ExecContext(ctx, `
+		INSERT INTO revoked_sessions (id, revoked_at, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET revoked_at = excluded.revoked_at, expires_at = excluded.expires_at
+	`, key, now, now.Add(sessionPolicy.MaxLifetime))
+	if err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+	return nil
+}
+
+// revoked reports whether the session was ended, itself or along with the
+// rest of its user's sessions
+func (s cookieSessionStore) revoked(ctx context.Context, session Session) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	rows, err := s.app.DBFrom(ctx).QueryContext(ctx, "SELECT id, revoked_at FROM revoked_sessions WHERE id IN (?, ?)",
+		session.ID, revokedUserKey(session.UserID))
+	if err != nil {
+		return false, fmt.Errorf("failed to check session: %w", err)
+	}
+	defer rows.Close()
+
+	revoked := false
+	for rows.Next() {
+		var id string
+		var revokedAt time.Time
+		if err := rows.Scan(&id, &revokedAt); err != nil {
+			return false, fmt.Errorf("failed to scan revoked session: %w", err)
+		}
+		// Logins are recorded to the second, so one in the same second as
+		// logging out everywhere is ended too
+		revoked = revoked || id == session.ID || session.CreatedAt.Unix() <= revokedAt.Unix()
+	}
+	if err := rows.Err(); err != nil {
+		return false, fmt.Errorf("failed to check session: %w", err)
+	}
+	return revoked, nil
+}
+
+func (s cookieSessionStore) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// issue signs a token for the session
+func (s cookieSessionStore) issue(userID int64, createdAt, issuedAt, expiresAt time.Time) string {
+	payload := make([]byte, 32)
+	binary.BigEndian.PutUint64(payload[:8], uint64(userID))
+	binary.BigEndian.PutUint64(payload[8:16], uint64(expiresAt.Unix()))
+	binary.BigEndian.PutUint64(payload[16:24], uint64(createdAt.Unix()))
+	binary.BigEndian.PutUint64(payload[24:], uint64(issuedAt.Unix()))
+
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(s.sign(payload))
+}
+
+func (s cookieSessionStore) Create(_ context.Context, userID int64, client SessionClient) (string, error) {
+	now := time.Now()
+	return s.issue(userID, now, now, sessionPolicy.expiry(now, now)), nil
+}
+
+func (s cookieSessionStore) Lookup(ctx context.Context, token string) (Session, error) {
+	session, err := s.verify(token)
+	if err != nil {
+		return Session{}, err
+	}
+	revoked, err := s.revoked(ctx, session)
+	if err != nil {
+		return Session{}, err
+	}
+	if revoked {
+		return Session{}, errInvalidSession
+	}
+	return session, nil
+}
+
+// verify checks the token's signature and expiry and returns its session
+func (s cookieSessionStore) verify(token string) (Session, error) {
+	enc := base64.RawURLEncoding
+	encodedPayload, encodedSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return Session{}, errInvalidSession
+	}
+	payload, err := enc.DecodeString(encodedPayload)
+	// Tokens issued before sessions slid hold only the user ID and expiry
+	if err != nil || (len(payload) != 16 && len(payload) != 32) {
+		return Session{}, errInvalidSession
+	}
+	sig, err := enc.DecodeString(encodedSig)
+	if err != nil || !hmac.Equal(sig, s.sign(payload)) {
+		return Session{}, errInvalidSession
+	}
+
+	expiresAt := time.Unix(int64(binary.BigEndian.Uint64(payload[8:16])), 0)
+	if time.Now().After(expiresAt) {
+		return Session{}, errSessionExpired
+	}
+	// Older tokens lasted a week from login
+	createdAt := expiresAt.Add(-7 * 24 * time.Hour)
+	issuedAt := createdAt
+	if len(payload) == 32 {
+		createdAt = time.Unix(int64(binary.BigEndian.Uint64(payload[16:24])), 0)
+		issuedAt = time.Unix(int64(binary.BigEndian.Uint64(payload[24:])), 0)
+	}
+	userID := int64(binary.BigEndian.Uint64(payload[:8]))
+	return Session{
+		ID:         cookieSessionID(userID, createdAt),
+		UserID:     userID,
+		CreatedAt:  createdAt,
+		LastSeenAt: issuedAt,
+		RotatedAt:  issuedAt,
+		ExpiresAt:  expiresAt,
+	}, nil
+}
+
+// Touch issues a new token, since the expiry is part of the token
+func (s cookieSessionStore) Touch(ctx context.Context, token string, now, expiresAt time.Time) (string, error) {
+	session, err := s.Lookup(ctx, token)
+	if err != nil {
+		return "", err
+	}
+	return s.issue(session.UserID, session.CreatedAt, now, expiresAt), nil
+}
+
+// Rotate is the same as Touch, every touch already issues a new token
+func (s cookieSessionStore) Rotate(ctx context.Context, token string, now, expiresAt time.Time) (string, error) {
+	return s.Touch(ctx, token, now, expiresAt)
+}
+
+// Delete revokes the session, including the tokens issued for it before
+// this one
+func (s cookieSessionStore) Delete(ctx context.Context, token string) error {
+	session, err := s.verify(token)
+	if errors.Is(err, errInvalidSession) || errors.Is(err, errSessionExpired) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return s.revoke(ctx, session.ID)
+}
+
+// DeleteByID fails, since there's no list of sessions to pick from
+func (s cookieSessionStore) DeleteByID(_ context.Context, id string) error {
+	return errNotRevocable
+}
+
+// DeleteForUser revokes every session the user started until now
+func (s cookieSessionStore) DeleteForUser(ctx context.Context, userID int64) error {
+	return s.revoke(ctx, revokedUserKey(userID))
+}
+
+func (s cookieSessionStore) List(_ context.Context) ([]Session, error) {
+	return nil, nil
+}
+
+// Cleanup forgets revoked sessions whose tokens have all expired
+func (s cookieSessionStore) Cleanup(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	if _, err := s.app.DB.ExecContext(ctx, "DELETE FROM revoked_sessions WHERE expires_at < ?", time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to delete expired revoked sessions: %w", err)
+	}
+	return nil
+}
+
+// Device summarizes the session's user agent, like "Firefox on macOS"
+func (s Session) Device() string {
+	ua := s.UserAgent
+	if ua == "" {
+		return "Unknown device"
+	}
+
+	browser := "Unknown browser"
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	} {
+		if strings.Contains(ua, b.token) {
+			browser = b.name
+			break
+		}
+	}
+
+	for _, platform := range []struct{ token, name string }{
+		{"iPhone", "iPhone"},
+		{"iPad", "iPad"},
+		{"Android", "Android"},
+		{"Mac OS X", "macOS"},
+		{"Windows", "Windows"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(ua, platform.token) {
+			return browser + " on " + platform.name
+		}
+	}
+	return browser
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestUsers creates users with the emails and returns their IDs
+func newTestUsers(t *testing.T, app *App, emails ...string) []int64 {
+	t.Helper()
+	var ids []int64
+	for _, email := range emails {
+		user, err := app.CreateOrGetUser(context.Background(), email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, user.ID)
+	}
+	return ids
+}
+
+// checkSessions looks each token up and compares the result with want
+func checkSessions(t *testing.T, store SessionStore, want map[string]error) {
+	t.Helper()
+	for name, wantErr := range want {
+		_, err := store.Lookup(context.Background(), name)
+		if !errors.Is(err, wantErr) {
+			t.Errorf("Lookup(%s): %v, want %v", name[:8], err, wantErr)
+		}
+	}
+}
+
+func TestSQLiteSessionRevocation(t *testing.T) {
+	app := newTestApp(t)
+	ctx := context.Background()
+	store := app.Sessions
+	users := newTestUsers(t, app, "a@example.com", "b@example.com")
+
+	create := func(userID int64) string {
+		t.Helper()
+		token, err := store.Create(ctx, userID, SessionClient{UserAgent: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	first, second, third, other := create(users[0]), create(users[0]), create(users[0]), create(users[1])
+
+	// Logging out ends only that session
+	if err := store.Delete(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	checkSessions(t, store, map[string]error{first: errInvalidSession, second: nil, third: nil, other: nil})
+
+	// Logging out with a token that was just replaced ends the session
+	rotated, err := store.Rotate(ctx, second, time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSessions(t, store, map[string]error{second: nil, rotated: nil})
+	if err := store.Delete(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+	checkSessions(t, store, map[string]error{second: errInvalidSession, rotated: errInvalidSession})
+
+	// Logging out everywhere ends the user's sessions and no one else's
+	if err := store.DeleteForUser(ctx, users[0]); err != nil {
+		t.Fatal(err)
+	}
+	checkSessions(t, store, map[string]error{third: errInvalidSession, other: nil})
+
+	// Sessions can be ended from the list
+	sessions, err := store.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("listed %d sessions, want 1", len(sessions))
+	}
+	if err := store.DeleteByID(ctx, sessions[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	checkSessions(t, store, map[string]error{other: errInvalidSession})
+}
+
+func TestCookieSessionRevocation(t *testing.T) {
+	app := newTestApp(t)
+	ctx := context.Background()
+	store := cookieSessionStore{app: app, secret: []byte(strings.Repeat("s", 32))}
+	users := newTestUsers(t, app, "a@example.com", "b@example.com")
+	now := time.Now()
+
+	// A login's tokens from before and after it was touched, another login
+	// by the same user, and another user's
+	login := now.Add(-time.Hour)
+	old := store.issue(users[0], login, login, now.Add(time.Hour))
+	current := store.issue(users[0], login, now, now.Add(time.Hour))
+	laptop := store.issue(users[0], now.Add(-time.Minute), now, now.Add(time.Hour))
+	other := store.issue(users[1], login, now, now.Add(time.Hour))
+	checkSessions(t, store, map[string]error{old: nil, current: nil, laptop: nil, other: nil})
+
+	// Tokens have to be signed with the secret and unexpired
+	forged := cookieSessionStore{app: app, secret: []byte(strings.Repeat("x", 32))}.issue(users[0], login, now, now.Add(time.Hour))
+	expired := store.issue(users[0], login, login, now.Add(-time.Minute))
+	checkSessions(t, store, map[string]error{forged: errInvalidSession, expired: errSessionExpired})
+
+	// Logging out ends every token issued for the login, so an old cookie
+	// can't be replayed
+	if err := store.Delete(ctx, current); err != nil {
+		t.Fatal(err)
+	}
+	checkSessions(t, store, map[string]error{old: errInvalidSession, current: errInvalidSession, laptop: nil, other: nil})
+
+	// Logging out everywhere ends the user's logins so far, but not later
+	// ones or anyone else's
+	if err := store.DeleteForUser(ctx, users[0]); err != nil {
+		t.Fatal(err)
+	}
+	later := now.Add(2 * time.Second)
+	next := store.issue(users[0], later, later, later.Add(time.Hour))
+	checkSessions(t, store, map[string]error{laptop: errInvalidSession, next: nil, other: nil})
+
+	// There's no list to end sessions from
+	if err := store.DeleteByID(ctx, "anything"); !errors.Is(err, errNotRevocable) {
+		t.Errorf("DeleteByID: %v, want %v", err, errNotRevocable)
+	}
+
+	// Revocations are forgotten once every token they cover has expired
+	if _, err := app.DB.Exec("UPDATE revoked_sessions SET expires_at = ? WHERE id = ?", now.Add(-time.Minute).UTC(), revokedUserKey(users[0])); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Cleanup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := app.DB.QueryRow("SELECT COUNT(*) FROM revoked_sessions").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("%d revoked sessions left after cleanup, want 1", n)
+	}
+}
+
+func TestSessionPolicyExpiry(t *testing.T) {
+	p := SessionPolicy{IdleTimeout: 7 * 24 * time.Hour, MaxLifetime: 30 * 24 * time.Hour}
+	login := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		now  time.Time
+		want time.Time
+	}{
+		{"at login", login, login.Add(7 * 24 * time.Hour)},
+		{"slides with activity", login.Add(10 * 24 * time.Hour), login.Add(17 * 24 * time.Hour)},
+		{"capped by the lifetime", login.Add(25 * 24 * time.Hour), login.Add(30 * 24 * time.Hour)},
+	}
+	for _, tt := range tests {
+		if got := p.expiry(login, tt.now); !got.Equal(tt.want) {
+			t.Errorf("%s: expiry %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRefreshSession(t *testing.T) {
+	app := newTestApp(t)
+	ctx := context.Background()
+	users := newTestUsers(t, app, "a@example.com")
+	token, err := app.Sessions.Create(ctx, users[0], SessionClient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := app.Sessions.Lookup(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := session.CreatedAt
+
+	// Requests soon after the last one leave the session alone
+	got, _, refreshed, err := app.refreshSession(ctx, token, login.Add(time.Second))
+	if err != nil || refreshed || got != token {
+		t.Fatalf("refresh right after login: %q, %t, %v", got, refreshed, err)
+	}
+
+	// Later ones slide the expiry, keeping the token
+	now := login.Add(sessionTouchInterval + time.Second)
+	got, expiresAt, refreshed, err := app.refreshSession(ctx, token, now)
+	if err != nil || !refreshed || got != token {
+		t.Fatalf("touch: %q, %t, %v", got, refreshed, err)
+	}
+	if want := sessionPolicy.expiry(login, now); !expiresAt.Equal(want) {
+		t.Errorf("touch moved expiry to %v, want %v", expiresAt, want)
+	}
+
+	// Once the rotate interval has passed the token is replaced. The old
+	// one still works in the grace period but doesn't rotate again.
+	now = login.Add(sessionPolicy.RotateInterval + time.Minute)
+	rotated, _, refreshed, err := app.refreshSession(ctx, token, now)
+	if err != nil || !refreshed || rotated == token {
+		t.Fatalf("rotate: %q, %t, %v", rotated, refreshed, err)
+	}
+	got, _, refreshed, err = app.refreshSession(ctx, token, now)
+	if err != nil || refreshed || got != token {
+		t.Fatalf("refresh with the replaced token: %q, %t, %v", got, refreshed, err)
+	}
+	if session, err := app.Sessions.Lookup(ctx, token); err != nil || !session.Superseded {
+		t.Errorf("replaced token in the grace period: %+v, %v", session, err)
+	}
+
+	// After the grace period the replaced token stops working
+	past := time.Now().Add(-sessionPolicy.RotateGrace - time.Minute)
+	next, err := app.Sessions.Rotate(ctx, rotated, past, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSessions(t, app.Sessions, map[string]error{rotated: errInvalidSession, next: nil})
+
+	// However active, the session ends after the maximum lifetime
+	_, _, _, err = app.refreshSession(ctx, next, login.Add(sessionPolicy.MaxLifetime+time.Second))
+	if !errors.Is(err, errSessionExpired) {
+		t.Fatalf("refresh past the lifetime: %v, want %v", err, errSessionExpired)
+	}
+	checkSessions(t, app.Sessions, map[string]error{next: errInvalidSession})
+}
+
+// The middleware gives the browser the rotated token and handlers the
+// request with it
+func TestRefreshSessionsMiddleware(t *testing.T) {
+	app := newTestApp(t)
+	ctx := context.Background()
+	users := newTestUsers(t, app, "a@example.com")
+	token, err := app.Sessions.Create(ctx, users[0], SessionClient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	due := time.Now().Add(-sessionPolicy.RotateInterval - time.Minute)
+	if _, err := app.DB.Exec("UPDATE sessions SET rotated_at = ?, last_seen_at = ? WHERE token = ?", due, due, token); err != nil {
+		t.Fatal(err)
+	}
+	app.sessionCache.Clear(ctx)
+
+	var seen string
+	handler := app.RefreshSessions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie(sessionCookieName); err == nil {
+			seen = cookie.Value
+		}
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: token})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	var issued string
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == sessionCookieName {
+			issued = cookie.Value
+		}
+	}
+	if issued == "" || issued == token {
+		t.Fatalf("cookie %q after rotation, want a new token", issued)
+	}
+	if seen != issued {
+		t.Errorf("handler saw token %q, want the new one %q", seen, issued)
+	}
+
+	// An unknown token clears the cookie
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "unknown"})
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Errorf("cookies %v for an unknown token, want the session cookie cleared", cookies)
+	}
+}
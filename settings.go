@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SettingsPage holds data for the account settings template
+type SettingsPage struct {
+	Meta PageMeta
+
+	// TwoFactorAvailable is false when there's no key to encrypt secrets
+	TwoFactorAvailable bool
+	TwoFactorEnabled   bool
+	BackupCodesLeft    int
+
+	// Set while enrolling an authenticator
+	SetupQR     template.HTML
+	SetupURI    string
+	SetupSecret string
+	// Shown once, right after enabling
+	BackupCodes []string
+
+	Message string
+	Error   string
+}
+
+// handleSettings serves the account settings page and its actions. Callers
+// must make sure the user is logged in.
+func (app *App) handleSettings(w http.ResponseWriter, r *http.Request, count int, user *User) error {
+	if r.URL.Path == "/settings/sessions" || strings.HasPrefix(r.URL.Path, "/settings/sessions/") {
+		return app.handleSessionSettings(w, r, count, user)
+	}
+	if r.URL.Path == "/settings/tokens" || strings.HasPrefix(r.URL.Path, "/settings/tokens/") {
+		return app.handleTokenSettings(w, r, count, user)
+	}
+	if r.URL.Path == "/settings/account" || strings.HasPrefix(r.URL.Path, "/settings/account/") {
+		return app.handleAccountSettings(w, r, count, user)
+	}
+
+	page := SettingsPage{
+		Meta: PageMeta{
+			Title: "Settings",
+			Count: count,
+			User:  user,
+
+			CSRFToken: csrfToken(r),
+		},
+	}
+
+	_, err := encryptionAEAD(app.Config.EncryptionKey)
+	page.TwoFactorAvailable = err == nil
+	if err != nil && !errors.Is(err, errNoEncryptionKey) {
+		return err
+	}
+
+	switch {
+	case r.URL.Path == "/settings" && r.Method == http.MethodGet:
+	case r.URL.Path == "/settings/profile" && r.Method == http.MethodPost:
+		problem, err := app.updateProfile(r, user)
+		if err != nil {
+			return err
+		}
+		if problem != "" {
+			page.Error = problem
+			break
+		}
+		// The page shows the new name and avatar
+		updated, err := app.GetUserByID(r.Context(), user.ID)
+		if err != nil {
+			return err
+		}
+		user, page.Meta.User = &updated, &updated
+		slog.InfoContext(r.Context(), "Profile updated", "user_id", user.ID)
+		page.Message = "Your profile is saved."
+	case r.URL.Path == "/settings/2fa/setup" && r.Method == http.MethodPost:
+		if !page.TwoFactorAvailable {
+			return NewHTTPError(errNoEncryptionKey, http.StatusBadRequest)
+		}
+		secret, err := app.StartTOTPEnrollment(r.Context(), user.ID)
+		if err != nil {
+			return err
+		}
+		if err := page.showSetup(secret, user.Email); err != nil {
+			return err
+		}
+	case r.URL.Path == "/settings/2fa/enable" && r.Method == http.MethodPost:
+		t, err := app.GetTOTP(r.Context(), user.ID)
+		if err != nil {
+			return err
+		}
+		if t.Enabled || len(t.Secret) == 0 {
+			http.Redirect(w, r, "/settings", http.StatusSeeOther)
+			return nil
+		}
+		step, ok := verifyTOTP(t.Secret, normalizeCode(r.FormValue("code")), time.Now(), 0)
+		if !ok {
+			page.Error = "That code didn't match. Check your device's clock and try again."
+			if err := page.showSetup(t.Secret, user.Email); err != nil {
+				return err
+			}
+			break
+		}
+		if page.BackupCodes, err = app.EnableTOTP(r.Context(), user.ID, step); err != nil {
+			return err
+		}
+		slog.InfoContext(r.Context(), "Two-factor login enabled", "user_id", user.ID)
+		page.Message = "Two-factor authentication is on."
+	case r.URL.Path == "/settings/2fa/disable" && r.Method == http.MethodPost:
+		ok, err := app.checkSecondFactor(r.Context(), user.ID, r.FormValue("code"))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			page.Error = "That code didn't work, so two-factor authentication is still on."
+			break
+		}
+		if err := app.DisableTOTP(r.Context(), user.ID); err != nil {
+			return err
+		}
+		slog.InfoContext(r.Context(), "Two-factor login disabled", "user_id", user.ID)
+		page.Message = "Two-factor authentication is off."
+	default:
+		return app.notFound(w, r)
+	}
+
+	if page.TwoFactorAvailable {
+		t, err := app.GetTOTP(r.Context(), user.ID)
+		if err != nil {
+			return err
+		}
+		page.TwoFactorEnabled = t.Enabled
+		if page.BackupCodesLeft, err = app.CountBackupCodes(r.Context(), user.ID); err != nil {
+			return err
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := app.render(w, r, http.StatusOK, "settings.html", page); err != nil {
+		return fmt.Errorf("failed to render settings page: %w", err)
+	}
+	return nil
+}
+
+// showSetup fills in the enrollment QR code and secret
+func (page *SettingsPage) showSetup(secret []byte, email string) error {
+	page.SetupURI = totpURI(secret, email)
+	page.SetupSecret = totpEncoding.EncodeToString(secret)
+	var err error
+	page.SetupQR, err = qrSVG(page.SetupURI)
+	return err
+}
+
+// SessionsPage holds data for the active sessions template
+type SessionsPage struct {
+	Meta      PageMeta
+	Sessions  []Session
+	CurrentID string
+	// Revocable is false when sessions live in signed cookies, which can
+	// only be ended all at once
+	Revocable bool
+}
+
+// handleSessionSettings lists the user's sessions and ends them one at a
+// time or all at once
+func (app *App) handleSessionSettings(w http.ResponseWriter, r *http.Request, count int, user *User) error {
+	ctx := r.Context()
+
+	var sessions []Session
+	all, err := app.Sessions.List(r.Context())
+	if err != nil {
+		return err
+	}
+	for _, session := range all {
+		if session.UserID == user.ID {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+
+	switch {
+	case r.URL.Path == "/settings/sessions" && r.Method == http.MethodGet:
+	case r.URL.Path == "/settings/sessions/revoke" && r.Method == http.MethodPost:
+		id := r.FormValue("id")
+		found := false
+		for _, session := range sessions {
+			found = found || session.ID == id
+		}
+		// Only the user's own sessions can be ended here
+		if !found {
+			return NewHTTPError(fmt.Errorf("session not found"), http.StatusNotFound)
+		}
+		if err := app.DeleteSessionByID(r.Context(), id); errors.Is(err, errNotRevocable) {
+			return NewHTTPError(err, http.StatusBadRequest)
+		} else if err != nil {
+			return fmt.Errorf("failed to revoke session: %w", err)
+		}
+
+		slog.InfoContext(ctx, "User revoked session", "user_id", user.ID, "session_id", id)
+		http.Redirect(w, r, "/settings/sessions", http.StatusSeeOther)
+		return nil
+	case r.URL.Path == "/settings/sessions/revoke-all" && r.Method == http.MethodPost:
+		if err := app.Sessions.DeleteForUser(r.Context(), user.ID); err != nil {
+			return err
+		}
+		clearSessionCookie(w)
+
+		slog.InfoContext(ctx, "User logged out everywhere", "user_id", user.ID)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	default:
+		return app.notFound(w, r)
+	}
+
+	current, err := app.currentSession(r)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	data := SessionsPage{
+		Meta: PageMeta{
+			Title: "Sessions",
+			Count: count,
+			User:  user,
+
+			CSRFToken: csrfToken(r),
+		},
+		Sessions:  sessions,
+		CurrentID: current.ID,
+		Revocable: app.sessionsRevocable(),
+	}
+	if err := app.render(w, r, http.StatusOK, "sessions.html", data); err != nil {
+		return fmt.Errorf("failed to render sessions page: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// shortlinkPrefix is where short links are served from
+const shortlinkPrefix = "/s/"
+
+// shortlinkCode is what a short link's code can be
+var shortlinkCode = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+var (
+	errShortlinkNotFound = errors.New("short link not found")
+	errShortlinkTaken    = errors.New("short link code is already taken")
+)
+
+// Shortlink is a short URL that redirects to a longer one
+type Shortlink struct {
+	Code      string
+	Target    string
+	CreatedBy string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	Clicks    int
+}
+
+// Path returns where the link is served
+func (l Shortlink) Path() string {
+	return shortlinkPrefix + l.Code
+}
+
+// Expired reports whether the link has stopped redirecting
+func (l Shortlink) Expired() bool {
+	return !l.ExpiresAt.IsZero() && !time.Now().Before(l.ExpiresAt)
+}
+
+// validShortlinkTarget reports whether a link can point at target: an
+// http or https URL, or a path on this site
+func validShortlinkTarget(target string) bool {
+	if strings.HasPrefix(target, "/") {
+		// Not //host, which browsers treat as another site
+		return !strings.HasPrefix(target, "//") && !strings.HasPrefix(target, `/\`)
+	}
+	u, err := url.Parse(target)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// CreateShortlink adds a link. An empty code gets a random one. It returns
+// the code, or errShortlinkTaken if the code is in use.
+func (app *App) CreateShortlink(ctx context.Context, userID int64, code, target string, lifetime time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	if code == "" {
+		random, err := generateRandomToken(4)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate code: %w", err)
+		}
+		code = random
+	}
+
+	var expiresAt sql.NullTime
+	if lifetime > 0 {
+		expiresAt = sql.NullTime{Time: time.Now().Add(lifetime), Valid: true}
+	}
+	res, err := app.DB.ExecContext(ctx, `
+		INSERT INTO shortlinks (code, target, created_by, created_at, expires_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (code) DO NOTHING
+	`, code, target, userID, time.Now(), expiresAt)
+	if err != nil {
+		return "", fmt.Errorf("failed to create short link: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return "", fmt.Errorf("failed to create short link: %w", err)
+	} else if n == 0 {
+		return "", errShortlinkTaken
+	}
+	return code, nil
+}
+
+// GetShortlink returns the link with a code, expired or not
+func (app *App) GetShortlink(ctx context.Context, code string) (Shortlink, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var l Shortlink
+	var expires sql.NullTime
+	err := app.DB.QueryRowContext(ctx,
+		"SELECT code, target, created_at, expires_at FROM shortlinks WHERE code = ?", code,
+	).Scan(&l.Code, &l.Target, &l.CreatedAt, &expires)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Shortlink{}, errShortlinkNotFound
+	} else if err != nil {
+		return Shortlink{}, fmt.Errorf("failed to get short link: %w", err)
+	}
+	l.ExpiresAt = expires.Time
+	return l, nil
+}
+
+// ListShortlinks returns every link with its clicks, newest first
+func (app *App) ListShortlinks(ctx context.Context) ([]Shortlink, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	rows, err := app.DB.QueryContext(ctx, `
+		SELECT s.code, s.target, COALESCE(u.email, ''), s.created_at, s.expires_at, s.clicks
+		FROM shortlinks s
+		LEFT JOIN users u ON u.id = s.created_by
+		ORDER BY s.created_at DESC, s.code
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list short links: %w", err)
+	}
+	defer rows.Close()
+
+	var links []Shortlink
+	for rows.Next() {
+		var l Shortlink
+		var expires sql.NullTime
+		if err := rows.Scan(&l.Code, &l.Target, &l.CreatedBy, &l.CreatedAt, &expires, &l.Clicks); err != nil {
+			return nil, fmt.Errorf("failed to scan short link: %w", err)
+		}
+		l.ExpiresAt = expires.Time
+		links = append(links, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating short links: %w", err)
+	}
+	return links, nil
+}
+
+// ExpireShortlink stops a link redirecting now. Its clicks are kept.
+func (app *App) ExpireShortlink(ctx context.Context, code string) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	now := time.Now()
+	res, err := app.DB.ExecContext(ctx,
+		"UPDATE shortlinks SET expires_at = ? WHERE code = ? AND (expires_at IS NULL OR expires_at > ?)",
+		now, code, now,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to expire short link: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to expire short link: %w", err)
+	} else if n == 0 {
+		return errShortlinkNotFound
+	}
+	return nil
+}
+
+// CountShortlinkClick adds a click to a link
+func (app *App) CountShortlinkClick(ctx context.Context, code string) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	if _, err := app.DB.ExecContext(ctx, "UPDATE shortlinks SET clicks = clicks + 1 WHERE code = ?", code); err != nil {
+		return fmt.Errorf("failed to count short link click: %w", err)
+	}
+	return nil
+}
+
+// handleShortlink redirects /s/{code} to the link's target and counts the
+// click. Redirects aren't page views, so the click is counted here. It's a
+// 302 so browsers come back each time and every click is counted.
+func (app *App) handleShortlink(w http.ResponseWriter, r *http.Request) error {
+	code := strings.TrimPrefix(r.URL.Path, shortlinkPrefix)
+	if !shortlinkCode.MatchString(code) {
+		return app.notFound(w, r)
+	}
+	link, err := app.GetShortlink(r.Context(), code)
+	if errors.Is(err, errShortlinkNotFound) {
+		return app.notFound(w, r)
+	} else if err != nil {
+		return err
+	}
+	if link.Expired() {
+		return NewHTTPError(fmt.Errorf("this link has expired"), http.StatusGone)
+	}
+
+	// A click that can't be counted still goes where it was headed
+	if err := app.CountShortlinkClick(r.Context(), code); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to count short link click", "code", code, "error", err)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, link.Target, http.StatusFound)
+	return nil
+}
+
+// ShortlinksPage holds data for the short links template
+type ShortlinksPage struct {
+	Meta     PageMeta
+	Links    []Shortlink
+	Expiries []string
+	// Created is the link that was just made, to show its URL
+	Created string
+	Error   string
+}
+
+// handleAdminShortlinks lists, creates and expires short links. Callers must
+// wrap it with RequireRole(RoleAdmin, ...).
+func (app *App) handleAdminShortlinks(w http.ResponseWriter, r *http.Request, count int, user *User) error {
+	page := ShortlinksPage{
+		Meta: PageMeta{
+			Title: "Short links",
+			Count: count,
+			User:  user,
+
+			CSRFToken: csrfToken(r),
+		},
+	}
+	// Links use the same lifetimes as API tokens
+	for _, e := range tokenExpiries {
+		page.Expiries = append(page.Expiries, e.Label)
+	}
+
+	switch {
+	case r.URL.Path == "/admin/shortlinks" && r.Method == http.MethodGet:
+	case r.URL.Path == "/admin/shortlinks/create" && r.Method == http.MethodPost:
+		code := strings.TrimSpace(r.FormValue("code"))
+		target := strings.TrimSpace(r.FormValue("target"))
+		lifetime := time.Duration(-1)
+		for _, e := range tokenExpiries {
+			if e.Label == r.FormValue("expires") {
+				lifetime = e.Duration
+			}
+		}
+
+		switch {
+		case code != "" && !shortlinkCode.MatchString(code):
+			page.Error = "Codes can only have letters, numbers, - and _, up to 64 of them."
+		case !validShortlinkTarget(target):
+			page.Error = "Links must go to an http or https URL, or a path on this site."
+		case lifetime < 0:
+			page.Error = "Choose when the link expires."
+		default:
+			created, err := app.CreateShortlink(r.Context(), user.ID, code, target, lifetime)
+			if errors.Is(err, errShortlinkTaken) {
+				page.Error = "That code is already taken."
+				break
+			} else if err != nil {
+				return err
+			}
+			if err := app.Audit(r.Context(), *user, nil, "shortlink.create", shortlinkPrefix+created+" to "+target); err != nil {
+				return err
+			}
+			page.Created = baseURL(r) + shortlinkPrefix + created
+		}
+	case r.URL.Path == "/admin/shortlinks/expire" && r.Method == http.MethodPost:
+		code := r.FormValue("code")
+		if err := app.ExpireShortlink(r.Context(), code); errors.Is(err, errShortlinkNotFound) {
+			return NewHTTPError(fmt.Errorf("no short link %q that hasn't expired", code), http.StatusNotFound)
+		} else if err != nil {
+			return err
+		}
+		if err := app.Audit(r.Context(), *user, nil, "shortlink.expire", shortlinkPrefix+code); err != nil {
+			return err
+		}
+		http.Redirect(w, r, "/admin/shortlinks", http.StatusSeeOther)
+		return nil
+	default:
+		return app.notFound(w, r)
+	}
+
+	var err error
+	if page.Links, err = app.ListShortlinks(r.Context()); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := app.render(w, r, http.StatusOK, "shortlinks.html", page); err != nil {
+		return fmt.Errorf("failed to render short links page: %w", err)
+	}
+	return nil
+}
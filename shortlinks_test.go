@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestShortlinkClicks(t *testing.T) {
+	app := newTestApp(t)
+	ctx := context.Background()
+	for _, code := range []string{"gh", "old"} {
+		if _, err := app.CreateShortlink(ctx, 1, code, "https://github.com/maxmcd/tulip", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := app.ExpireShortlink(ctx, "old"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/s/gh", http.StatusFound},
+		{"/s/gh", http.StatusFound},
+		{"/s/gh", http.StatusFound},
+		{"/s/old", http.StatusGone},
+		{"/s/missing", http.StatusNotFound},
+	}
+	handler := app.Handler()
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("GET %s: status %d, want %d", tt.path, w.Code, tt.status)
+		}
+		if tt.status == http.StatusFound && w.Header().Get("Location") != "https://github.com/maxmcd/tulip" {
+			t.Errorf("GET %s: redirected to %q", tt.path, w.Header().Get("Location"))
+		}
+	}
+
+	links, err := app.ListShortlinks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clicks := map[string]int{}
+	for _, l := range links {
+		clicks[l.Code] = l.Clicks
+	}
+	if clicks["gh"] != 3 {
+		t.Errorf("gh has %d clicks, want 3", clicks["gh"])
+	}
+	if clicks["old"] != 0 {
+		t.Errorf("expired link has %d clicks, want 0", clicks["old"])
+	}
+}
+
+func TestValidShortlinkTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		valid  bool
+	}{
+		{"https://example.com/page", true},
+		{"http://example.com", true},
+		{"/blog/post", true},
+		{"//evil.example", false},
+		{`/\evil.example`, false},
+		{"javascript:alert(1)", false},
+		{"https://", false},
+		{"example.com", false},
+	}
+	for _, tt := range tests {
+		if got := validShortlinkTarget(tt.target); got != tt.valid {
+			t.Errorf("validShortlinkTarget(%q) = %t, want %t", tt.target, got, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	texttemplate "text/template"
+)
+
+// Site is one of the sites the server hosts, picked by the request's Host.
+// Each has its own posts, templates and title. Accounts, devices, media and
+// the admin pages are shared, and the admin pages show the posts of the
+// site they're visited on.
+type Site struct {
+	// Name is the site's SITES_<NAME> setting, or "" for the default site
+	Name string
+	// Host is the host name the site answers, without a port. The default
+	// site answers every host no other site claims.
+	Host  string
+	Title string
+	// PostsDir holds the site's post markdown files
+	PostsDir string
+	// TemplatesDir holds templates that replace the built in ones of the
+	// same name, or is empty to use the built in ones as they are
+	TemplatesDir string
+
+	// blog is the most recently loaded posts, see Blog
+	blog     atomic.Pointer[Blog]
+	reloadMu sync.Mutex
+
+	// pages and text are the parsed templates, see App.templates
+	pages *template.Template
+	text  *texttemplate.Template
+}
+
+// Blog returns the site's most recently loaded posts
+func (s *Site) Blog() *Blog {
+	return s.blog.Load()
+}
+
+// key scopes a post's slug or file name to the site, for the tables shared
+// by every site. The default site's keys are unchanged, so its data from
+// before there were several sites still matches.
+func (s *Site) key(k string) string {
+	if s.Name == "" {
+		return k
+	}
+	return s.Name + ":" + k
+}
+
+// unkey returns the slug or file name in a key from key
+func (s *Site) unkey(k string) string {
+	if s.Name == "" {
+		return k
+	}
+	return strings.TrimPrefix(k, s.Name+":")
+}
+
+// parseSites reads the sites from the SITES_<NAME> settings, each a comma
+// separated list like "host=project.example.com,posts=./project,
+// title=Project,templates=./project/tmpl". Only host and posts are
+// required. The default site comes first, serving ./blog at SITE_URL's
+// host with SITE_TITLE.
+func parseSites(c Config) ([]*Site, error) {
+	def := &Site{Title: c.SiteTitle, PostsDir: c.BlogDir}
+	if u, err := url.Parse(c.SiteURL); err == nil {
+		def.Host = strings.ToLower(u.Hostname())
+	}
+	sites := []*Site{def}
+
+	names := make([]string, 0, len(c.Sites))
+	for name := range c.Sites {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		site := &Site{Name: name, Title: name}
+		for _, part := range strings.Split(c.Sites[name], ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			key, value, ok := strings.Cut(part, "=")
+			value = strings.TrimSpace(value)
+			switch strings.TrimSpace(key) {
+			case "host":
+				site.Host = strings.ToLower(value)
+			case "posts":
+				site.PostsDir = value
+			case "title":
+				site.Title = value
+			case "templates":
+				site.TemplatesDir = value
+			default:
+				ok = false
+			}
+			if !ok {
+				return nil, fmt.Errorf("invalid SITES_%s entry %q, expected host, posts, title or templates=value", strings.ToUpper(name), part)
+			}
+		}
+		if site.Host == "" || site.PostsDir == "" {
+			return nil, fmt.Errorf("SITES_%s must set host and posts", strings.ToUpper(name))
+		}
+		for _, other := range sites {
+			if other.Host == site.Host {
+				return nil, fmt.Errorf("SITES_%s has the same host as another site, %s", strings.ToUpper(name), site.Host)
+			}
+			if filepath.Clean(other.PostsDir) == filepath.Clean(site.PostsDir) {
+				return nil, fmt.Errorf("SITES_%s has the same posts directory as another site, %s", strings.ToUpper(name), site.PostsDir)
+			}
+		}
+		sites = append(sites, site)
+	}
+	return sites, nil
+}
+
+// defaultSite returns the site for hosts no other site claims
+func (app *App) defaultSite() *Site {
+	return app.sites[0]
+}
+
+// siteForHost returns the site that serves a host, which may have a port
+func (app *App) siteForHost(host string) *Site {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, site := range app.sites[1:] {
+		if site.Host == host {
+			return site
+		}
+	}
+	return app.defaultSite()
+}
+
+// siteFor returns the site a request is for
+func (app *App) siteFor(r *http.Request) *Site {
+	return app.siteForHost(r.Host)
+}
+
+// siteForURL returns the site that serves an absolute URL, like a post's
+// canonical URL in a background job
+func (app *App) siteForURL(rawURL string) *Site {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return app.defaultSite()
+	}
+	return app.siteForHost(u.Host)
+}
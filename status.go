@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyWindow is how far back the status endpoint's p99 looks
+const latencyWindow = 5 * time.Minute
+
+// latencySamples is how many recent request durations are kept. On a busy
+// site the window is cut short rather than growing without bound.
+const latencySamples = 4096
+
+// statusIPLimit caps status checks from one client, since each one pings
+// the database
+var statusIPLimit = RateLimit{Name: "status-ip", Burst: 60, Per: time.Minute}
+
+// SiteStatus is the coarse health of the site, for external status pages
+type SiteStatus struct {
+	// Status is "ok", "degraded" when the database can't be reached, or
+	// "draining" when the server is shutting down. Either of the last two
+	// is sent with a 503, so health checks take the instance out.
+	Status   string `json:"status"`
+	Database string `json:"database"`
+	Posts    int    `json:"posts"`
+	// P99Millis is the 99th percentile request duration over the last five
+	// minutes, or null when there haven't been any requests
+	P99Millis     *float64  `json:"p99_ms"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+	CheckedAt     time.Time `json:"checked_at"`
+}
+
+// latencyTracker keeps the durations of recent requests in a ring. The
+// zero value is ready to use.
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples [latencySamples]latencySample
+	next    int
+}
+
+type latencySample struct {
+	at       time.Time
+	duration time.Duration
+}
+
+// record adds a request's duration
+func (t *latencyTracker) record(at time.Time, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples[t.next] = latencySample{at: at, duration: d}
+	t.next = (t.next + 1) % latencySamples
+}
+
+// percentile returns the pth percentile of the durations recorded since a
+// time, and false if there are none
+func (t *latencyTracker) percentile(p float64, since time.Time) (time.Duration, bool) {
+	t.mu.Lock()
+	var durations []time.Duration
+	for _, s := range t.samples {
+		if !s.at.IsZero() && !s.at.Before(since) {
+			durations = append(durations, s.duration)
+		}
+	}
+	t.mu.Unlock()
+
+	if len(durations) == 0 {
+		return 0, false
+	}
+	slices.Sort(durations)
+	i := int(math.Ceil(p/100*float64(len(durations)))) - 1
+	return durations[max(i, 0)], true
+}
+
+// trackLatency records how long each request takes for the status
+// endpoint. Event streams stay open for as long as the page does, so
+// they're left out.
+func (app *App) trackLatency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		if strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+			return
+		}
+		app.latency.record(start, time.Since(start))
+	})
+}
+
+// handleAPIStatus returns the site's health at GET /api/v1/status, unless
+// PUBLIC_STATUS=off. It needs no login, so it only reports numbers that are
+// safe to publish.
+func (app *App) handleAPIStatus(w http.ResponseWriter, r *http.Request) error {
+	if !app.Config.PublicStatus {
+		return NewHTTPError(fmt.Errorf("no such endpoint: %s", r.URL.Path), http.StatusNotFound)
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return NewHTTPError(fmt.Errorf("method not allowed"), http.StatusMethodNotAllowed)
+	}
+	if err := app.checkRateLimit(w, r, statusIPLimit, clientIP(r).String()); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	status := SiteStatus{
+		Status:        "ok",
+		Database:      "ok",
+		Posts:         len(app.siteFor(r).Blog().Posts),
+		UptimeSeconds: int64(now.Sub(app.startedAt).Seconds()),
+		CheckedAt:     now.UTC(),
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+	if err := app.DB.PingContext(ctx); err != nil {
+		status.Status = "degraded"
+		status.Database = "unreachable"
+	}
+	if app.draining.Load() {
+		status.Status = "draining"
+	}
+	if p99, ok := app.latency.percentile(99, now.Add(-latencyWindow)); ok {
+		ms := float64(p99.Microseconds()) / 1000
+		status.P99Millis = &ms
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if status.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return writeJSON(w, status)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Store is the database behind DB, picked by DATABASE_URL. Queries are
+// written once, in SQL that SQLite and Postgres both run with ? for
+// parameters, and the Store covers what differs between them: connecting,
+// column types and looking at the schema.
+type Store interface {
+	// Open connects to the database
+	Open() (*sql.DB, error)
+	// String describes the database for logs, without any password
+	String() string
+	// Schema adapts a statement from createTables, which are written for
+	// SQLite, to the database
+	Schema(stmt string) string
+	// HasTable reports whether a table exists in db
+	HasTable(ctx context.Context, db *sql.DB, table string) (bool, error)
+	// HasColumn reports whether a table in db has a column
+	HasColumn(ctx context.Context, db *sql.DB, table, column string) (bool, error)
+	// FullTextSearch reports whether posts can be indexed in posts_fts
+	FullTextSearch() bool
+	// LockTable returns a statement that keeps other transactions from
+	// writing to a table until this one ends, or "" if writes are already
+	// serialized
+	LockTable(table string) string
+}
+
+// newStore picks the database from DATABASE_URL: a postgres:// URL, or
+// empty for the SQLite database at databasePath
+func newStore(cfg Config) (Store, error) {
+	dsn := cfg.DatabaseURL
+	switch {
+	case dsn == "":
+		return sqliteStore{path: databasePath()}, nil
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		config, err := pgx.ParseConfig(dsn)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DATABASE_URL: %w", err)
+		}
+		return postgresStore{config: config}, nil
+	default:
+		return nil, fmt.Errorf("unsupported DATABASE_URL %q, expected a postgres:// URL", redactURL(dsn))
+	}
+}
+
+// redactURL hides the password in a connection URL
+func redactURL(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "(unparseable)"
+	}
+	return u.Redacted()
+}
+
+// sqliteStore keeps everything in a single SQLite file
+type sqliteStore struct {
+	path string
+}
+
+// Open turns on WAL so reads don't wait on writes, and waits for a busy
+// database rather than failing with "database is locked" when requests
+// write at the same time. Transactions still take the write lock on their
+// first write, which WithRequestTx relies on.
+func (s sqliteStore) Open() (*sql.DB, error) {
+	dsn := "file:" + s.path + "?_busy_timeout=5000&_journal_mode=WAL"
+	return sql.OpenDB(tracedConnector{dsnConnector{dsn, &sqlite3.SQLiteDriver{}}, "sqlite"}), nil
+}
+
+func (s sqliteStore) String() string {
+	return "sqlite " + s.path
+}
+
+func (sqliteStore) Schema(stmt string) string {
+	return stmt
+}
+
+func (sqliteStore) HasTable(ctx context.Context, db *sql.DB, table string) (bool, error) {
+	var exists int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&exists)
+	return exists > 0, err
+}
+
+func (sqliteStore) HasColumn(ctx context.Context, db *sql.DB, table, column string) (bool, error) {
+	var exists int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&exists)
+	return exists > 0, err
+}
+
+func (sqliteStore) FullTextSearch() bool {
+	return true
+}
+
+// LockTable has nothing to do, since SQLite has a single writer
+func (sqliteStore) LockTable(table string) string {
+	return ""
+}
+
+// postgresStore keeps everything in a Postgres database, for running
+// several replicas or on a host without a persistent disk
+type postgresStore struct {
+	config *pgx.ConnConfig
+}
+
+func (s postgresStore) Open() (*sql.DB, error) {
+	return sql.OpenDB(tracedConnector{postgresConnector{stdlib.GetConnector(*s.config)}, "postgresql"}), nil
+}
+
+func (s postgresStore) String() string {
+	return fmt.Sprintf("postgres %s@%s:%d/%s", s.config.User, s.config.Host, s.config.Port, s.config.Database)
+}
+
+var (
+	// postgresGenerated matches SQLite's generated columns over JSON facts
+	postgresGenerated = regexp.MustCompile(`(\w+) (TEXT|INTEGER) GENERATED ALWAYS AS \((.+)\) VIRTUAL`)
+	// postgresJSONPath matches json_extract(column, '$.a.b')
+	postgresJSONPath = regexp.MustCompile(`json_extract\((\w+), '\$\.([\w.]+)'\)`)
+	// postgresJSONLength matches json_array_length(column, '$.a')
+	postgresJSONLength = regexp.MustCompile(`json_array_length\((\w+), '\$\.(\w+)'\)`)
+)
+
+// Schema maps SQLite's types to Postgres ones. Booleans stay integers so
+// the same queries work on both, and generated columns are stored since
+// Postgres doesn't have virtual ones.
+func (postgresStore) Schema(stmt string) string {
+	stmt = postgresGenerated.ReplaceAllStringFunc(stmt, func(column string) string {
+		m := postgresGenerated.FindStringSubmatch(column)
+		expr := postgresJSONPath.ReplaceAllStringFunc(m[3], func(e string) string {
+			p := postgresJSONPath.FindStringSubmatch(e)
+			keys := strings.Split(p[2], ".")
+			path := ""
+			for _, key := range keys[:len(keys)-1] {
+				path += fmt.Sprintf(" -> '%s'", key)
+			}
+			return fmt.Sprintf("(%s::jsonb%s ->> '%s')", p[1], path, keys[len(keys)-1])
+		})
+		expr = postgresJSONLength.ReplaceAllString(expr, "jsonb_array_length($1::jsonb -> '$2')")
+		return fmt.Sprintf("%s %s GENERATED ALWAYS AS (CAST(%s AS %s)) STORED", m[1], m[2], expr, m[2])
+	})
+	return strings.NewReplacer(
+		"CURRENT_TIMESTAMP", "CURRENT_TIMESTAMP",
+		"INTEGER PRIMARY KEY AUTOINCREMENT", "BIGSERIAL PRIMARY KEY",
+		"INTEGER", "BIGINT",
+		"BOOLEAN", "BIGINT",
+		"REAL", "DOUBLE PRECISION",
+		"BLOB", "BYTEA",
+		"TIMESTAMP", "TIMESTAMPTZ",
+	).Replace(stmt)
+}
+
+func (postgresStore) HasTable(ctx context.Context, db *sql.DB, table string) (bool, error) {
+	var exists int
+	err := db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?",
+		table,
+	).Scan(&exists)
+	return exists > 0, err
+}
+
+func (postgresStore) HasColumn(ctx context.Context, db *sql.DB, table, column string) (bool, error) {
+	var exists int
+	err := db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = ? AND column_name = ?",
+		table, column,
+	).Scan(&exists)
+	return exists > 0, err
+}
+
+// FullTextSearch is off for Postgres, which matches posts in memory
+func (postgresStore) FullTextSearch() bool {
+	return false
+}
+
+// LockTable lets other transactions read the table but not write to it
+func (postgresStore) LockTable(table string) string {
+	return "LOCK TABLE " + table + " IN EXCLUSIVE MODE"
+}
+
+// postgresConnector hands out connections that take SQLite style queries
+type postgresConnector struct {
+	driver.Connector
+}
+
+func (c postgresConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return postgresConn{conn.(*stdlib.Conn)}, nil
+}
+
+// postgresConn numbers ? placeholders as $1, $2... and sends booleans as
+// integers, matching how they're stored in SQLite
+type postgresConn struct {
+	*stdlib.Conn
+}
+
+func (c postgresConn) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(rebind(query))
+}
+
+func (c postgresConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.Conn.PrepareContext(ctx, rebind(query))
+}
+
+func (c postgresConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.Conn.ExecContext(ctx, rebind(query), args)
+}
+
+func (c postgresConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.Conn.QueryContext(ctx, rebind(query), args)
+}
+
+func (c postgresConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if b, ok := nv.Value.(bool); ok {
+		nv.Value = int64(0)
+		if b {
+			nv.Value = int64(1)
+		}
+		return nil
+	}
+	return c.Conn.CheckNamedValue(nv)
+}
+
+// rebind replaces ? placeholders with numbered ones, leaving question marks
+// in strings, quoted identifiers and comments alone
+func rebind(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(query[i+1:], c)
+			if end < 0 {
+				b.WriteString(query[i:])
+				return b.String()
+			}
+			b.WriteString(query[i : i+end+2])
+			i += end + 1
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				b.WriteString(query[i:])
+				return b.String()
+			}
+			b.WriteString(query[i : i+end])
+			i += end - 1
+		case c == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
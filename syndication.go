@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Syndication statuses
+const (
+	syndicationPending = "pending"
+	syndicationDone    = "done"
+	syndicationFailed  = "failed"
+)
+
+const (
+	// syndicationMaxAttempts is how many times a cross-post is tried before
+	// it's marked failed and needs a manual retry
+	syndicationMaxAttempts = 5
+	syndicationRetryDelay  = 5 * time.Minute
+)
+
+var syndicationClient = &http.Client{Timeout: 30 * time.Second}
+
+// SyndicationTarget is an external platform posts can be cross-posted to
+type SyndicationTarget struct {
+	Name  string
+	Label string
+	// publish creates the post with the credentials in cfg and returns its
+	// URL on the platform
+	publish func(cfg Config, post Post, markdown, canonicalURL string) (string, error)
+}
+
+// syndicationTargets returns the platforms with credentials configured:
+// DEVTO_API_KEY, MEDIUM_TOKEN, or MASTODON_URL and MASTODON_TOKEN
+func syndicationTargets(cfg Config) []SyndicationTarget {
+	var targets []SyndicationTarget
+	if cfg.DevtoAPIKey != "" {
+		targets = append(targets, SyndicationTarget{Name: "devto", Label: "DEV", publish: publishDevTo})
+	}
+	if cfg.MediumToken != "" {
+		targets = append(targets, SyndicationTarget{Name: "medium", Label: "Medium", publish: publishMedium})
+	}
+	if cfg.MastodonURL != "" && cfg.MastodonToken != "" {
+		targets = append(targets, SyndicationTarget{Name: "mastodon", Label: "Mastodon", publish: publishMastodon})
+	}
+	return targets
+}
+
+// syndicationTarget finds a configured target by name
+func syndicationTarget(cfg Config, name string) (SyndicationTarget, bool) {
+	for _, target := range syndicationTargets(cfg) {
+		if target.Name == name {
+			return target, true
+		}
+	}
+	return SyndicationTarget{}, false
+}
+
+// Syndication tracks cross-posting one post to one platform
+type Syndication struct {
+	// Slug is keyed to the post's site, see Site.key
+	Slug          string
+	Target        string
+	CanonicalURL  string
+	Status        string
+	Attempts      int
+	RemoteURL     string
+	LastError     string
+	NextAttemptAt time.Time
+	UpdatedAt     time.Time
+}
+
+// QueueSyndication schedules cross-posting a post. Posts already sent to a
+// target aren't sent again.
+func (app *App) QueueSyndication(ctx context.Context, slug, target, canonicalURL string) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := app.DB.ExecContext(ctx, `
+		INSERT INTO syndications (slug, target, canonical_url, status, next_attempt_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(slug, target) DO NOTHING
+	`, slug, target, canonicalURL, syndicationPending, time.Now(), time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to queue syndication: %w", err)
+	}
+	return nil
+}
+
+// RetrySyndication puts a failed cross-post back in the queue
+func (app *App) RetrySyndication(ctx context.Context, slug, target string) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := app.DB.ExecContext(ctx, `
+		UPDATE syndications SET status = ?, attempts = 0, next_attempt_at = ?, updated_at = ?
+		WHERE slug = ? AND target = ? AND status = ?
+	`, syndicationPending, time.Now(), time.Now(), slug, target, syndicationFailed)
+	if err != nil {
+		return fmt.Errorf("failed to retry syndication: %w", err)
+	}
+	return nil
+}
+
+// ListSyndications returns the most recently updated cross-posts
+func (app *App) ListSyndications(ctx context.Context, limit int) ([]Syndication, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	rows, err := app.DB.QueryContext(ctx, `
+		SELECT slug, target, canonical_url, status, attempts, remote_url, last_error, next_attempt_at, updated_at
+		FROM syndications
+		ORDER BY updated_at DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query syndications: %w", err)
+	}
+	defer rows.Close()
+
+	var syndications []Syndication
+	for rows.Next() {
+		var s Syndication
+		err := rows.Scan(&s.Slug, &s.Target, &s.CanonicalURL, &s.Status, &s.Attempts, &s.RemoteURL, &s.LastError, &s.NextAttemptAt, &s.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan syndication row: %w", err)
+		}
+		syndications = append(syndications, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating syndication rows: %w", err)
+	}
+	return syndications, nil
+}
+
+// SyndicatePending sends every cross-post that's due
+func (app *App) SyndicatePending(ctx context.Context, now time.Time) error {
+	// Only the query is bounded, posting to the platforms has its own timeouts
+	qctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	rows, err := app.DB.QueryContext(qctx,
+		"SELECT slug, target, canonical_url, attempts FROM syndications WHERE status = ? AND next_attempt_at <= ?",
+		syndicationPending, now,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to query pending syndications: %w", err)
+	}
+	var due []Syndication
+	for rows.Next() {
+		var s Syndication
+		if err := rows.Scan(&s.Slug, &s.Target, &s.CanonicalURL, &s.Attempts); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan syndication row: %w", err)
+		}
+		due = append(due, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating syndication rows: %w", err)
+	}
+
+	for _, s := range due {
+		remoteURL, err := app.syndicate(s)
+		if err != nil {
+			s.Attempts++
+			status := syndicationPending
+			if s.Attempts >= syndicationMaxAttempts {
+				status = syndicationFailed
+			}
+			// Back off exponentially between attempts
+			next := now.Add(syndicationRetryDelay << (s.Attempts - 1))
+			slog.Error("Failed to cross-post", "slug", s.Slug, "target", s.Target, "attempt", s.Attempts, "error", err)
+			_, dbErr := app.DB.ExecContext(ctx, `
+				UPDATE syndications SET status = ?, attempts = ?, last_error = ?, next_attempt_at = ?, updated_at = ?
+				WHERE slug = ? AND target = ?
+			`, status, s.Attempts, err.Error(), next, now, s.Slug, s.Target)
+			if dbErr != nil {
+				return fmt.Errorf("failed to update syndication: %w", dbErr)
+			}
+			continue
+		}
+
+		slog.Info("Cross-posted", "slug", s.Slug, "target", s.Target, "url", remoteURL)
+		_, err = app.DB.ExecContext(ctx, `
+			UPDATE syndications SET status = ?, attempts = attempts + 1, remote_url = ?, last_error = '', updated_at = ?
+			WHERE slug = ? AND target = ?
+		`, syndicationDone, remoteURL, now, s.Slug, s.Target)
+		if err != nil {
+			return fmt.Errorf("failed to update syndication: %w", err)
+		}
+	}
+	return nil
+}
+
+// syndicate publishes one post to one platform
+func (app *App) syndicate(s Syndication) (string, error) {
+	target, ok := syndicationTarget(app.Config, s.Target)
+	if !ok {
+		return "", fmt.Errorf("%s is not configured", s.Target)
+	}
+	// The canonical URL is on the site the post was saved on
+	site := app.siteForURL(s.CanonicalURL)
+	post, ok := site.Blog().PostBySlug(site.unkey(s.Slug))
+	if !ok {
+		return "", fmt.Errorf("post not found: %s", s.Slug)
+	}
+
+	source, err := os.ReadFile(post.FileName)
+	if err != nil {
+		return "", fmt.Errorf("failed to read post: %w", err)
+	}
+	// Strip the frontmatter, the platforms take the title separately
+	markdown := string(source)
+	if parts := strings.SplitN(markdown, "---\n", 3); len(parts) == 3 {
+		markdown = strings.TrimSpace(parts[2])
+	}
+
+	return target.publish(app.Config, post, markdown, s.CanonicalURL)
+}
+
+// postJSON sends a JSON request and decodes the JSON response
+func postJSON(url string, headers map[string]string, body, result any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := syndicationClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// publishDevTo creates a published article on DEV
+func publishDevTo(cfg Config, post Post, markdown, canonicalURL string) (string, error) {
+	var result struct {
+		URL string `json:"url"`
+	}
+	err := postJSON("https://dev.to/api/articles", map[string]string{"api-key": cfg.DevtoAPIKey}, map[string]any{
+		"article": map[string]any{
+			"title":         post.Title,
+			"body_markdown": markdown,
+			"description":   post.Description,
+			"canonical_url": canonicalURL,
+			"published":     true,
+		},
+	}, &result)
+	return result.URL, err
+}
+
+// publishMedium creates a public story for the token's owner on Medium
+func publishMedium(cfg Config, post Post, markdown, canonicalURL string) (string, error) {
+	auth := map[string]string{"Authorization": "Bearer " + cfg.MediumToken}
+
+	req, err := http.NewRequest(http.MethodGet, "https://api.medium.com/v1/me", nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", auth["Authorization"])
+	resp, err := syndicationClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up medium user: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to look up medium user: %s", resp.Status)
+	}
+	var me struct {
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&me); err != nil {
+		return "", fmt.Errorf("failed to decode medium user: %w", err)
+	}
+
+	var result struct {
+		Data struct {
+			URL string `json:"url"`
+		} `json:"data"`
+	}
+	err = postJSON("https://api.medium.com/v1/users/"+me.Data.ID+"/posts", auth, map[string]any{
+		"title":         post.Title,
+		"contentFormat": "markdown",
+		"content":       "# " + post.Title + "\n\n" + markdown,
+		"canonicalUrl":  canonicalURL,
+		"publishStatus": "public",
+	}, &result)
+	return result.Data.URL, err
+}
+
+// publishMastodon posts a status linking to the post
+func publishMastodon(cfg Config, post Post, markdown, canonicalURL string) (string, error) {
+	status := post.Title
+	if post.Description != "" {
+		status += "\n\n" + post.Description
+	}
+	status += "\n\n" + canonicalURL
+
+	var result struct {
+		URL string `json:"url"`
+	}
+	err := postJSON(strings.TrimSuffix(cfg.MastodonURL, "/")+"/api/v1/statuses", map[string]string{
+		"Authorization": "Bearer " + cfg.MastodonToken,
+		// Stops a retry after a lost response from posting twice
+		"Idempotency-Key": "tulip-" + post.Slug,
+	}, map[string]any{"status": status}, &result)
+	return result.URL, err
+}
+
+// handleAdminRetrySyndication requeues a failed cross-post
+func (app *App) handleAdminRetrySyndication(w http.ResponseWriter, r *http.Request, user *User) error {
+	slug, target := r.FormValue("slug"), r.FormValue("target")
+	if slug == "" || target == "" {
+		return NewHTTPError(fmt.Errorf("missing slug or target"), http.StatusBadRequest)
+	}
+	if err := app.RetrySyndication(r.Context(), slug, target); err != nil {
+		return err
+	}
+
+	if err := app.Audit(r.Context(), *user, nil, "syndication.retry", slug+" to "+target); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+	return nil
+}
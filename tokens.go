@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiTokenPrefix starts every API token, so leaked tokens are easy to spot
+const apiTokenPrefix = "tulip_"
+
+// tokenTouchInterval limits how often a token's last used time is written
+const tokenTouchInterval = time.Minute
+
+var (
+	errInvalidToken  = errors.New("invalid or expired API token")
+	errTokenNotFound = errors.New("token not found")
+)
+
+// APIScope is a permission an API token can be granted
+type APIScope struct {
+	Name        string
+	Description string
+}
+
+// apiScopes are the scopes tokens can have, in the order they're shown
+var apiScopes = []APIScope{
+	{Name: "devices:read", Description: "List your devices"},
+	{Name: "devices:write", Description: "Register devices and report their heartbeats, facts and metrics"},
+	{Name: "media:write", Description: "Upload images for posts (admins only)"},
+	{Name: "admin:act-as", Description: "Act as another user with X-Acting-As (admins only)"},
+}
+
+// validScope reports whether a scope exists
+func validScope(name string) bool {
+	return slices.ContainsFunc(apiScopes, func(s APIScope) bool { return s.Name == name })
+}
+
+// tokenExpiries are the lifetimes offered when creating a token. Zero never
+// expires.
+var tokenExpiries = []struct {
+	Label    string
+	Duration time.Duration
+}{
+	{"30 days", 30 * 24 * time.Hour},
+	{"90 days", 90 * 24 * time.Hour},
+	{"1 year", 365 * 24 * time.Hour},
+	{"Never", 0},
+}
+
+// APIToken is a personal access token for programmatic access. Only a hash
+// of the token is stored.
+type APIToken struct {
+	ID         int64
+	UserID     int64
+	Name       string
+	Prefix     string
+	Scopes     []string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	ExpiresAt  time.Time
+}
+
+// HasScope reports whether the token was granted a scope
+func (t APIToken) HasScope(scope string) bool {
+	return slices.Contains(t.Scopes, scope)
+}
+
+// Expired reports whether the token has expired
+func (t APIToken) Expired() bool {
+	return !t.ExpiresAt.IsZero() && time.Now().After(t.ExpiresAt)
+}
+
+// hashAPIToken returns the stored form of a token
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIToken mints a token for a user and returns it. The token can't
+// be recovered later.
+func (app *App) CreateAPIToken(ctx context.Context, userID int64, name string, scopes []string, lifetime time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	random, err := generateRandomToken(20)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	token := apiTokenPrefix + random
+
+	var expiresAt sql.NullTime
+	if lifetime > 0 {
+		expiresAt = sql.NullTime{Time: time.Now().Add(lifetime), Valid: true}
+	}
+	_, err = app.DB.ExecContext(ctx,
+		"INSERT INTO api_tokens (user_id, name, token_hash, prefix, scopes, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		userID, name, hashAPIToken(token), token[:len(apiTokenPrefix)+4], strings.Join(scopes, " "), expiresAt,
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to create api token: %w", err)
+	}
+	return token, nil
+}
+
+// apiTokenColumns are scanned by scanAPIToken
+const apiTokenColumns = "id, user_id, name, prefix, scopes, created_at, last_used_at, expires_at"
+
+// scanAPIToken reads a row of apiTokenColumns
+func scanAPIToken(row interface{ Scan(...any) error }) (APIToken, error) {
+	var t APIToken
+	var scopes string
+	var lastUsed, expires sql.NullTime
+	if err := row.Scan(&t.ID, &t.UserID, &t.Name, &t.Prefix, &scopes, &t.CreatedAt, &lastUsed, &expires); err != nil {
+		return APIToken{}, err
+	}
+	t.Scopes = strings.Fields(scopes)
+	t.LastUsedAt = lastUsed.Time
+	t.ExpiresAt = expires.Time
+	return t, nil
+}
+
+// GetAPITokens returns a user's tokens, newest first
+func (app *App) GetAPITokens(ctx context.Context, userID int64) ([]APIToken, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	rows, err := app.DB.QueryContext(ctx, "SELECT "+apiTokenColumns+" FROM api_tokens WHERE user_id = ? ORDER BY created_at DESC, id DESC", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query api tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan api token row: %w", err)
+		}
+		tokens = append(tokens, t)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating api token rows: %w", err)
+	}
+	return tokens, nil
+}
+
+// LookupAPIToken returns the token and its owner, recording that it was used
+func (app *App) LookupAPIToken(ctx context.Context, token string) (APIToken, User, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	t, err := scanAPIToken(app.DB.QueryRowContext(ctx, "SELECT "+apiTokenColumns+" FROM api_tokens WHERE token_hash = ?", hashAPIToken(token)))
+	if err == sql.ErrNoRows {
+		return APIToken{}, User{}, errInvalidToken
+	} else if err != nil {
+		return APIToken{}, User{}, fmt.Errorf("failed to query api token: %w", err)
+	}
+	if t.Expired() {
+		return APIToken{}, User{}, errInvalidToken
+	}
+
+	if now := time.Now(); now.Sub(t.LastUsedAt) > tokenTouchInterval {
+		if _, err := app.DB.ExecContext(ctx, "UPDATE api_tokens SET last_used_at = ? WHERE id = ?", now, t.ID); err != nil {
+			return APIToken{}, User{}, fmt.Errorf("failed to update api token: %w", err)
+		}
+		t.LastUsedAt = now
+	}
+
+	user, err := app.GetUserByID(ctx, t.UserID)
+	if err != nil {
+		return APIToken{}, User{}, err
+	}
+	if !user.DeleteAfter.IsZero() {
+		return APIToken{}, User{}, errInvalidToken
+	}
+	return t, user, nil
+}
+
+// DeleteAPIToken revokes one of a user's tokens
+func (app *App) DeleteAPIToken(ctx context.Context, userID, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	result, err := app.DB.ExecContext(ctx, "DELETE FROM api_tokens WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete api token: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to delete api token: %w", err)
+	} else if n == 0 {
+		return errTokenNotFound
+	}
+	return nil
+}
+
+// Auth is who made a request and how
+type Auth struct {
+	// User is whose data the request sees and changes
+	User User
+	// Actor is who made the request. It's User unless an admin sent
+	// X-Acting-As.
+	Actor User
+	// Token is set when the request used an API token rather than a session
+	Token *APIToken
+}
+
+// Can reports whether the request may use a scope. Sessions can do
+// anything the user can.
+func (a Auth) Can(scope string) bool {
+	return a.Token == nil || a.Token.HasScope(scope)
+}
+
+// bearerToken returns the token from an Authorization: Bearer header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// hasBearerToken reports whether a request authenticates with a token.
+// Browsers never add the header on their own, so these requests don't need
+// CSRF protection.
+func hasBearerToken(r *http.Request) bool {
+	_, ok := bearerToken(r)
+	return ok
+}
+
+// authenticateRequest identifies the user behind a JSON API request, from
+// an Authorization: Bearer token if there is one and the session cookie
+// otherwise. It returns a 401 HTTPError when neither works. Admins can
+// act as another user with X-Acting-As, see actAs.
+func (app *App) authenticateRequest(w http.ResponseWriter, r *http.Request) (Auth, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		user, err := app.getCurrentUser(r)
+		if err != nil {
+			return Auth{}, NewHTTPError(fmt.Errorf("login required"), http.StatusUnauthorized)
+		}
+		return app.actAs(w, r, Auth{User: user})
+	}
+
+	t, user, err := app.LookupAPIToken(r.Context(), token)
+	if errors.Is(err, errInvalidToken) {
+		// Failed attempts count against the address so tokens can't be
+		// guessed
+		if err := app.checkRateLimit(w, r, verifyIPLimit, clientIP(r).String()); err != nil {
+			return Auth{}, err
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		return Auth{}, NewHTTPError(err, http.StatusUnauthorized)
+	} else if err != nil {
+		return Auth{}, err
+	}
+
+	setRequestUser(r, user.ID)
+	return app.actAs(w, r, Auth{User: user, Token: &t})
+}
+
+// requireScope returns a 403 HTTPError if the request can't use a scope
+func requireScope(auth Auth, scope string) error {
+	if !auth.Can(scope) {
+		return NewHTTPError(fmt.Errorf("this token doesn't have the %s scope", scope), http.StatusForbidden)
+	}
+	return nil
+}
+
+// TokensPage holds data for the API tokens template
+type TokensPage struct {
+	Meta     PageMeta
+	Tokens   []APIToken
+	Scopes   []APIScope
+	Expiries []string
+	// NewToken is shown once, right after it's created
+	NewToken string
+	Error    string
+}
+
+// handleTokenSettings lists, creates and revokes the user's API tokens
+func (app *App) handleTokenSettings(w http.ResponseWriter, r *http.Request, count int, user *User) error {
+	page := TokensPage{
+		Meta: PageMeta{
+			Title: "API tokens",
+			Count: count,
+			User:  user,
+
+			CSRFToken: csrfToken(r),
+		},
+		Scopes: apiScopes,
+	}
+	for _, e := range tokenExpiries {
+		page.Expiries = append(page.Expiries, e.Label)
+	}
+
+	switch {
+	case r.URL.Path == "/settings/tokens" && r.Method == http.MethodGet:
+	case r.URL.Path == "/settings/tokens/create" && r.Method == http.MethodPost:
+		name := strings.TrimSpace(r.FormValue("name"))
+		scopes := r.Form["scope"]
+		lifetime := time.Duration(-1)
+		for _, e := range tokenExpiries {
+			if e.Label == r.FormValue("expires") {
+				lifetime = e.Duration
+			}
+		}
+
+		switch {
+		case name == "" || len(name) > 100:
+			page.Error = "Give the token a name of up to 100 characters."
+		case len(scopes) == 0:
+			page.Error = "Choose at least one scope."
+		case slices.ContainsFunc(scopes, func(s string) bool { return !validScope(s) }):
+			page.Error = "Unknown scope."
+		case lifetime < 0:
+			page.Error = "Choose when the token expires."
+		default:
+			token, err := app.CreateAPIToken(r.Context(), user.ID, name, scopes, lifetime)
+			if err != nil {
+				return err
+			}
+			if err := app.Audit(r.Context(), *user, user, "token.create", fmt.Sprintf("%s (%s)", name, strings.Join(scopes, ", "))); err != nil {
+				return err
+			}
+			page.NewToken = token
+		}
+	case r.URL.Path == "/settings/tokens/revoke" && r.Method == http.MethodPost:
+		id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if err != nil {
+			return NewHTTPError(fmt.Errorf("invalid token id"), http.StatusBadRequest)
+		}
+		if err := app.DeleteAPIToken(r.Context(), user.ID, id); errors.Is(err, errTokenNotFound) {
+			return NewHTTPError(err, http.StatusNotFound)
+		} else if err != nil {
+			return err
+		}
+		if err := app.Audit(r.Context(), *user, user, "token.revoke", fmt.Sprintf("token %d", id)); err != nil {
+			return err
+		}
+		http.Redirect(w, r, "/settings/tokens", http.StatusSeeOther)
+		return nil
+	default:
+		return app.notFound(w, r)
+	}
+
+	var err error
+	if page.Tokens, err = app.GetAPITokens(r.Context(), user.ID); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	// The new token is in the page, keep it out of caches
+	w.Header().Set("Cache-Control", "no-store")
+	if err := app.render(w, r, http.StatusOK, "tokens.html", page); err != nil {
+		return fmt.Errorf("failed to render tokens page: %w", err)
+	}
+	return nil
+}
+
+// APIDevice is a device as returned by the JSON API
+type APIDevice struct {
+	ID         int64      `json:"id"`
+	Hostname   string     `json:"hostname"`
+	Name       string     `json:"name"`
+	Type       string     `json:"type"`
+	Notes      string     `json:"notes"`
+	Tags       []string   `json:"tags"`
+	OS         string     `json:"os"`
+	Arch       string     `json:"arch"`
+	IP         string     `json:"ip"`
+	LastSeenAt *time.Time `json:"last_seen_at"`
+	Online     bool       `json:"online"`
+}
+
+// apiDevice converts a device for the JSON API
+func apiDevice(d Device) APIDevice {
+	result := APIDevice{
+		ID:       d.ID,
+		Hostname: d.Hostname,
+		Name:     d.Name,
+		Type:     d.DeviceType,
+		Notes:    d.Notes,
+		Tags:     d.Tags,
+		OS:       d.OS,
+		Arch:     d.Architecture,
+		IP:       d.IP,
+		Online:   d.Online(),
+	}
+	if result.Tags == nil {
+		result.Tags = []string{}
+	}
+	if !d.LastSeenAt.IsZero() {
+		result.LastSeenAt = &d.LastSeenAt
+	}
+	return result
+}
+
+// handleAPIDevices lists the user's devices at GET /api/devices
+func (app *App) handleAPIDevices(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return NewHTTPError(fmt.Errorf("method not allowed"), http.StatusMethodNotAllowed)
+	}
+	auth, err := app.authenticateRequest(w, r)
+	if err != nil {
+		return err
+	}
+	if err := requireScope(auth, "devices:read"); err != nil {
+		return err
+	}
+
+	devices, err := app.GetDevices(r.Context(), auth.User.ID)
+	if err != nil {
+		return err
+	}
+	result := make([]APIDevice, 0, len(devices))
+	for _, d := range devices {
+		result = append(result, apiDevice(d))
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return writeJSON(w, result)
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"rsc.io/qr"
+)
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is how many periods either side of now are accepted, to allow
+	// for clock drift
+	totpSkew = 1
+
+	backupCodeCount = 10
+
+	twoFactorCookieName = "tulip_2fa"
+	pendingLoginTTL     = 5 * time.Minute
+	// pendingLoginAttempts is how many wrong codes end a pending login
+	pendingLoginAttempts = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode computes the RFC 6238 code for a time step
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// verifyTOTP checks a code against the steps around now. It returns the
+// matching step so it can't be used again.
+func verifyTOTP(secret []byte, code string, now time.Time, lastStep int64) (int64, bool) {
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// normalizeCode strips the spaces and dashes people type in codes
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(code)))
+}
+
+// TOTP is a user's authenticator enrollment
+type TOTP struct {
+	Secret   []byte
+	Enabled  bool
+	LastStep int64
+}
+
+// GetTOTP returns the user's enrollment, or a zero TOTP if they have none
+func (app *App) GetTOTP(ctx context.Context, userID int64) (TOTP, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var sealed []byte
+	var t TOTP
+	err := app.DBFrom(ctx).QueryRowContext(ctx,
+		"SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE id = ?",
+		userID,
+	).Scan(&sealed, &t.Enabled, &t.LastStep)
+	if err != nil {
+		return TOTP{}, fmt.Errorf("failed to query totp: %w", err)
+	}
+	if len(sealed) == 0 {
+		return TOTP{}, nil
+	}
+	if t.Secret, err = decryptSecret(app.Config.EncryptionKey, sealed); err != nil {
+		return TOTP{}, err
+	}
+	return t, nil
+}
+
+// StartTOTPEnrollment stores a new secret for the user, which isn't required
+// at login until it's confirmed with a code
+func (app *App) StartTOTPEnrollment(ctx context.Context, userID int64) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate totp secret: %w", err)
+	}
+	sealed, err := encryptSecret(app.Config.EncryptionKey, secret)
+	if err != nil {
+		return nil, err
+	}
+	_, err = app.DB.ExecContext(ctx,
+		"UPDATE users SET totp_secret = ?, totp_enabled = 0, totp_last_step = 0 WHERE id = ? AND totp_enabled = 0",
+		sealed, userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save totp secret: %w", err)
+	}
+	return secret, nil
+}
+
+// EnableTOTP turns on two-factor login and returns new backup codes
+func (app *App) EnableTOTP(ctx context.Context, userID, step int64) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	codes := make([]string, backupCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("failed to generate backup code: %w", err)
+		}
+		code := hex.EncodeToString(b)
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+
+	tx, err := app.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET totp_enabled = 1, totp_last_step = ? WHERE id = ?", step, userID); err != nil {
+		return nil, fmt.Errorf("failed to enable totp: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM backup_codes WHERE user_id = ?", userID); err != nil {
+		return nil, fmt.Errorf("failed to delete backup codes: %w", err)
+	}
+	for _, code := range codes {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO backup_codes (user_id, code_hash) VALUES (?, ?)", userID, hashBackupCode(code)); err != nil {
+			return nil, fmt.Errorf("failed to save backup code: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return codes, nil
+}
+
+// DisableTOTP turns off two-factor login and forgets the secret
+func (app *App) DisableTOTP(ctx context.Context, userID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	if _, err := app.DB.ExecContext(ctx, "UPDATE users SET totp_secret = NULL, totp_enabled = 0, totp_last_step = 0 WHERE id = ?", userID); err != nil {
+		return fmt.Errorf("failed to disable totp: %w", err)
+	}
+	if _, err := app.DB.ExecContext(ctx, "DELETE FROM backup_codes WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to delete backup codes: %w", err)
+	}
+	return nil
+}
+
+// hashBackupCode hashes a backup code for storage. The codes are random, so
+// a fast hash is enough.
+func hashBackupCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// CountBackupCodes returns how many unused backup codes the user has
+func (app *App) CountBackupCodes(ctx context.Context, userID int64) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var count int
+	err := app.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM backup_codes WHERE user_id = ? AND used_at IS NULL", userID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count backup codes: %w", err)
+	}
+	return count, nil
+}
+
+// checkSecondFactor verifies a TOTP or backup code for the user, marking it
+// used so it can't be replayed
+func (app *App) checkSecondFactor(ctx context.Context, userID int64, code string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	t, err := app.GetTOTP(context.Background(), userID)
+	if err != nil {
+		return false, err
+	}
+	if !t.Enabled {
+		return false, nil
+	}
+
+	code = normalizeCode(code)
+	if len(code) == totpDigits {
+		step, ok := verifyTOTP(t.Secret, code, time.Now(), t.LastStep)
+		if !ok {
+			return false, nil
+		}
+		// Only advance, in case two logins race
+		result, err := app.DB.ExecContext(ctx, "UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?", step, userID, step)
+		if err != nil {
+			return false, fmt.Errorf("failed to record totp use: %w", err)
+		}
+		n, err := result.RowsAffected()
+		return n == 1, err
+	}
+
+	result, err := app.DB.ExecContext(ctx,
+		"UPDATE backup_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		time.Now(), userID, hashBackupCode(code),
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to use backup code: %w", err)
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// totpURI is the otpauth:// provisioning URI authenticator apps scan
+func totpURI(secret []byte, email string) string {
+	v := url.Values{}
+	v.Set("secret", totpEncoding.EncodeToString(secret))
+	v.Set("issuer", "Tulip")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape("Tulip:"+email) + "?" + v.Encode()
+}
+
+// qrSVG renders text as a QR code in SVG
+func qrSVG(text string) (template.HTML, error) {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode qr code: %w", err)
+	}
+
+	// Leave the four module quiet zone scanners need
+	const border = 4
+	var path strings.Builder
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if code.Black(x, y) {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x+border, y+border)
+			}
+		}
+	}
+	size := code.Size + 2*border
+	return template.HTML(fmt.Sprintf(
+		`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="200" height="200" shape-rendering="crispEdges"><rect width="100%%" height="100%%" fill="#fff"/><path d="%s" fill="#000"/></svg>`,
+		size, size, path.String(),
+	)), nil
+}
+
+// completeLogin finishes a first-factor login. Users with two-factor login
+// enabled are sent to enter a code before they get a session.
+func (app *App) completeLogin(w http.ResponseWriter, r *http.Request, user User, method string) error {
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	t, err := app.GetTOTP(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	if t.Enabled {
+		token, err := generateRandomToken(32)
+		if err != nil {
+			return fmt.Errorf("failed to generate token: %w", err)
+		}
+		_, err = app.DBFrom(ctx).ExecContext(ctx,
+			"INSERT INTO pending_logins (token, user_id, method, expires_at) VALUES (?, ?, ?, ?)",
+			token, user.ID, method, time.Now().Add(pendingLoginTTL),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to save pending login: %w", err)
+		}
+		setTwoFactorCookie(w, token, int(pendingLoginTTL.Seconds()))
+
+		slog.InfoContext(ctx, "Login awaiting second factor", "user_id", user.ID, "method", method)
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return nil
+	}
+
+	if err := app.startSession(w, r, user); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "User logged in", "user_id", user.ID, "email", user.Email, "method", method)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
+
+// setTwoFactorCookie stores the pending login token for the code form
+func setTwoFactorCookie(w http.ResponseWriter, token string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     twoFactorCookieName,
+		Value:    token,
+		Path:     "/login/2fa",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   maxAge,
+	})
+}
+
+// TwoFactorPage holds data for the login code template
+type TwoFactorPage struct {
+	Meta  PageMeta
+	Error string
+}
+
+// handleTwoFactorLogin asks for the code after the first factor and starts
+// the session once it's right
+func (app *App) handleTwoFactorLogin(w http.ResponseWriter, r *http.Request, count int) error {
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+	page := TwoFactorPage{
+		Meta: PageMeta{
+			Title: "Two-factor authentication",
+			Count: count,
+
+			CSRFToken: csrfToken(r),
+		},
+	}
+
+	cookie, err := r.Cookie(twoFactorCookieName)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+	var userID int64
+	var method string
+	var attempts int
+	var expiresAt time.Time
+	err = app.DB.QueryRowContext(ctx,
+		"SELECT user_id, method, attempts, expires_at FROM pending_logins WHERE token = ?",
+		cookie.Value,
+	).Scan(&userID, &method, &attempts, &expiresAt)
+	if err == sql.ErrNoRows || (err == nil && (time.Now().After(expiresAt) || attempts >= pendingLoginAttempts)) {
+		setTwoFactorCookie(w, "", -1)
+		http.Redirect(w, r, "/login?error=invalid_token", http.StatusSeeOther)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to query pending login: %w", err)
+	}
+
+	if r.Method == http.MethodPost {
+		if err := app.checkRateLimit(w, r, verifyIPLimit, clientIP(r).String()); err != nil {
+			return err
+		}
+
+		ok, err := app.checkSecondFactor(ctx, userID, r.FormValue("code"))
+		if err != nil {
+			return err
+		}
+		if ok {
+			// The pending login is only used up once the session exists
+			user, err := app.GetUserByID(ctx, userID)
+			if err != nil {
+				return err
+			}
+			err = app.InTx(ctx, func(ctx context.Context) error {
+				if _, err := app.DBFrom(ctx).ExecContext(ctx, "DELETE FROM pending_logins WHERE token = ?", cookie.Value); err != nil {
+					return fmt.Errorf("failed to delete pending login: %w", err)
+				}
+				return app.startSession(w, r.WithContext(ctx), user)
+			})
+			if err != nil {
+				return err
+			}
+			setTwoFactorCookie(w, "", -1)
+			slog.InfoContext(ctx, "User logged in", "user_id", user.ID, "email", user.Email, "method", method, "two_factor", true)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return nil
+		}
+
+		if _, err := app.DB.ExecContext(ctx, "UPDATE pending_logins SET attempts = attempts + 1 WHERE token = ?", cookie.Value); err != nil {
+			return fmt.Errorf("failed to record attempt: %w", err)
+		}
+		slog.WarnContext(ctx, "Wrong two-factor code", "user_id", userID)
+		page.Error = "That code didn't work. Please try again."
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := app.render(w, r, http.StatusOK, "login_2fa.html", page); err != nil {
+		return fmt.Errorf("failed to render two-factor page: %w", err)
+	}
+	return nil
+}
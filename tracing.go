@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// traceBufferSize is how many finished spans can wait to be exported
+	// before new ones are dropped
+	traceBufferSize = 4096
+	// traceBatchSize and traceFlushInterval are how many spans are sent to
+	// the collector at once, and how long a smaller batch waits
+	traceBatchSize     = 512
+	traceFlushInterval = 5 * time.Second
+)
+
+// spanKind is a span's OTLP kind
+type spanKind int
+
+const (
+	spanInternal spanKind = 1
+	spanServer   spanKind = 2
+	spanClient   spanKind = 3
+)
+
+// Tracer exports spans as OpenTelemetry traces to an OTLP/HTTP collector.
+// Spans are only made inside a sampled trace, so a request that isn't
+// sampled costs a context lookup per query.
+type Tracer struct {
+	endpoint      string
+	header        http.Header
+	service       string
+	samplePercent int
+	// spans are finished spans waiting for StartTracing to export them
+	spans chan *Span
+}
+
+// newTracer sends traces to OTEL_EXPORTER_OTLP_ENDPOINT when TRACING is
+// on. It returns nil otherwise.
+func newTracer(cfg Config) (*Tracer, error) {
+	if !cfg.Tracing {
+		return nil, nil
+	}
+	u, err := url.Parse(cfg.OTLPEndpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_ENDPOINT must be set to the collector's URL for tracing")
+	}
+	header, err := otlpHeaders(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Tracer{
+		endpoint:      strings.TrimSuffix(cfg.OTLPEndpoint, "/") + "/v1/traces",
+		header:        header,
+		service:       cfg.OTelServiceName,
+		samplePercent: cfg.TraceSamplePercent,
+		spans:         make(chan *Span, traceBufferSize),
+	}, nil
+}
+
+// Span is a timed operation in a trace. A nil *Span is a span that isn't
+// being recorded, and all its methods do nothing. A span belongs to the
+// goroutine that started it.
+type Span struct {
+	tracer     *Tracer
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	name       string
+	kind       spanKind
+	start      time.Time
+	end        time.Time
+	attributes []otlpAttribute
+	err        string
+}
+
+type spanKey struct{}
+
+// spanFrom returns the span the context is in, if any
+func spanFrom(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// newSpan starts a span in a trace and returns a context carrying it
+func (t *Tracer) newSpan(ctx context.Context, traceID [16]byte, parentID [8]byte, name string, kind spanKind, attrs []otlpAttribute) (context.Context, *Span) {
+	span := &Span{
+		tracer:     t,
+		traceID:    traceID,
+		parentID:   parentID,
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: attrs,
+	}
+	// crypto/rand.Read never fails
+	rand.Read(span.spanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// sampled decides whether a new trace is recorded, going by
+// TRACE_SAMPLE_PERCENT
+func (t *Tracer) sampled() bool {
+	return t.samplePercent >= 100 || mathrand.IntN(100) < t.samplePercent
+}
+
+// startSpan starts a span as a child of the one in ctx. Outside a sampled
+// trace it returns a nil span, so work done there isn't recorded.
+func startSpan(ctx context.Context, name string, kind spanKind, attrs ...otlpAttribute) (context.Context, *Span) {
+	parent := spanFrom(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.newSpan(ctx, parent.traceID, parent.spanID, name, kind, attrs)
+}
+
+// startTrace starts a span for background work, like a job or reloading
+// posts. It's a child of the span in ctx if there is one, so a reload
+// started by a request shows up in the request's trace, and otherwise
+// starts a new trace if it's sampled.
+func (app *App) startTrace(ctx context.Context, name string, attrs ...otlpAttribute) (context.Context, *Span) {
+	if spanFrom(ctx) != nil {
+		return startSpan(ctx, name, spanInternal, attrs...)
+	}
+	if app.tracer == nil || !app.tracer.sampled() {
+		return ctx, nil
+	}
+	var traceID [16]byte
+	rand.Read(traceID[:])
+	return app.tracer.newSpan(ctx, traceID, [8]byte{}, name, spanInternal, attrs)
+}
+
+// SetAttributes adds attributes to the span
+func (s *Span) SetAttributes(attrs ...otlpAttribute) {
+	if s == nil {
+		return
+	}
+	s.attributes = append(s.attributes, attrs...)
+}
+
+// SetError marks the span as failed, if err isn't nil
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.err = err.Error()
+}
+
+// TraceID returns the span's trace ID in hex, as collectors show it
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// End finishes the span and queues it to be exported. If the queue is full
+// the span is dropped rather than holding up the work it timed.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	select {
+	case s.tracer.spans <- s:
+	default:
+	}
+}
+
+// StartTracing exports finished spans in the background, in batches, when
+// TRACING is on
+func (app *App) StartTracing() {
+	if app.tracer == nil {
+		return
+	}
+	slog.Info("Sending traces to OTLP collector", "endpoint", app.tracer.endpoint, "sample_percent", app.tracer.samplePercent)
+	go func() {
+		ticker := time.NewTicker(traceFlushInterval)
+		defer ticker.Stop()
+		var batch []*Span
+		for {
+			select {
+			case span := <-app.tracer.spans:
+				batch = append(batch, span)
+				if len(batch) < traceBatchSize {
+					continue
+				}
+			case <-ticker.C:
+				if len(batch) == 0 {
+					continue
+				}
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), errorReportClient.Timeout)
+			if err := app.tracer.export(ctx, batch); err != nil {
+				slog.Error("Failed to export traces", "error", err, "spans", len(batch))
+			}
+			cancel()
+			batch = nil
+		}
+	}()
+}
+
+// export sends spans to the collector in OTLP's JSON encoding
+func (t *Tracer) export(ctx context.Context, spans []*Span) error {
+	encoded := make([]map[string]any, 0, len(spans))
+	for _, s := range spans {
+		span := map[string]any{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        s.attributes,
+		}
+		if s.parentID != ([8]byte{}) {
+			span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != "" {
+			span["status"] = map[string]any{"code": 2, "message": scrubErrorText(s.err)}
+		}
+		encoded = append(encoded, span)
+	}
+	payload := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpAttribute{otlpString("service.name", t.service)},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "tulip"},
+				"spans": encoded,
+			}},
+		}},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode otlp traces: %w", err)
+	}
+	return postErrorReport(ctx, "otlp collector", t.endpoint, t.header, body)
+}
+
+// parseTraceparent reads a W3C traceparent header, like
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func parseTraceparent(header string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || parts[0] == "ff" || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, false, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == ([16]byte{}) {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == ([8]byte{}) {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+// traceRequests records a span for each sampled request. A request with a
+// traceparent header joins the caller's trace, and is recorded if the
+// caller's was.
+func (app *App) traceRequests(next http.Handler) http.Handler {
+	if app.tracer == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get("traceparent"))
+		if !ok {
+			rand.Read(traceID[:])
+			parentID, sampled = [8]byte{}, app.tracer.sampled()
+		}
+		if !sampled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Paths can have tokens in them, like unsubscribe links
+		path := scrubErrorText(r.URL.Path)
+		ctx, span := app.tracer.newSpan(r.Context(), traceID, parentID, r.Method+" "+path, spanServer, []otlpAttribute{
+			otlpString("http.request.method", r.Method),
+			otlpString("server.address", r.Host),
+			otlpString("url.path", path),
+			otlpString("user_agent.original", r.UserAgent()),
+		})
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			span.SetAttributes(
+				otlpInt("http.response.status_code", int64(rec.status)),
+				otlpString("request.id", w.Header().Get(requestIDHeader)),
+			)
+			if rec.status >= 500 {
+				span.SetError(errors.New(http.StatusText(rec.status)))
+			}
+			span.End()
+		}()
+		next.ServeHTTP(rec, r.WithContext(ctx))
+	})
+}
+
+// tracedConnector records a span for each query run inside a sampled trace
+type tracedConnector struct {
+	driver.Connector
+	// system is the db.system.name attribute, like "sqlite"
+	system string
+}
+
+func (c tracedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tracedConn{Conn: conn, system: c.system}, nil
+}
+
+// tracedConn passes everything through to the driver's connection, timing
+// queries and statements. Where the driver doesn't support something it
+// answers the way database/sql treats a driver without it.
+type tracedConn struct {
+	driver.Conn
+	system string
+}
+
+// startQuery starts a span named after the query's first keyword, like
+// SELECT
+func (c tracedConn) startQuery(ctx context.Context, query string) *Span {
+	text := strings.Join(strings.Fields(query), " ")
+	operation, _, _ := strings.Cut(text, " ")
+	_, span := startSpan(ctx, strings.ToUpper(operation), spanClient,
+		otlpString("db.system.name", c.system),
+		otlpString("db.query.text", text),
+	)
+	return span
+}
+
+func (c tracedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	span := c.startQuery(ctx, query)
+	res, err := execer.ExecContext(ctx, query, args)
+	if !errors.Is(err, driver.ErrSkip) {
+		span.SetError(err)
+	}
+	span.End()
+	return res, err
+}
+
+// QueryContext times how long the query takes to start returning rows,
+// not reading them
+func (c tracedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	span := c.startQuery(ctx, query)
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if !errors.Is(err, driver.ErrSkip) {
+		span.SetError(err)
+	}
+	span.End()
+	return rows, err
+}
+
+func (c tracedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c tracedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c tracedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c tracedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c tracedConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c tracedConn) CheckNamedValue(v *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(v)
+	}
+	return driver.ErrSkip
+}
+
+// dsnConnector connects with a driver that doesn't have its own Connector
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
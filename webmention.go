@@ -0,0 +1,699 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Webmention verification statuses. Whether a mention is shown is up to an
+// admin, see Webmention.Approved.
+const (
+	// webmentionPending is waiting for the source to be fetched
+	webmentionPending = "pending"
+	// webmentionVerified links to the post
+	webmentionVerified = "verified"
+	// webmentionRejected didn't link to the post, or couldn't be fetched
+	webmentionRejected = "rejected"
+)
+
+const (
+	// webmentionMaxBody is how much of a page is read when verifying a
+	// source or discovering an endpoint
+	webmentionMaxBody = 1 << 20
+	// webmentionMaxTitle is how long a source's title is kept
+	webmentionMaxTitle = 200
+)
+
+// webmentionIPLimit caps mentions received from one client
+var webmentionIPLimit = RateLimit{Name: "webmention-ip", Burst: 30, Per: time.Hour}
+
+// webmentionClient fetches other sites' pages. It won't connect to loopback
+// or private addresses, since anyone can ask for a source to be fetched.
+var webmentionClient = newWebmentionClient(false)
+
+// webmentionDevClient is webmentionClient for development, where the other
+// site is usually on the same machine
+var webmentionDevClient = newWebmentionClient(true)
+
+func newWebmentionClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if !allowPrivate {
+		dialer.Control = refusePrivateAddress
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   15 * time.Second,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return fmt.Errorf("too many redirects")
+			}
+			return nil
+		},
+	}
+}
+
+// refusePrivateAddress is a net.Dialer Control function that stops
+// connections to loopback, private, link-local and multicast addresses. It
+// runs after DNS resolution, so hostnames pointing at them are refused too.
+func refusePrivateAddress(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	ip := addrPort.Addr().Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("refusing to connect to %s", ip)
+	}
+	return nil
+}
+
+// webmentionHTTP returns the client for fetching other sites
+func (app *App) webmentionHTTP() *http.Client {
+	if app.Config.isDevelopment() {
+		return webmentionDevClient
+	}
+	return webmentionClient
+}
+
+// Webmention is a page on another site that links to one of the posts
+type Webmention struct {
+	ID     int64
+	Source string
+	// Slug is keyed to the post's site, see Site.key, and Target is the
+	// post's URL as the source linked it
+	Slug   string
+	Target string
+	// Title is the source page's title, if it has one
+	Title     string
+	Status    string
+	Approved  bool
+	LastError string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Host is the source's host name, for showing mentions without a title
+func (m Webmention) Host() string {
+	u, err := url.Parse(m.Source)
+	if err != nil {
+		return m.Source
+	}
+	return strings.TrimPrefix(u.Hostname(), "www.")
+}
+
+const webmentionColumns = "id, source, slug, target, title, status, approved, last_error, created_at, updated_at"
+
+func scanWebmention(row interface{ Scan(...any) error }) (Webmention, error) {
+	var m Webmention
+	err := row.Scan(&m.ID, &m.Source, &m.Slug, &m.Target, &m.Title, &m.Status, &m.Approved, &m.LastError, &m.CreatedAt, &m.UpdatedAt)
+	return m, err
+}
+
+// errWebmentionNotFound is returned for an unknown mention ID
+var errWebmentionNotFound = errors.New("webmention not found")
+
+// ReceiveWebmention queues a mention of a post for verification. A mention
+// that's sent again, because the source was updated or deleted, is checked
+// again but keeps its approval.
+func (app *App) ReceiveWebmention(ctx context.Context, source, slug, target string) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	now := time.Now()
+	_, err := app.DB.ExecContext(ctx, `
+		INSERT INTO webmentions (source, slug, target, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (source, slug) DO UPDATE SET target = excluded.target, status = excluded.status, updated_at = excluded.updated_at
+	`, source, slug, target, webmentionPending, now, now)
+	if err != nil {
+		return fmt.Errorf("failed to store webmention: %w", err)
+	}
+	// A mention sent again is hidden until it's checked again
+	app.mentionCache.Invalidate(ctx, slug)
+
+	select {
+	case app.webmentionWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// ListWebmentions returns the most recently received mentions of any post
+func (app *App) ListWebmentions(ctx context.Context, limit int) ([]Webmention, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	rows, err := app.DB.QueryContext(ctx, `
+		SELECT `+webmentionColumns+`
+		FROM webmentions
+		ORDER BY updated_at DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webmentions: %w", err)
+	}
+	return collectWebmentions(rows)
+}
+
+// PostWebmentions returns the verified and approved mentions of a post,
+// oldest first
+func (app *App) PostWebmentions(ctx context.Context, slug string) ([]Webmention, error) {
+	return app.mentionCache.Get(ctx, slug, func(ctx context.Context) ([]Webmention, error) {
+		return app.postWebmentions(ctx, slug)
+	})
+}
+
+func (app *App) postWebmentions(ctx context.Context, slug string) ([]Webmention, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	rows, err := app.DB.QueryContext(ctx, `
+		SELECT `+webmentionColumns+`
+		FROM webmentions
+		WHERE slug = ? AND status = ? AND approved
+		ORDER BY created_at
+	`, slug, webmentionVerified)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query post webmentions: %w", err)
+	}
+	return collectWebmentions(rows)
+}
+
+func collectWebmentions(rows *sql.Rows) ([]Webmention, error) {
+	defer rows.Close()
+	var mentions []Webmention
+	for rows.Next() {
+		m, err := scanWebmention(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webmention row: %w", err)
+		}
+		mentions = append(mentions, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating webmention rows: %w", err)
+	}
+	return mentions, nil
+}
+
+// ApproveWebmention shows a mention below its post once it's verified
+func (app *App) ApproveWebmention(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	res, err := app.DB.ExecContext(ctx, "UPDATE webmentions SET approved = ?, updated_at = ? WHERE id = ?", true, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("failed to approve webmention: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errWebmentionNotFound
+	}
+	app.mentionCache.Clear(ctx)
+	return nil
+}
+
+// DeleteWebmention removes a mention. The source can send it again, which
+// puts it back up for approval.
+func (app *App) DeleteWebmention(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	res, err := app.DB.ExecContext(ctx, "DELETE FROM webmentions WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete webmention: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errWebmentionNotFound
+	}
+	app.mentionCache.Clear(ctx)
+	return nil
+}
+
+// webmentionsVersion identifies a post's shown mentions for its ETag, and
+// returns when they last changed
+func webmentionsVersion(mentions []Webmention) (string, time.Time) {
+	h := sha256.New()
+	var latest time.Time
+	for _, m := range mentions {
+		fmt.Fprintf(h, "%d:%d\n", m.ID, m.UpdatedAt.UnixNano())
+		if m.UpdatedAt.After(latest) {
+			latest = m.UpdatedAt
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), latest
+}
+
+// VerifyPendingWebmentions fetches the source of each pending mention and
+// checks it still links to the post
+func (app *App) VerifyPendingWebmentions(ctx context.Context) error {
+	qctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	rows, err := app.DB.QueryContext(qctx, "SELECT id, source, target FROM webmentions WHERE status = ? ORDER BY updated_at", webmentionPending)
+	if err != nil {
+		return fmt.Errorf("failed to query pending webmentions: %w", err)
+	}
+	type pending struct {
+		id             int64
+		source, target string
+	}
+	var due []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.source, &p.target); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan webmention row: %w", err)
+		}
+		due = append(due, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating webmention rows: %w", err)
+	}
+
+	for _, p := range due {
+		status, lastError := webmentionVerified, ""
+		title, err := app.verifyWebmentionSource(ctx, p.source, p.target)
+		if err != nil {
+			status, lastError = webmentionRejected, err.Error()
+			slog.Info("Rejected webmention", "source", p.source, "target", p.target, "error", err)
+		}
+		_, err = app.DB.ExecContext(ctx,
+			"UPDATE webmentions SET status = ?, title = ?, last_error = ?, updated_at = ? WHERE id = ? AND status = ?",
+			status, title, lastError, time.Now(), p.id, webmentionPending,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update webmention: %w", err)
+		}
+	}
+	if len(due) > 0 {
+		app.mentionCache.Clear(ctx)
+	}
+	return nil
+}
+
+// StartWebmentionVerifier checks received mentions in the background, as
+// they come in and every minute in case one was missed
+func (app *App) StartWebmentionVerifier() {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			if err := app.VerifyPendingWebmentions(context.Background()); err != nil {
+				slog.Error("Failed to verify webmentions", "error", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-app.webmentionWake:
+			}
+		}
+	}()
+}
+
+// verifyWebmentionSource fetches the source and returns its title if it
+// links to target
+func (app *App) verifyWebmentionSource(ctx context.Context, source, target string) (string, error) {
+	resp, body, err := app.fetchPage(ctx, source)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("source returned %s", resp.Status)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		// Plain text and anything else only has to contain the URL
+		if !strings.Contains(body, target) {
+			return "", fmt.Errorf("source doesn't mention %s", target)
+		}
+		return "", nil
+	}
+
+	for _, link := range htmlLinks(body) {
+		if href, err := resp.Request.URL.Parse(link.Href); err == nil && sameURL(href.String(), target) {
+			return pageTitle(body), nil
+		}
+	}
+	return "", fmt.Errorf("source doesn't link to %s", target)
+}
+
+// fetchPage GETs a page on another site, reading up to webmentionMaxBody
+// of it
+func (app *App) fetchPage(ctx context.Context, pageURL string) (*http.Response, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "text/html, */*;q=0.5")
+	resp, err := app.webmentionHTTP().Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch %s: %w", pageURL, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, webmentionMaxBody))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read %s: %w", pageURL, err)
+	}
+	return resp, string(body), nil
+}
+
+// sameURL compares two URLs ignoring their fragments and a trailing slash
+func sameURL(a, b string) bool {
+	normalize := func(s string) string {
+		s, _, _ = strings.Cut(s, "#")
+		return strings.TrimSuffix(s, "/")
+	}
+	return normalize(a) == normalize(b)
+}
+
+var (
+	htmlLinkTag   = regexp.MustCompile(`(?is)<(a|link)\s[^>]*>`)
+	htmlAttribute = regexp.MustCompile(`(?is)([a-z-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+	htmlTitle     = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+)
+
+// htmlLink is an a or link element
+type htmlLink struct {
+	Tag  string
+	Rel  []string
+	Href string
+}
+
+// htmlLinks returns the a and link elements in a page that have an href, in
+// document order. It's a scan for tags rather than a full parse, which is
+// enough for finding links.
+func htmlLinks(page string) []htmlLink {
+	var links []htmlLink
+	for _, tag := range htmlLinkTag.FindAllStringSubmatch(page, -1) {
+		link := htmlLink{Tag: strings.ToLower(tag[1])}
+		hasHref := false
+		for _, attr := range htmlAttribute.FindAllStringSubmatch(tag[0], -1) {
+			value := html.UnescapeString(attr[2] + attr[3] + attr[4])
+			switch strings.ToLower(attr[1]) {
+			case "href":
+				link.Href, hasHref = strings.TrimSpace(value), true
+			case "rel":
+				link.Rel = strings.Fields(strings.ToLower(value))
+			}
+		}
+		if hasHref {
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// pageTitle returns a page's title, shortened to webmentionMaxTitle
+func pageTitle(page string) string {
+	m := htmlTitle.FindStringSubmatch(page)
+	if m == nil {
+		return ""
+	}
+	return truncate(strings.Join(strings.Fields(html.UnescapeString(m[1])), " "), webmentionMaxTitle)
+}
+
+// handleWebmention receives webmentions: a form POST with the source page
+// that links here and the target post it links to. The source is verified
+// in the background, so a valid request gets 202 Accepted.
+func (app *App) handleWebmention(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return methodNotAllowed(w, r, []string{http.MethodPost})
+	}
+	if err := app.checkRateLimit(w, r, webmentionIPLimit, clientIP(r).String()); err != nil {
+		return err
+	}
+
+	source, target := r.PostFormValue("source"), r.PostFormValue("target")
+	sourceURL, err := url.Parse(source)
+	if err != nil || (sourceURL.Scheme != "http" && sourceURL.Scheme != "https") || sourceURL.Host == "" {
+		return NewHTTPError(fmt.Errorf("source must be an http or https URL"), http.StatusBadRequest)
+	}
+	targetURL, err := url.Parse(target)
+	if err != nil || (targetURL.Scheme != "http" && targetURL.Scheme != "https") || targetURL.Host == "" {
+		return NewHTTPError(fmt.Errorf("target must be an http or https URL"), http.StatusBadRequest)
+	}
+	if sameURL(source, target) {
+		return NewHTTPError(fmt.Errorf("source and target must be different pages"), http.StatusBadRequest)
+	}
+	if !app.isOwnHost(r, targetURL.Host) {
+		return NewHTTPError(fmt.Errorf("target must be a page on %s", r.Host), http.StatusBadRequest)
+	}
+
+	slug, ok := strings.CutPrefix(strings.TrimSuffix(targetURL.Path, "/"), "/blog/")
+	if !ok || slug == "" {
+		return NewHTTPError(fmt.Errorf("target must be a blog post"), http.StatusBadRequest)
+	}
+	site := app.siteForHost(targetURL.Host)
+	if _, ok := site.Blog().PostBySlug(slug); !ok {
+		// Links to a post from before its slug changed still count
+		newSlug, found, err := app.SlugRedirect(r.Context(), site, slug)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return NewHTTPError(fmt.Errorf("target post not found: %s", targetURL.Path), http.StatusBadRequest)
+		}
+		slug = newSlug
+	}
+
+	if err := app.ReceiveWebmention(r.Context(), source, site.key(slug), target); err != nil {
+		return err
+	}
+	slog.InfoContext(r.Context(), "Received webmention", "source", source, "slug", slug)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "Accepted, the source will be checked for a link to the target.")
+	return nil
+}
+
+// isOwnHost reports whether host is one of the sites served here, by
+// SITE_URL, SITES_ or the host the request came in on
+func (app *App) isOwnHost(r *http.Request, host string) bool {
+	if strings.EqualFold(host, r.Host) || app.siteForHost(host) != app.defaultSite() {
+		return true
+	}
+	if site, err := url.Parse(app.Config.SiteURL); err == nil && site.Host != "" {
+		return strings.EqualFold(host, site.Host)
+	}
+	return false
+}
+
+// handleAdminWebmention approves or deletes a received mention
+func (app *App) handleAdminWebmention(w http.ResponseWriter, r *http.Request, user *User) error {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		return NewHTTPError(fmt.Errorf("invalid webmention id"), http.StatusBadRequest)
+	}
+
+	action, verb := app.ApproveWebmention, "approve"
+	if r.URL.Path == "/admin/webmentions/delete" {
+		action, verb = app.DeleteWebmention, "delete"
+	}
+	if err := action(r.Context(), id); errors.Is(err, errWebmentionNotFound) {
+		return NewHTTPError(err, http.StatusNotFound)
+	} else if err != nil {
+		return err
+	}
+
+	if err := app.Audit(r.Context(), *user, nil, "webmention."+verb, fmt.Sprintf("webmention %d", id)); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+	return nil
+}
+
+// sendWebmentions tells the sites a newly saved post links to about it.
+// Each link is only sent once, so redelivery and later edits don't send
+// again. Failures to reach the other site are recorded and not retried,
+// since most sites don't take webmentions at all.
+func (app *App) sendWebmentions(ctx context.Context, e Event) error {
+	var saved PostSavedEvent
+	if err := json.Unmarshal(e.Payload, &saved); err != nil {
+		return fmt.Errorf("failed to decode event: %w", err)
+	}
+	site := app.siteForURL(saved.URL)
+	post, ok := site.Blog().PostBySlug(saved.Slug)
+	if !ok {
+		return nil
+	}
+	source, err := url.Parse(saved.URL)
+	if err != nil {
+		return fmt.Errorf("invalid post url %q: %w", saved.URL, err)
+	}
+
+	seen := make(map[string]bool)
+	for _, link := range htmlLinks(string(post.Content)) {
+		target, err := source.Parse(link.Href)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || strings.EqualFold(target.Host, source.Host) {
+			continue
+		}
+		target.Fragment = ""
+		if seen[target.String()] {
+			continue
+		}
+		seen[target.String()] = true
+
+		sent, err := app.webmentionSent(ctx, site.key(saved.Slug), target.String())
+		if err != nil {
+			return err
+		}
+		if sent {
+			continue
+		}
+
+		endpoint, sendErr := app.sendWebmention(ctx, saved.URL, target.String())
+		if sendErr != nil {
+			slog.Info("Failed to send webmention", "slug", saved.Slug, "target", target.String(), "error", sendErr)
+		} else if endpoint != "" {
+			slog.Info("Sent webmention", "slug", saved.Slug, "target", target.String(), "endpoint", endpoint)
+		}
+		if err := app.recordWebmentionSent(ctx, site.key(saved.Slug), target.String(), endpoint, sendErr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// webmentionSent reports whether a post's link to target has been tried
+func (app *App) webmentionSent(ctx context.Context, slug, target string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var n int
+	err := app.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM sent_webmentions WHERE slug = ? AND target = ?", slug, target).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("failed to query sent webmentions: %w", err)
+	}
+	return n > 0, nil
+}
+
+// recordWebmentionSent stores the outcome of sending a mention. endpoint is
+// empty when the target doesn't take webmentions.
+func (app *App) recordWebmentionSent(ctx context.Context, slug, target, endpoint string, sendErr error) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var lastError string
+	if sendErr != nil {
+		lastError = sendErr.Error()
+	}
+	_, err := app.DB.ExecContext(ctx, `
+		INSERT INTO sent_webmentions (slug, target, endpoint, last_error, sent_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (slug, target) DO NOTHING
+	`, slug, target, endpoint, lastError, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to record sent webmention: %w", err)
+	}
+	return nil
+}
+
+// sendWebmention discovers target's webmention endpoint and notifies it
+// that source links to target. It returns the endpoint, or "" if target
+// doesn't have one.
+func (app *App) sendWebmention(ctx context.Context, source, target string) (string, error) {
+	endpoint, err := app.discoverWebmentionEndpoint(ctx, target)
+	if err != nil || endpoint == "" {
+		return "", err
+	}
+
+	form := url.Values{"source": {source}, "target": {target}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return endpoint, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := app.webmentionHTTP().Do(req)
+	if err != nil {
+		return endpoint, fmt.Errorf("failed to send webmention: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return endpoint, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return endpoint, nil
+}
+
+// discoverWebmentionEndpoint finds target's endpoint from, in order, its
+// Link headers and its first link or a element with rel="webmention"
+func (app *App) discoverWebmentionEndpoint(ctx context.Context, target string) (string, error) {
+	resp, body, err := app.fetchPage(ctx, target)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("target returned %s", resp.Status)
+	}
+
+	var href string
+	found := false
+	for _, header := range resp.Header.Values("Link") {
+		if href, found = webmentionLinkHeader(header); found {
+			break
+		}
+	}
+	if !found {
+		if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "text/html" {
+			for _, link := range htmlLinks(body) {
+				if slices.Contains(link.Rel, "webmention") {
+					href, found = link.Href, true
+					break
+				}
+			}
+		}
+	}
+	if !found {
+		return "", nil
+	}
+
+	// An empty href is the target page itself
+	endpoint, err := resp.Request.URL.Parse(href)
+	if err != nil {
+		return "", fmt.Errorf("invalid webmention endpoint %q: %w", href, err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return "", fmt.Errorf("invalid webmention endpoint %q", href)
+	}
+	return endpoint.String(), nil
+}
+
+// webmentionLinkHeader finds a rel="webmention" link in a Link header value,
+// like `<https://example.com/webmention>; rel="webmention"`
+func webmentionLinkHeader(header string) (string, bool) {
+	for _, link := range strings.Split(header, ",") {
+		ref, params, ok := strings.Cut(strings.TrimSpace(link), ";")
+		if !ok || !strings.HasPrefix(ref, "<") || !strings.HasSuffix(ref, ">") {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(strings.TrimSpace(name), "rel") &&
+				slices.Contains(strings.Fields(strings.ToLower(strings.Trim(value, `"`))), "webmention") {
+				return strings.TrimSuffix(strings.TrimPrefix(ref, "<"), ">"), true
+			}
+		}
+	}
+	return "", false
+}
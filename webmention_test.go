@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRefusePrivateAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		refused bool
+	}{
+		{"93.184.216.34:443", false},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", false},
+		{"127.0.0.1:80", true},
+		{"[::1]:80", true},
+		{"10.0.0.1:80", true},
+		{"172.16.5.4:80", true},
+		{"192.168.1.1:80", true},
+		{"169.254.169.254:80", true},
+		{"0.0.0.0:80", true},
+		{"[::]:80", true},
+		{"[fd00::1]:80", true},
+		{"[fe80::1]:80", true},
+		{"[::ffff:127.0.0.1]:80", true},
+		{"[::ffff:10.0.0.1]:80", true},
+		{"224.0.0.1:80", true},
+	}
+	for _, tt := range tests {
+		err := refusePrivateAddress("tcp", tt.address, nil)
+		if refused := err != nil; refused != tt.refused {
+			t.Errorf("%s: error %v, want refused: %t", tt.address, err, tt.refused)
+		}
+	}
+}
+
+// The production client refuses to fetch from this machine, while the
+// development one allows it
+func TestWebmentionClientPrivate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	if resp, err := webmentionClient.Get(srv.URL); err == nil {
+		resp.Body.Close()
+		t.Error("webmentionClient fetched from a loopback address")
+	} else if !strings.Contains(err.Error(), "refusing to connect to 127.0.0.1") {
+		t.Errorf("webmentionClient: %v, want the connection refused", err)
+	}
+
+	resp, err := webmentionDevClient.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("webmentionDevClient: %v", err)
+	}
+	resp.Body.Close()
+}
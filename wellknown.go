@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// wellKnownHandlers answer /.well-known/NAME (RFC 8615). A new discovery
+// endpoint is an entry here rather than another branch in the root handler.
+var wellKnownHandlers = map[string]func(*App, http.ResponseWriter, *http.Request) error{
+	"security.txt":    (*App).handleSecurityTxt,
+	"change-password": (*App).handleChangePassword,
+	"webfinger":       (*App).handleWebFinger,
+}
+
+// securityTxtLifetime is how far ahead security.txt's Expires is. RFC 9116
+// recommends less than a year.
+const securityTxtLifetime = 180 * 24 * time.Hour
+
+// robotsDisallowed are the paths crawlers are asked to skip besides the
+// admin guard's: pages behind a login and endpoints that aren't pages
+var robotsDisallowed = []string{"/login", "/logout", "/auth/", "/settings", "/passkeys", "/devices", "/api/", "/push/", "/challenge/", "/search"}
+
+// handleWellKnown serves the registered /.well-known/ endpoints. Others go
+// to the upstream when proxying, since they used to.
+func (app *App) handleWellKnown(w http.ResponseWriter, r *http.Request) error {
+	handler, ok := wellKnownHandlers[strings.TrimPrefix(r.URL.Path, "/.well-known/")]
+	if !ok {
+		if app.upstream != nil {
+			app.upstream.ServeHTTP(w, r)
+			return nil
+		}
+		return NewHTTPError(fmt.Errorf("page not found: %s", r.URL.Path), http.StatusNotFound)
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return methodNotAllowed(w, r, []string{http.MethodGet, http.MethodHead})
+	}
+	return handler(app, w, r)
+}
+
+// handleSecurityTxt tells security researchers where to report problems,
+// from SECURITY_CONTACT or ADMIN_EMAILS
+func (app *App) handleSecurityTxt(w http.ResponseWriter, r *http.Request) error {
+	contacts := app.Config.SecurityContact
+	if len(contacts) == 0 {
+		for _, email := range app.Config.AdminEmails {
+			contacts = append(contacts, "mailto:"+email)
+		}
+	}
+	if len(contacts) == 0 {
+		return NewHTTPError(fmt.Errorf("no security contact is configured"), http.StatusNotFound)
+	}
+
+	var b strings.Builder
+	for _, contact := range contacts {
+		fmt.Fprintf(&b, "Contact: %s\n", contact)
+	}
+	expires := time.Now().UTC().Add(securityTxtLifetime).Truncate(24 * time.Hour)
+	fmt.Fprintf(&b, "Expires: %s\n", expires.Format(time.RFC3339))
+	fmt.Fprintf(&b, "Canonical: %s\n", canonicalURL(r))
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	_, err := w.Write([]byte(b.String()))
+	return err
+}
+
+// handleChangePassword sends password managers to the account settings
+// (RFC 8615's change-password URL). Logins don't have passwords, but that's
+// where a user secures their account.
+func (app *App) handleChangePassword(w http.ResponseWriter, r *http.Request) error {
+	http.Redirect(w, r, "/settings", http.StatusFound)
+	return nil
+}
+
+// WebFingerLink is a link in a WebFinger response
+type WebFingerLink struct {
+	Rel  string `json:"rel"`
+	Type string `json:"type,omitempty"`
+	Href string `json:"href"`
+}
+
+// WebFingerResponse is the JSON resource descriptor WebFinger answers with
+type WebFingerResponse struct {
+	Subject string          `json:"subject"`
+	Links   []WebFingerLink `json:"links"`
+}
+
+// handleWebFinger resolves acct:NAME@HOST for the WEBFINGER_ACCOUNTS to
+// the site (RFC 7033), so the address can be used to find it
+func (app *App) handleWebFinger(w http.ResponseWriter, r *http.Request) error {
+	resource := r.URL.Query().Get("resource")
+	if resource == "" {
+		return NewHTTPError(fmt.Errorf("resource is required"), http.StatusBadRequest)
+	}
+	account, ok := strings.CutPrefix(resource, "acct:")
+	name, host, found := strings.Cut(account, "@")
+	if !ok || !found {
+		return NewHTTPError(fmt.Errorf("invalid resource %q, expected acct:name@host", resource), http.StatusBadRequest)
+	}
+	requestHost := r.Host
+	if h, _, err := net.SplitHostPort(requestHost); err == nil {
+		requestHost = h
+	}
+	if !strings.EqualFold(host, requestHost) || !slices.Contains(app.Config.WebFingerAccounts, name) {
+		return NewHTTPError(fmt.Errorf("unknown resource %q", resource), http.StatusNotFound)
+	}
+
+	base := baseURL(r)
+	links := []WebFingerLink{
+		{Rel: "http://webfinger.net/rel/profile-page", Type: "text/html", Href: base + "/"},
+		{Rel: "http://webfinger.net/rel/avatar", Type: "image/svg+xml", Href: base + "/icon.svg"},
+	}
+	// Clients can ask for only some kinds of link
+	if rels := r.URL.Query()["rel"]; len(rels) > 0 {
+		links = slices.DeleteFunc(links, func(link WebFingerLink) bool {
+			return !slices.Contains(rels, link.Rel)
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/jrd+json")
+	// Browsers look addresses up from other sites
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if err := json.NewEncoder(w).Encode(WebFingerResponse{Subject: resource, Links: links}); err != nil {
+		return fmt.Errorf("failed to write webfinger response: %w", err)
+	}
+	return nil
+}
+
+// handleRobotsTxt asks crawlers to skip admin pages and pages behind a
+// login, or the whole site in development
+func (app *App) handleRobotsTxt(w http.ResponseWriter, r *http.Request) error {
+	var b strings.Builder
+	b.WriteString("User-agent: *\n")
+	if app.Config.isDevelopment() {
+		b.WriteString("Disallow: /\n")
+	} else {
+		for _, path := range append(slices.Clone(guardedPrefixes), robotsDisallowed...) {
+			fmt.Fprintf(&b, "Disallow: %s\n", path)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	_, err := w.Write([]byte(b.String()))
+	return err
+}
+
+// handleHumansTxt credits the site and the software it runs on
+// (humanstxt.org)
+func (app *App) handleHumansTxt(w http.ResponseWriter, r *http.Request) error {
+	site := app.siteFor(r)
+	var b strings.Builder
+	b.WriteString("/* SITE */\n")
+	fmt.Fprintf(&b, "Title: %s\n", site.Title)
+	if modified := site.Blog().ModTime; !modified.IsZero() {
+		fmt.Fprintf(&b, "Last update: %s\n", modified.UTC().Format("2006/01/02"))
+	}
+	b.WriteString("Software: Tulip, Go\n")
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	_, err := w.Write([]byte(b.String()))
+	return err
+}